@@ -0,0 +1,166 @@
+package main
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "context"
+  "strings"
+  "net/http"
+  "encoding/json"
+)
+
+// Formats of the access log.
+const (
+  // accessLogCommon is the Common Log Format of NCSA and Apache.
+  accessLogCommon   = "common"
+  // accessLogCombined is the common format followed by the referer and the
+  // user agent.
+  accessLogCombined = "combined"
+  // accessLogJSON is a JSON object per line.
+  accessLogJSON     = "json"
+)
+
+// accessLog writes a line for each request to the HTTP server, naming the
+// token that authenticated it, if one did.
+type accessLog struct {
+  mutex  sync.Mutex
+  w      io.Writer
+  format string
+}
+
+// accessRecord is what is logged of a request, filled in as it is served.
+type accessRecord struct {
+  user   string
+  status int
+  bytes  int64
+}
+
+type accessRecordKey struct{}
+
+// open_access_log opens the access log at path, appending to it, or writes it
+// to standard output if path is "-".
+func open_access_log(path, format string) (*accessLog, error) {
+  if path == "-" {
+    return &accessLog{w: os.Stdout, format: format}, nil
+  }
+  f, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0640)
+  if err != nil {
+    return nil, err
+  }
+  return &accessLog{w: f, format: format}, nil
+}
+
+// set_access_user records the name of the token that authenticated r, for
+// the access log.
+func set_access_user(r *http.Request, user string) {
+  if rec, ok := r.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+    rec.user = user
+  }
+}
+
+// Wrap logs every request served by h.
+func (l *accessLog) Wrap(h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+    rec := &accessRecord{}
+    h.ServeHTTP(&accessResponseWriter{ResponseWriter: w, rec: rec}, r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec)))
+    l.write(r, rec, start)
+  })
+}
+
+func (l *accessLog) write(r *http.Request, rec *accessRecord, start time.Time) {
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    host = r.RemoteAddr
+  }
+  status := rec.status
+  if status == 0 {
+    status = http.StatusOK
+  }
+
+  var line string
+  switch l.format {
+  case accessLogJSON:
+    b, _ := json.Marshal(struct {
+      Time      string  `json:"time"`
+      Remote    string  `json:"remote_addr"`
+      User      string  `json:"user,omitempty"`
+      Method    string  `json:"method"`
+      URI       string  `json:"uri"`
+      Proto     string  `json:"proto"`
+      Status    int     `json:"status"`
+      Bytes     int64   `json:"bytes"`
+      Duration  float64 `json:"duration_seconds"`
+      Referer   string  `json:"referer,omitempty"`
+      UserAgent string  `json:"user_agent,omitempty"`
+    }{start.Format(time.RFC3339Nano), host, rec.user, r.Method, r.RequestURI, r.Proto, status, rec.bytes,
+      time.Since(start).Seconds(), r.Referer(), r.UserAgent()})
+    line = string(b) + "\n"
+  default:
+    line = fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s", host, common_field(rec.user),
+      start.Format("02/Jan/2006:15:04:05 -0700"), r.Method, r.RequestURI, r.Proto, status, common_bytes(rec.bytes))
+    if l.format == accessLogCombined {
+      line += fmt.Sprintf(" %q %q", or_dash(r.Referer()), or_dash(r.UserAgent()))
+    }
+    line += "\n"
+  }
+
+  l.mutex.Lock()
+  defer l.mutex.Unlock()
+  if _, err := io.WriteString(l.w, line); err != nil {
+    logDedup.Errorf(httpLog, "access_log", "failed to write access log: %v", err)
+  }
+}
+
+// common_field returns a field of the common format, which is - if empty and
+// may not contain spaces.
+func common_field(s string) string {
+  return strings.Replace(or_dash(s), " ", "_", -1)
+}
+
+func or_dash(s string) string {
+  if s == "" {
+    return "-"
+  }
+  return s
+}
+
+func common_bytes(n int64) string {
+  if n == 0 {
+    return "-"
+  }
+  return fmt.Sprint(n)
+}
+
+// accessResponseWriter records the status and size of a response.
+type accessResponseWriter struct {
+  http.ResponseWriter
+  rec *accessRecord
+}
+
+func (w *accessResponseWriter) WriteHeader(code int) {
+  if w.rec.status == 0 {
+    w.rec.status = code
+  }
+  w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessResponseWriter) Write(b []byte) (int, error) {
+  if w.rec.status == 0 {
+    w.rec.status = http.StatusOK
+  }
+  n, err := w.ResponseWriter.Write(b)
+  w.rec.bytes += int64(n)
+  return n, err
+}
+
+// Flush passes flushes on, for the handlers that stream their responses.
+func (w *accessResponseWriter) Flush() {
+  if f, ok := w.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+  "fmt"
+  "strconv"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+var decodeAnomalies = prometheus.NewCounterVec(
+  prometheus.CounterOpts{
+    Namespace: namespace,
+    Name:      "decode_anomalies_total",
+    Help:      "Confirms with a reserved value in a field, or data after their last entry, by MME type and field. They are still decoded unless --decode.strict is given.",
+  },
+  []string{"mme_type", "field"})
+
+var decodedConfirms = prometheus.NewCounterVec(
+  prometheus.CounterOpts{
+    Namespace: namespace,
+    Name:      "decoded_confirms_total",
+    Help:      "Confirms handed to a decoder, by MME type and the MMV (management message version) of the layout they were parsed as, including those that turn out to be malformed.",
+  },
+  []string{"mme_type", "mmv"})
+
+// strictDecoding rejects confirms with anomalies as malformed, rather than
+// decoding what they hold. Vendor firmware is full of them, so it is only
+// for protocol development.
+var strictDecoding bool
+
+// accept counts the confirm f, and the anomalies in err, which a decoder
+// returned for it. It returns nil if they are all there is to err and
+// decoding is lenient, and err otherwise.
+func accept(f *homeplug.Frame, err error) error {
+  mmeType := fmt.Sprintf("%04x", f.Type())
+  decodedConfirms.WithLabelValues(mmeType, strconv.Itoa(int(f.Version[0]))).Inc()
+  a, ok := err.(homeplug.Anomalies)
+  if !ok {
+    return err
+  }
+  for _, x := range a {
+    decodeAnomalies.WithLabelValues(mmeType, x.Field).Inc()
+  }
+  if strictDecoding {
+    return err
+  }
+  return nil
+}
+
+// tolerated is accept for confirms that are decoded again later, where
+// their anomalies are counted.
+func tolerated(err error) bool {
+  _, ok := err.(homeplug.Anomalies)
+  return err == nil || ok && !strictDecoding
+}
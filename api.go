@@ -0,0 +1,675 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "time"
+  "context"
+  "reflect"
+  "strings"
+  "net/http"
+  "encoding/json"
+)
+
+// apiVersion is the version of the JSON structures below. Fields may be added
+// within a version, but never renamed, removed, or changed in meaning; doing
+// so requires a new version served under a new path.
+const apiVersion = "v1"
+
+// apiQueryPath is the endpoint for on-demand queries, which needs the probe
+// scope rather than the api scope.
+const apiQueryPath = "/api/" + apiVersion + "/query"
+
+type apiTopology struct {
+  APIVersion string       `json:"api_version"`
+  Target     string       `json:"target"`
+  Time       time.Time    `json:"time"`
+  Networks   []apiNetwork `json:"networks"`
+  Stations   []apiStation `json:"stations"`
+  Links      []apiLink    `json:"links"`
+}
+
+type apiNetwork struct {
+  ID         string       `json:"network_identifier"`
+  ShortID    uint8        `json:"short_network_identifier"`
+  CCoAddress string       `json:"coordinator_mac_address"`
+  CCoTEI     uint8        `json:"coordinator_terminal_equipment_identifier"`
+  Schedule   *apiSchedule `json:"schedule,omitempty"`
+  Mode       string       `json:"network_mode,omitempty"`
+}
+
+type apiSchedule struct {
+  Period    float64            `json:"beacon_period_seconds"`
+  Allocated map[string]float64 `json:"allocated_seconds"`
+}
+
+type apiStation struct {
+  Address          string  `json:"mac_address"`
+  TEI              uint8   `json:"terminal_equipment_identifier"`
+  BridgedAddress   string  `json:"bridged_mac_address,omitempty"`
+  NetworkID        string  `json:"network_identifier,omitempty"`
+  Reporter         bool    `json:"reporter"`
+  Protocol         string  `json:"protocol,omitempty"`
+  Capabilities     string  `json:"capabilities,omitempty"`
+  BridgedIP        string  `json:"bridged_ip_address,omitempty"`
+  BridgedReachable *bool   `json:"bridged_reachable,omitempty"`
+  BridgedHostName  string  `json:"bridged_host_name,omitempty"`
+  AVVersion        string  `json:"av_version,omitempty"`
+  MaxFrequency     float64 `json:"capability_max_frequency_hertz,omitempty"`
+  ObservedOnly     bool    `json:"observed_only"`
+  Phase            string  `json:"phase,omitempty"`
+  Asleep           bool    `json:"asleep,omitempty"`
+  Vendor           string  `json:"vendor,omitempty"`
+  FirmwareVersion  string  `json:"firmware_version,omitempty"`
+  DeviceClass      string  `json:"device_class,omitempty"`
+  MMEVersions      map[string]uint8 `json:"mme_versions,omitempty"`
+  RoundTrip        float64 `json:"round_trip_seconds,omitempty"`
+  DeviceType       string  `json:"device_type,omitempty"`
+  Reboots          uint64  `json:"reboots,omitempty"`
+}
+
+// apiDevices is the inventory of stations served by /api/v1/devices, each with
+// the fields of an apiStation that were asked for.
+type apiDevices struct {
+  APIVersion string                   `json:"api_version"`
+  Time       time.Time                `json:"time"`
+  Devices    []map[string]interface{} `json:"devices"`
+}
+
+// apiDeviceAliases are the shorter names the devices filters may be given.
+var apiDeviceAliases = map[string]string{
+  "nid": "network_identifier",
+  "mac": "mac_address",
+}
+
+type apiLink struct {
+  Reporter    string  `json:"reporter_mac_address"`
+  Protocol    string  `json:"protocol"`
+  Source      string  `json:"source_mac_address"`
+  Destination string  `json:"destination_mac_address"`
+  Rate        float64 `json:"rate_bytes"`
+  Saturated   bool    `json:"saturated,omitempty"`
+  Coupling    string  `json:"coupling_path,omitempty"`
+}
+
+type apiQueryRequest struct {
+  MAC string `json:"mac"`
+  MME string `json:"mme"`
+}
+
+type apiQueryResult struct {
+  APIVersion string       `json:"api_version"`
+  MAC        string       `json:"mac"`
+  MME        string       `json:"mme"`
+  Time       time.Time    `json:"time"`
+  Networks   []apiNetwork `json:"networks"`
+  Stations   []apiStation `json:"stations"`
+  Links      []apiLink    `json:"links"`
+}
+
+type apiError struct {
+  APIVersion string `json:"api_version"`
+  Error      string `json:"error"`
+}
+
+func new_api_topology(s *Snapshot) *apiTopology {
+  t := &apiTopology{
+    APIVersion: apiVersion,
+    Target:     s.Target.String(),
+    Time:       s.Time,
+    Networks:   []apiNetwork{},
+    Stations:   []apiStation{},
+    Links:      []apiLink{},
+  }
+  for _, network := range s.Networks {
+    an := apiNetwork{
+      ID:         network.ID,
+      ShortID:    network.ShortID,
+      CCoAddress: network.CCoAddress.String(),
+      CCoTEI:     network.CCoTEI,
+      Mode:       network.Mode,
+    }
+    if network.Schedule != nil {
+      an.Schedule = &apiSchedule{network.Schedule.Period, network.Schedule.Allocated}
+    }
+    t.Networks = append(t.Networks, an)
+  }
+  for _, station := range s.Stations {
+    as := apiStation{
+      Address:         station.Address.String(),
+      TEI:             station.TEI,
+      BridgedAddress:  station.BridgedAddress.String(),
+      NetworkID:       station.NetworkID,
+      Reporter:        station.Reporter,
+      Protocol:        station.Protocol,
+      Capabilities:    station.Capabilities(),
+      ObservedOnly:    station.ObservedOnly(),
+      Phase:           station.Phase,
+      Asleep:          station.Asleep,
+      Vendor:          station.Vendor,
+      BridgedHostName: station.BridgedHostName,
+      MMEVersions:     station.MMEVersions,
+      RoundTrip:       station.RoundTrip.Seconds(),
+      DeviceType:      station.DeviceType,
+      Reboots:         station.Reboots,
+    }
+    if station.Capability != nil {
+      as.AVVersion = station.Capability.Version()
+      as.MaxFrequency = station.Capability.MaxFrequency()
+    }
+    if station.Firmware != nil {
+      as.FirmwareVersion = station.Firmware.Version
+      as.DeviceClass = station.Firmware.DeviceClass
+    }
+    if station.BridgedIP != nil {
+      reachable := station.BridgedReachable
+      as.BridgedIP = station.BridgedIP.String()
+      as.BridgedReachable = &reachable
+    }
+    t.Stations = append(t.Stations, as)
+  }
+  for _, link := range s.Links {
+    t.Links = append(t.Links, apiLink{
+      Reporter:    link.Reporter.String(),
+      Protocol:    link.Protocol,
+      Source:      link.Source.String(),
+      Destination: link.Destination.String(),
+      Rate:        link.Rate,
+      Saturated:   link.Saturated,
+      Coupling:    link_coupling(s, link),
+    })
+  }
+  return t
+}
+
+// API is the output serving the /api/v1 endpoints. Like the Prometheus
+// output, it polls the devices itself on every request when not running in
+// cached mode.
+type API struct {
+  poller   *Poller
+  cached   bool
+  snapshot snapshotStore
+  // segments are the APIs of the other --interface, by interface name.
+  segments map[string]*API
+}
+
+func NewAPI(poller *Poller, cached bool) *API {
+  return &API{
+    poller: poller,
+    cached: cached,
+  }
+}
+
+func (a *API) Name() string {
+  return "api"
+}
+
+func (a *API) Publish(s *Snapshot) error {
+  a.snapshot.Store(s)
+  return nil
+}
+
+// AddSegment serves the API of the segment polled on iface to the requests
+// whose interface parameter names it.
+func (a *API) AddSegment(iface string, segment *API) {
+  if a.segments == nil {
+    a.segments = map[string]*API{}
+  }
+  a.segments[iface] = segment
+}
+
+// segment returns the API of the interface that the interface parameter of r
+// names, or a itself if it names none.
+func (a *API) segment(r *http.Request) (*API, error) {
+  name := r.URL.Query().Get("interface")
+  if name == "" || name == a.poller.transport.iface.Name {
+    return a, nil
+  }
+  if segment, ok := a.segments[name]; ok {
+    return segment, nil
+  }
+  return nil, fmt.Errorf("interface %q is not polled", name)
+}
+
+func (a *API) Register(mux *http.ServeMux) {
+  mux.HandleFunc("/api/" + apiVersion + "/schema", a.serveSchema)
+  mux.HandleFunc("/api/" + apiVersion + "/metrics-schema", a.serveMetricsSchema)
+  mux.HandleFunc("/api/" + apiVersion + "/topology", a.serveTopology(func(t *apiTopology) interface{} {
+    return t
+  }))
+  mux.HandleFunc("/api/" + apiVersion + "/networks", a.serveTopology(func(t *apiTopology) interface{} {
+    return struct {
+      APIVersion string       `json:"api_version"`
+      Networks   []apiNetwork `json:"networks"`
+    }{t.APIVersion, t.Networks}
+  }))
+  mux.HandleFunc("/api/" + apiVersion + "/stations", a.serveTopology(func(t *apiTopology) interface{} {
+    return struct {
+      APIVersion string       `json:"api_version"`
+      Stations   []apiStation `json:"stations"`
+    }{t.APIVersion, t.Stations}
+  }))
+  mux.HandleFunc("/api/" + apiVersion + "/devices", a.serveDevices)
+  mux.HandleFunc(apiQueryPath, a.serveQuery)
+  mux.HandleFunc(apiBurstPath, a.serveBurst)
+  mux.HandleFunc("/api/" + apiVersion + "/links", a.serveTopology(func(t *apiTopology) interface{} {
+    return struct {
+      APIVersion string    `json:"api_version"`
+      Links      []apiLink `json:"links"`
+    }{t.APIVersion, t.Links}
+  }))
+}
+
+func (a *API) current(ctx context.Context) (*Snapshot, error) {
+  if !a.cached {
+    return a.poller.Poll(ctx)
+  }
+  return a.snapshot.Load(), nil
+}
+
+// latest returns the last published snapshot, polling the devices only if
+// nothing has been published yet.
+func (a *API) latest(ctx context.Context) (*Snapshot, error) {
+  s := a.snapshot.Load()
+  if s == nil && !a.cached {
+    return a.poller.Poll(ctx)
+  }
+  return s, nil
+}
+
+func (a *API) serveTopology(view func(*apiTopology) interface{}) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    a, err := a.segment(r)
+    if err != nil {
+      write_api_json(w, http.StatusBadRequest, apiError{apiVersion, err.Error()})
+      return
+    }
+    s, err := a.current(r.Context())
+    if err != nil {
+      httpLog.Errorf("Error polling Homeplug: %v", err)
+      write_api_json(w, http.StatusServiceUnavailable, apiError{apiVersion, err.Error()})
+      return
+    }
+    if s == nil {
+      write_api_json(w, http.StatusServiceUnavailable, apiError{apiVersion, "no data has been polled yet"})
+      return
+    }
+    write_api_json(w, http.StatusOK, view(new_api_topology(s)))
+  }
+}
+
+// serveDevices serves the stations that match every filter given as a
+// parameter named after a station field, or one of its aliases, with any of
+// the parameter's values. Values are compared to the JSON form of the field
+// without regard to case, and a field that is left out is empty. The fields
+// parameter lists, separated by commas, the fields to return of each.
+func (a *API) serveDevices(w http.ResponseWriter, r *http.Request) {
+  a, err := a.segment(r)
+  if err != nil {
+    write_api_json(w, http.StatusBadRequest, apiError{apiVersion, err.Error()})
+    return
+  }
+  known := json_fields(reflect.TypeOf(apiStation{}))
+  filters := map[string][]string{}
+  var fields []string
+  for name, values := range r.URL.Query() {
+    if name == "interface" {
+      continue
+    }
+    if name == "fields" {
+      for _, v := range values {
+        for _, field := range strings.Split(v, ",") {
+          if field = strings.TrimSpace(field); field == "" {
+            continue
+          }
+          if !known[field] {
+            write_api_json(w, http.StatusBadRequest, apiError{apiVersion, fmt.Sprintf("unknown field %q", field)})
+            return
+          }
+          fields = append(fields, field)
+        }
+      }
+      continue
+    }
+    field := name
+    if alias, ok := apiDeviceAliases[name]; ok {
+      field = alias
+    }
+    if !known[field] {
+      write_api_json(w, http.StatusBadRequest, apiError{apiVersion, fmt.Sprintf("unknown filter %q", name)})
+      return
+    }
+    filters[field] = append(filters[field], values...)
+  }
+
+  s, err := a.current(r.Context())
+  if err != nil {
+    httpLog.Errorf("Error polling Homeplug: %v", err)
+    write_api_json(w, http.StatusServiceUnavailable, apiError{apiVersion, err.Error()})
+    return
+  }
+  if s == nil {
+    write_api_json(w, http.StatusServiceUnavailable, apiError{apiVersion, "no data has been polled yet"})
+    return
+  }
+
+  t := new_api_topology(s)
+  devices := apiDevices{APIVersion: apiVersion, Time: t.Time, Devices: []map[string]interface{}{}}
+  for _, station := range t.Stations {
+    // The fields are compared and selected in their JSON form, so that they
+    // are named and formatted as everywhere else in the API.
+    b, err := json.Marshal(station)
+    if err != nil {
+      write_api_json(w, http.StatusInternalServerError, apiError{apiVersion, err.Error()})
+      return
+    }
+    var m map[string]interface{}
+    if err := json.Unmarshal(b, &m); err != nil {
+      write_api_json(w, http.StatusInternalServerError, apiError{apiVersion, err.Error()})
+      return
+    }
+    if !device_matches(m, filters) {
+      continue
+    }
+    if len(fields) > 0 {
+      selected := map[string]interface{}{}
+      for _, field := range fields {
+        if v, ok := m[field]; ok {
+          selected[field] = v
+        }
+      }
+      m = selected
+    }
+    devices.Devices = append(devices.Devices, m)
+  }
+  write_api_json(w, http.StatusOK, devices)
+}
+
+func device_matches(m map[string]interface{}, filters map[string][]string) bool {
+  for field, values := range filters {
+    have := ""
+    if v, ok := m[field]; ok {
+      have = fmt.Sprint(v)
+    }
+    match := false
+    for _, want := range values {
+      match = match || strings.EqualFold(have, want)
+    }
+    if !match {
+      return false
+    }
+  }
+  return true
+}
+
+// json_fields returns the names that the fields of the struct type t are
+// marshalled as.
+func json_fields(t reflect.Type) map[string]bool {
+  fields := map[string]bool{}
+  for i := 0; i < t.NumField(); i++ {
+    name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+    if name != "" && name != "-" {
+      fields[name] = true
+    }
+  }
+  return fields
+}
+
+// serveQuery sends a single read-only request to a device on demand, and
+// returns whatever was decoded from the replies.
+func (a *API) serveQuery(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    w.Header().Set("Allow", http.MethodPost)
+    write_api_json(w, http.StatusMethodNotAllowed, apiError{apiVersion, "only POST is supported"})
+    return
+  }
+  a, err := a.segment(r)
+  if err != nil {
+    write_api_json(w, http.StatusBadRequest, apiError{apiVersion, err.Error()})
+    return
+  }
+
+  var q apiQueryRequest
+  if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&q); err != nil {
+    write_api_json(w, http.StatusBadRequest, apiError{apiVersion, fmt.Sprintf("invalid request: %v", err)})
+    return
+  }
+  dest, err := net.ParseMAC(q.MAC)
+  if err != nil || len(dest) != 6 {
+    write_api_json(w, http.StatusBadRequest, apiError{apiVersion, fmt.Sprintf("invalid mac %q", q.MAC)})
+    return
+  }
+  family, request, ok := find_query_request(q.MME)
+  if !ok {
+    write_api_json(w, http.StatusBadRequest, apiError{apiVersion, fmt.Sprintf("unsupported mme %q", q.MME)})
+    return
+  }
+
+  s, err := a.poller.Query(r.Context(), dest, family, request)
+  if err != nil {
+    httpLog.Errorf("Error querying %v: %v", dest, err)
+    write_api_json(w, http.StatusServiceUnavailable, apiError{apiVersion, err.Error()})
+    return
+  }
+  t := new_api_topology(s)
+  write_api_json(w, http.StatusOK, apiQueryResult{
+    APIVersion: apiVersion,
+    MAC:        dest.String(),
+    MME:        q.MME,
+    Time:       t.Time,
+    Networks:   t.Networks,
+    Stations:   t.Stations,
+    Links:      t.Links,
+  })
+}
+
+func (a *API) serveSchema(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/schema+json")
+  _, _ = w.Write([]byte(apiSchema))
+}
+
+func write_api_json(w http.ResponseWriter, code int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(code)
+  enc := json.NewEncoder(w)
+  enc.SetIndent("", "  ")
+  if err := enc.Encode(v); err != nil {
+    httpLog.Debugf("failed to write API response: %v", err)
+  }
+}
+
+// apiSchema is the JSON Schema describing the documents served under
+// /api/v1. It must be kept in sync with the api* types above.
+const apiSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/brandond/homeplug_exporter/api/v1/schema",
+  "title": "homeplug_exporter API v1",
+  "definitions": {
+    "mac_address": {
+      "type": "string",
+      "pattern": "^([0-9a-f]{2}:){5}[0-9a-f]{2}$"
+    },
+    "protocol": {
+      "type": "string",
+      "enum": ["qualcomm", "homeplug_av", "custom"]
+    },
+    "api_version": {
+      "const": "v1"
+    },
+    "network": {
+      "type": "object",
+      "required": ["network_identifier", "short_network_identifier", "coordinator_mac_address", "coordinator_terminal_equipment_identifier"],
+      "properties": {
+        "network_identifier": {"type": "string", "pattern": "^[0-9a-f]{14}$"},
+        "short_network_identifier": {"type": "integer", "minimum": 0, "maximum": 255},
+        "coordinator_mac_address": {"$ref": "#/definitions/mac_address"},
+        "coordinator_terminal_equipment_identifier": {"type": "integer", "minimum": 0, "maximum": 255},
+        "network_mode": {"type": "string", "pattern": "^(uncoordinated|coordinated|csma_only|unknown-[0-9]+)$"},
+        "schedule": {
+          "type": "object",
+          "required": ["beacon_period_seconds", "allocated_seconds"],
+          "properties": {
+            "beacon_period_seconds": {"type": "number", "minimum": 0},
+            "allocated_seconds": {"type": "object", "additionalProperties": {"type": "number", "minimum": 0}}
+          }
+        }
+      }
+    },
+    "station": {
+      "type": "object",
+      "required": ["mac_address", "terminal_equipment_identifier", "reporter", "observed_only"],
+      "properties": {
+        "mac_address": {"$ref": "#/definitions/mac_address"},
+        "terminal_equipment_identifier": {"type": "integer", "minimum": 0, "maximum": 255},
+        "bridged_mac_address": {"$ref": "#/definitions/mac_address"},
+        "network_identifier": {"type": "string", "pattern": "^[0-9a-f]{14}$"},
+        "reporter": {"type": "boolean"},
+        "protocol": {"$ref": "#/definitions/protocol"},
+        "capabilities": {"type": "string"},
+        "bridged_ip_address": {"type": "string", "format": "ipv4"},
+        "bridged_reachable": {"type": "boolean"},
+        "bridged_host_name": {"type": "string"},
+        "av_version": {"type": "string"},
+        "capability_max_frequency_hertz": {"type": "number", "minimum": 0},
+        "observed_only": {"type": "boolean"},
+        "phase": {"type": "string"},
+        "asleep": {"type": "boolean"},
+        "vendor": {"type": "string"},
+        "firmware_version": {"type": "string"},
+        "device_class": {"type": "string"},
+        "mme_versions": {"type": "object", "additionalProperties": {"type": "integer", "minimum": 0, "maximum": 255}},
+        "round_trip_seconds": {"type": "number", "minimum": 0},
+        "device_type": {"type": "string", "enum": ["greenphy", "av", "av2", "homeplug_1.0"]},
+        "reboots": {"type": "integer", "minimum": 0}
+      }
+    },
+    "link": {
+      "type": "object",
+      "required": ["reporter_mac_address", "protocol", "source_mac_address", "destination_mac_address", "rate_bytes"],
+      "properties": {
+        "reporter_mac_address": {"$ref": "#/definitions/mac_address"},
+        "protocol": {"$ref": "#/definitions/protocol"},
+        "source_mac_address": {"$ref": "#/definitions/mac_address"},
+        "destination_mac_address": {"$ref": "#/definitions/mac_address"},
+        "rate_bytes": {"type": "number", "minimum": 0},
+        "saturated": {"type": "boolean"},
+        "coupling_path": {"type": "string", "enum": ["same_phase", "cross_phase"]}
+      }
+    },
+    "topology": {
+      "type": "object",
+      "required": ["api_version", "target", "time", "networks", "stations", "links"],
+      "properties": {
+        "api_version": {"$ref": "#/definitions/api_version"},
+        "target": {"$ref": "#/definitions/mac_address"},
+        "time": {"type": "string", "format": "date-time"},
+        "networks": {"type": "array", "items": {"$ref": "#/definitions/network"}},
+        "stations": {"type": "array", "items": {"$ref": "#/definitions/station"}},
+        "links": {"type": "array", "items": {"$ref": "#/definitions/link"}}
+      }
+    },
+    "networks": {
+      "type": "object",
+      "required": ["api_version", "networks"],
+      "properties": {
+        "api_version": {"$ref": "#/definitions/api_version"},
+        "networks": {"type": "array", "items": {"$ref": "#/definitions/network"}}
+      }
+    },
+    "stations": {
+      "type": "object",
+      "required": ["api_version", "stations"],
+      "properties": {
+        "api_version": {"$ref": "#/definitions/api_version"},
+        "stations": {"type": "array", "items": {"$ref": "#/definitions/station"}}
+      }
+    },
+    "links": {
+      "type": "object",
+      "required": ["api_version", "links"],
+      "properties": {
+        "api_version": {"$ref": "#/definitions/api_version"},
+        "links": {"type": "array", "items": {"$ref": "#/definitions/link"}}
+      }
+    },
+    "devices": {
+      "type": "object",
+      "required": ["api_version", "time", "devices"],
+      "properties": {
+        "api_version": {"$ref": "#/definitions/api_version"},
+        "time": {"type": "string", "format": "date-time"},
+        "devices": {
+          "type": "array",
+          "items": {
+            "type": "object",
+            "description": "A station, with only the properties named by the fields parameter if it was given",
+            "propertyNames": {"enum": ["mac_address", "terminal_equipment_identifier", "bridged_mac_address", "network_identifier", "reporter", "protocol", "capabilities", "bridged_ip_address", "bridged_reachable", "bridged_host_name", "av_version", "capability_max_frequency_hertz", "observed_only", "phase", "asleep", "vendor", "firmware_version", "device_class", "mme_versions", "round_trip_seconds", "device_type", "reboots"]}
+          }
+        }
+      }
+    },
+    "query_request": {
+      "type": "object",
+      "required": ["mac", "mme"],
+      "properties": {
+        "mac": {"type": "string"},
+        "mme": {"type": "string", "enum": ["VS_NW_INFO", "CM_NW_INFO", "CM_NW_STATS", "CM_STA_CAP"]}
+      }
+    },
+    "query_result": {
+      "type": "object",
+      "required": ["api_version", "mac", "mme", "time", "networks", "stations", "links"],
+      "properties": {
+        "api_version": {"$ref": "#/definitions/api_version"},
+        "mac": {"$ref": "#/definitions/mac_address"},
+        "mme": {"type": "string"},
+        "time": {"type": "string", "format": "date-time"},
+        "networks": {"type": "array", "items": {"$ref": "#/definitions/network"}},
+        "stations": {"type": "array", "items": {"$ref": "#/definitions/station"}},
+        "links": {"type": "array", "items": {"$ref": "#/definitions/link"}}
+      }
+    },
+    "burst": {
+      "type": "object",
+      "required": ["api_version", "active"],
+      "properties": {
+        "api_version": {"$ref": "#/definitions/api_version"},
+        "active": {"type": "boolean"},
+        "until": {"type": "string", "format": "date-time"},
+        "interval_seconds": {"type": "number", "exclusiveMinimum": 0}
+      }
+    },
+    "metrics_schema": {
+      "type": "object",
+      "required": ["api_version", "metrics"],
+      "properties": {
+        "api_version": {"$ref": "#/definitions/api_version"},
+        "metrics": {
+          "type": "array",
+          "items": {
+            "type": "object",
+            "required": ["name", "type", "help", "labels", "collector"],
+            "properties": {
+              "name": {"type": "string"},
+              "type": {"type": "string", "enum": ["counter", "gauge"]},
+              "help": {"type": "string"},
+              "labels": {"type": "array", "items": {"type": "string"}},
+              "const_labels": {"type": "object", "additionalProperties": {"type": "string"}},
+              "collector": {"type": "string"}
+            }
+          }
+        }
+      }
+    },
+    "error": {
+      "type": "object",
+      "required": ["api_version", "error"],
+      "properties": {
+        "api_version": {"$ref": "#/definitions/api_version"},
+        "error": {"type": "string"}
+      }
+    }
+  }
+}
+`
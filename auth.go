@@ -0,0 +1,149 @@
+package main
+
+import (
+  "fmt"
+  "sync"
+  "strings"
+  "net/http"
+  "io/ioutil"
+  "crypto/subtle"
+
+  "github.com/prometheus/common/config"
+)
+
+// Scopes that bearer tokens can be granted. Each HTTP endpoint belongs to
+// one of them.
+const (
+  scopeMetrics = "metrics"
+  scopeAPI     = "api"
+  scopeProbe   = "probe"
+  scopeAdmin   = "admin"
+)
+
+var authScopes = []string{scopeMetrics, scopeAPI, scopeProbe, scopeAdmin}
+
+type AuthConfig struct {
+  Tokens []TokenConfig `yaml:"tokens,omitempty"`
+}
+
+type TokenConfig struct {
+  // Name identifies the token in the access log. By default, it is
+  // token-<index>.
+  Name      string        `yaml:"name,omitempty"`
+  Token     config.Secret `yaml:"token,omitempty"`
+  TokenFile string        `yaml:"token_file,omitempty"`
+  Scopes    []string      `yaml:"scopes"`
+}
+
+// Authenticator checks bearer tokens against the configured scopes. A scope
+// only requires a token once at least one token has been granted it, so
+// endpoints stay open until tokens are configured for them.
+type Authenticator struct {
+  mutex  sync.RWMutex
+  tokens map[string][]authToken
+}
+
+type authToken struct {
+  name  string
+  value string
+}
+
+func NewAuthenticator(cfg AuthConfig) (*Authenticator, error) {
+  a := &Authenticator{tokens: map[string][]authToken{}}
+  for i, tc := range cfg.Tokens {
+    token := string(tc.Token)
+    if tc.TokenFile != "" {
+      if token != "" {
+        return nil, fmt.Errorf("token %d: at most one of token and token_file may be set", i)
+      }
+      b, err := ioutil.ReadFile(tc.TokenFile)
+      if err != nil {
+        return nil, fmt.Errorf("token %d: %v", i, err)
+      }
+      token = strings.TrimSpace(string(b))
+    }
+    if token == "" {
+      return nil, fmt.Errorf("token %d: token or token_file is required", i)
+    }
+    if len(tc.Scopes) == 0 {
+      return nil, fmt.Errorf("token %d: at least one scope is required", i)
+    }
+    name := tc.Name
+    if name == "" {
+      name = fmt.Sprintf("token-%d", i)
+    }
+    for _, scope := range tc.Scopes {
+      if !valid_scope(scope) {
+        return nil, fmt.Errorf("token %d: unknown scope %q, must be one of %v", i, scope, authScopes)
+      }
+      a.tokens[scope] = append(a.tokens[scope], authToken{name, token})
+    }
+  }
+  return a, nil
+}
+
+// Reload replaces the tokens with those of cfg, unless it is invalid.
+func (a *Authenticator) Reload(cfg AuthConfig) error {
+  b, err := NewAuthenticator(cfg)
+  if err != nil {
+    return err
+  }
+  a.mutex.Lock()
+  a.tokens = b.tokens
+  a.mutex.Unlock()
+  return nil
+}
+
+func valid_scope(scope string) bool {
+  for _, s := range authScopes {
+    if s == scope {
+      return true
+    }
+  }
+  return false
+}
+
+// Wrap requires requests to h to carry a bearer token granted scope, if any
+// token has been granted it.
+func (a *Authenticator) Wrap(scope string, h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !a.Required(scope) {
+      h.ServeHTTP(w, r)
+      return
+    }
+
+    auth := r.Header.Get("Authorization")
+    if !strings.HasPrefix(auth, "Bearer ") {
+      w.Header().Set("WWW-Authenticate", `Bearer realm="homeplug_exporter"`)
+      http.Error(w, "Unauthorized", http.StatusUnauthorized)
+      return
+    }
+    name, ok := a.granted(scope, strings.TrimPrefix(auth, "Bearer "))
+    if !ok {
+      http.Error(w, "Forbidden", http.StatusForbidden)
+      return
+    }
+    set_access_user(r, name)
+    h.ServeHTTP(w, r)
+  })
+}
+
+// Required reports whether requests in scope need a token.
+func (a *Authenticator) Required(scope string) bool {
+  a.mutex.RLock()
+  defer a.mutex.RUnlock()
+  return len(a.tokens[scope]) > 0
+}
+
+// granted returns the name of the token if it is granted scope.
+func (a *Authenticator) granted(scope, token string) (string, bool) {
+  a.mutex.RLock()
+  defer a.mutex.RUnlock()
+  name, ok := "", false
+  for _, t := range a.tokens[scope] {
+    if subtle.ConstantTimeCompare([]byte(t.value), []byte(token)) == 1 {
+      name, ok = t.name, true
+    }
+  }
+  return name, ok
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+  "net"
+  "sync"
+  "time"
+  "strings"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+// Some adapters lock up when hammered with vendor MMEs. A heavy collector is
+// suspended for a device after it has failed to answer backoffThreshold
+// times in a row; each failure of the single query made when the suspension
+// ends doubles it, up to backoffMax.
+const (
+  backoffThreshold = 3
+  backoffInitial   = 5 * time.Minute
+  backoffMax       = time.Hour
+)
+
+var collectorDegraded = prometheus.NewGaugeVec(
+  prometheus.GaugeOpts{
+    Namespace: namespace,
+    Name:      "collector_degraded",
+    Help:      "Whether a heavy collector is suspended for a device that stopped answering it. Discovery continues.",
+  },
+  []string{"collector", "mac_address"})
+
+// collectorBackoff tracks the devices that keep failing each heavy
+// collector.
+type collectorBackoff struct {
+  mutex   sync.Mutex
+  devices map[[2]string]*backoffState
+  lru     lruIndex
+}
+
+type backoffState struct {
+  failures int
+  delay    time.Duration
+  until    time.Time
+}
+
+// Suspended reports whether collector should skip the device for now.
+func (b *collectorBackoff) Suspended(collector string, device net.HardwareAddr) bool {
+  b.mutex.Lock()
+  defer b.mutex.Unlock()
+  st, ok := b.devices[[2]string{collector, device.String()}]
+  return ok && time.Now().Before(st.until)
+}
+
+// Record records whether the device answered the collector's query.
+func (b *collectorBackoff) Record(collector string, device net.HardwareAddr, answered bool) {
+  b.mutex.Lock()
+  defer b.mutex.Unlock()
+  if b.devices == nil {
+    b.devices = map[[2]string]*backoffState{}
+  }
+  key := [2]string{collector, device.String()}
+  st, ok := b.devices[key]
+  if answered {
+    if ok {
+      if st.delay > 0 {
+        pollerLog.Infof("%v answers %s again, resuming it", device, collector)
+        collectorDegraded.DeleteLabelValues(collector, device.String())
+      }
+      delete(b.devices, key)
+      b.lru.remove(key[0] + "/" + key[1])
+    }
+    return
+  }
+  if !ok {
+    st = &backoffState{}
+    b.devices[key] = st
+  }
+  if evicted, ok := b.lru.touch(key[0] + "/" + key[1]); ok {
+    parts := strings.SplitN(evicted, "/", 2)
+    old := [2]string{parts[0], parts[1]}
+    if gone := b.devices[old]; gone != nil && gone.delay > 0 {
+      collectorDegraded.DeleteLabelValues(old[0], old[1])
+    }
+    delete(b.devices, old)
+  }
+  st.failures++
+  if st.failures < backoffThreshold {
+    return
+  }
+  switch {
+  case st.delay == 0:
+    st.delay = backoffInitial
+  case st.delay < backoffMax:
+    st.delay *= 2
+    if st.delay > backoffMax {
+      st.delay = backoffMax
+    }
+  }
+  st.until = time.Now().Add(st.delay)
+  pollerLog.Warnf("%v did not answer %s %d times in a row, suspending it for %v", device, collector, st.failures, st.delay)
+  collectorDegraded.WithLabelValues(collector, device.String()).Set(1)
+}
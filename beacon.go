@@ -0,0 +1,62 @@
+package main
+
+import (
+  "fmt"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// atu is the allocation time unit that beacon schedules are expressed in.
+const atu = 10.24e-6
+
+// Special GLIDs, which allocate time to something other than a link.
+const (
+  glidLocalCSMA  = 0xFF
+  glidSharedCSMA = 0xFE
+  glidTDMAMax    = 0xF7
+)
+
+// network_mode_name returns the exported name of a beacon network mode.
+func network_mode_name(nm uint8) string {
+  if int(nm) < len(homeplug.NetworkModes) {
+    return homeplug.NetworkModes[nm]
+  }
+  return fmt.Sprintf("unknown-%d", nm)
+}
+
+// Schedule is how the CCo of a network divides the beacon period.
+type Schedule struct {
+  // Period is the length of the beacon period in seconds, taken as the end
+  // of the last allocation.
+  Period float64
+  // Allocated is the time given to each kind of allocation ("csma", "tdma"
+  // or "other") in each beacon period, in seconds.
+  Allocated map[string]float64
+  // RawPeriod and RawAllocated are the same in allocation time units, as
+  // they are sent.
+  RawPeriod    uint16
+  RawAllocated map[string]uint32
+}
+
+func new_schedule(b *homeplug.Beacon) *Schedule {
+  s := &Schedule{Allocated: map[string]float64{}, RawAllocated: map[string]uint32{}}
+  for _, a := range b.Allocations {
+    if a.End <= a.Start {
+      continue
+    }
+    kind := "other"
+    switch {
+    case a.GLID == glidLocalCSMA || a.GLID == glidSharedCSMA:
+      kind = "csma"
+    case a.GLID <= glidTDMAMax:
+      kind = "tdma"
+    }
+    s.Allocated[kind] += float64(a.End - a.Start) * atu
+    s.RawAllocated[kind] += uint32(a.End - a.Start)
+    if a.End > s.RawPeriod {
+      s.RawPeriod = a.End
+      s.Period = float64(a.End) * atu
+    }
+  }
+  return s
+}
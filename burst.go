@@ -0,0 +1,152 @@
+package main
+
+import (
+  "sync"
+  "time"
+  "strconv"
+  "net/http"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/common/model"
+)
+
+// apiBurstPath is the endpoint for burst polling, which needs the admin scope
+// rather than the api scope, as it sends more queries to the devices.
+const apiBurstPath = "/api/" + apiVersion + "/burst"
+
+// defaultBurstDuration is how long a burst lasts if the request doesn't say.
+const defaultBurstDuration = 10 * time.Minute
+
+var pollerBurst = prometheus.NewGauge(
+  prometheus.GaugeOpts{
+    Namespace: namespace,
+    Name:      "poller_burst_active",
+    Help:      "Whether a burst requested through the API is polling more often, with every collector enabled.",
+  })
+
+// pollBurst is a temporary increase of the polling frequency, during which
+// every poll runs the heavy collectors whatever their flags and schedules.
+type pollBurst struct {
+  mutex       sync.Mutex
+  interval    time.Duration
+  maxDuration time.Duration
+  until       time.Time
+  // wake cuts short the background poller's wait when a burst starts or is
+  // stopped.
+  wake        chan struct{}
+}
+
+// SetBurstOptions sets how often a burst polls, and for how long one may be
+// requested at most.
+func (p *Poller) SetBurstOptions(interval, maxDuration time.Duration) {
+  p.burst.mutex.Lock()
+  defer p.burst.mutex.Unlock()
+  p.burst.interval = interval
+  p.burst.maxDuration = maxDuration
+}
+
+// Burst polls every burst interval for d, up to the longest burst allowed,
+// or until the end of the current burst if that is later. It returns the
+// time the burst ends.
+func (p *Poller) Burst(d time.Duration) time.Time {
+  b := &p.burst
+  b.mutex.Lock()
+  if d > b.maxDuration {
+    d = b.maxDuration
+  }
+  if until := time.Now().Add(d); until.After(b.until) {
+    b.until = until
+  }
+  until, interval := b.until, b.interval
+  b.mutex.Unlock()
+  pollerBurst.Set(1)
+  pollerLog.Infof("burst polling every %s until %s", interval, until.Format(time.RFC3339))
+  b.signal()
+  return until
+}
+
+// StopBurst ends the current burst, if there is one.
+func (p *Poller) StopBurst() {
+  b := &p.burst
+  b.mutex.Lock()
+  active := time.Now().Before(b.until)
+  b.until = time.Time{}
+  b.mutex.Unlock()
+  if active {
+    pollerBurst.Set(0)
+    pollerLog.Infof("burst polling stopped")
+    b.signal()
+  }
+}
+
+// bursting returns the interval and end of the current burst, and whether
+// there is one.
+func (p *Poller) bursting() (time.Duration, time.Time, bool) {
+  b := &p.burst
+  b.mutex.Lock()
+  defer b.mutex.Unlock()
+  if b.until.IsZero() {
+    return 0, time.Time{}, false
+  }
+  if !time.Now().Before(b.until) {
+    b.until = time.Time{}
+    pollerBurst.Set(0)
+    pollerLog.Infof("burst polling ended")
+    return 0, time.Time{}, false
+  }
+  return b.interval, b.until, true
+}
+
+func (b *pollBurst) signal() {
+  select {
+  case b.wake <- struct{}{}:
+  default:
+  }
+}
+
+type apiBurst struct {
+  APIVersion string     `json:"api_version"`
+  Active     bool       `json:"active"`
+  Until      *time.Time `json:"until,omitempty"`
+  Interval   float64    `json:"interval_seconds,omitempty"`
+}
+
+// serveBurst starts or extends a burst on POST, for the duration given by the
+// duration parameter, ends it on DELETE, and reports it on any request. The
+// request body is ignored, so that it can be posted to by Alertmanager's
+// webhook receiver.
+func (a *API) serveBurst(w http.ResponseWriter, r *http.Request) {
+  a, err := a.segment(r)
+  if err != nil {
+    write_api_json(w, http.StatusBadRequest, apiError{apiVersion, err.Error()})
+    return
+  }
+  switch r.Method {
+  case http.MethodGet:
+  case http.MethodPost:
+    d := defaultBurstDuration
+    if v := r.URL.Query().Get("duration"); v != "" {
+      pd, err := model.ParseDuration(v)
+      if err != nil || pd <= 0 {
+        write_api_json(w, http.StatusBadRequest, apiError{apiVersion, "invalid duration " + strconv.Quote(v)})
+        return
+      }
+      d = time.Duration(pd)
+    }
+    a.poller.Burst(d)
+  case http.MethodDelete:
+    a.poller.StopBurst()
+  default:
+    w.Header().Set("Allow", "GET, POST, DELETE")
+    write_api_json(w, http.StatusMethodNotAllowed, apiError{apiVersion, "only GET, POST and DELETE are supported"})
+    return
+  }
+
+  status := apiBurst{APIVersion: apiVersion}
+  if interval, until, ok := a.poller.bursting(); ok {
+    status.Active = true
+    status.Until = &until
+    status.Interval = interval.Seconds()
+  }
+  write_api_json(w, http.StatusOK, status)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+  "bytes"
+  "net"
+)
+
+// Capacity estimates the aggregate throughput that the network with the
+// given ID carries between its hub and the rest of its stations when all of
+// them are busy, in bytes per second. The hub is the local adapter if it is
+// a member of the network, where the router usually is, and the CCo
+// otherwise.
+//
+// Only one link transmits at a time, so when each station is given the same
+// throughput, every byte it is sent takes the time of a byte at its link's
+// rate: the capacity is the harmonic mean of the rates of the links to the
+// hub, each the lowest reported in either direction, and the slowest links
+// weigh the most. Stations without a rate to the hub are left out. It
+// returns false if there are none with one.
+func (s *Snapshot) Capacity(id string) (float64, bool) {
+  network := s.Network(id)
+  if network == nil {
+    return 0, false
+  }
+  hub := network.CCoAddress
+  if local := s.Station(s.Local); local != nil && local.NetworkID == id {
+    hub = s.Local
+  }
+  if hub == nil {
+    return 0, false
+  }
+
+  // The lowest rate of each link to the hub, whichever family reported it.
+  rates := map[string]float64{}
+  for _, p := range s.LinkPairs(false) {
+    var peer net.HardwareAddr
+    switch {
+    case bytes.Equal(p.A, hub):
+      peer = p.B
+    case bytes.Equal(p.B, hub):
+      peer = p.A
+    default:
+      continue
+    }
+    station := s.Station(peer)
+    if station == nil || station.NetworkID != id || p.Rate <= 0 {
+      continue
+    }
+    if rate, ok := rates[peer.String()]; !ok || p.Rate < rate {
+      rates[peer.String()] = p.Rate
+    }
+  }
+  if len(rates) == 0 {
+    return 0, false
+  }
+
+  var perByte float64
+  for _, rate := range rates {
+    perByte += 1 / rate
+  }
+  return float64(len(rates)) / perByte, true
+}
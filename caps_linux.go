@@ -0,0 +1,33 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "strconv"
+  "io/ioutil"
+)
+
+// capNetRaw is the bit of CAP_NET_RAW in the capability sets.
+const capNetRaw = 13
+
+// check_capabilities returns an error if the process lacks CAP_NET_RAW. If
+// the capabilities can't be read, it leaves it to opening the socket to fail.
+func check_capabilities() error {
+  b, err := ioutil.ReadFile("/proc/self/status")
+  if err != nil {
+    return nil
+  }
+  for _, line := range strings.Split(string(b), "\n") {
+    if !strings.HasPrefix(line, "CapEff:") {
+      continue
+    }
+    eff, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+    if err != nil {
+      return nil
+    }
+    if eff & (1 << capNetRaw) == 0 {
+      return fmt.Errorf("CAP_NET_RAW is required to open raw sockets; run as root or grant it with 'setcap cap_net_raw+ep'")
+    }
+  }
+  return nil
+}
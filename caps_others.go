@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+// check_capabilities always succeeds, as raw socket permissions are only
+// described by capabilities on Linux.
+func check_capabilities() error {
+  return nil
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "strings"
+  "io/ioutil"
+  "encoding/hex"
+  "text/template"
+
+  "github.com/prometheus/common/config"
+  "github.com/prometheus/common/model"
+  "gopkg.in/yaml.v2"
+)
+
+// Config is the contents of the file given by --config.file. Everything in
+// it is optional; flags remain the primary means of configuration.
+type Config struct {
+  // HTTPClient is shared by every outbound HTTP client, unless a client has
+  // an http_client section of its own.
+  HTTPClient         config.HTTPClientConfig `yaml:"http_client,omitempty"`
+  RemoteWrite        []RemoteWriteConfig     `yaml:"remote_write,omitempty"`
+  Zabbix             []ZabbixConfig          `yaml:"zabbix,omitempty"`
+  MQTT               []MQTTConfig            `yaml:"mqtt,omitempty"`
+  Auth               AuthConfig              `yaml:"auth,omitempty"`
+  Links              LinksConfig             `yaml:"links,omitempty"`
+  EventLog           *EventLogConfig         `yaml:"event_log,omitempty"`
+  Webhooks           []WebhookConfig         `yaml:"webhooks,omitempty"`
+  Probe              ProbeConfig             `yaml:"probe,omitempty"`
+  // Modules are named sets of probe settings, and Targets named devices
+  // that /probe can be asked for in place of a MAC address.
+  Modules            map[string]ModuleConfig `yaml:"modules,omitempty"`
+  Targets            []TargetConfig          `yaml:"targets,omitempty"`
+  MetricRules        []MetricRuleConfig      `yaml:"metric_rules,omitempty"`
+  Synthetic          *SyntheticConfig        `yaml:"synthetic_target,omitempty"`
+  Exec               []ExecConfig            `yaml:"exec,omitempty"`
+  SNMP               *SNMPConfig             `yaml:"snmp,omitempty"`
+  // SourceAddresses maps destination addresses to the source address that
+  // unicast queries to them are sent from, for adapters that only answer
+  // the client paired with them.
+  SourceAddresses    map[string]string       `yaml:"source_addresses,omitempty"`
+  // Phases maps station addresses to the electrical phase they are wired
+  // to, such as L1, L2 or L3.
+  Phases             map[string]string       `yaml:"phases,omitempty"`
+  // Vendors names the vendors of the stations whose addresses start with an
+  // OUI, in addition to those that are built in.
+  Vendors            map[string]string       `yaml:"vendors,omitempty"`
+  // CollectorSchedules restrict the heavy collectors they name to the
+  // times their crontab-style schedule matches, in local time.
+  CollectorSchedules map[string]string       `yaml:"collector_schedules,omitempty"`
+  // DeviceTypes sets the device type of the stations with an address, or
+  // an OUI, such as the GreenPHY modules that can't be told apart from AV
+  // stations.
+  DeviceTypes        map[string]string       `yaml:"device_types,omitempty"`
+  // Accept pins the replies that polls decode to the stations of the
+  // networks and reporters it lists.
+  Accept             AcceptConfig            `yaml:"accept,omitempty"`
+}
+
+// AcceptConfig lists the networks, by network identifier (NID), and the
+// reporters whose replies are decoded. Either is left out if it is empty.
+type AcceptConfig struct {
+  NetworkIDs []string `yaml:"network_ids,omitempty"`
+  Reporters  []string `yaml:"reporters,omitempty"`
+}
+
+// Ways of exporting link rates.
+const (
+  // linkModeDirected exports the tx and rx rates of every reporter.
+  linkModeDirected      = "directed"
+  // linkModeUndirectedMin exports one rate per pair of stations, the lowest
+  // reported in either direction.
+  linkModeUndirectedMin = "undirected_min"
+  // linkModeUndirected exports one rate per pair of stations and direction.
+  linkModeUndirected    = "undirected"
+)
+
+// Ways of exporting rates that the devices don't report exactly.
+const (
+  // rateClamp exports a saturated rate as 255 Mbit/s, the least it may be.
+  rateClamp    = "clamp"
+  // rateNaN exports NaN in place of a saturated or unknown rate.
+  rateNaN      = "nan"
+  // rateExtended asks Qualcomm stations for the 16-bit rates of VS_NW_INFO
+  // MMV 1, and clamps the rates of those that only send 8-bit ones.
+  rateExtended = "extended"
+  // rateZero exports an unknown rate as 0.
+  rateZero     = "zero"
+)
+
+type LinksConfig struct {
+  Mode          string `yaml:"mode,omitempty"`
+  // SaturatedRate is how a rate of 255 Mbit/s is exported, which devices
+  // report for any rate from 255 up: clamp, nan or extended.
+  SaturatedRate string `yaml:"saturated_rate,omitempty"`
+  // UnknownRate is how a rate of 0 is exported, which devices report for
+  // links they have not measured: zero or nan.
+  UnknownRate   string `yaml:"unknown_rate,omitempty"`
+}
+
+// ProbeConfig sets the defaults for /probe, and the most that the timeout
+// and retries parameters may ask for.
+type ProbeConfig struct {
+  Timeout    model.Duration `yaml:"timeout,omitempty"`
+  MaxTimeout model.Duration `yaml:"max_timeout,omitempty"`
+  Retries    int            `yaml:"retries,omitempty"`
+  MaxRetries int            `yaml:"max_retries,omitempty"`
+  // Interfaces are those other than --interface that the interface
+  // parameter may ask for.
+  Interfaces []string       `yaml:"interfaces,omitempty"`
+}
+
+// ModuleConfig overrides the probe defaults for the targets that refer to
+// it, or for the probes that ask for it with the module parameter.
+type ModuleConfig struct {
+  Timeout    model.Duration `yaml:"timeout,omitempty"`
+  Retries    *int           `yaml:"retries,omitempty"`
+  // Collectors are the heavy collectors that are run, in place of those
+  // enabled by the flags. An empty list runs none of them.
+  Collectors []string       `yaml:"collectors,omitempty"`
+}
+
+// TargetConfig is a device that /probe queries when the target parameter
+// is its Name, at Destination on Interface, or --interface if it has none.
+// Its own settings override those of its Module.
+type TargetConfig struct {
+  Name         string `yaml:"name"`
+  Interface    string `yaml:"interface,omitempty"`
+  Destination  string `yaml:"destination"`
+  Module       string `yaml:"module,omitempty"`
+  ModuleConfig `yaml:",inline"`
+}
+
+// SyntheticConfig defines a fake target that /probe answers without querying
+// any device, with a network of Stations stations whose links all have the
+// given Rate.
+type SyntheticConfig struct {
+  Address  string `yaml:"address"`
+  Stations int    `yaml:"stations,omitempty"`
+  Rate     uint8  `yaml:"rate,omitempty"`
+}
+
+// ExecConfig is a program run on every scrape, whose output is merged into
+// the metrics. Command is the program and its arguments; no shell is used.
+type ExecConfig struct {
+  Name    string         `yaml:"name"`
+  Command []string       `yaml:"command"`
+  Timeout model.Duration `yaml:"timeout,omitempty"`
+}
+
+// SNMPConfig enables the SNMP agent, which answers SNMPv1 and v2c requests
+// from managers that know Community with the last poll's tables under
+// BaseOID.
+type SNMPConfig struct {
+  ListenAddress string `yaml:"listen_address"`
+  Community     string `yaml:"community,omitempty"`
+  BaseOID       string `yaml:"base_oid,omitempty"`
+}
+
+type EventLogConfig struct {
+  Path           string    `yaml:"path"`
+  // MaxSize is the size in bytes beyond which the file is rotated. If 0, it
+  // is never rotated.
+  MaxSize        int64     `yaml:"max_size_bytes,omitempty"`
+  // MaxFiles is the number of rotated files kept.
+  MaxFiles       int       `yaml:"max_files,omitempty"`
+  // RateThresholds are the rates, in bytes/s, whose crossing by a link is
+  // logged.
+  RateThresholds []float64 `yaml:"rate_thresholds_bytes,omitempty"`
+}
+
+type WebhookConfig struct {
+  URL        string                   `yaml:"url"`
+  // Events are the types of event sent. By default, stations joining and
+  // leaving are.
+  Events     []string                 `yaml:"events,omitempty"`
+  // Body is a text/template for the request body, executed with the Event.
+  Body       string                   `yaml:"body,omitempty"`
+  Timeout    model.Duration           `yaml:"timeout,omitempty"`
+  HTTPClient *config.HTTPClientConfig `yaml:"http_client,omitempty"`
+}
+
+type RemoteWriteConfig struct {
+  URL        string                   `yaml:"url"`
+  Timeout    model.Duration           `yaml:"timeout,omitempty"`
+  HTTPClient *config.HTTPClientConfig `yaml:"http_client,omitempty"`
+}
+
+// ZabbixConfig is a Zabbix server or proxy that the metrics are sent to as
+// trapper items of Host.
+type ZabbixConfig struct {
+  Server  string             `yaml:"server"`
+  Host    string             `yaml:"host"`
+  Timeout model.Duration     `yaml:"timeout,omitempty"`
+  // Items map metrics to item keys. If there are any, metrics without one
+  // are not sent.
+  Items   []ZabbixItemConfig `yaml:"items,omitempty"`
+}
+
+// ZabbixItemConfig gives the item key of the series of Metric, as a
+// text/template executed with their labels.
+type ZabbixItemConfig struct {
+  Metric string `yaml:"metric"`
+  Key    string `yaml:"key"`
+}
+
+// MQTTConfig is an MQTT broker that the topology and stations are published
+// to, under Topic.
+type MQTTConfig struct {
+  Broker    string            `yaml:"broker"`
+  ClientID  string            `yaml:"client_id,omitempty"`
+  Topic     string            `yaml:"topic,omitempty"`
+  Username  string            `yaml:"username,omitempty"`
+  Password  config.Secret     `yaml:"password,omitempty"`
+  // Retain has the broker keep the last message of each topic for clients
+  // that subscribe later.
+  Retain    bool              `yaml:"retain,omitempty"`
+  Timeout   model.Duration    `yaml:"timeout,omitempty"`
+  TLSConfig *config.TLSConfig `yaml:"tls_config,omitempty"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+  c := &Config{
+    Links: LinksConfig{Mode: linkModeDirected, SaturatedRate: rateClamp, UnknownRate: rateZero},
+    Probe: ProbeConfig{
+      Timeout:    model.Duration(queryTimeout),
+      MaxTimeout: model.Duration(10 * time.Second),
+      MaxRetries: 3,
+    },
+  }
+  if path == "" {
+    return c, nil
+  }
+
+  b, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  if err := yaml.UnmarshalStrict(b, c); err != nil {
+    return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+  }
+  if err := c.HTTPClient.Validate(); err != nil {
+    return nil, fmt.Errorf("http_client: %v", err)
+  }
+  switch c.Links.Mode {
+  case linkModeDirected, linkModeUndirectedMin, linkModeUndirected:
+  default:
+    return nil, fmt.Errorf("links: unknown mode %q", c.Links.Mode)
+  }
+  switch c.Links.SaturatedRate {
+  case rateClamp, rateNaN, rateExtended:
+  default:
+    return nil, fmt.Errorf("links: unknown saturated_rate %q", c.Links.SaturatedRate)
+  }
+  switch c.Links.UnknownRate {
+  case rateZero, rateNaN:
+  default:
+    return nil, fmt.Errorf("links: unknown unknown_rate %q", c.Links.UnknownRate)
+  }
+  if c.Probe.Timeout <= 0 || c.Probe.MaxTimeout < c.Probe.Timeout {
+    return nil, fmt.Errorf("probe: timeout must be positive and no more than max_timeout")
+  }
+  if c.Probe.Retries < 0 || c.Probe.MaxRetries < c.Probe.Retries {
+    return nil, fmt.Errorf("probe: retries must not be negative or more than max_retries")
+  }
+  for _, name := range c.Probe.Interfaces {
+    if name == "" {
+      return nil, fmt.Errorf("probe: interfaces must not be empty")
+    }
+  }
+  for name, m := range c.Modules {
+    if err := m.validate(); err != nil {
+      return nil, fmt.Errorf("modules: %s: %v", name, err)
+    }
+  }
+  targets := map[string]bool{}
+  for i, t := range c.Targets {
+    if t.Name == "" || targets[t.Name] {
+      return nil, fmt.Errorf("targets %d: name is required and must be unique", i)
+    }
+    targets[t.Name] = true
+    if _, err := net.ParseMAC(t.Name); err == nil {
+      return nil, fmt.Errorf("targets %s: name must not be a MAC address", t.Name)
+    }
+    if a, err := net.ParseMAC(t.Destination); err != nil || len(a) != 6 {
+      return nil, fmt.Errorf("targets %s: destination must be a MAC address", t.Name)
+    }
+    if _, ok := c.Modules[t.Module]; t.Module != "" && !ok {
+      return nil, fmt.Errorf("targets %s: unknown module %q", t.Name, t.Module)
+    }
+    if err := t.ModuleConfig.validate(); err != nil {
+      return nil, fmt.Errorf("targets %s: %v", t.Name, err)
+    }
+  }
+  if _, err := compile_metric_rules(c.MetricRules); err != nil {
+    return nil, err
+  }
+  if c.Synthetic != nil {
+    a, err := net.ParseMAC(c.Synthetic.Address)
+    if err != nil || len(a) != 6 || a[0] & 0x01 != 0 {
+      return nil, fmt.Errorf("synthetic_target: address must be a unicast MAC address")
+    }
+    if c.Synthetic.Stations == 0 {
+      c.Synthetic.Stations = 2
+    }
+    if c.Synthetic.Stations < 1 || c.Synthetic.Stations > 64 {
+      return nil, fmt.Errorf("synthetic_target: stations must be between 1 and 64")
+    }
+    if c.Synthetic.Rate == 0 {
+      c.Synthetic.Rate = 100
+    }
+  }
+  names := map[string]bool{}
+  for i := range c.Exec {
+    e := &c.Exec[i]
+    if e.Name == "" || names[e.Name] {
+      return nil, fmt.Errorf("exec %d: name is required and must be unique", i)
+    }
+    names[e.Name] = true
+    if len(e.Command) == 0 || e.Command[0] == "" {
+      return nil, fmt.Errorf("exec %s: command is required", e.Name)
+    }
+    if e.Timeout == 0 {
+      e.Timeout = model.Duration(10 * time.Second)
+    }
+  }
+  if c.SNMP != nil {
+    if c.SNMP.ListenAddress == "" {
+      return nil, fmt.Errorf("snmp: listen_address is required")
+    }
+    if c.SNMP.Community == "" {
+      c.SNMP.Community = "public"
+    }
+    if c.SNMP.BaseOID == "" {
+      c.SNMP.BaseOID = snmpDefaultBaseOID
+    }
+    if _, err := parse_oid(c.SNMP.BaseOID); err != nil {
+      return nil, fmt.Errorf("snmp: base_oid: %v", err)
+    }
+  }
+  if c.EventLog != nil && c.EventLog.Path == "" {
+    return nil, fmt.Errorf("event_log: path is required")
+  }
+  for dest, src := range c.SourceAddresses {
+    d, err := net.ParseMAC(dest)
+    if err != nil {
+      return nil, fmt.Errorf("source_addresses: %v", err)
+    }
+    if d[0] & 0x01 != 0 {
+      return nil, fmt.Errorf("source_addresses: %s is not a unicast address", dest)
+    }
+    if _, err := net.ParseMAC(src); err != nil {
+      return nil, fmt.Errorf("source_addresses: %s: %v", dest, err)
+    }
+  }
+  for address, phase := range c.Phases {
+    if _, err := net.ParseMAC(address); err != nil {
+      return nil, fmt.Errorf("phases: %v", err)
+    }
+    if phase == "" {
+      return nil, fmt.Errorf("phases: %s has no phase", address)
+    }
+  }
+  for prefix, vendor := range c.Vendors {
+    if _, err := parse_oui(prefix); err != nil {
+      return nil, fmt.Errorf("vendors: %v", err)
+    }
+    if vendor == "" {
+      return nil, fmt.Errorf("vendors: %s has no vendor", prefix)
+    }
+  }
+  for key, t := range c.DeviceTypes {
+    if _, err := parse_device_type_key(key); err != nil {
+      return nil, fmt.Errorf("device_types: %v", err)
+    }
+    switch t {
+    case deviceTypeGreenPHY, deviceTypeAV, deviceTypeAV2:
+    default:
+      return nil, fmt.Errorf("device_types: %s: unknown device type %q", key, t)
+    }
+  }
+  for _, id := range c.Accept.NetworkIDs {
+    if b, err := hex.DecodeString(id); err != nil || len(b) != 7 {
+      return nil, fmt.Errorf("accept: network ID %q must be 14 hex digits", id)
+    }
+  }
+  for _, address := range c.Accept.Reporters {
+    if a, err := net.ParseMAC(address); err != nil || len(a) != 6 {
+      return nil, fmt.Errorf("accept: reporter %q must be a MAC address", address)
+    }
+  }
+  for name, spec := range c.CollectorSchedules {
+    known := false
+    for _, collector := range scheduledCollectors {
+      known = known || name == collector
+    }
+    if !known {
+      return nil, fmt.Errorf("collector_schedules: unknown collector %q", name)
+    }
+    schedule, err := parse_cron(spec)
+    if err != nil {
+      return nil, fmt.Errorf("collector_schedules: %s: %v", name, err)
+    }
+    if schedule.Next(time.Now()).IsZero() {
+      return nil, fmt.Errorf("collector_schedules: %s: schedule %q never matches", name, spec)
+    }
+  }
+  for i, wh := range c.Webhooks {
+    if wh.URL == "" {
+      return nil, fmt.Errorf("webhooks %d: url is required", i)
+    }
+    for _, e := range wh.Events {
+      switch e {
+      case eventStationJoined, eventStationLeft, eventCCoChanged:
+      default:
+        return nil, fmt.Errorf("webhooks %d: unknown event %q", i, e)
+      }
+    }
+    if _, err := parse_webhook_template(wh.Body); err != nil {
+      return nil, fmt.Errorf("webhooks %d: body: %v", i, err)
+    }
+    if wh.HTTPClient != nil {
+      if err := wh.HTTPClient.Validate(); err != nil {
+        return nil, fmt.Errorf("webhooks %d: http_client: %v", i, err)
+      }
+    }
+  }
+  for i, rw := range c.RemoteWrite {
+    if rw.URL == "" {
+      return nil, fmt.Errorf("remote_write %d: url is required", i)
+    }
+    if rw.HTTPClient != nil {
+      if err := rw.HTTPClient.Validate(); err != nil {
+        return nil, fmt.Errorf("remote_write %d: http_client: %v", i, err)
+      }
+    }
+  }
+  for i, z := range c.Zabbix {
+    if z.Server == "" || z.Host == "" {
+      return nil, fmt.Errorf("zabbix %d: server and host are required", i)
+    }
+    for _, item := range z.Items {
+      if item.Metric == "" || item.Key == "" {
+        return nil, fmt.Errorf("zabbix %d: items need a metric and a key", i)
+      }
+      if _, err := template.New(item.Metric).Parse(item.Key); err != nil {
+        return nil, fmt.Errorf("zabbix %d: item %s: %v", i, item.Metric, err)
+      }
+    }
+  }
+  for i, m := range c.MQTT {
+    if m.Broker == "" {
+      return nil, fmt.Errorf("mqtt %d: broker is required", i)
+    }
+    if strings.ContainsAny(m.Topic, "+#") {
+      return nil, fmt.Errorf("mqtt %d: topic must not contain wildcards", i)
+    }
+    if m.Password != "" && m.Username == "" {
+      return nil, fmt.Errorf("mqtt %d: password needs a username", i)
+    }
+  }
+  return c, nil
+}
+
+func (m ModuleConfig) validate() error {
+  if m.Timeout < 0 {
+    return fmt.Errorf("timeout must not be negative")
+  }
+  if m.Retries != nil && *m.Retries < 0 {
+    return fmt.Errorf("retries must not be negative")
+  }
+  for _, name := range m.Collectors {
+    known := false
+    for _, collector := range scheduledCollectors {
+      known = known || name == collector
+    }
+    if !known {
+      return fmt.Errorf("unknown collector %q", name)
+    }
+  }
+  return nil
+}
+
+// target returns the named target, or nil if there is none.
+func (c *Config) target(name string) *TargetConfig {
+  for i := range c.Targets {
+    if c.Targets[i].Name == name {
+      return &c.Targets[i]
+    }
+  }
+  return nil
+}
+
+// probeInterfaces returns the interfaces other than --interface that /probe
+// may query: those in the probe section, and those of the targets.
+func (c *Config) probeInterfaces() []string {
+  names := append([]string{}, c.Probe.Interfaces...)
+  for _, t := range c.Targets {
+    if t.Interface != "" {
+      names = append(names, t.Interface)
+    }
+  }
+  return names
+}
+
+// sourceAddresses returns the parsed source_addresses, keyed by the string
+// form of the destination address.
+func (c *Config) sourceAddresses() map[string]net.HardwareAddr {
+  sources := map[string]net.HardwareAddr{}
+  for dest, src := range c.SourceAddresses {
+    d, _ := net.ParseMAC(dest)
+    s, _ := net.ParseMAC(src)
+    sources[d.String()] = s
+  }
+  return sources
+}
+
+// vendors returns the configured vendors, keyed by the string form of the
+// OUI.
+func (c *Config) vendors() map[string]string {
+  vendors := map[string]string{}
+  for prefix, vendor := range c.Vendors {
+    o, _ := parse_oui(prefix)
+    vendors[o] = vendor
+  }
+  return vendors
+}
+
+// phases returns the configured phases, keyed by the string form of the
+// station address.
+func (c *Config) phases() map[string]string {
+  phases := map[string]string{}
+  for address, phase := range c.Phases {
+    a, _ := net.ParseMAC(address)
+    phases[a.String()] = phase
+  }
+  return phases
+}
+
+// deviceTypes returns the configured device types, keyed by the string form
+// of the station address or OUI.
+func (c *Config) deviceTypes() map[string]string {
+  types := map[string]string{}
+  for key, t := range c.DeviceTypes {
+    k, _ := parse_device_type_key(key)
+    types[k] = t
+  }
+  return types
+}
+
+// replyFilter returns the filter of the accepted networks and reporters.
+func (c *Config) replyFilter() replyFilter {
+  f := replyFilter{networks: map[string]bool{}, reporters: map[string]bool{}}
+  for _, id := range c.Accept.NetworkIDs {
+    b, _ := hex.DecodeString(id)
+    f.networks[hex.EncodeToString(b)] = true
+  }
+  for _, address := range c.Accept.Reporters {
+    a, _ := net.ParseMAC(address)
+    f.reporters[a.String()] = true
+  }
+  return f
+}
+
+// collectorSchedules returns the parsed collector_schedules.
+func (c *Config) collectorSchedules() map[string]*cronSchedule {
+  schedules := map[string]*cronSchedule{}
+  for name, spec := range c.CollectorSchedules {
+    schedules[name], _ = parse_cron(spec)
+  }
+  return schedules
+}
+
+// metricRules returns the compiled metric_rules.
+func (c *Config) metricRules() metricRules {
+  rules, _ := compile_metric_rules(c.MetricRules)
+  return rules
+}
+
+// clientConfig returns the HTTP client configuration for an outbound client,
+// which is its own if it has one, or otherwise the shared one.
+func (c *Config) clientConfig(own *config.HTTPClientConfig) config.HTTPClientConfig {
+  if own != nil {
+    return *own
+  }
+  return c.HTTPClient
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+  "fmt"
+  "net"
+)
+
+// autoMacvlan, given as --interface, selects the first macvlan interface that
+// is up, which is how a container on a macvlan network reaches the LAN.
+const autoMacvlan = "auto-macvlan"
+
+// find_macvlan_interface returns the first macvlan interface that is up.
+func find_macvlan_interface() (*net.Interface, error) {
+  ifaces, err := net.Interfaces()
+  if err != nil {
+    return nil, err
+  }
+  for i := range ifaces {
+    if ifaces[i].Flags & net.FlagUp != 0 && link_kind(&ifaces[i]) == "macvlan" {
+      return &ifaces[i], nil
+    }
+  }
+  return nil, fmt.Errorf("no macvlan interface is up; attach the container to a macvlan network whose parent is on the powerline adapters' LAN")
+}
+
+// check_raw_interface returns an error if HomePlug frames can't be exchanged
+// on iface at all, and warns of the setups in which they are unlikely to
+// reach the devices, such as a container on a bridge network. Both end up
+// as "no devices found" otherwise.
+func check_raw_interface(iface *net.Interface) error {
+  if len(iface.HardwareAddr) != 6 {
+    return fmt.Errorf("interface %s has no Ethernet address, so HomePlug frames can't be sent on it", iface.Name)
+  }
+  switch kind := link_kind(iface); {
+  case kind == "ipvlan":
+    return fmt.Errorf("interface %s is an ipvlan, which only passes IP traffic to the container; use a macvlan network, or the host's network, instead", iface.Name)
+  case kind == "veth" && in_container() && peer_elsewhere(iface):
+    mainLog.Warnf("interface %s is the end of a veth in a container on a bridge network, such as Docker's default one; HomePlug frames only reach the devices if the bridge includes the interface of their LAN. Run the container with --net=host, or on a macvlan network with --interface=%s", iface.Name, autoMacvlan)
+  }
+  return nil
+}
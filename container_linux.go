@@ -0,0 +1,91 @@
+package main
+
+import (
+  "os"
+  "net"
+  "unsafe"
+  "strconv"
+  "strings"
+  "syscall"
+  "io/ioutil"
+  "path/filepath"
+)
+
+// iflaInfoKind is the attribute of IFLA_LINKINFO that names the kind of a
+// virtual interface.
+const iflaInfoKind = 1
+
+// link_kind returns the kind of iface as `ip -d link` names it, such as veth,
+// macvlan, ipvlan or bridge, or "" for a physical interface or if it can't be
+// read.
+func link_kind(iface *net.Interface) string {
+  rib, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+  if err != nil {
+    return ""
+  }
+  msgs, err := syscall.ParseNetlinkMessage(rib)
+  if err != nil {
+    return ""
+  }
+  for i := range msgs {
+    m := &msgs[i]
+    if m.Header.Type != syscall.RTM_NEWLINK || len(m.Data) < syscall.SizeofIfInfomsg {
+      continue
+    }
+    if int((*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0])).Index) != iface.Index {
+      continue
+    }
+    attrs, err := syscall.ParseNetlinkRouteAttr(m)
+    if err != nil {
+      return ""
+    }
+    for _, a := range attrs {
+      if a.Attr.Type != syscall.IFLA_LINKINFO {
+        continue
+      }
+      // The link info is nested attributes, which are parsed as those of a
+      // message of their own.
+      nested := &syscall.NetlinkMessage{
+        Header: syscall.NlMsghdr{Type: syscall.RTM_NEWLINK},
+        Data:   append(make([]byte, syscall.SizeofIfInfomsg), a.Value...),
+      }
+      info, err := syscall.ParseNetlinkRouteAttr(nested)
+      if err != nil {
+        return ""
+      }
+      for _, ia := range info {
+        if ia.Attr.Type == iflaInfoKind {
+          return strings.TrimRight(string(ia.Value), "\x00")
+        }
+      }
+    }
+    return ""
+  }
+  return ""
+}
+
+// in_container reports whether the exporter runs in a Docker or Podman
+// container.
+func in_container() bool {
+  for _, path := range []string{"/.dockerenv", "/run/.containerenv"} {
+    if _, err := os.Stat(path); err == nil {
+      return true
+    }
+  }
+  return false
+}
+
+// peer_elsewhere reports whether the peer of the veth iface is in another
+// network namespace, as that of a container on a bridge network is.
+func peer_elsewhere(iface *net.Interface) bool {
+  b, err := ioutil.ReadFile(filepath.Join("/sys/class/net", iface.Name, "iflink"))
+  if err != nil {
+    return false
+  }
+  index, err := strconv.Atoi(strings.TrimSpace(string(b)))
+  if err != nil || index == iface.Index {
+    return false
+  }
+  _, err = net.InterfaceByIndex(index)
+  return err != nil
+}
@@ -0,0 +1,24 @@
+// +build !linux
+
+package main
+
+import (
+  "net"
+)
+
+// link_kind always returns "", as the kind of an interface is only read from
+// netlink on Linux.
+func link_kind(iface *net.Interface) string {
+  return ""
+}
+
+// in_container always reports false, as containers are only detected on
+// Linux.
+func in_container() bool {
+  return false
+}
+
+// peer_elsewhere always reports false.
+func peer_elsewhere(iface *net.Interface) bool {
+  return false
+}
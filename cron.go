@@ -0,0 +1,154 @@
+package main
+
+import (
+  "fmt"
+  "time"
+  "strconv"
+  "strings"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+// scheduledCollectors are the heavy collectors that collector_schedules may
+// restrict to certain times of day.
+var scheduledCollectors = []string{"schedule", "link_stats", "firmware", "tone_maps", "discover_list"}
+
+var collectorNextRun = prometheus.NewGaugeVec(
+  prometheus.GaugeOpts{
+    Namespace: namespace,
+    Name:      "collector_next_run_timestamp_seconds",
+    Help:      "Time at or after which the next poll runs a heavy collector that is restricted by collector_schedules.",
+  },
+  []string{"collector"})
+
+// cronShortcuts are the named schedules that may be given in place of the
+// five fields.
+var cronShortcuts = map[string]string{
+  "@hourly":   "0 * * * *",
+  "@daily":    "0 0 * * *",
+  "@midnight": "0 0 * * *",
+  "@weekly":   "0 0 * * 0",
+  "@monthly":  "0 0 1 * *",
+}
+
+// cronSchedule is a crontab(5) time specification: a minute, hour, day of
+// the month, month and day of the week field, each a set of the values it
+// matches. As in cron, a time matches either day field when both are
+// restricted.
+type cronSchedule struct {
+  minute, hour, dom, month, dow uint64
+  domAny, dowAny                bool
+}
+
+// parse_cron parses a schedule of five space-separated fields, each of which
+// is * or a comma-separated list of values and ranges, optionally followed
+// by /step. Sunday is day 0 or 7.
+func parse_cron(spec string) (*cronSchedule, error) {
+  if s, ok := cronShortcuts[strings.TrimSpace(spec)]; ok {
+    spec = s
+  }
+  fields := strings.Fields(spec)
+  if len(fields) != 5 {
+    return nil, fmt.Errorf("schedule %q must have 5 fields", spec)
+  }
+  c := &cronSchedule{
+    domAny: fields[2] == "*",
+    dowAny: fields[4] == "*",
+  }
+  var err error
+  bounds := []struct {
+    set      *uint64
+    min, max int
+  }{
+    {&c.minute, 0, 59},
+    {&c.hour, 0, 23},
+    {&c.dom, 1, 31},
+    {&c.month, 1, 12},
+    {&c.dow, 0, 7},
+  }
+  for i, b := range bounds {
+    if *b.set, err = parse_cron_field(fields[i], b.min, b.max); err != nil {
+      return nil, fmt.Errorf("schedule %q: %v", spec, err)
+    }
+  }
+  if c.dow & (1 << 7) != 0 {
+    c.dow |= 1
+  }
+  return c, nil
+}
+
+func parse_cron_field(field string, min, max int) (uint64, error) {
+  var set uint64
+  for _, item := range strings.Split(field, ",") {
+    step := 1
+    if i := strings.Index(item, "/"); i >= 0 {
+      n, err := strconv.Atoi(item[i + 1:])
+      if err != nil || n < 1 {
+        return 0, fmt.Errorf("invalid step in %q", item)
+      }
+      item, step = item[:i], n
+    }
+    lo, hi := min, max
+    if item != "*" {
+      r := strings.SplitN(item, "-", 2)
+      var err error
+      if lo, err = strconv.Atoi(r[0]); err != nil {
+        return 0, fmt.Errorf("invalid value %q", item)
+      }
+      hi = lo
+      if len(r) == 2 {
+        if hi, err = strconv.Atoi(r[1]); err != nil {
+          return 0, fmt.Errorf("invalid range %q", item)
+        }
+      } else if step > 1 {
+        hi = max
+      }
+      if lo < min || hi > max || lo > hi {
+        return 0, fmt.Errorf("%q is out of range %d-%d", item, min, max)
+      }
+    }
+    for v := lo; v <= hi; v += step {
+      set |= 1 << uint(v)
+    }
+  }
+  return set, nil
+}
+
+func (c *cronSchedule) matchDay(t time.Time) bool {
+  dom := c.dom & (1 << uint(t.Day())) != 0
+  dow := c.dow & (1 << uint(t.Weekday())) != 0
+  if !c.domAny && !c.dowAny {
+    return dom || dow
+  }
+  return dom && dow
+}
+
+// Next returns the first minute after t that the schedule matches, in the
+// location of t, or the zero time if there is none within five years.
+func (c *cronSchedule) Next(t time.Time) time.Time {
+  loc := t.Location()
+  t = t.Truncate(time.Minute).Add(time.Minute)
+  limit := t.AddDate(5, 0, 0)
+  for t.Before(limit) {
+    y, m, d := t.Date()
+    switch {
+    case c.month & (1 << uint(m)) == 0:
+      t = time.Date(y, m + 1, 1, 0, 0, 0, 0, loc)
+    case !c.matchDay(t):
+      t = time.Date(y, m, d + 1, 0, 0, 0, 0, loc)
+    case c.hour & (1 << uint(t.Hour())) == 0:
+      t = time.Date(y, m, d, t.Hour() + 1, 0, 0, 0, loc)
+    case c.minute & (1 << uint(t.Minute())) == 0:
+      t = t.Add(time.Minute)
+    default:
+      return t
+    }
+  }
+  return time.Time{}
+}
+
+// cronRun is when a heavy collector restricted by a schedule is next due.
+type cronRun struct {
+  schedule *cronSchedule
+  next     time.Time
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+  "fmt"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// protocolCustom is the protocol of the stations that only a decoder
+// registered with homeplug.RegisterDecoder reports.
+const protocolCustom = "custom"
+
+// decode_registered decodes a frame that no protocol family handles with the
+// decoder registered for it, and merges what it returns into the snapshot.
+// It reports whether there is such a decoder.
+func decode_registered(s *Snapshot, m *homeplug.Message) (bool, error) {
+  fn, ok := homeplug.RegisteredDecoder(&m.Frame)
+  if !ok {
+    return false, nil
+  }
+  v, err := fn(m)
+  if err = accept(&m.Frame, err); err != nil {
+    return true, err
+  }
+  switch c := v.(type) {
+  case *homeplug.NetworkInfo:
+    s.AddNetworkInfo(protocolCustom, m.Source, c)
+  case *homeplug.AVNetworkInfo:
+    s.AddAVNetworkInfo(protocolCustom, m.Source, c)
+  case *homeplug.AVNetworkStats:
+    s.AddAVNetworkStats(protocolCustom, m.Source, c)
+  case *homeplug.StationCapability:
+    s.AddStationCapability(m.Source, c)
+  case nil:
+  default:
+    return true, fmt.Errorf("registered decoder of %04x returned a %T, which is not merged", m.Frame.Type(), v)
+  }
+  return true, nil
+}
@@ -0,0 +1,14 @@
+package main
+
+// defaults are the settings that differ between builds for different kinds of
+// host. They are chosen at compile time with build tags.
+type defaults struct {
+  // interfaces are tried in order when no --interface is given, before
+  // falling back to the first interface that is up.
+  interfaces        []string
+  // checkCapabilities makes the exporter check that it may open raw sockets
+  // before trying to, so that it can say how to fix it.
+  checkCapabilities bool
+  // interfaceWait is the default --interface.wait.
+  interfaceWait     string
+}
@@ -0,0 +1,10 @@
+// +build !router
+
+package main
+
+// Defaults for ordinary hosts, where the exporter may run unprivileged and
+// needs CAP_NET_RAW granted to it.
+var buildDefaults = defaults{
+  checkCapabilities: true,
+  interfaceWait:     "0s",
+}
@@ -0,0 +1,13 @@
+// +build router
+
+package main
+
+// Defaults for router firmware such as OpenWrt, selected with -tags router.
+// The exporter runs as root on the router itself, and the powerline adapters
+// hang off the LAN bridge rather than whichever interface comes up first.
+var buildDefaults = defaults{
+  interfaces:        []string{"br-lan", "br0", "lan"},
+  checkCapabilities: false,
+  // The LAN bridge may only come up after the exporter has started.
+  interfaceWait:     "5m",
+}
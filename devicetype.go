@@ -0,0 +1,47 @@
+package main
+
+import (
+  "fmt"
+  "net"
+)
+
+// Types of devices, as exported in the device_type label.
+const (
+  deviceTypeGreenPHY = "greenphy"
+  deviceTypeAV       = "av"
+  deviceTypeAV2      = "av2"
+  deviceTypeLegacy   = "homeplug_1.0"
+)
+
+// parse_device_type_key returns the string form of a key of device_types,
+// which is either a station address or an OUI.
+func parse_device_type_key(key string) (string, error) {
+  if a, err := net.ParseMAC(key); err == nil && len(a) == 6 {
+    return a.String(), nil
+  }
+  if o, err := parse_oui(key); err == nil {
+    return o, nil
+  }
+  return "", fmt.Errorf("%q is neither a MAC address nor an OUI", key)
+}
+
+// assign_device_types sets the device type of every station: the one in
+// types for its address or else its OUI, or else what its capabilities
+// tell. GreenPHY stations report the HomePlug AV 1.1 version in CM_STA_CAP,
+// so they are only told apart from AV ones if they are configured.
+func assign_device_types(s *Snapshot, types map[string]string) {
+  for i := range s.Stations {
+    station := &s.Stations[i]
+    if t, ok := types[station.Address.String()]; ok {
+      station.DeviceType = t
+    } else if t, ok := types[oui(station.Address)]; ok {
+      station.DeviceType = t
+    } else if station.Legacy {
+      station.DeviceType = deviceTypeLegacy
+    } else if station.Capability != nil && station.Capability.AVVersion >= 0x01 {
+      station.DeviceType = deviceTypeAV2
+    } else if station.Capability != nil {
+      station.DeviceType = deviceTypeAV
+    }
+  }
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+  "math"
+  "sync"
+  "time"
+)
+
+// sampleDiff leaves a set of samples out of the expositions of the metrics
+// endpoint while they have not changed by minChange since they were last
+// exposed, for at most refresh, so that the link stats and tone maps of a
+// large segment do not swamp Prometheus with samples that say nothing new.
+type sampleDiff struct {
+  minChange float64
+  refresh   time.Duration
+  // total compares the sum of the changes of the samples with minChange,
+  // rather than the change of each one.
+  total     bool
+
+  mutex   sync.Mutex
+  exposed map[string]exposedSamples
+  lru     lruIndex
+}
+
+// exposedSamples are the values of a set of samples as they were last
+// exposed, and when.
+type exposedSamples struct {
+  values []float64
+  at     time.Time
+}
+
+// new_link_stats_diff returns a sampleDiff of the counters of each link and
+// direction, any one of which changing by minChange exposes them all.
+func new_link_stats_diff(minChange float64, refresh time.Duration) *sampleDiff {
+  return &sampleDiff{
+    minChange: minChange,
+    refresh:   refresh,
+    exposed:   map[string]exposedSamples{},
+    lru:       lruIndex{cache: "link_stats_exposed"},
+  }
+}
+
+// new_tone_map_diff returns a sampleDiff of the bits of the carriers of each
+// tone map, exposed once they have changed by minChange bits in all.
+func new_tone_map_diff(minChange float64, refresh time.Duration) *sampleDiff {
+  return &sampleDiff{
+    minChange: minChange,
+    refresh:   refresh,
+    total:     true,
+    exposed:   map[string]exposedSamples{},
+    lru:       lruIndex{cache: "tone_maps_exposed"},
+  }
+}
+
+// ExposeLinkStats reports whether the counters of l are to be exposed at
+// now, and returns when they last were, which is now if they are.
+func (d *sampleDiff) ExposeLinkStats(l LinkStats, now time.Time) (bool, time.Time) {
+  key := l.Reporter.String() + "/" + l.Peer.String() + "/" + l.Direction
+  values := []float64{float64(l.MPDUAcked), float64(l.MPDUCollided), float64(l.MPDUFailed), float64(l.PBPassed), float64(l.PBFailed)}
+  return d.expose(key, values, now)
+}
+
+// ExposeToneMap reports whether the bits of the carriers of t are to be
+// exposed at now, and returns when they last were, which is now if they are.
+func (d *sampleDiff) ExposeToneMap(t *ToneMap, now time.Time) (bool, time.Time) {
+  return d.expose(t.Reporter.String() + "/" + t.Peer.String(), t.Bits, now)
+}
+
+func (d *sampleDiff) expose(key string, values []float64, now time.Time) (bool, time.Time) {
+  d.mutex.Lock()
+  defer d.mutex.Unlock()
+  last, ok := d.exposed[key]
+  if ok && now.Sub(last.at) < d.refresh && len(last.values) == len(values) && !d.changed(last.values, values) {
+    return false, last.at
+  }
+  d.exposed[key] = exposedSamples{append([]float64(nil), values...), now}
+  if evicted, ok := d.lru.touch(key); ok {
+    delete(d.exposed, evicted)
+  }
+  return true, now
+}
+
+// changed reports whether values have changed by minChange since last.
+func (d *sampleDiff) changed(last, values []float64) bool {
+  sum := 0.0
+  for i := range values {
+    delta := math.Abs(values[i] - last[i])
+    if !d.total && delta >= d.minChange {
+      return true
+    }
+    sum += delta
+  }
+  return d.total && sum >= d.minChange
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+  "net"
+  "time"
+  "testing"
+)
+
+func TestLinkStatsDiff(t *testing.T) {
+  d := new_link_stats_diff(100, time.Hour)
+  now := time.Unix(1000000, 0)
+  l := LinkStats{Reporter: net.HardwareAddr{0, 0xB0, 0x52, 0, 0, 1}, Peer: net.HardwareAddr{0, 0xB0, 0x52, 0, 0, 2}, Direction: "tx", MPDUAcked: 1000}
+  if expose, _ := d.ExposeLinkStats(l, now); !expose {
+    t.Fatalf("first counters not exposed")
+  }
+  l.MPDUAcked, l.PBFailed = 1099, 99
+  if expose, at := d.ExposeLinkStats(l, now.Add(time.Minute)); expose || !at.Equal(now) {
+    t.Errorf("counters that each changed by less than 100 exposed: %v at %v", expose, at)
+  }
+  l.MPDUAcked = 1100
+  if expose, _ := d.ExposeLinkStats(l, now.Add(2 * time.Minute)); !expose {
+    t.Errorf("counter that changed by 100 not exposed")
+  }
+  if expose, _ := d.ExposeLinkStats(l, now.Add(2 * time.Hour)); !expose {
+    t.Errorf("unchanged counters not exposed after the refresh")
+  }
+}
+
+func TestToneMapDiff(t *testing.T) {
+  d := new_tone_map_diff(10, time.Hour)
+  now := time.Unix(1000000, 0)
+  tm := &ToneMap{Reporter: net.HardwareAddr{0, 0xB0, 0x52, 0, 0, 1}, Peer: net.HardwareAddr{0, 0xB0, 0x52, 0, 0, 2}, Bits: make([]float64, 20)}
+  if expose, _ := d.ExposeToneMap(tm, now); !expose {
+    t.Fatalf("first tone map not exposed")
+  }
+  // Nine carriers gaining a bit each is less than 10 bits in all.
+  bits := make([]float64, 20)
+  for i := 0; i < 9; i++ {
+    bits[i] = 1
+  }
+  tm.Bits = bits
+  if expose, at := d.ExposeToneMap(tm, now.Add(time.Minute)); expose || !at.Equal(now) {
+    t.Errorf("tone map that changed by 9 bits exposed: %v at %v", expose, at)
+  }
+  bits = append([]float64(nil), bits...)
+  bits[19] = -1
+  tm.Bits = bits
+  if expose, _ := d.ExposeToneMap(tm, now.Add(2 * time.Minute)); !expose {
+    t.Errorf("tone map that changed by 10 bits not exposed")
+  }
+  // The bits exposed are copied, so changing the slice passed in later does
+  // not change what the next tone map is compared with.
+  bits[0] = 5
+  tm.Bits = append([]float64(nil), bits...)
+  tm.Bits[0] = 1
+  if expose, _ := d.ExposeToneMap(tm, now.Add(3 * time.Minute)); expose {
+    t.Errorf("unchanged tone map exposed")
+  }
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "bytes"
+  "context"
+  "encoding/hex"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// DiscoveredStation is a station that Reporter hears, as listed in its
+// CC_DISCOVER_LIST confirm. It may be a member of a neighbouring network.
+type DiscoveredStation struct {
+  Reporter    net.HardwareAddr
+  Address     net.HardwareAddr
+  TEI         uint8
+  ShortID     uint8
+  SameNetwork bool
+  // SignalLevel is 0 if it is not known, 1 above -10 dB, and each level
+  // after 5 dB less, down to 15 at -75 dB or less.
+  SignalLevel uint8
+}
+
+// DiscoveredNetwork is a network that Reporter hears the beacons of, as
+// listed in its CC_DISCOVER_LIST confirm.
+type DiscoveredNetwork struct {
+  Reporter    net.HardwareAddr
+  ID          string
+  ShortID     uint8
+  HybridMode  uint8
+  BeaconSlots uint8
+}
+
+// queryDiscoverLists asks each reporter in the snapshot for the stations and
+// networks it hears. It is a standard MME, so stations of every family are
+// asked. Like querySchedules, it returns the first error or missing answer.
+func (p *Poller) queryDiscoverLists(ctx context.Context, s *Snapshot, timeout time.Duration) error {
+  var failed error
+  for _, station := range s.Stations {
+    if !station.Reporter {
+      continue
+    }
+    reporter := station.Address
+    if p.backoff.Suspended("discover_list", reporter) || p.quarantine.Suspended(reporter) {
+      continue
+    }
+    if ctx.Err() != nil {
+      return ctx.Err()
+    }
+    msgs := p.prefetched(reporter, homeplug.CCDiscoverListCnf, 1, nil)
+    if msgs == nil {
+      request := homeplug.Frame{Version: homeplug.AVVersion, MMEType: homeplug.CCDiscoverListReq}
+      var err error
+      msgs, err = p.transport.Request(ctx, reporter, []homeplug.Frame{request}, timeout, func(msgs []homeplug.Message) bool {
+        return bytes.Equal(msgs[len(msgs) - 1].Source, reporter) && msgs[len(msgs) - 1].Frame.MMEType == homeplug.CCDiscoverListCnf
+      })
+      if err != nil {
+        pollerLog.Errorf("Error querying discover list of %v: %v", reporter, err)
+        if failed == nil {
+          failed = err
+        }
+        continue
+      }
+    }
+    answered := false
+    for _, m := range msgs {
+      if !bytes.Equal(m.Source, reporter) || m.Frame.MMEType != homeplug.CCDiscoverListCnf {
+        continue
+      }
+      answered = true
+      var d homeplug.DiscoverList
+      if err := accept(&m.Frame, (&d).UnmarshalBinary(m.Frame.Payload)); err != nil {
+        logDedup.Errorf(decoderLog, "decode", "[%v] failed to unmarshal CC_DISCOVER_LIST frame: %v", m.Source, err)
+        continue
+      }
+      s.AddDiscoverList(reporter, &d)
+      s.DecodedAs(&m)
+    }
+    p.backoff.Record("discover_list", reporter, answered)
+    if !answered && failed == nil {
+      failed = fmt.Errorf("%v did not answer the discover list query", reporter)
+    }
+  }
+  return failed
+}
+
+// AddDiscoverList merges a CC_DISCOVER_LIST confirm sent by reporter into
+// the snapshot. Stations and networks listed twice are only added once.
+func (s *Snapshot) AddDiscoverList(reporter net.HardwareAddr, d *homeplug.DiscoverList) {
+  seen := map[string]bool{}
+  for _, ds := range d.Stations {
+    if seen[ds.Address.String()] {
+      continue
+    }
+    seen[ds.Address.String()] = true
+    s.Discovered = append(s.Discovered, DiscoveredStation{
+      Reporter:    reporter,
+      Address:     ds.Address,
+      TEI:         ds.TEI,
+      ShortID:     ds.ShortID,
+      SameNetwork: ds.SameNetwork,
+      SignalLevel: ds.SignalLevel,
+    })
+  }
+  for _, dn := range d.Networks {
+    id := hex.EncodeToString(dn.NetworkID[:])
+    if seen[id] {
+      continue
+    }
+    seen[id] = true
+    s.Neighbours = append(s.Neighbours, DiscoveredNetwork{
+      Reporter:    reporter,
+      ID:          id,
+      ShortID:     dn.ShortID,
+      HybridMode:  dn.HybridMode,
+      BeaconSlots: dn.BeaconSlots,
+    })
+  }
+}
+
+// restoreDiscoverLists adds the discover lists last collected from the
+// reporters that are still in s.
+func (p *Poller) restoreDiscoverLists(s *Snapshot) {
+  for _, d := range p.discovered {
+    if s.Station(d.Reporter) != nil {
+      s.Discovered = append(s.Discovered, d)
+    }
+  }
+  for _, n := range p.neighbours {
+    if s.Station(n.Reporter) != nil {
+      s.Neighbours = append(s.Neighbours, n)
+    }
+  }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+  "time"
+)
+
+// Types of topology events.
+const (
+  eventStationJoined = "station_joined"
+  eventStationLeft   = "station_left"
+  eventCCoChanged    = "cco_changed"
+  eventRateBelow     = "rate_below_threshold"
+  eventRateAbove     = "rate_above_threshold"
+)
+
+// Event is a change in the topology between two consecutive snapshots.
+type Event struct {
+  Time               time.Time `json:"time"`
+  Type               string    `json:"type"`
+  Address            string    `json:"mac_address,omitempty"`
+  NetworkID          string    `json:"network_identifier,omitempty"`
+  CCoAddress         string    `json:"coordinator_mac_address,omitempty"`
+  PreviousCCoAddress string    `json:"previous_coordinator_mac_address,omitempty"`
+  Source             string    `json:"source_mac_address,omitempty"`
+  Destination        string    `json:"destination_mac_address,omitempty"`
+  Rate               float64   `json:"rate_bytes,omitempty"`
+  Threshold          float64   `json:"threshold_bytes,omitempty"`
+}
+
+// diff_snapshots returns the events that turn prev into cur. Rates are
+// compared per direction, using the lowest rate reported for it, against
+// each of the thresholds.
+func diff_snapshots(prev, cur *Snapshot, thresholds []float64) []Event {
+  events := []Event{}
+
+  for _, station := range cur.Stations {
+    if prev.Station(station.Address) == nil {
+      events = append(events, Event{
+        Time:      cur.Time,
+        Type:      eventStationJoined,
+        Address:   station.Address.String(),
+        NetworkID: station.NetworkID,
+      })
+    }
+  }
+  for _, station := range prev.Stations {
+    if cur.Station(station.Address) == nil {
+      events = append(events, Event{
+        Time:      cur.Time,
+        Type:      eventStationLeft,
+        Address:   station.Address.String(),
+        NetworkID: station.NetworkID,
+      })
+    }
+  }
+
+  for _, network := range cur.Networks {
+    old := prev.Network(network.ID)
+    if old == nil || old.CCoAddress.String() == network.CCoAddress.String() {
+      continue
+    }
+    events = append(events, Event{
+      Time:               cur.Time,
+      Type:               eventCCoChanged,
+      NetworkID:          network.ID,
+      CCoAddress:         network.CCoAddress.String(),
+      PreviousCCoAddress: old.CCoAddress.String(),
+    })
+  }
+
+  if len(thresholds) == 0 {
+    return events
+  }
+  oldRates := directed_rates(prev)
+  rates := directed_rates(cur)
+  seen := map[string]bool{}
+  for _, link := range cur.Links {
+    key := link.Source.String() + ">" + link.Destination.String()
+    old, ok := oldRates[key]
+    if !ok || seen[key] {
+      continue
+    }
+    seen[key] = true
+    rate := rates[key]
+    for _, t := range thresholds {
+      e := Event{
+        Time:        cur.Time,
+        Source:      link.Source.String(),
+        Destination: link.Destination.String(),
+        Rate:        rate,
+        Threshold:   t,
+      }
+      if old >= t && rate < t {
+        e.Type = eventRateBelow
+      } else if old < t && rate >= t {
+        e.Type = eventRateAbove
+      } else {
+        continue
+      }
+      events = append(events, e)
+    }
+  }
+  return events
+}
+
+// directed_rates returns the lowest rate reported from each source to each
+// destination, keyed by "source>destination".
+func directed_rates(s *Snapshot) map[string]float64 {
+  rates := map[string]float64{}
+  for _, link := range s.Links {
+    key := link.Source.String() + ">" + link.Destination.String()
+    if r, ok := rates[key]; !ok || link.Rate < r {
+      rates[key] = link.Rate
+    }
+  }
+  return rates
+}
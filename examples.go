@@ -0,0 +1,196 @@
+package main
+
+import (
+  "net"
+  "sort"
+  "time"
+  "net/url"
+  "net/http"
+  "text/template"
+
+  "github.com/prometheus/common/model"
+)
+
+// examplePrometheusPath serves a Prometheus scrape configuration for this
+// exporter, generated from its running configuration.
+const examplePrometheusPath = "/examples/prometheus.yml"
+
+// exampleMinTimeout is the shortest scrape timeout recommended, which is
+// Prometheus' default.
+const exampleMinTimeout = 10 * time.Second
+
+var examplePrometheus = template.Must(template.New("prometheus.yml").Parse(`# Generated by homeplug_exporter from its running configuration.
+scrape_configs:
+  # The devices found by polling {{.Target}}.
+  - job_name: homeplug
+    scrape_interval: {{.Interval}}
+    scrape_timeout: {{.Timeout}}
+    metrics_path: {{.MetricsPath}}
+{{- if .MetricsToken}}
+    # A token granted the metrics scope.
+    bearer_token_file: /etc/prometheus/homeplug_exporter.token
+{{- end}}
+    static_configs:
+      - targets: ["{{.Address}}"]
+
+  # Each station on its own, through /probe.
+  - job_name: homeplug_probe
+    scrape_interval: {{.ProbeInterval}}
+    scrape_timeout: {{.ProbeTimeout}}
+    metrics_path: /probe
+{{- if .ProbeToken}}
+    # A token granted the probe scope.
+    bearer_token_file: /etc/prometheus/homeplug_exporter.token
+{{- end}}
+    static_configs:
+{{- if .Stations}}
+      - targets:
+{{- range .Stations}}
+        - "{{.}}"
+{{- end}}
+{{- else}}
+      # No station has been found yet; list their MAC addresses here.
+      - targets: []
+{{- end}}
+    relabel_configs:
+      - source_labels: [__address__]
+        target_label: __param_target
+      - source_labels: [__param_target]
+        target_label: instance
+      - target_label: __address__
+        replacement: "{{.Address}}"
+{{- if .Targets}}
+
+  # The targets of the configuration file, by name.
+  - job_name: homeplug_targets
+    scrape_interval: {{.ProbeInterval}}
+    scrape_timeout: {{.TargetTimeout}}
+    metrics_path: /probe
+{{- if .ProbeToken}}
+    # A token granted the probe scope.
+    bearer_token_file: /etc/prometheus/homeplug_exporter.token
+{{- end}}
+    static_configs:
+      - targets:
+{{- range .Targets}}
+        - "{{.}}"
+{{- end}}
+    relabel_configs:
+      - source_labels: [__address__]
+        target_label: __param_target
+      - source_labels: [__param_target]
+        target_label: instance
+      - target_label: __address__
+        replacement: "{{.Address}}"
+{{- end}}
+`))
+
+type examplePrometheusData struct {
+  Target        string
+  Address       string
+  MetricsPath   string
+  MetricsToken  bool
+  Interval      model.Duration
+  Timeout       model.Duration
+  ProbeToken    bool
+  ProbeInterval model.Duration
+  ProbeTimeout  model.Duration
+  Stations      []string
+  TargetTimeout model.Duration
+  Targets       []string
+}
+
+// prometheus_example_handler serves a scrape configuration with a job for
+// the metrics endpoint and one that probes each station found by the last
+// poll, and one for the configured targets if there are any. The intervals
+// follow the poll interval, and the timeouts how long the last poll's
+// collectors took and the probe settings.
+func prometheus_example_handler(exporter *Exporter, config func() *Config, auth *Authenticator) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    cfg := config()
+    d := examplePrometheusData{
+      Target:       join_addresses(exporter.poller.dests),
+      Address:      example_address(*listeningAddress, r.Host),
+      MetricsPath:  *metricsEndpoint,
+      MetricsToken: auth.Required(scopeMetrics),
+      ProbeToken:   auth.Required(scopeProbe),
+    }
+
+    // With a background poll, scrapes are served from the last one, and
+    // more frequent ones would see the same data.
+    interval := *pollInterval
+    if interval == 0 {
+      interval = time.Minute
+    }
+    var poll, heavy time.Duration
+    if s := exporter.snapshot.Load(); s != nil {
+      for collector, run := range s.Collectors {
+        poll += run.Duration
+        if collector != "discovery" {
+          heavy += run.Duration
+        }
+      }
+      for _, station := range s.Stations {
+        d.Stations = append(d.Stations, station.Address.String())
+      }
+      sort.Strings(d.Stations)
+    }
+    if *pollInterval > 0 {
+      poll = 0
+    }
+    timeout := example_timeout(poll, interval)
+    d.Interval, d.Timeout = model.Duration(interval), model.Duration(timeout)
+
+    // A probe waits for the configured timeout on every attempt, and runs
+    // the same heavy collectors as a poll.
+    probe := time.Duration(cfg.Probe.Timeout) * time.Duration(cfg.Probe.Retries + 1) + heavy
+    probeInterval := time.Minute
+    if probeInterval < interval {
+      probeInterval = interval
+    }
+    probeTimeout := example_timeout(probe, probeInterval)
+    d.ProbeInterval, d.ProbeTimeout = model.Duration(probeInterval), model.Duration(probeTimeout)
+
+    // The targets' job waits for the slowest of them.
+    var slowest time.Duration
+    for _, target := range cfg.Targets {
+      t, _ := probe_target(cfg, url.Values{"target": {target.Name}})
+      if probe := t.timeout * time.Duration(t.retries + 1) + heavy; probe > slowest {
+        slowest = probe
+      }
+      d.Targets = append(d.Targets, target.Name)
+    }
+    d.TargetTimeout = model.Duration(example_timeout(slowest, probeInterval))
+
+    w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+    if err := examplePrometheus.Execute(w, d); err != nil {
+      httpLog.Errorf("Error writing %s: %v", examplePrometheusPath, err)
+    }
+  }
+}
+
+// example_address returns the address Prometheus should scrape: the listen
+// address, or where the request was sent if it listens on every address.
+func example_address(listen, host string) string {
+  h, _, err := net.SplitHostPort(listen)
+  if err == nil && h != "" && !net.ParseIP(h).IsUnspecified() {
+    return listen
+  }
+  if host != "" {
+    return host
+  }
+  return "localhost" + listen
+}
+
+// example_timeout returns a scrape timeout with half again as much time as
+// d, in whole seconds, of at least exampleMinTimeout and at most interval.
+func example_timeout(d, interval time.Duration) time.Duration {
+  t := (d * 3 / 2 + time.Second - 1).Truncate(time.Second)
+  if t < exampleMinTimeout {
+    t = exampleMinTimeout
+  }
+  if t > interval {
+    t = interval
+  }
+  return t
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+  "sync"
+  "time"
+  "bytes"
+  "context"
+  "strings"
+  "os/exec"
+  "encoding/json"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/common/expfmt"
+  dto "github.com/prometheus/client_model/go"
+)
+
+var (
+  execSuccess = prometheus.NewDesc(
+    prometheus.BuildFQName(namespace, "exec", "success"),
+    "Whether the exec collector ran successfully and printed valid metrics",
+    []string{"collector"}, nil)
+  execDuration = prometheus.NewDesc(
+    prometheus.BuildFQName(namespace, "exec", "duration_seconds"),
+    "How long the exec collector took to run",
+    []string{"collector"}, nil)
+)
+
+// ExecCollector runs the configured programs on every scrape, with the
+// devices found by the last poll on their stdin as an API topology document,
+// and merges the metrics they print in the text format into the exposition.
+type ExecCollector struct {
+  configs  []ExecConfig
+  snapshot snapshotStore
+}
+
+func NewExecCollector(configs []ExecConfig) *ExecCollector {
+  return &ExecCollector{configs: configs}
+}
+
+func (c *ExecCollector) Name() string {
+  return "exec"
+}
+
+func (c *ExecCollector) Publish(s *Snapshot) error {
+  c.snapshot.Store(s)
+  return nil
+}
+
+type execResult struct {
+  mfs      []*dto.MetricFamily
+  success  bool
+  duration float64
+}
+
+// Gather runs every program at once. The metrics of a program that fails,
+// or prints anything that can't be parsed, are left out. So are those in the
+// exporter's own namespace, which could collide with its metrics.
+func (c *ExecCollector) Gather() ([]*dto.MetricFamily, error) {
+  input := []byte("{}")
+  if s := c.snapshot.Load(); s != nil {
+    b, err := json.Marshal(new_api_topology(s))
+    if err != nil {
+      return nil, err
+    }
+    input = b
+  }
+
+  results := make([]execResult, len(c.configs))
+  var wg sync.WaitGroup
+  for i := range c.configs {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      results[i] = run_exec(c.configs[i], input)
+    }(i)
+  }
+  wg.Wait()
+
+  registry := prometheus.NewRegistry()
+  registry.MustRegister(execResultCollector{c.configs, results})
+  mfs, err := registry.Gather()
+  if err != nil {
+    return nil, err
+  }
+  for _, r := range results {
+    mfs = append(mfs, r.mfs...)
+  }
+  return mfs, nil
+}
+
+func run_exec(cfg ExecConfig, input []byte) execResult {
+  start := time.Now()
+  ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeout))
+  defer cancel()
+
+  var stdout, stderr bytes.Buffer
+  cmd := exec.CommandContext(ctx, cfg.Command[0], cfg.Command[1:]...)
+  cmd.Stdin = bytes.NewReader(input)
+  cmd.Stdout = &stdout
+  cmd.Stderr = &stderr
+  err := cmd.Run()
+  r := execResult{duration: time.Since(start).Seconds()}
+  if stderr.Len() > 0 {
+    mainLog.Debugf("exec collector %s: %s", cfg.Name, strings.TrimSpace(stderr.String()))
+  }
+  if err != nil {
+    logDedup.Errorf(mainLog, "exec", "exec collector %s failed: %v", cfg.Name, err)
+    return r
+  }
+
+  var parser expfmt.TextParser
+  families, err := parser.TextToMetricFamilies(&stdout)
+  if err != nil {
+    logDedup.Errorf(mainLog, "exec", "exec collector %s printed invalid metrics: %v", cfg.Name, err)
+    return r
+  }
+  for name, mf := range families {
+    if strings.HasPrefix(name, namespace + "_") {
+      logDedup.Errorf(mainLog, "exec", "exec collector %s printed %s, which is in the exporter's namespace; dropping it", cfg.Name, name)
+      continue
+    }
+    r.mfs = append(r.mfs, mf)
+  }
+  r.success = true
+  return r
+}
+
+type execResultCollector struct {
+  configs []ExecConfig
+  results []execResult
+}
+
+func (c execResultCollector) Describe(ch chan<- *prometheus.Desc) {
+  ch <- execSuccess
+  ch <- execDuration
+}
+
+func (c execResultCollector) Collect(ch chan<- prometheus.Metric) {
+  for i, r := range c.results {
+    success := 0.0
+    if r.success {
+      success = 1
+    }
+    ch <- prometheus.MustNewConstMetric(execSuccess, prometheus.GaugeValue, success, c.configs[i].Name)
+    ch <- prometheus.MustNewConstMetric(execDuration, prometheus.GaugeValue, r.duration, c.configs[i].Name)
+  }
+}
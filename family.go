@@ -0,0 +1,221 @@
+package main
+
+import (
+  "fmt"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// ProtocolFamily is the set of MMEs used to query networks and stations from
+// one family of Homeplug devices. Devices of different families share the
+// same mains, so every enabled family is queried on each poll.
+type ProtocolFamily struct {
+  Name     string
+  Requests []homeplug.Frame
+  Confirms [][2]byte
+  // Optional confirms are decoded if they arrive, but devices of the family
+  // are not expected to send them.
+  Optional [][2]byte
+  // Decode merges one of the family's confirms into the snapshot.
+  Decode   func(s *Snapshot, m *homeplug.Message) error
+}
+
+var protocolFamilies = []ProtocolFamily{
+  {
+    Name: "qualcomm",
+    Requests: []homeplug.Frame{
+      {Version: homeplug.HPVersion, MMEType: homeplug.NwInfoReq, Vendor: homeplug.HPVendor},
+      {Version: homeplug.AVVersion, MMEType: homeplug.CMStaCapReq},
+    },
+    Confirms: [][2]byte{homeplug.NwInfoCnf},
+    Optional: [][2]byte{homeplug.CMStaCapCnf},
+    Decode:   decode_qualcomm,
+  },
+  {
+    Name: "homeplug_av",
+    Requests: []homeplug.Frame{
+      {Version: homeplug.AVVersion, MMEType: homeplug.CMNwInfoReq},
+      {Version: homeplug.AVVersion, MMEType: homeplug.CMNwStatsReq},
+      {Version: homeplug.AVVersion, MMEType: homeplug.CMStaCapReq},
+    },
+    Confirms: [][2]byte{homeplug.CMNwInfoCnf, homeplug.CMNwStatsCnf},
+    Optional: [][2]byte{homeplug.CMStaCapCnf},
+    Decode:   decode_homeplug_av,
+  },
+}
+
+// queryMMEs are the requests that can be sent on their own through the API,
+// by name. They only read from the devices.
+var queryMMEs = map[string][2]byte{
+  "VS_NW_INFO":  homeplug.NwInfoReq,
+  "CM_NW_INFO":  homeplug.CMNwInfoReq,
+  "CM_NW_STATS": homeplug.CMNwStatsReq,
+  "CM_STA_CAP":  homeplug.CMStaCapReq,
+}
+
+// find_query_request returns the named request and the family that decodes
+// its confirm.
+func find_query_request(name string) (*ProtocolFamily, homeplug.Frame, bool) {
+  t, ok := queryMMEs[name]
+  if !ok {
+    return nil, homeplug.Frame{}, false
+  }
+  for i := range protocolFamilies {
+    for _, r := range protocolFamilies[i].Requests {
+      if r.MMEType == t {
+        return &protocolFamilies[i], r, true
+      }
+    }
+  }
+  return nil, homeplug.Frame{}, false
+}
+
+// extended_rate_families returns the families with the Qualcomm VS_NW_INFO
+// request sent as MMV 1, so that AR7400 and later chips answer with rates
+// beyond 255 Mbit/s.
+func extended_rate_families(families []ProtocolFamily) []ProtocolFamily {
+  extended := make([]ProtocolFamily, len(families))
+  for i, family := range families {
+    family.Requests = append([]homeplug.Frame(nil), family.Requests...)
+    for j, r := range family.Requests {
+      if r.MMEType == homeplug.NwInfoReq && r.IsVendorSpecific() {
+        family.Requests[j].Version = homeplug.AVVersion
+      }
+    }
+    extended[i] = family
+  }
+  return extended
+}
+
+// get_protocol_families returns the named families, in order of preference.
+func get_protocol_families(names []string) ([]ProtocolFamily, error) {
+  families := []ProtocolFamily{}
+  for _, family := range protocolFamilies {
+    for _, name := range names {
+      if name == family.Name {
+        families = append(families, family)
+        break
+      }
+    }
+  }
+  if len(families) == 0 {
+    return nil, fmt.Errorf("no protocol families in %v", names)
+  }
+  return families, nil
+}
+
+// Handles reports whether the frame is one of the family's confirms. Vendor
+// specific confirms must also carry the vendor OUI of the family's requests.
+func (f *ProtocolFamily) Handles(h *homeplug.Frame) bool {
+  return f.handles(h, f.Confirms) || f.handles(h, f.Optional)
+}
+
+func (f *ProtocolFamily) handles(h *homeplug.Frame, confirms [][2]byte) bool {
+  for _, t := range confirms {
+    if h.MMEType != t {
+      continue
+    }
+    if !h.IsVendorSpecific() {
+      return true
+    }
+    for _, r := range f.Requests {
+      if r.IsVendorSpecific() && r.Vendor == h.Vendor {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// Answered reports whether msgs include each of the family's required
+// confirms.
+func (f *ProtocolFamily) Answered(msgs []homeplug.Message) bool {
+  return received(f, f.Confirms, msgs)
+}
+
+// Complete reports whether msgs include each of the family's confirms,
+// including the optional ones.
+func (f *ProtocolFamily) Complete(msgs []homeplug.Message) bool {
+  return f.Answered(msgs) && received(f, f.Optional, msgs)
+}
+
+func received(f *ProtocolFamily, confirms [][2]byte, msgs []homeplug.Message) bool {
+  for _, t := range confirms {
+    found := false
+    for i := range msgs {
+      if msgs[i].Frame.MMEType == t && f.Handles(&msgs[i].Frame) {
+        found = true
+        break
+      }
+    }
+    if !found {
+      return false
+    }
+  }
+  return true
+}
+
+func decode_qualcomm(s *Snapshot, m *homeplug.Message) error {
+  if m.Frame.MMEType == homeplug.CMStaCapCnf {
+    return decode_station_capability(s, m)
+  }
+  var n homeplug.NetworkInfo
+  unmarshal := (&n).UnmarshalBinary
+  if m.Frame.Version[0] >= 1 {
+    unmarshal = (&n).UnmarshalExtended
+  }
+  if err := accept(&m.Frame, unmarshal(m.Frame.Payload)); err != nil {
+    return fmt.Errorf("failed to unmarshal network info frame: %v", err)
+  }
+  s.AddNetworkInfo("qualcomm", m.Source, &n)
+  return nil
+}
+
+func decode_homeplug_av(s *Snapshot, m *homeplug.Message) error {
+  switch m.Frame.MMEType {
+  case homeplug.CMNwInfoCnf:
+    var n homeplug.AVNetworkInfo
+    if err := accept(&m.Frame, (&n).UnmarshalBinary(m.Frame.Payload)); err != nil {
+      return fmt.Errorf("failed to unmarshal CM_NW_INFO frame: %v", err)
+    }
+    s.AddAVNetworkInfo("homeplug_av", m.Source, &n)
+  case homeplug.CMNwStatsCnf:
+    var n homeplug.AVNetworkStats
+    if err := accept(&m.Frame, (&n).UnmarshalBinary(m.Frame.Payload)); err != nil {
+      return fmt.Errorf("failed to unmarshal CM_NW_STATS frame: %v", err)
+    }
+    s.AddAVNetworkStats("homeplug_av", m.Source, &n)
+  case homeplug.CMStaCapCnf:
+    return decode_station_capability(s, m)
+  }
+  return nil
+}
+
+// decode_memberships records the memberships stated in each standard
+// CM_NW_INFO confirm, before the families decode them, so that they are
+// known for stations that no family decodes it for. Malformed confirms, and
+// their anomalies, are left for the families to report.
+func decode_memberships(s *Snapshot, msgs []homeplug.Message) {
+  for i := range msgs {
+    m := &msgs[i]
+    if m.Legacy != nil || m.Frame.MMEType != homeplug.CMNwInfoCnf {
+      continue
+    }
+    var n homeplug.AVNetworkInfo
+    if !tolerated((&n).UnmarshalBinary(m.Frame.Payload)) {
+      continue
+    }
+    s.AddMemberships(m.Source, &n)
+  }
+}
+
+// decode_station_capability decodes the standard CM_STA_CAP confirm, which
+// devices of every family may answer.
+func decode_station_capability(s *Snapshot, m *homeplug.Message) error {
+  var c homeplug.StationCapability
+  if err := accept(&m.Frame, (&c).UnmarshalBinary(m.Frame.Payload)); err != nil {
+    return fmt.Errorf("failed to unmarshal CM_STA_CAP frame: %v", err)
+  }
+  s.AddStationCapability(m.Source, &c)
+  return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+  "os"
+  "net"
+  "sync/atomic"
+
+  "github.com/mdlayher/raw"
+  "golang.org/x/sys/unix"
+)
+
+// fanoutConn is a receive-only packet socket that is a member of a
+// PACKET_FANOUT group, in which the kernel spreads the received frames
+// evenly over the members.
+type fanoutConn struct {
+  fd    int
+  stats raw.Stats
+}
+
+// listen_fanout opens n packet sockets on iface that share the frames of
+// EtherType et received between them. Members of a group must receive the
+// same EtherType, so each has a group of its own.
+func listen_fanout(iface *net.Interface, n int, et uint16) ([]passiveReader, error) {
+  proto := uint16(et >> 8 | (et & 0xff) << 8)
+  group := (os.Getpid() + int(et)) & 0xffff
+  var conns []passiveReader
+  for i := 0; i < n; i++ {
+    fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(proto))
+    if err == nil {
+      err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index})
+      if err == nil {
+        err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, group | unix.PACKET_FANOUT_LB << 16)
+      }
+      if err != nil {
+        unix.Close(fd)
+      }
+    }
+    if err != nil {
+      for _, c := range conns {
+        c.Close()
+      }
+      return nil, err
+    }
+    conns = append(conns, &fanoutConn{fd: fd})
+  }
+  return conns, nil
+}
+
+func (c *fanoutConn) ReadFrom(b []byte) (int, net.Addr, error) {
+  n, sa, err := unix.Recvfrom(c.fd, b, 0)
+  if err != nil {
+    return 0, nil, err
+  }
+  addr := &raw.Addr{}
+  if ll, ok := sa.(*unix.SockaddrLinklayer); ok {
+    addr.HardwareAddr = net.HardwareAddr(ll.Addr[:ll.Halen])
+  }
+  return n, addr, nil
+}
+
+// Stats returns the frames received and dropped since the socket was
+// opened. The kernel resets its counts each time they are read.
+func (c *fanoutConn) Stats() (*raw.Stats, error) {
+  s, err := unix.GetsockoptTpacketStats(c.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+  if err != nil {
+    return nil, err
+  }
+  return &raw.Stats{
+    Packets: atomic.AddUint64(&c.stats.Packets, uint64(s.Packets)),
+    Drops:   atomic.AddUint64(&c.stats.Drops, uint64(s.Drops)),
+  }, nil
+}
+
+func (c *fanoutConn) Close() error {
+  return unix.Close(c.fd)
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+  "net"
+  "errors"
+)
+
+func listen_fanout(iface *net.Interface, n int, et uint16) ([]passiveReader, error) {
+  return nil, errors.New("multiple passive readers are only supported on Linux")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "encoding/hex"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+var foreignReplies = prometheus.NewCounterVec(
+  prometheus.CounterOpts{
+    Namespace: namespace,
+    Name:      "foreign_replies_total",
+    Help:      "Replies dropped because their source is not one of the configured reporters, or not a member of one of the configured networks, by reason.",
+  },
+  []string{"reason"})
+
+// replyFilter pins the replies to polls to the stations of the networks and
+// reporters configured under accept, on trunked or bridged topologies where
+// adapters of other segments answer too. Either is left out if it is empty.
+type replyFilter struct {
+  networks  map[string]bool
+  reporters map[string]bool
+}
+
+// Filter returns the messages from accepted stations, and counts and drops
+// the others. A station is a member of the networks its network info
+// confirms among msgs list; one that sent none is not a member of any.
+func (f replyFilter) Filter(msgs []homeplug.Message) []homeplug.Message {
+  if len(f.networks) == 0 && len(f.reporters) == 0 {
+    return msgs
+  }
+  members := map[string]bool{}
+  if len(f.networks) != 0 {
+    for i := range msgs {
+      for _, id := range confirm_networks(&msgs[i]) {
+        if f.networks[id] {
+          members[msgs[i].Source.String()] = true
+        }
+      }
+    }
+  }
+  kept := msgs[:0]
+  for _, m := range msgs {
+    reason := ""
+    if len(f.reporters) != 0 && !f.reporters[m.Source.String()] {
+      reason = "reporter"
+    } else if len(f.networks) != 0 && !members[m.Source.String()] {
+      reason = "network"
+    }
+    if reason == "" {
+      kept = append(kept, m)
+      continue
+    }
+    foreignReplies.WithLabelValues(reason).Inc()
+    logDedup.Errorf(pollerLog, "foreign", "dropped a reply from %v, which is not an accepted %s", m.Source, reason)
+  }
+  return kept
+}
+
+// confirm_networks returns the IDs of the networks that the sender of a
+// network info confirm states it is a member of. Malformed confirms are left
+// for the families to report.
+func confirm_networks(m *homeplug.Message) []string {
+  var ids []string
+  if m.Legacy != nil {
+    return nil
+  }
+  switch m.Frame.MMEType {
+  case homeplug.NwInfoCnf:
+    var n homeplug.NetworkInfo
+    unmarshal := (&n).UnmarshalBinary
+    if m.Frame.Version[0] >= 1 {
+      unmarshal = (&n).UnmarshalExtended
+    }
+    if !tolerated(unmarshal(m.Frame.Payload)) {
+      return nil
+    }
+    for _, ns := range n.Networks {
+      ids = append(ids, hex.EncodeToString(ns.NetworkID[:]))
+    }
+  case homeplug.CMNwInfoCnf:
+    var n homeplug.AVNetworkInfo
+    if !tolerated((&n).UnmarshalBinary(m.Frame.Payload)) {
+      return nil
+    }
+    for _, ns := range n.Networks {
+      ids = append(ids, hex.EncodeToString(ns.NetworkID[:]))
+    }
+  }
+  return ids
+}
@@ -3,9 +3,14 @@ module github.com/brandond/homeplug_exporter
 go 1.14
 
 require (
+	github.com/golang/snappy v0.0.1
 	github.com/mdlayher/ethernet v0.0.0-20190606142754-0394541c37b7
 	github.com/mdlayher/raw v0.0.0-20191009151244-50f2db8cc065
 	github.com/prometheus/client_golang v1.0.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.9.1
+	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/sys v0.0.0-20190606122018-79a91cf218c4
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,215 @@
+package main
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "math"
+  "time"
+  "bytes"
+  "errors"
+  "io/ioutil"
+  "encoding/binary"
+
+  "github.com/golang/snappy"
+)
+
+// historyMagic starts a history file, followed by the snappy-compressed
+// samples. Within it, each link is its key and its samples in order: the
+// first as a Unix time in seconds and a rate, and the others as the
+// difference from the one before, so that steady rates take a byte or two.
+// Rates are kept to the byte per second, which is as precise as the devices
+// report them.
+const historyMagic = "HPHIST1\n"
+
+var errHistoryFormat = errors.New("not a history file")
+
+// Load adds the samples kept in the history file at path that are within the
+// retention period. A missing file is not an error.
+func (o *HistoryOutput) Load(path string) error {
+  b, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  rates, err := decode_history(b)
+  if err != nil {
+    return fmt.Errorf("%s: %v", path, err)
+  }
+
+  cutoff := time.Now().Add(-o.retention)
+  o.mutex.Lock()
+  defer o.mutex.Unlock()
+  n := 0
+  for key, samples := range rates {
+    i := 0
+    for i < len(samples) && !samples[i].time.After(cutoff) {
+      i++
+    }
+    if i < len(samples) {
+      o.rates[key] = samples[i:]
+      n += len(samples) - i
+    }
+  }
+  mainLog.Infof("loaded %d rates of %d links from %s", n, len(o.rates), path)
+  return nil
+}
+
+// Save replaces the history file at path with the samples kept in memory.
+// If they would make it larger than maxSize, the oldest ones are left out of
+// the file until they don't; a maxSize of 0 is no limit.
+func (o *HistoryOutput) Save(path string, maxSize int64) error {
+  o.mutex.Lock()
+  rates := make(map[historyKey][]rateSample, len(o.rates))
+  for key, samples := range o.rates {
+    rates[key] = samples
+  }
+  o.mutex.Unlock()
+
+  b := encode_history(rates)
+  for maxSize > 0 && int64(len(b)) > maxSize && len(rates) > 0 {
+    oldest, newest := history_span(rates)
+    // Drop the share of the span by which the file is over, and at least a
+    // sample of each link.
+    drop := time.Duration(float64(newest.Sub(oldest)) * (1 - float64(maxSize) / float64(len(b))))
+    if drop < historyResolution {
+      drop = historyResolution
+    }
+    cutoff := oldest.Add(drop)
+    for key, samples := range rates {
+      i := 0
+      for i < len(samples) && samples[i].time.Before(cutoff) {
+        i++
+      }
+      if i == len(samples) {
+        delete(rates, key)
+      } else {
+        rates[key] = samples[i:]
+      }
+    }
+    mainLog.Debugf("history file would be %d bytes, leaving out the rates before %s", len(b), cutoff.Format(time.RFC3339))
+    b = encode_history(rates)
+  }
+  return write_file_atomic(path, b)
+}
+
+// Persist saves the history to path every interval.
+func (o *HistoryOutput) Persist(path string, maxSize int64, interval time.Duration) {
+  for {
+    time.Sleep(interval)
+    if err := o.Save(path, maxSize); err != nil {
+      mainLog.Errorf("failed to save history to %s: %v", path, err)
+    }
+  }
+}
+
+func history_span(rates map[historyKey][]rateSample) (time.Time, time.Time) {
+  var oldest, newest time.Time
+  for _, samples := range rates {
+    first, last := samples[0].time, samples[len(samples) - 1].time
+    if oldest.IsZero() || first.Before(oldest) {
+      oldest = first
+    }
+    if last.After(newest) {
+      newest = last
+    }
+  }
+  return oldest, newest
+}
+
+func encode_history(rates map[historyKey][]rateSample) []byte {
+  var body bytes.Buffer
+  buf := make([]byte, binary.MaxVarintLen64)
+  uvarint := func(v uint64) {
+    body.Write(buf[:binary.PutUvarint(buf, v)])
+  }
+  varint := func(v int64) {
+    body.Write(buf[:binary.PutVarint(buf, v)])
+  }
+  str := func(s string) {
+    uvarint(uint64(len(s)))
+    body.WriteString(s)
+  }
+
+  uvarint(uint64(len(rates)))
+  for key, samples := range rates {
+    str(key.reporter)
+    str(key.peer)
+    str(key.direction)
+    str(key.protocol)
+    uvarint(uint64(len(samples)))
+    var t, rate int64
+    for _, s := range samples {
+      st, sr := s.time.Unix(), int64(math.Round(s.rate))
+      varint(st - t)
+      varint(sr - rate)
+      t, rate = st, sr
+    }
+  }
+  return append([]byte(historyMagic), snappy.Encode(nil, body.Bytes())...)
+}
+
+func decode_history(b []byte) (map[historyKey][]rateSample, error) {
+  if !bytes.HasPrefix(b, []byte(historyMagic)) {
+    return nil, errHistoryFormat
+  }
+  body, err := snappy.Decode(nil, b[len(historyMagic):])
+  if err != nil {
+    return nil, err
+  }
+  r := bytes.NewReader(body)
+  str := func() (string, error) {
+    n, err := binary.ReadUvarint(r)
+    if err != nil {
+      return "", err
+    }
+    if n > uint64(r.Len()) {
+      return "", io.ErrUnexpectedEOF
+    }
+    s := make([]byte, n)
+    _, err = io.ReadFull(r, s)
+    return string(s), err
+  }
+
+  links, err := binary.ReadUvarint(r)
+  if err != nil {
+    return nil, err
+  }
+  rates := map[historyKey][]rateSample{}
+  for i := uint64(0); i < links; i++ {
+    var key historyKey
+    for _, field := range []*string{&key.reporter, &key.peer, &key.direction, &key.protocol} {
+      if *field, err = str(); err != nil {
+        return nil, err
+      }
+    }
+    n, err := binary.ReadUvarint(r)
+    if err != nil {
+      return nil, err
+    }
+    // Every sample takes at least two bytes.
+    if n > uint64(r.Len()) / 2 {
+      return nil, io.ErrUnexpectedEOF
+    }
+    samples := make([]rateSample, 0, n)
+    var t, rate int64
+    for j := uint64(0); j < n; j++ {
+      dt, err := binary.ReadVarint(r)
+      if err != nil {
+        return nil, err
+      }
+      dr, err := binary.ReadVarint(r)
+      if err != nil {
+        return nil, err
+      }
+      t, rate = t + dt, rate + dr
+      samples = append(samples, rateSample{time.Unix(t, 0), float64(rate)})
+    }
+    if len(samples) > 0 {
+      rates[key] = samples
+    }
+  }
+  return rates, nil
+}
@@ -1,317 +1,1497 @@
 package main
 
 import (
-  "io"
   "fmt"
+  "os"
   "net"
+  "math"
   "sync"
   "time"
   "strconv"
+  "strings"
+  "bytes"
   "errors"
+  "context"
+  "syscall"
   "net/http"
+  "os/signal"
   "encoding/hex"
 
   "github.com/prometheus/client_golang/prometheus"
   "github.com/prometheus/client_golang/prometheus/promhttp"
+  dto "github.com/prometheus/client_model/go"
   "github.com/prometheus/common/log"
   "github.com/prometheus/common/version"
   "gopkg.in/alecthomas/kingpin.v2"
   "github.com/mdlayher/ethernet"
   "github.com/mdlayher/raw"
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
 )
 
-const (
-  namespace   = "homeplug"
-  etherType   = 0x88E1
-)
+const namespace = "homeplug"
 
 var (
-  hpVersion        = [...]byte{0x00}
-  nwInfoReq        = [...]byte{0xA0, 0x38}
-  nwInfoCnf        = [...]byte{0xA0, 0x39}
-  hpVendor         = [...]byte{0x00, 0xB0, 0x52}
-
+  configFile       = kingpin.Flag("config.file", "Path to the optional configuration file.").String()
   listeningAddress = kingpin.Flag("telemetry.address", "Address on which to expose metrics.").Default(":9702").String()
   metricsEndpoint  = kingpin.Flag("telemetry.endpoint", "Path under which to expose metrics.").Default("/metrics").String()
-  interfaceName    = kingpin.Flag("interface", "Interface to search for Homeplug devices.").String()
-  destAddress      = kingpin.Flag("destaddr", "Destination MAC address for Homeplug devices.").Default("00B052000001").HexBytes()
+  openMetrics      = kingpin.Flag("telemetry.openmetrics", "Serve metrics in the OpenMetrics format to scrapers that ask for it.").Bool()
+  disableGzip      = kingpin.Flag("telemetry.disable-compression", "Never gzip metrics, even if the scraper accepts it, to save CPU on small devices.").Bool()
+  accessLogPath    = kingpin.Flag("telemetry.access-log", "File to which a line is appended for every HTTP request, naming the token that authenticated it; - for standard output. If empty, requests are not logged.").String()
+  accessLogFormat  = kingpin.Flag("telemetry.access-log-format", "Format of the access log: common, combined (common with the referer and user agent) or json.").Default(accessLogCommon).Enum(accessLogCommon, accessLogCombined, accessLogJSON)
+  maxScrapes       = kingpin.Flag("telemetry.max-requests", "Maximum number of concurrent scrapes; further ones are answered with 503. If 0, there is no limit.").Default("0").Int()
+  interfaceNames   = kingpin.Flag("interface", "Interface to search for Homeplug devices, or auto-macvlan for the first macvlan interface that is up, as in a container on a macvlan network. May be repeated to poll the segments of several interfaces at once, in which case their metrics have an interface label.").Strings()
+  interfaceWait    = kingpin.Flag("interface.wait", "How long to keep trying to find the interface and open the transport at startup, with a growing backoff, if it is not up yet, before exiting. Meanwhile, the metrics endpoint serves homeplug_up 0. If 0, the exporter exits at once.").Default(buildDefaults.interfaceWait).Duration()
+  transportKind    = kingpin.Flag("transport", "How to reach the devices: raw sends frames on the interface, pcap-replay answers requests from the capture given by --pcap.file, ssh captures and sends them on --interface of the host given by --ssh.destination.").Default("raw").Enum("raw", "pcap-replay", "ssh")
+  pcapFile         = kingpin.Flag("pcap.file", "Capture in the pcap format replayed by --transport=pcap-replay.").String()
+  sshDestination   = kingpin.Flag("ssh.destination", "Host that --transport=ssh reaches the devices through, as [user@]host.").String()
+  sshCommand       = kingpin.Flag("ssh.command", "SSH client run by --transport=ssh. Its sessions are run without a terminal, in batch mode.").Default("ssh").String()
+  sshArgs          = kingpin.Flag("ssh.arg", "Argument given to the SSH client before the destination, such as -i with a key file or -p with a port. May be repeated.").Strings()
+  sshTcpdump       = kingpin.Flag("ssh.tcpdump", "Command run on the SSH destination to capture the devices' frames, followed by tcpdump's arguments.").Default("tcpdump").String()
+  sshInjector      = kingpin.Flag("ssh.injector", "Command run on the SSH destination to send frames, followed by --interface. It reads them as a pcap stream on its stdin.").Default("homeplug_exporter inject").String()
+  destAddresses    = kingpin.Flag("destaddr", "Destination MAC address for Homeplug devices. May be repeated, or given as a comma-separated list, to query each address in turn, merging what they answer into one set of metrics.").Default("00B052000001").Strings()
+  aliasAddresses   = kingpin.Flag("local-alias", "Address answered only by the adapter attached to the interface, asked in turn until one is, to find the local adapter whatever its chip. May be repeated, or given as a comma-separated list.").Default("00B052000001").Strings()
+  etherTypeNames   = kingpin.Flag("transport.ethertype", "EtherType to receive management frames on, 88e1 for HomePlug AV and 887b for HomePlug 1.0. Stations only seen on 887b are exported as homeplug_1.0. May be repeated.").Default("88e1", "887b").Enums("88e1", "887b")
+  vlanID           = kingpin.Flag("transport.vlan-id", "802.1Q VLAN ID to tag outgoing frames with. If 0 and a priority is set, frames are only priority tagged.").Default("0").Uint16()
+  vlanPriority     = kingpin.Flag("transport.vlan-priority", "802.1p priority code point (0-7) to tag outgoing frames with.").Default("0").Uint8()
+  socketPriority   = kingpin.Flag("transport.socket-priority", "Socket priority (SO_PRIORITY) for outgoing frames, used by queueing disciplines and VLAN egress priority maps. If negative, the system default is used.").Default("-1").Int()
+  protocols        = kingpin.Flag("protocol", "Protocol family to query Homeplug devices with. May be repeated.").Default("qualcomm", "homeplug_av").Enums("qualcomm", "homeplug_av")
+  pollInterval     = kingpin.Flag("poll.interval", "Interval at which to poll Homeplug devices in the background. If 0, devices are polled on every scrape.").Default("0s").Duration()
+  jsonFile         = kingpin.Flag("output.json-file", "File to which the results of each poll are written as JSON.").String()
+  probeBridged     = kingpin.Flag("probe.bridged-hosts", "ARP probe the hosts bridged behind each adapter on every poll. Only hosts in the neighbour table of the interface can be probed.").Bool()
+  resolveHosts     = kingpin.Flag("probe.host-names", "Name the hosts bridged behind each adapter, by asking them over mDNS or else the system resolver. Only hosts in the neighbour table of the interface can be named.").Bool()
+  collectSchedule  = kingpin.Flag("collect.schedule", "Ask the CCo of each network for its beacon schedule on every poll.").Bool()
+  collectLinkStats = kingpin.Flag("collect.link-stats", "Ask each Qualcomm station for the MAC-level counters of its links on every poll.").Bool()
+  collectFirmware  = kingpin.Flag("collect.firmware", "Ask each Qualcomm station for its firmware version on every poll.").Bool()
+  linkStatsMinChange = kingpin.Flag("collect.link-stats.min-change", "Leave the link stats counters of a link out of scrapes of the metrics endpoint until one of them has changed by at least this much since they were last in one, to keep the samples of large segments down. If 0, they are in every scrape.").Default("0").Float64()
+  linkStatsRefresh = kingpin.Flag("collect.link-stats.refresh", "Longest that --collect.link-stats.min-change and --collect.tone-maps.per-carrier.min-change leave the samples of a link out of scrapes.").Default("15m").Duration()
+  collectToneMaps  = kingpin.Flag("collect.tone-maps", "Ask each Qualcomm station for the tone maps of its links on every poll.").Bool()
+  collectDiscover  = kingpin.Flag("collect.discover-list", "Ask each station for the stations and networks it hears, including those of neighbouring networks, with CC_DISCOVER_LIST on every poll.").Bool()
+  collectPipeline  = kingpin.Flag("collect.pipeline", "Send the requests of the firmware, link stats and discover list collectors to each Qualcomm station back to back, instead of waiting for each confirm before sending the next request. Roughly halves how long those collectors take, but some firmware drops requests that arrive while it is busy; the collectors ask again for any confirm that is missing.").Bool()
+  toneMapsPerCarrier = kingpin.Flag("collect.tone-maps.per-carrier", "Export the bits of each of the 1155 carriers of every tone map, instead of only their average over each MHz. Adds over a thousand samples per link.").Bool()
+  carrierMinChange = kingpin.Flag("collect.tone-maps.per-carrier.min-change", "Leave the bits of the carriers of a tone map out of scrapes of the metrics endpoint until they have changed by at least this many bits in all since they were last in one, to keep the samples of --collect.tone-maps.per-carrier down. If 0, they are in every scrape.").Default("0").Float64()
+  quarantineThreshold = kingpin.Flag("quarantine.threshold", "Number of polls in a row in which a station sent malformed confirms after which it is quarantined: its decoding errors are only logged at debug level, and the schedule and link stats collectors skip it. If 0, stations are never quarantined.").Default("5").Int()
+  quarantineReprobe = kingpin.Flag("quarantine.reprobe-interval", "Interval at which the collectors query quarantined stations again, to see whether they have recovered.").Default("15m").Duration()
+  decodeStrict     = kingpin.Flag("decode.strict", "Reject confirms with reserved values in their fields, or data after their last entry, as malformed, instead of decoding what they hold and counting the anomalies. For protocol development; vendor firmware often has them.").Bool()
+  burstInterval    = kingpin.Flag("burst.interval", "Interval at which to poll during a burst requested with /api/v1/burst, with every collector enabled.").Default("5s").Duration()
+  burstMaxDuration = kingpin.Flag("burst.max-duration", "Longest burst that /api/v1/burst may request.").Default("1h").Duration()
+  passive          = kingpin.Flag("passive", "Count the management frames sent by every station on the interface, including unsolicited indications.").Bool()
+  passiveReaders   = kingpin.Flag("passive.readers", "Number of sockets and goroutines receiving frames for --passive. If more than 1, the kernel spreads the frames over them with PACKET_FANOUT, so that busy segments are not dropped.").Default("1").Int()
+  cacheMax         = kingpin.Flag("cache.max-entries", "Largest number of entries in each of the caches of the state kept per station or link, and of replies a query buffers, so that a segment with a great many stations cannot exhaust memory. The least recently used entries are evicted beyond that. If 0, there is no limit.").Default("10000").Int()
+  historyRetention = kingpin.Flag("history.retention", "How long to keep the rate of every link in memory. If at least 24h, the change in each rate since 24 hours earlier is exported. If 0, no history is kept.").Default("0s").Duration()
+  historyFile      = kingpin.Flag("history.file", "File in which the history is kept compressed across restarts, saved every history.save-interval and on exit. If empty, it is only kept in memory.").String()
+  historyFileSize  = kingpin.Flag("history.file-max-size", "Largest size of the history file; the oldest rates are left out of it beyond that. If 0, there is no limit.").Default("16MiB").Bytes()
+  historySave      = kingpin.Flag("history.save-interval", "Interval at which the history is saved to history.file.").Default("5m").Duration()
+  textfileDir      = kingpin.Flag("textfile.directory", "Instead of serving metrics over HTTP, keep them in homeplug.prom in the given node_exporter textfile collector directory, polling every poll.interval (1m if 0).").String()
+  logDedupInterval = kingpin.Flag("log.dedup-interval", "Interval during which repeats of frequent error messages are counted rather than logged. If 0, every message is logged.").Default("1m").Duration()
+  logComponentLevels = kingpin.Flag("log.component-level", "Log level of one component (main, transport, decoder, poller or http) as component=level, overriding --log.level. May be repeated.").PlaceHolder("COMPONENT=LEVEL").StringMap()
+  soak             = kingpin.Flag("soak", "Continuously poll and query the discovered stations, logging resource usage and failing if it grows past the --soak.max-* limits, to test for leaks.").Hidden().Bool()
+  soakDiscovery    = kingpin.Flag("soak.discovery-interval", "Interval between discovery polls in soak mode.").Hidden().Default("10s").Duration()
+  soakQuery        = kingpin.Flag("soak.query-interval", "Interval between unicast queries of discovered stations in soak mode.").Hidden().Default("1s").Duration()
+  soakDuration     = kingpin.Flag("soak.duration", "How long to soak test for before exiting, with status 0 if usage stayed within the limits. If 0, until a limit is exceeded or the exporter is stopped.").Hidden().Default("0s").Duration()
+  soakGoroutines   = kingpin.Flag("soak.max-goroutine-growth", "Number of goroutines by which the soak test may grow from the first discovery poll before it fails.").Hidden().Default("50").Int()
+  soakHeap         = kingpin.Flag("soak.max-heap-growth", "Size by which the heap in use may grow from the first discovery poll before the soak test fails.").Hidden().Default("64MiB").Bytes()
+  versionCheck     = kingpin.Flag("version-check", "Check GitHub for a newer release once a day, and export homeplug_exporter_update_available. The shared http_client settings and proxy environment variables apply.").Bool()
+  versionCheckURL  = kingpin.Flag("version-check.url", "URL of the GitHub API for the latest release, for mirrors.").Default(defaultReleasesURL).String()
+  rawValues        = kingpin.Flag("debug.raw-values", "Export a _raw companion of each converted metric, with the value as sent by the devices, for comparing with vendor tools.").Bool()
+  pibDump          = kingpin.Flag("debug.pib-dump", "Serve /debug/pib, which reads the PIB of the Qualcomm adapter given by its target parameter, for support cases.").Bool()
+  supportBundle    = kingpin.Flag("support-bundle", "Poll the devices once, write a support bundle for attaching to bug reports to the given file, and exit.").String()
+  commandAPIURL    = kingpin.Flag("command.api-url", "URL of the exporter that the rates and check commands read the last poll from, with its API, when it already polls the interface. By default, the --telemetry.address of this host.").String()
+  commandToken     = kingpin.Flag("command.api-token-file", "File with a bearer token of the api scope for --command.api-url.").String()
+
+  serveCmd         = kingpin.Command("serve", "Run the exporter. This is the default.").Default()
+  ratesCmd         = kingpin.Command("rates", "Poll the devices once, print the links below --min-mbps, and exit with status 2 if there are any, for use as a Nagios or Icinga check.")
+  minMbps          = ratesCmd.Flag("min-mbps", "Lowest acceptable rate of a link, in Mbit/s.").Required().Float64()
+  checkCmd         = kingpin.Command("check", "Poll the devices once and report link rates and device presence as a Nagios or Icinga check, with performance data.")
+  checkWarnMbps    = checkCmd.Flag("warn-mbps", "Rate of a link, in Mbit/s, below which the check is WARNING. If 0, it is not checked.").Default("0").Float64()
+  checkCritMbps    = checkCmd.Flag("crit-mbps", "Rate of a link, in Mbit/s, below which the check is CRITICAL. If 0, it is not checked.").Default("0").Float64()
+  checkExpect      = checkCmd.Flag("expect", "MAC address of a device that must answer, or the check is CRITICAL. May be repeated.").Strings()
+  injectCmd        = kingpin.Command("inject", "Send the frames of a pcap stream read from stdin on --interface until it ends. --transport=ssh runs it on the host it reaches the devices through.")
+
+  framesReceived = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+      Namespace: namespace,
+      Name:      "frames_received_total",
+      Help:      "Homeplug frames received, by interface, vendor OUI and MME type, including those that are not decoded.",
+    },
+    []string{"interface", "oui", "mme_type"})
+
+  mmeRetransmissions = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+      Namespace: namespace,
+      Name:      "mme_retransmissions_total",
+      Help:      "Requests sent again to a destination because nothing answered them, including those of module reads.",
+    },
+    []string{"interface", "target"})
+
+  pollerConflict = prometheus.NewGaugeVec(
+    prometheus.GaugeOpts{
+      Namespace: namespace,
+      Name:      "poller_conflict",
+      Help:      "Whether polling is suspended because another exporter is already polling on the interface.",
+    },
+    []string{"interface"})
 )
 
+// Exporter is the Prometheus output. It serves the most recently published
+// snapshot, or polls the devices itself on every scrape when not running in
+// cached mode.
 type Exporter struct {
- iface   *net.Interface
- conn    *raw.Conn
- dest    net.HardwareAddr
- mutex   sync.Mutex
-
- txRate  *prometheus.Desc
- rxRate  *prometheus.Desc
- network *prometheus.Desc
+ poller   *Poller
+ cached   bool
+ linkMode string
+ // saturatedRate and unknownRate are how rates of 255 and 0 Mbit/s are
+ // exported.
+ saturatedRate string
+ unknownRate   string
+ // snapshot is loaded once per scrape, so that every series of a scrape
+ // comes from the same poll.
+ snapshot snapshotStore
+ // rules are applied to the metrics of single snapshots, which are not
+ // gathered through the default registry, and by Gatherer to those that
+ // are. They may be replaced while they are used.
+ rulesMutex sync.RWMutex
+ rules      metricRules
+
+ txRate      *prometheus.Desc
+ rxRate      *prometheus.Desc
+ phyRate     *prometheus.Desc
+ linkRate    *prometheus.Desc
+ linkDirRate *prometheus.Desc
+ network     *prometheus.Desc
+ device      *prometheus.Desc
+ station     *prometheus.Desc
+ asleep      *prometheus.Desc
+ local       *prometheus.Desc
+ bridged     *prometheus.Desc
+ hostName    *prometheus.Desc
+ firmware    *prometheus.Desc
+ mmeVersion  *prometheus.Desc
+ roundTrip   *prometheus.Desc
+ reboots     *prometheus.Desc
+ membership  *prometheus.Desc
+ route       *prometheus.Desc
+ maxFreq     *prometheus.Desc
+ period      *prometheus.Desc
+ allocated   *prometheus.Desc
+ mode        *prometheus.Desc
+ capacity    *prometheus.Desc
+ mpdus       *prometheus.Desc
+ pbs         *prometheus.Desc
+ // linkDiff, if set, leaves unchanged link stats out of scrapes, and
+ // linkExposed tells when they were last in one.
+ linkDiff    *sampleDiff
+ linkExposed *prometheus.Desc
+ // toneBits and toneCarriers summarize the tone maps, and carrierBits, if
+ // perCarrier is set, has every carrier of them.
+ toneBits     *prometheus.Desc
+ toneCarriers *prometheus.Desc
+ carrierBits  *prometheus.Desc
+ perCarrier   bool
+ // toneDiff, if set, leaves the unchanged carriers of tone maps out of
+ // scrapes, and toneExposed tells when they were last in one.
+ toneDiff     *sampleDiff
+ toneExposed  *prometheus.Desc
+ // discovered, discoveredSig and neighbour are what the stations hear, from
+ // their discover lists.
+ discovered    *prometheus.Desc
+ discoveredSig *prometheus.Desc
+ neighbour     *prometheus.Desc
+ dataAge     *prometheus.Desc
+ retransmits *prometheus.Desc
+ colDuration *prometheus.Desc
+ colSuccess  *prometheus.Desc
+ // raw are the companions of the converted metrics, carrying the values as
+ // they were sent, if they are exported.
+ raw            bool
+ rawTxRate      *prometheus.Desc
+ rawRxRate      *prometheus.Desc
+ rawLinkRate    *prometheus.Desc
+ rawLinkDirRate *prometheus.Desc
+ rawMaxFreq     *prometheus.Desc
+ rawPeriod      *prometheus.Desc
+ rawAllocated   *prometheus.Desc
 }
 
-func NewExporter(iface *net.Interface, conn *raw.Conn, dest net.HardwareAddr) *Exporter {
+// NewExporter returns the Prometheus output of poller. Every metric it
+// exports has the given constant labels, which may be nil.
+func NewExporter(poller *Poller, cached bool, linkMode string, labels prometheus.Labels) *Exporter {
   return &Exporter{
-    iface:  iface,
-    conn:   conn,
-    dest:   dest,
+    poller:   poller,
+    cached:   cached,
+    linkMode: linkMode,
     txRate: prometheus.NewDesc(
       prometheus.BuildFQName(namespace, "station", "tx_rate_bytes"),
       "Average PHY Tx data rate",
-      []string{"mac_address", "terminal_equipment_identifier"},
-      nil),
+      []string{"mac_address", "terminal_equipment_identifier", "protocol", "reporter_mac", "coupling_path"},
+      labels),
     rxRate: prometheus.NewDesc(
       prometheus.BuildFQName(namespace, "station", "rx_rate_bytes"),
       "Average PHY Rx data rate",
-      []string{"mac_address", "terminal_equipment_identifier"},
-      nil),
+      []string{"mac_address", "terminal_equipment_identifier", "protocol", "reporter_mac", "coupling_path"},
+      labels),
+    phyRate: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "phy_rate_mbps"),
+      "Average PHY data rate in the given direction as reported by reporter_mac, in Mbit/s, unconverted",
+      []string{"mac_address", "terminal_equipment_identifier", "protocol", "reporter_mac", "coupling_path", "direction"},
+      labels),
+    linkRate: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link", "rate_bytes"),
+      "Lowest average PHY data rate reported between two stations",
+      []string{"a_mac_address", "b_mac_address", "protocol", "coupling_path"},
+      labels),
+    linkDirRate: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link", "rate_bytes"),
+      "Lowest average PHY data rate reported between two stations",
+      []string{"a_mac_address", "b_mac_address", "protocol", "direction", "coupling_path"},
+      labels),
     network: prometheus.NewDesc(
       prometheus.BuildFQName(namespace, "network", "id"),
       "Logical network information",
-      []string{"network_identifier", "terminal_equipment_identifier", "coordinator_mac_address"},
-      nil),
+      []string{"network_identifier", "terminal_equipment_identifier", "coordinator_mac_address", "protocol", "reporter_mac"},
+      labels),
+    device: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "device", "info"),
+      "Devices that answered a query, labeled by the protocol family they answered with, or unknown if they only answered with errors",
+      []string{"mac_address", "capabilities"},
+      labels),
+    station: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "info"),
+      "Every station known from a poll, including those only observed in the reports of others",
+      []string{"mac_address", "network_identifier", "observed_only", "phase", "device_type"},
+      labels),
+    asleep: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "asleep"),
+      "AV2 stations that the CCo's beacon lists as in power save, which are members of the network but don't answer until they wake",
+      []string{"mac_address", "network_identifier"},
+      labels),
+    local: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "local_adapter", "info"),
+      "The adapter attached to the exporter's interface, which answers the local alias",
+      []string{"mac_address"},
+      labels),
+    bridged: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "bridged_host", "reachable"),
+      "Whether the host bridged behind a station answered an ARP request",
+      []string{"mac_address", "bridged_mac_address", "ip_address"},
+      labels),
+    hostName: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "bridged_host", "info"),
+      "The name of the host bridged behind a station, from mDNS or the system resolver",
+      []string{"mac_address", "bridged_mac_address", "host_name"},
+      labels),
+    firmware: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station_firmware", "info"),
+      "The firmware version a Qualcomm station runs, and its chip, from VS_SW_VER",
+      []string{"mac_address", "version", "device_class"},
+      labels),
+    mmeVersion: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station_mme_version", "info"),
+      "The MMV (management message version) of the layout each type of confirm a station sent was decoded as",
+      []string{"mac_address", "mme_type", "mmv"},
+      labels),
+    roundTrip: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "round_trip_seconds"),
+      "The lowest time from a request being sent to the first confirm of a station in the poll. For the local adapter it is the Ethernet hop to it, and for the others it includes the powerline hop",
+      []string{"mac_address"},
+      labels),
+    reboots: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "reboots_total"),
+      "Reboots of the station noticed since the exporter started, from the link stats counters of all its links starting again from zero, or from it coming back with another TEI",
+      []string{"mac_address"},
+      labels),
+    membership: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "network", "membership"),
+      "Networks a station stated it is a member of in a standard CM_NW_INFO confirm, by role",
+      []string{"mac_address", "network_identifier", "terminal_equipment_identifier", "role"},
+      labels),
+    route: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "route_info"),
+      "How a station reaches the CCo (uplink) or is reached by it (downlink) in networks with proxy coordinators, directly or through the proxy coordinator given by proxy_mac",
+      []string{"mac_address", "network_identifier", "direction", "route", "proxy_mac"},
+      labels),
+    maxFreq: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "capability_max_frequency_hertz"),
+      "Upper edge of the widest powerline band the station is capable of, from the HomePlug AV version in its CM_STA_CAP, whatever band its links use",
+      []string{"mac_address", "av_version"},
+      labels),
+    period: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "network", "beacon_period_seconds"),
+      "Length of the beacon period scheduled by the CCo",
+      []string{"network_identifier", "reporter_mac"},
+      labels),
+    allocated: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "network", "schedule_allocated_ratio"),
+      "Fraction of the beacon period allocated to CSMA, TDMA or other uses by the CCo",
+      []string{"network_identifier", "allocation", "reporter_mac"},
+      labels),
+    mode: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "network", "mode"),
+      "Network mode stated in the CCo's beacon, 1 for the current mode and 0 for the others",
+      []string{"network_identifier", "mode", "reporter_mac"},
+      labels),
+    capacity: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "network", "capacity_bytes"),
+      "Estimated aggregate throughput of the network between the local adapter, or the CCo, and the other stations, the harmonic mean of the lowest rate of each of their links to it",
+      []string{"network_identifier"},
+      labels),
+    mpdus: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link", "mpdus_total"),
+      "MAC frames sent or received on the link to a peer, by result, as counted by the reporter",
+      []string{"reporter_mac", "peer_mac", "direction", "result"},
+      labels),
+    pbs: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link", "pbs_total"),
+      "PHY blocks sent or received on the link to a peer, by result, as counted by the reporter",
+      []string{"reporter_mac", "peer_mac", "direction", "result"},
+      labels),
+    linkExposed: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link_stats", "exposed_timestamp_seconds"),
+      "When the link stats counters of the link were last in a scrape, as a Unix time. Counters that did not change by --collect.link-stats.min-change are left out",
+      []string{"reporter_mac", "peer_mac", "direction"},
+      labels),
+    toneBits: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link_tone_map", "bits_per_carrier"),
+      "Average bits per carrier of the tone map the reporter uses to send to the peer, over the carriers in each MHz from frequency_mhz and the slots of the tone map, from VS_TONE_MAP_CHAR",
+      []string{"reporter_mac", "peer_mac", "frequency_mhz"},
+      labels),
+    toneCarriers: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link_tone_map", "carriers"),
+      "Carriers of the tone map the reporter uses to send to the peer with each modulation, averaged over its slots, from VS_TONE_MAP_CHAR",
+      []string{"reporter_mac", "peer_mac", "modulation"},
+      labels),
+    carrierBits: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link", "carrier_bits"),
+      "Bits the given carrier carries in the tone map the reporter uses to send to the peer, averaged over its slots, from VS_TONE_MAP_CHAR",
+      []string{"reporter_mac", "peer_mac", "carrier"},
+      labels),
+    toneExposed: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link", "carrier_bits_exposed_timestamp_seconds"),
+      "When the carrier bits of the tone map the reporter uses to send to the peer were last in a scrape, as a Unix time. Tone maps whose carriers did not change by --collect.tone-maps.per-carrier.min-change bits in all are left out",
+      []string{"reporter_mac", "peer_mac"},
+      labels),
+    discovered: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "discovered_station", "info"),
+      "A station the reporter hears, from its CC_DISCOVER_LIST, and whether it is in the reporter's network",
+      []string{"reporter_mac", "mac_address", "terminal_equipment_identifier", "short_network_identifier", "same_network"},
+      labels),
+    discoveredSig: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "discovered_station", "signal_level"),
+      "Signal level of a station the reporter hears, from its CC_DISCOVER_LIST: 1 above -10 dB, and each level after 5 dB less, down to 15 at -75 dB or less. Left out if it is not known",
+      []string{"reporter_mac", "mac_address"},
+      labels),
+    neighbour: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "discovered_network", "info"),
+      "A network the reporter hears the beacons of, from its CC_DISCOVER_LIST. alien is true for networks that no polled station is a member of",
+      []string{"reporter_mac", "network_identifier", "short_network_identifier", "alien"},
+      labels),
+    dataAge: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "", "data_age_seconds"),
+      "Seconds since the served data was last successfully polled",
+      []string{"target"},
+      labels),
+    retransmits: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "poll", "retransmissions"),
+      "Requests sent again to a destination during the served poll because nothing answered them",
+      []string{"target"},
+      labels),
+    colDuration: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "collector", "duration_seconds"),
+      "How long a collector took during the served poll",
+      []string{"collector"},
+      labels),
+    colSuccess: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "collector", "success"),
+      "Whether a collector got every answer it asked for during the served poll",
+      []string{"collector"},
+      labels),
+    rawTxRate: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "tx_rate_megabits_raw"),
+      "Average PHY Tx data rate as reported, in Mbit/s",
+      []string{"mac_address", "terminal_equipment_identifier", "protocol", "reporter_mac", "coupling_path"},
+      labels),
+    rawRxRate: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "rx_rate_megabits_raw"),
+      "Average PHY Rx data rate as reported, in Mbit/s",
+      []string{"mac_address", "terminal_equipment_identifier", "protocol", "reporter_mac", "coupling_path"},
+      labels),
+    rawLinkRate: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link", "rate_megabits_raw"),
+      "Lowest average PHY data rate reported between two stations, as reported, in Mbit/s",
+      []string{"a_mac_address", "b_mac_address", "protocol", "coupling_path"},
+      labels),
+    rawLinkDirRate: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "link", "rate_megabits_raw"),
+      "Lowest average PHY data rate reported between two stations, as reported, in Mbit/s",
+      []string{"a_mac_address", "b_mac_address", "protocol", "direction", "coupling_path"},
+      labels),
+    rawMaxFreq: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "station", "capability_max_frequency_hertz_raw"),
+      "HomePlug AV version field of CM_STA_CAP that the maximum frequency the station is capable of is derived from",
+      []string{"mac_address", "av_version"},
+      labels),
+    rawPeriod: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "network", "beacon_period_seconds_raw"),
+      "Length of the beacon period scheduled by the CCo, in allocation time units of 10.24us",
+      []string{"network_identifier", "reporter_mac"},
+      labels),
+    rawAllocated: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "network", "schedule_allocated_ratio_raw"),
+      "Time allocated to CSMA, TDMA or other uses in each beacon period, in allocation time units of 10.24us",
+      []string{"network_identifier", "allocation", "reporter_mac"},
+      labels),
   }
 }
 
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-  ch <- e.txRate
-  ch <- e.rxRate
-  ch <- e.network
+func (e *Exporter) Name() string {
+  return "prometheus"
 }
 
-func (e *Exporter) Collect (ch chan<- prometheus.Metric) {
-  e.mutex.Lock()
-  defer e.mutex.Unlock()
-  err := e.collect(ch)
-  if err != nil {
-    log.Errorf("Error scraping Homeplug: %v", err)
-  }
+func (e *Exporter) Publish(s *Snapshot) error {
+  e.snapshot.Store(s)
+  return nil
 }
 
-func (e *Exporter) collect(ch chan<- prometheus.Metric) error {
-  netinfos, err := get_homeplug_netinfo(e.iface, e.conn, e.dest)
-  if err != nil {
-    return err
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+  switch e.linkMode {
+  case linkModeUndirectedMin:
+    ch <- e.linkRate
+  case linkModeUndirected:
+    ch <- e.linkDirRate
+  default:
+    ch <- e.txRate
+    ch <- e.rxRate
   }
-
-  for _, info := range netinfos {
-    for _, network := range info.Networks {
-      ch <- prometheus.MustNewConstMetric(e.network, prometheus.GaugeValue,
-            float64(network.ShortID), hex.EncodeToString(network.NetworkID[:]), strconv.FormatInt(int64(network.TEI), 10), network.CCoAddress.String())
+  ch <- e.phyRate
+  ch <- e.network
+  ch <- e.device
+  ch <- e.station
+  ch <- e.asleep
+  ch <- e.local
+  ch <- e.bridged
+  ch <- e.hostName
+  ch <- e.firmware
+  ch <- e.mmeVersion
+  ch <- e.roundTrip
+  ch <- e.reboots
+  ch <- e.membership
+  ch <- e.route
+  ch <- e.maxFreq
+  ch <- e.period
+  ch <- e.allocated
+  ch <- e.mode
+  ch <- e.capacity
+  ch <- e.mpdus
+  ch <- e.pbs
+  ch <- e.linkExposed
+  ch <- e.toneBits
+  ch <- e.toneCarriers
+  if e.perCarrier {
+    ch <- e.carrierBits
+    ch <- e.toneExposed
+  }
+  ch <- e.discovered
+  ch <- e.discoveredSig
+  ch <- e.neighbour
+  ch <- e.dataAge
+  ch <- e.retransmits
+  ch <- e.colDuration
+  ch <- e.colSuccess
+  if e.raw {
+    switch e.linkMode {
+    case linkModeUndirectedMin:
+      ch <- e.rawLinkRate
+    case linkModeUndirected:
+      ch <- e.rawLinkDirRate
+    default:
+      ch <- e.rawTxRate
+      ch <- e.rawRxRate
     }
+    ch <- e.rawMaxFreq
+    ch <- e.rawPeriod
+    ch <- e.rawAllocated
+  }
+}
 
-    for _, station := range info.Stations {
-      ch <- prometheus.MustNewConstMetric(e.txRate, prometheus.GaugeValue,
-            float64(uint64(station.TxRate) * 1024 * 1024 / 8), station.Address.String(), strconv.FormatInt(int64(station.TEI), 10))
-      ch <- prometheus.MustNewConstMetric(e.rxRate, prometheus.GaugeValue,
-            float64(uint64(station.RxRate) * 1024 * 1024 / 8), station.Address.String(), strconv.FormatInt(int64(station.TEI), 10))
+func (e *Exporter) Collect (ch chan<- prometheus.Metric) {
+  if !e.cached {
+    s, err := e.poller.Poll(context.Background())
+    if err != nil {
+      httpLog.Errorf("Error scraping Homeplug: %v", err)
+      return
     }
+    e.collect(ch, s, true)
+    return
   }
-  return nil
+
+  s := e.snapshot.Load()
+  if s == nil {
+    return
+  }
+  ch <- prometheus.MustNewConstMetric(e.dataAge, prometheus.GaugeValue,
+        time.Since(s.Time).Seconds(), s.Target.String())
+  e.collect(ch, s, true)
 }
 
-type HomeplugNetworkInfo struct {
-  Networks []HomeplugNetworkStatus
-  Stations []HomeplugStationStatus
+// SetRawValues enables exporting a _raw companion of each converted metric,
+// with the value as it was sent, for comparing with vendor tools.
+func (e *Exporter) SetRawValues(enabled bool) {
+  e.raw = enabled
 }
 
-func (n *HomeplugNetworkInfo) UnmarshalBinary(b []byte) error {
-  o := 0
+// SetLinkStatsMinChange leaves the link stats counters of a link out of
+// scrapes until one of them has changed by minChange since they were last
+// in one, or refresh has passed. Snapshots pushed to outputs or probed
+// always have them.
+func (e *Exporter) SetLinkStatsMinChange(minChange float64, refresh time.Duration) {
+  e.linkDiff = new_link_stats_diff(minChange, refresh)
+}
 
-  var num_networks = int(b[o])
-  o++
-  for i := 0; i < num_networks; i++ {
-    var ns HomeplugNetworkStatus
-    size, err := (&ns).UnmarshalBinary(b[o:])
-    if err != nil {
-      return err
-    }
-    n.Networks = append(n.Networks, ns)
-    o += size
-  }
+// SetToneMapMinChange leaves the bits of the carriers of a tone map out of
+// scrapes until they have changed by minChange bits in all since they were
+// last in one, or refresh has passed, like SetLinkStatsMinChange.
+func (e *Exporter) SetToneMapMinChange(minChange float64, refresh time.Duration) {
+  e.toneDiff = new_tone_map_diff(minChange, refresh)
+}
 
-  var num_stations = int(b[o])
-  o++
-  for i := 0; i < num_stations; i++ {
-    var ss HomeplugStationStatus
-    size, err := (&ss).UnmarshalBinary(b[o:])
-    if err != nil {
-      return err
-    }
-    n.Stations = append(n.Stations, ss)
-    o += size
+// SetRateHandling sets how rates that the devices report as 255 Mbit/s,
+// with saturated set to nan, or as 0, with unknown set to nan, are exported.
+func (e *Exporter) SetRateHandling(saturated, unknown string) {
+  e.saturatedRate, e.unknownRate = saturated, unknown
+}
+
+// rate returns the exported value of a converted rate: NaN in place of a
+// saturated or unknown one, if they are to be.
+func (e *Exporter) rate(rate float64, raw uint16, saturated bool) float64 {
+  if saturated && e.saturatedRate == rateNaN || raw == 0 && e.unknownRate == rateNaN {
+    return math.NaN()
   }
+  return rate
+}
 
-  return nil
+// SetToneMapPerCarrier enables exporting the bits of every carrier of the
+// tone maps, as well as the MHz averages.
+func (e *Exporter) SetToneMapPerCarrier(enabled bool) {
+  e.perCarrier = enabled
 }
 
-type HomeplugNetworkStatus struct {
-  NetworkID  [7]byte
-  ShortID    uint8
-  TEI        uint8
-  Role       uint8
-  CCoAddress net.HardwareAddr
-  CCoTEI     uint8
+// SetMetricRules sets the rules applied by gatherSnapshot and Gatherer.
+func (e *Exporter) SetMetricRules(rules metricRules) {
+  e.rulesMutex.Lock()
+  e.rules = rules
+  e.rulesMutex.Unlock()
 }
 
-func (s *HomeplugNetworkStatus) UnmarshalBinary(b []byte) (int, error) {
-  if len(b) < 17 {
-    return 0, io.ErrUnexpectedEOF
-  }
-  copy(s.NetworkID[:], b[0:7])
-  s.ShortID = b[7]
-  s.TEI = b[8]
-  s.Role = b[9]
-  s.CCoAddress = b[10:16]
-  s.CCoTEI = b[16]
-  return 17, nil
+func (e *Exporter) metricRules() metricRules {
+  e.rulesMutex.RLock()
+  defer e.rulesMutex.RUnlock()
+  return e.rules
 }
 
-type HomeplugStationStatus struct {
-  Address        net.HardwareAddr
-  TEI            uint8
-  BridgedAddress net.HardwareAddr
-  TxRate         uint8
-  RxRate         uint8
+// Gatherer returns g with the metric rules applied to what it gathers, as
+// they are at the time.
+func (e *Exporter) Gatherer(g prometheus.Gatherer) prometheus.Gatherer {
+  return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+    return e.metricRules().gatherer(g).Gather()
+  })
 }
 
-func (s *HomeplugStationStatus) UnmarshalBinary(b []byte) (int, error) {
-  if len(b) < 15 {
-    return 0, io.ErrUnexpectedEOF
+// gatherSnapshot returns the metrics of a single snapshot, with the metric
+// rules applied.
+func (e *Exporter) gatherSnapshot(s *Snapshot) ([]*dto.MetricFamily, error) {
+  registry := prometheus.NewRegistry()
+  if err := registry.Register(e.snapshotCollector(s)); err != nil {
+    return nil, err
   }
-  s.Address = b[0:6]
-  s.TEI = b[6]
-  s.BridgedAddress = b[7:13]
-  s.TxRate = b[13]
-  s.RxRate = b[14]
-  return 15, nil
+  return e.metricRules().gatherer(registry).Gather()
 }
 
-type HomeplugFrame struct {
-  Version [1]byte
-  MMEType [2]byte
-  Vendor  [3]byte
-  Payload []byte
+// snapshotCollector returns a collector for the metrics of a single
+// snapshot, for outputs that push metrics rather than being scraped.
+func (e *Exporter) snapshotCollector(s *Snapshot) prometheus.Collector {
+  return snapshotCollector{e, s}
 }
 
-func (h *HomeplugFrame) MarshalBinary() ([]byte, error) {
-  b := make([]byte, h.length())
-  _, err := h.read(b)
-  return b, err
+type snapshotCollector struct {
+  e *Exporter
+  s *Snapshot
 }
 
-func (h *HomeplugFrame) read(b []byte) (int, error) {
-  b[0] = h.Version[0]
-  b[1] = h.MMEType[1]
-  b[2] = h.MMEType[0]
-  b[3] = h.Vendor[0]
-  b[4] = h.Vendor[1]
-  b[5] = h.Vendor[2]
-  copy(b[6:], h.Payload[:])
-  return len(b), nil
+func (c snapshotCollector) Describe(ch chan<- *prometheus.Desc) {
+  c.e.Describe(ch)
 }
 
-func (h *HomeplugFrame) length() int {
-  return 6 + len(h.Payload)
+func (c snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+  c.e.collect(ch, c.s, false)
 }
 
-func (h *HomeplugFrame) UnmarshalBinary(b []byte) error {
-  if len(b) < 6 {
-    return io.ErrUnexpectedEOF
+// collect sends the metrics of s. If gated, the link stats and carrier bits
+// sent are those that linkDiff and toneDiff, where set, decide.
+func (e *Exporter) collect(ch chan<- prometheus.Metric, s *Snapshot, gated bool) {
+  if s.Local != nil {
+    ch <- prometheus.MustNewConstMetric(e.local, prometheus.GaugeValue, 1, s.Local.String())
+  }
+  for target, n := range s.Retransmissions {
+    ch <- prometheus.MustNewConstMetric(e.retransmits, prometheus.GaugeValue, float64(n), target)
+  }
+  for collector, r := range s.Collectors {
+    success := 0.0
+    if r.Success {
+      success = 1
+    }
+    ch <- prometheus.MustNewConstMetric(e.colDuration, prometheus.GaugeValue, r.Duration.Seconds(), collector)
+    ch <- prometheus.MustNewConstMetric(e.colSuccess, prometheus.GaugeValue, success, collector)
+  }
+  for _, network := range s.Networks {
+    reporter := network.CCoAddress.String()
+    if network.Mode != "" {
+      for _, mode := range homeplug.NetworkModes {
+        value := 0.0
+        if mode == network.Mode {
+          value = 1
+        }
+        ch <- prometheus.MustNewConstMetric(e.mode, prometheus.GaugeValue, value, network.ID, mode, reporter)
+      }
+    }
+    if capacity, ok := s.Capacity(network.ID); ok {
+      ch <- prometheus.MustNewConstMetric(e.capacity, prometheus.GaugeValue, capacity, network.ID)
+    }
+    if network.Schedule == nil || network.Schedule.Period == 0 {
+      continue
+    }
+    ch <- prometheus.MustNewConstMetric(e.period, prometheus.GaugeValue,
+          network.Schedule.Period, network.ID, reporter)
+    for _, kind := range []string{"csma", "tdma", "other"} {
+      ch <- prometheus.MustNewConstMetric(e.allocated, prometheus.GaugeValue,
+            network.Schedule.Allocated[kind] / network.Schedule.Period, network.ID, kind, reporter)
+    }
+    if e.raw {
+      ch <- prometheus.MustNewConstMetric(e.rawPeriod, prometheus.GaugeValue,
+            float64(network.Schedule.RawPeriod), network.ID, reporter)
+      for _, kind := range []string{"csma", "tdma", "other"} {
+        ch <- prometheus.MustNewConstMetric(e.rawAllocated, prometheus.GaugeValue,
+              float64(network.Schedule.RawAllocated[kind]), network.ID, kind, reporter)
+      }
+    }
+  }
+
+  now := time.Now()
+  for _, l := range s.LinkStats {
+    reporter, peer := l.Reporter.String(), l.Peer.String()
+    if gated && e.linkDiff != nil {
+      expose, at := e.linkDiff.ExposeLinkStats(l, now)
+      ch <- prometheus.MustNewConstMetric(e.linkExposed, prometheus.GaugeValue,
+            float64(at.Unix()), reporter, peer, l.Direction)
+      if !expose {
+        continue
+      }
+    }
+    ch <- prometheus.MustNewConstMetric(e.mpdus, prometheus.CounterValue,
+          float64(l.MPDUAcked), reporter, peer, l.Direction, "acked")
+    if l.Direction == "tx" {
+      ch <- prometheus.MustNewConstMetric(e.mpdus, prometheus.CounterValue,
+            float64(l.MPDUCollided), reporter, peer, l.Direction, "collided")
+    }
+    ch <- prometheus.MustNewConstMetric(e.mpdus, prometheus.CounterValue,
+          float64(l.MPDUFailed), reporter, peer, l.Direction, "failed")
+    ch <- prometheus.MustNewConstMetric(e.pbs, prometheus.CounterValue,
+          float64(l.PBPassed), reporter, peer, l.Direction, "passed")
+    ch <- prometheus.MustNewConstMetric(e.pbs, prometheus.CounterValue,
+          float64(l.PBFailed), reporter, peer, l.Direction, "failed")
+  }
+
+  for _, t := range s.ToneMaps {
+    reporter, peer := t.Reporter.String(), t.Peer.String()
+    for mhz, bits := range t.BandBits() {
+      ch <- prometheus.MustNewConstMetric(e.toneBits, prometheus.GaugeValue,
+            bits, reporter, peer, strconv.Itoa(mhz))
+    }
+    for _, modulation := range homeplug.Modulations {
+      ch <- prometheus.MustNewConstMetric(e.toneCarriers, prometheus.GaugeValue,
+            t.Modulations[modulation], reporter, peer, modulation)
+    }
+    if e.perCarrier && gated && e.toneDiff != nil {
+      expose, at := e.toneDiff.ExposeToneMap(&t, now)
+      ch <- prometheus.MustNewConstMetric(e.toneExposed, prometheus.GaugeValue,
+            float64(at.Unix()), reporter, peer)
+      if !expose {
+        continue
+      }
+    }
+    if e.perCarrier {
+      for i, bits := range t.Bits {
+        ch <- prometheus.MustNewConstMetric(e.carrierBits, prometheus.GaugeValue,
+              bits, reporter, peer, strconv.Itoa(homeplug.ToneMapFirstCarrier + i))
+      }
+    }
   }
 
-  bb := make([]byte, len(b) - 6)
-  copy(bb[:], b[6:])
+  for _, d := range s.Discovered {
+    ch <- prometheus.MustNewConstMetric(e.discovered, prometheus.GaugeValue,
+          1, d.Reporter.String(), d.Address.String(), strconv.Itoa(int(d.TEI)), strconv.Itoa(int(d.ShortID)), strconv.FormatBool(d.SameNetwork))
+    if d.SignalLevel != 0 {
+      ch <- prometheus.MustNewConstMetric(e.discoveredSig, prometheus.GaugeValue,
+            float64(d.SignalLevel), d.Reporter.String(), d.Address.String())
+    }
+  }
+  for _, n := range s.Neighbours {
+    ch <- prometheus.MustNewConstMetric(e.neighbour, prometheus.GaugeValue,
+          1, n.Reporter.String(), n.ID, strconv.Itoa(int(n.ShortID)), strconv.FormatBool(s.Network(n.ID) == nil))
+  }
 
-  h.Version[0] = b[0]
-  h.MMEType[1] = b[1]
-  h.MMEType[0] = b[2]
-  h.Vendor[0] = b[3]
-  h.Vendor[1] = b[4]
-  h.Vendor[2] = b[5]
-  h.Payload = bb
-  return nil
+  for _, station := range s.Stations {
+    ch <- prometheus.MustNewConstMetric(e.station, prometheus.GaugeValue,
+          1, station.Address.String(), station.NetworkID, strconv.FormatBool(station.ObservedOnly()), station.Phase, station.DeviceType)
+    if station.Asleep {
+      ch <- prometheus.MustNewConstMetric(e.asleep, prometheus.GaugeValue,
+            1, station.Address.String(), station.NetworkID)
+    }
+    if station.Responded {
+      ch <- prometheus.MustNewConstMetric(e.device, prometheus.GaugeValue,
+            1, station.Address.String(), station.Capabilities())
+    }
+    if station.Capability != nil {
+      ch <- prometheus.MustNewConstMetric(e.maxFreq, prometheus.GaugeValue,
+            station.Capability.MaxFrequency(), station.Address.String(), station.Capability.Version())
+      if e.raw {
+        ch <- prometheus.MustNewConstMetric(e.rawMaxFreq, prometheus.GaugeValue,
+              float64(station.Capability.AVVersion), station.Address.String(), station.Capability.Version())
+      }
+    }
+    if station.BridgedIP != nil {
+      reachable := 0.0
+      if station.BridgedReachable {
+        reachable = 1
+      }
+      ch <- prometheus.MustNewConstMetric(e.bridged, prometheus.GaugeValue,
+            reachable, station.Address.String(), station.BridgedAddress.String(), station.BridgedIP.String())
+    }
+    if station.BridgedHostName != "" {
+      ch <- prometheus.MustNewConstMetric(e.hostName, prometheus.GaugeValue,
+            1, station.Address.String(), station.BridgedAddress.String(), station.BridgedHostName)
+    }
+    if station.Firmware != nil {
+      ch <- prometheus.MustNewConstMetric(e.firmware, prometheus.GaugeValue,
+            1, station.Address.String(), station.Firmware.Version, station.Firmware.DeviceClass)
+    }
+    for mmeType, mmv := range station.MMEVersions {
+      ch <- prometheus.MustNewConstMetric(e.mmeVersion, prometheus.GaugeValue,
+            1, station.Address.String(), mmeType, strconv.Itoa(int(mmv)))
+    }
+    if station.RoundTrip != 0 {
+      ch <- prometheus.MustNewConstMetric(e.roundTrip, prometheus.GaugeValue,
+            station.RoundTrip.Seconds(), station.Address.String())
+    }
+    ch <- prometheus.MustNewConstMetric(e.reboots, prometheus.CounterValue,
+          float64(station.Reboots), station.Address.String())
+  }
+
+  for _, m := range s.Memberships {
+    ch <- prometheus.MustNewConstMetric(e.membership, prometheus.GaugeValue,
+          1, m.Address.String(), m.NetworkID, strconv.FormatInt(int64(m.TEI), 10), m.RoleName())
+  }
+
+  for _, r := range station_routes(s) {
+    route, proxy := "direct", ""
+    if r.Proxy != nil {
+      route, proxy = "proxy", r.Proxy.String()
+    }
+    ch <- prometheus.MustNewConstMetric(e.route, prometheus.GaugeValue,
+          1, r.Address.String(), r.NetworkID, r.Direction, route, proxy)
+  }
+
+  for _, station := range s.Stations {
+    if !station.Reporter {
+      continue
+    }
+    network := s.Network(station.NetworkID)
+    if network == nil {
+      continue
+    }
+    ch <- prometheus.MustNewConstMetric(e.network, prometheus.GaugeValue,
+          float64(network.ShortID), network.ID, strconv.FormatInt(int64(station.TEI), 10), network.CCoAddress.String(), station.Protocol, station.Address.String())
+  }
+
+  // The rates as the devices report them, whatever the link mode, for
+  // comparing with vendor tools.
+  for _, link := range s.Links {
+    peer, direction := s.Station(link.Destination), "tx"
+    if !bytes.Equal(link.Source, link.Reporter) {
+      peer, direction = s.Station(link.Source), "rx"
+    }
+    ch <- prometheus.MustNewConstMetric(e.phyRate, prometheus.GaugeValue,
+          float64(link.RawRate), peer.Address.String(), strconv.FormatInt(int64(peer.TEI), 10), link.Protocol, link.Reporter.String(), link_coupling(s, link), direction)
+  }
+
+  switch e.linkMode {
+  case linkModeUndirectedMin:
+    for _, p := range s.LinkPairs(false) {
+      coupling := coupling_path(s.Station(p.A), s.Station(p.B))
+      ch <- prometheus.MustNewConstMetric(e.linkRate, prometheus.GaugeValue,
+            e.rate(p.Rate, p.RawRate, p.Saturated), p.A.String(), p.B.String(), p.Protocol, coupling)
+      if e.raw {
+        ch <- prometheus.MustNewConstMetric(e.rawLinkRate, prometheus.GaugeValue,
+              float64(p.RawRate), p.A.String(), p.B.String(), p.Protocol, coupling)
+      }
+    }
+    return
+  case linkModeUndirected:
+    for _, p := range s.LinkPairs(true) {
+      coupling := coupling_path(s.Station(p.A), s.Station(p.B))
+      ch <- prometheus.MustNewConstMetric(e.linkDirRate, prometheus.GaugeValue,
+            e.rate(p.Rate, p.RawRate, p.Saturated), p.A.String(), p.B.String(), p.Protocol, p.Direction, coupling)
+      if e.raw {
+        ch <- prometheus.MustNewConstMetric(e.rawLinkDirRate, prometheus.GaugeValue,
+              float64(p.RawRate), p.A.String(), p.B.String(), p.Protocol, p.Direction, coupling)
+      }
+    }
+    return
+  }
+
+  for _, link := range s.Links {
+    coupling := link_coupling(s, link)
+    if bytes.Equal(link.Source, link.Reporter) {
+      peer := s.Station(link.Destination)
+      ch <- prometheus.MustNewConstMetric(e.txRate, prometheus.GaugeValue,
+            e.rate(link.Rate, link.RawRate, link.Saturated), peer.Address.String(), strconv.FormatInt(int64(peer.TEI), 10), link.Protocol, link.Reporter.String(), coupling)
+      if e.raw {
+        ch <- prometheus.MustNewConstMetric(e.rawTxRate, prometheus.GaugeValue,
+              float64(link.RawRate), peer.Address.String(), strconv.FormatInt(int64(peer.TEI), 10), link.Protocol, link.Reporter.String(), coupling)
+      }
+    } else {
+      peer := s.Station(link.Source)
+      ch <- prometheus.MustNewConstMetric(e.rxRate, prometheus.GaugeValue,
+            e.rate(link.Rate, link.RawRate, link.Saturated), peer.Address.String(), strconv.FormatInt(int64(peer.TEI), 10), link.Protocol, link.Reporter.String(), coupling)
+      if e.raw {
+        ch <- prometheus.MustNewConstMetric(e.rawRxRate, prometheus.GaugeValue,
+              float64(link.RawRate), peer.Address.String(), strconv.FormatInt(int64(peer.TEI), 10), link.Protocol, link.Reporter.String(), coupling)
+      }
+    }
+  }
 }
 
 func main() {
+  log.AddHook(logRecorder{})
   log.AddFlags(kingpin.CommandLine)
   kingpin.Version(version.Print("homeplug_exporter"))
   kingpin.HelpFlag.Short('h')
-  kingpin.Parse()
+  command := kingpin.Parse()
+
+  if err := configure_component_logs(kingpin.CommandLine.GetFlag("log.level").Model().Value.String(), *logComponentLevels); err != nil {
+    mainLog.Fatalf("invalid --log.component-level: %v", err)
+  }
+  // The first --interface is the one the API, the outputs and /probe serve;
+  // the others are polled alongside it.
+  interfaceName := ""
+  if len(*interfaceNames) > 0 {
+    interfaceName = (*interfaceNames)[0]
+  }
+
+  // The injector is run by --transport=ssh on the remote host, where its
+  // stderr is logged.
+  if command == injectCmd.FullCommand() {
+    iface, err := get_interface_or_default(interfaceName)
+    if err != nil {
+      mainLog.Fatalf("failed to get interface: %v", err)
+    }
+    os.Exit(run_inject(iface, os.Stdin))
+  }
+
+  mainLog.Infof("Starting homeplug_exporter %s", version.Info())
+  mainLog.Infof("Build context %s", version.BuildContext())
+
+  go logDedup.Run(*logDedupInterval)
+  strictDecoding = *decodeStrict
+  cacheMaxEntries = *cacheMax
+
+  cfg, err := LoadConfig(*configFile)
+  if err != nil {
+    mainLog.Fatalf("failed to load config: %v", err)
+  }
+
+  var iface *net.Interface
+  var replayFile string
+  var ssh *SSHOptions
+  if *transportKind != "raw" && (*passive || *probeBridged || *resolveHosts || len(cfg.probeInterfaces()) > 0 || len(*interfaceNames) > 1) {
+    mainLog.Fatalf("--passive, --probe.bridged-hosts, --probe.host-names, probe.interfaces, the interfaces of targets and more than one --interface need a local interface, not --transport=%s", *transportKind)
+  }
+  switch *transportKind {
+  case "pcap-replay":
+    if *pcapFile == "" {
+      mainLog.Fatalf("--transport=pcap-replay needs --pcap.file")
+    }
+    iface, replayFile = replayInterface, *pcapFile
+  case "ssh":
+    if *sshDestination == "" || interfaceName == "" {
+      mainLog.Fatalf("--transport=ssh needs --ssh.destination and the --interface on it")
+    }
+    ssh = &SSHOptions{
+      Command:     *sshCommand,
+      Args:        *sshArgs,
+      Destination: *sshDestination,
+      Interface:   interfaceName,
+      Tcpdump:     *sshTcpdump,
+      Injector:    *sshInjector,
+    }
+  }
+
+  if buildDefaults.checkCapabilities && *transportKind == "raw" {
+    if err := check_capabilities(); err != nil {
+      mainLog.Fatalf("insufficient privileges: %v", err)
+    }
+  }
+
+  auth, err := NewAuthenticator(cfg.Auth)
+  if err != nil {
+    mainLog.Fatalf("invalid auth config: %v", err)
+  }
+
+  etherTypes := parse_ethertypes(*etherTypeNames)
+  transportOpts := TransportOptions{
+    VLANID:          *vlanID,
+    VLANPriority:    *vlanPriority,
+    SocketPriority:  *socketPriority,
+    SourceAddresses: cfg.sourceAddresses(),
+    ReplayFile:      replayFile,
+    SSH:             ssh,
+    EtherTypes:      etherTypes,
+  }
+  // Until the transport is open, a server of the exporter's own, serving
+  // homeplug_up as 0, takes the place of the exporter's.
+  var startupMetrics http.Handler
+  if command == serveCmd.FullCommand() && *textfileDir == "" && *supportBundle == "" {
+    startupMetrics = auth.Wrap(scopeMetrics, startup_metrics_handler(cfg))
+  }
+  register_collector("exporter", exporterUp)
+  var transport *Transport
+  err = open_with_retry(*interfaceWait, startupMetrics, func() error {
+    var err error
+    switch *transportKind {
+    case "ssh":
+      if iface, err = ssh_interface(*ssh); err != nil {
+        return fmt.Errorf("failed to reach %s: %v", *sshDestination, err)
+      }
+    case "raw":
+      if iface, err = get_interface_or_default(interfaceName); err != nil {
+        return fmt.Errorf("failed to get interface: %v", err)
+      }
+      // A socket can be opened on an interface that is down, but no frame
+      // would get through it.
+      if *interfaceWait > 0 && iface.Flags & net.FlagUp == 0 {
+        return fmt.Errorf("interface %s is down", iface.Name)
+      }
+    }
+    if transport, err = NewTransport(iface, transportOpts); err != nil {
+      return fmt.Errorf("failed to listen: %v", err)
+    }
+    return nil
+  })
+  if err != nil {
+    mainLog.Fatalf("%v", err)
+  }
+  serve_transport(transport)
+  if *transportKind == "raw" {
+    if err := check_raw_interface(iface); err != nil {
+      mainLog.Fatalf("%v", err)
+    }
+  }
 
-  log.Infoln("Starting homeplug_exporter", version.Info())
-  log.Infoln("Build context", version.BuildContext())
+  dests, err := parse_destinations(*destAddresses)
+  if err != nil {
+    mainLog.Fatalf("invalid --destaddr: %v", err)
+  }
+  if localAliases, err = parse_destinations(*aliasAddresses); err != nil {
+    mainLog.Fatalf("invalid --local-alias: %v", err)
+  }
 
-  iface, err := get_interface_or_default(*interfaceName)
+  families, err := get_protocol_families(*protocols)
   if err != nil {
-    log.Fatalf("failed to get interface: %v", err)
+    mainLog.Fatalf("invalid protocol: %v", err)
+  }
+  if cfg.Links.SaturatedRate == rateExtended {
+    families = extended_rate_families(families)
   }
 
-  conn, err := raw.ListenPacket(iface, etherType, nil)
+  reloader := NewConfigReloader(*configFile, cfg)
+  // configure_poller applies the settings of cfg that a reload can change.
+  configure_poller := func(poller *Poller, cfg *Config) {
+    poller.SetCollectSchedules(*collectSchedule)
+    poller.SetCollectLinkStats(*collectLinkStats)
+    poller.SetCollectFirmware(*collectFirmware)
+    poller.SetCollectToneMaps(*collectToneMaps)
+    poller.SetCollectDiscoverList(*collectDiscover)
+    poller.SetPipeline(*collectPipeline)
+    poller.SetCollectorSchedules(cfg.collectorSchedules())
+    poller.SetPhases(cfg.phases())
+    poller.SetVendors(cfg.vendors())
+    poller.SetDeviceTypes(cfg.deviceTypes())
+    poller.SetReplyFilter(cfg.replyFilter())
+  }
+  // new_poller sets up a poller on transport, for the interface given by
+  // the flags or one that /probe is asked for.
+  new_poller := func(transport *Transport) (*Poller, error) {
+    poller := NewPoller(transport, dests, families)
+    configure_poller(poller, reloader.Config())
+    poller.SetBurstOptions(*burstInterval, *burstMaxDuration)
+    poller.SetQuarantine(*quarantineThreshold, *quarantineReprobe)
+    if *probeBridged {
+      prober, err := NewARPProber(transport.iface)
+      if err != nil {
+        return nil, fmt.Errorf("failed to probe bridged hosts: %v", err)
+      }
+      poller.SetProber(prober)
+    }
+    if *resolveHosts {
+      poller.SetResolver(NewHostResolver(transport.iface))
+    }
+    return poller, nil
+  }
+  poller, err := new_poller(transport)
   if err != nil {
-    log.Fatalf("failed to listen: %v", err)
+    mainLog.Fatalf("%v", err)
+  }
+  if cfg.Synthetic != nil {
+    poller.SetSyntheticTarget(new_synthetic_target(*cfg.Synthetic))
+  }
+  probePollers := new_probe_interfaces(poller, cfg.probeInterfaces(), func(iface *net.Interface) (*Poller, error) {
+    transport, err := NewTransport(iface, transportOpts)
+    if err != nil {
+      return nil, err
+    }
+    return new_poller(transport)
+  })
+  apiURL := *commandAPIURL
+  if apiURL == "" {
+    apiURL = command_api_url(*listeningAddress)
+  }
+  switch command {
+  case ratesCmd.FullCommand():
+    os.Exit(run_rates(command_poll(poller, apiURL, *commandToken), *minMbps, os.Stdout))
+  case checkCmd.FullCommand():
+    var expected []net.HardwareAddr
+    for _, e := range *checkExpect {
+      address, err := net.ParseMAC(e)
+      if err != nil {
+        fmt.Printf("HOMEPLUG UNKNOWN - invalid --expect: %v\n", err)
+        os.Exit(nagiosUnknown)
+      }
+      expected = append(expected, address)
+    }
+    os.Exit(run_check(command_poll(poller, apiURL, *commandToken), *checkWarnMbps, *checkCritMbps, expected, os.Stdout))
+  }
+  // new_exporter sets up the Prometheus output of a poller. With more than
+  // one --interface, its metrics are labeled with the poller's.
+  new_exporter := func(poller *Poller) *Exporter {
+    var labels prometheus.Labels
+    if len(*interfaceNames) > 1 {
+      labels = prometheus.Labels{"interface": poller.transport.iface.Name}
+    }
+    exporter := NewExporter(poller, *pollInterval > 0, cfg.Links.Mode, labels)
+    exporter.SetMetricRules(cfg.metricRules())
+    exporter.SetRawValues(*rawValues)
+    exporter.SetRateHandling(cfg.Links.SaturatedRate, cfg.Links.UnknownRate)
+    exporter.SetToneMapPerCarrier(*toneMapsPerCarrier)
+    if *linkStatsMinChange > 0 {
+      exporter.SetLinkStatsMinChange(*linkStatsMinChange, *linkStatsRefresh)
+    }
+    if *carrierMinChange > 0 {
+      exporter.SetToneMapMinChange(*carrierMinChange, *linkStatsRefresh)
+    }
+    return exporter
+  }
+  exporter := new_exporter(poller)
+  // Each --interface after the first is a segment of its own, with a
+  // transport, poller and exporter of its own, polled concurrently with the
+  // first. Only the server polls them, and only their exporters, the API
+  // and /probe serve them.
+  var segments []*Exporter
+  interfaces := []string{iface.Name}
+  if len(*interfaceNames) > 1 && (command != serveCmd.FullCommand() || *textfileDir != "" || *supportBundle != "") {
+    mainLog.Warnf("Only the first --interface, %s, is polled outside of the server", iface.Name)
+  } else if len(*interfaceNames) > 1 {
+    for _, name := range (*interfaceNames)[1:] {
+      segmentIface, err := get_interface_or_default(name)
+      if err != nil {
+        mainLog.Fatalf("failed to get interface: %v", err)
+      }
+      for _, seen := range interfaces {
+        if seen == segmentIface.Name {
+          mainLog.Fatalf("interface %s is given more than once", seen)
+        }
+      }
+      if err := check_raw_interface(segmentIface); err != nil {
+        mainLog.Fatalf("%v", err)
+      }
+      transport, err := NewTransport(segmentIface, transportOpts)
+      if err != nil {
+        mainLog.Fatalf("failed to listen on %s: %v", segmentIface.Name, err)
+      }
+      serve_transport(transport)
+      segment, err := new_poller(transport)
+      if err != nil {
+        mainLog.Fatalf("%v", err)
+      }
+      segmentExporter := new_exporter(segment)
+      segment.AddOutput(segmentExporter)
+      register_collector("exporter", segmentExporter)
+      probePollers.AddSegment(segment)
+      segments = append(segments, segmentExporter)
+      interfaces = append(interfaces, segmentIface.Name)
+    }
+  }
+  reloader.OnReload(func(cfg *Config) error {
+    if *transportKind != "raw" && len(cfg.probeInterfaces()) > 0 {
+      return fmt.Errorf("probe.interfaces and the interfaces of targets need a local interface, not --transport=%s", *transportKind)
+    }
+    return auth.Reload(cfg.Auth)
+  })
+  reloader.OnReload(func(cfg *Config) error {
+    exporter.SetMetricRules(cfg.metricRules())
+    probePollers.SetAllowed(cfg.probeInterfaces())
+    for _, p := range probePollers.Pollers() {
+      configure_poller(p, cfg)
+    }
+    for _, e := range segments {
+      e.SetMetricRules(cfg.metricRules())
+      configure_poller(e.poller, cfg)
+    }
+    return nil
+  })
+  go reloader.Run()
+  poller.AddOutput(exporter)
+  api := NewAPI(poller, *pollInterval > 0)
+  poller.AddOutput(api)
+  for _, e := range segments {
+    segmentAPI := NewAPI(e.poller, *pollInterval > 0)
+    e.poller.AddOutput(segmentAPI)
+    api.AddSegment(e.poller.transport.iface.Name, segmentAPI)
+  }
+  // firstOnly are the outputs that could only serve the first interface.
+  var firstOnly []string
+  if *jsonFile != "" {
+    poller.AddOutput(NewJSONFileOutput(*jsonFile))
+    firstOnly = append(firstOnly, "--output.json-file")
+  }
+  gatherers := prometheus.Gatherers{prometheus.DefaultGatherer}
+  if len(cfg.Exec) > 0 {
+    execs := NewExecCollector(cfg.Exec)
+    poller.AddOutput(execs)
+    gatherers = append(gatherers, execs)
+    describe_collector("exec", execResultCollector{})
+    firstOnly = append(firstOnly, "exec")
+  }
+  if *historyRetention > 0 {
+    history := NewHistoryOutput(*historyRetention)
+    if *historyFile != "" {
+      if err := history.Load(*historyFile); err != nil {
+        mainLog.Warnf("failed to load history, starting afresh: %v", err)
+      }
+      go history.Persist(*historyFile, int64(*historyFileSize), *historySave)
+      on_exit(func() {
+        if err := history.Save(*historyFile, int64(*historyFileSize)); err != nil {
+          mainLog.Errorf("failed to save history to %s: %v", *historyFile, err)
+        }
+      })
+    }
+    poller.AddOutput(history)
+    register_collector("history", history)
+    firstOnly = append(firstOnly, "--history.retention")
+  }
+  if cfg.SNMP != nil {
+    agent, err := NewSNMPAgent(*cfg.SNMP)
+    if err != nil {
+      mainLog.Fatalf("failed to start SNMP agent: %v", err)
+    }
+    if *pollInterval <= 0 {
+      mainLog.Warnf("The SNMP agent only serves polled data, but --poll.interval is 0")
+    }
+    poller.AddOutput(agent)
+    go agent.Run()
+    firstOnly = append(firstOnly, "snmp")
+  }
+  if cfg.EventLog != nil {
+    poller.AddOutput(NewEventLogOutput(*cfg.EventLog))
+    firstOnly = append(firstOnly, "event_log")
+  }
+  if len(cfg.Webhooks) > 0 {
+    firstOnly = append(firstOnly, "webhooks")
+  }
+  if len(cfg.RemoteWrite) > 0 {
+    firstOnly = append(firstOnly, "remote_write")
+  }
+  if len(cfg.Zabbix) > 0 {
+    firstOnly = append(firstOnly, "zabbix")
+  }
+  if len(cfg.MQTT) > 0 {
+    firstOnly = append(firstOnly, "mqtt")
+  }
+  if len(segments) > 0 && len(firstOnly) > 0 {
+    mainLog.Fatalf("%s can only serve one segment, not those of every --interface", strings.Join(firstOnly, ", "))
+  }
+  for _, wh := range cfg.Webhooks {
+    client, err := new_http_client(cfg.clientConfig(wh.HTTPClient), "webhook", wh.URL)
+    if err != nil {
+      mainLog.Fatalf("failed to create webhook client for %s: %v", wh.URL, err)
+    }
+    o, err := NewWebhookOutput(wh, client)
+    if err != nil {
+      mainLog.Fatalf("invalid webhook for %s: %v", wh.URL, err)
+    }
+    poller.AddOutput(o)
+  }
+  for _, rw := range cfg.RemoteWrite {
+    client, err := new_http_client(cfg.clientConfig(rw.HTTPClient), "remote_write", rw.URL)
+    if err != nil {
+      mainLog.Fatalf("failed to create remote_write client for %s: %v", rw.URL, err)
+    }
+    poller.AddOutput(NewRemoteWriteOutput(exporter, rw, client))
+  }
+  for _, z := range cfg.Zabbix {
+    o, err := NewZabbixOutput(exporter, z)
+    if err != nil {
+      mainLog.Fatalf("invalid zabbix output for %s: %v", z.Server, err)
+    }
+    poller.AddOutput(o)
+  }
+  for _, m := range cfg.MQTT {
+    o, err := NewMQTTOutput(m)
+    if err != nil {
+      mainLog.Fatalf("invalid mqtt output for %s: %v", m.Broker, err)
+    }
+    poller.AddOutput(o)
+    on_exit(o.Close)
+  }
+  if *supportBundle != "" {
+    if err := write_support_bundle_file(*supportBundle, poller); err != nil {
+      mainLog.Fatalf("failed to write support bundle: %v", err)
+    }
+    mainLog.Infof("Wrote support bundle to %s", *supportBundle)
+    return
   }
 
-  dest := net.HardwareAddr((*destAddress)[0:6])
+  if *textfileDir != "" {
+    run_textfile(poller, NewTextfileOutput(exporter, *textfileDir))
+    return
+  }
 
-  exporter := NewExporter(iface, conn, dest)
-  prometheus.MustRegister(exporter)
-  prometheus.MustRegister(version.NewCollector("homeplug_exporter"))
+  if *pollInterval > 0 {
+    mainLog.Infof("Polling in the background every %s", *pollInterval)
+  }
+  // Without a poll interval, the background poller only polls during bursts.
+  go poller.Run(*pollInterval)
+  for _, e := range segments {
+    go e.poller.Run(*pollInterval)
+  }
+  if *versionCheck {
+    client, err := new_http_client(cfg.clientConfig(nil), "version_check", *versionCheckURL)
+    if err != nil {
+      mainLog.Fatalf("failed to create version check client: %v", err)
+    }
+    register_collector("version_check", updateAvailable)
+    go run_version_check(client, *versionCheckURL)
+  }
+  if *soak {
+    mainLog.Warnf("Soak testing: discovery every %s, queries every %s", *soakDiscovery, *soakQuery)
+    go run_soak(poller, *soakDiscovery, *soakQuery, *soakDuration, soakLimits{*soakGoroutines, uint64(*soakHeap)})
+  }
+  register_collector("exporter", exporter)
+  register_collector("version", version.NewCollector("homeplug_exporter"))
+  register_collector("transport", framesReceived)
+  register_collector("decoder", decodeAnomalies)
+  register_collector("decoder", decodedConfirms)
+  register_collector("poller", foreignReplies)
+  register_collector("poller", pollerConflict)
+  register_collector("poller", mmeRetransmissions)
+  register_collector("transport", transportState)
+  register_collector("transport", transportEchoes)
+  register_collector("transport", transportFragments)
+  register_collector("transport", queryTruncated)
+  register_collector("cache", cacheEntries)
+  register_collector("cache", cacheEvictions)
+  if *transportKind == "raw" {
+    register_collector("transport", new_interface_collector(interfaces))
+  }
+  register_collector("poller", collectorDegraded)
+  register_collector("poller", collectorNextRun)
+  register_collector("poller", pollerBurst)
+  register_collector("poller", stationQuarantined)
+  register_collector("logging", logSuppressed)
+  register_collector("config", configReloadSuccess)
+  register_collector("config", configReloadTime)
+  describe_collector("probe", probeCollector{})
+  // The Go and process collectors are registered by the client library.
+  describe_collector("go", prometheus.NewGoCollector())
+  describe_collector("process", prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+  if *passive {
+    listener, err := NewPassiveListener(iface, *passiveReaders, etherTypes)
+    if err != nil {
+      mainLog.Fatalf("failed to listen passively: %v", err)
+    }
+    listener.Run()
+    register_collector("passive", listener)
+  }
 
-  log.Infof("Collecting from MAC address %s via interface %s", dest.String(), iface.Name)
-  log.Infof("Starting Server: %s", *listeningAddress)
+  mainLog.Infof("Collecting from MAC address %s via interface %s", join_addresses(dests), strings.Join(interfaces, ", "))
+  mainLog.Infof("Starting Server: %s", *listeningAddress)
 
-  http.Handle(*metricsEndpoint, promhttp.Handler())
+  apiMux := http.NewServeMux()
+  api.Register(apiMux)
+  metrics := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+    metrics_handler(exporter.Gatherer(gatherers), metricsOptions{
+      OpenMetrics:         *openMetrics,
+      DisableCompression:  *disableGzip,
+      MaxRequestsInFlight: *maxScrapes,
+    }))
+  http.Handle(*metricsEndpoint, auth.Wrap(scopeMetrics, metrics))
+  http.Handle("/api/", auth.Wrap(scopeAPI, apiMux))
+  http.Handle(apiQueryPath, auth.Wrap(scopeProbe, apiMux))
+  http.Handle(apiBurstPath, auth.Wrap(scopeAdmin, apiMux))
+  http.Handle("/probe", auth.Wrap(scopeProbe, probe_handler(exporter, probePollers, reloader.Config)))
+  http.Handle(examplePrometheusPath, auth.Wrap(scopeAPI, prometheus_example_handler(exporter, reloader.Config, auth)))
+  http.Handle(reloadPath, auth.Wrap(scopeAdmin, reloader.Handler()))
+  http.Handle("/debug/support-bundle", auth.Wrap(scopeAdmin, support_bundle_handler(api)))
+  if *pibDump {
+    http.Handle("/debug/pib", auth.Wrap(scopeAdmin, pib_dump_handler(poller)))
+  }
   http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
     _, _ = w.Write([]byte(`<html>
              <head><title>Homeplug Exporter</title></head>
              <body>
              <h1>Homeplug Exporter</h1>
              <p><a href='` + *metricsEndpoint + `'>Metrics</a></p>
+             <p><a href='/api/` + apiVersion + `/topology'>Topology</a></p>
+             <p><a href='` + examplePrometheusPath + `'>Example Prometheus configuration</a></p>
              </body>
              </html>`))
   })
-  log.Fatal(http.ListenAndServe(*listeningAddress, nil))
+  var handler http.Handler = http.DefaultServeMux
+  if *accessLogPath != "" {
+    accessLog, err := open_access_log(*accessLogPath, *accessLogFormat)
+    if err != nil {
+      mainLog.Fatalf("failed to open access log: %v", err)
+    }
+    handler = accessLog.Wrap(handler)
+  }
+  mainLog.Fatalf("%v", http.ListenAndServe(*listeningAddress, handler))
+}
+
+// run_textfile polls the devices and publishes to the textfile output until
+// the process is told to stop, then removes the file.
+func run_textfile(poller *Poller, o *TextfileOutput) {
+  interval := *pollInterval
+  if interval == 0 {
+    interval = time.Minute
+  }
+  poller.AddOutput(o)
+  mainLog.Infof("Writing %s every %s", o.path, interval)
+  go poller.Run(interval)
+
+  on_exit(func() {
+    if err := o.Remove(); err != nil {
+      mainLog.Errorf("failed to remove %s: %v", o.path, err)
+    }
+  })
+  select {}
+}
+
+var (
+  exitMutex sync.Mutex
+  exitHooks []func()
+)
+
+// on_exit runs f when the process is told to stop, before it exits. Once a
+// function has been given, interrupts and SIGTERM no longer kill the process
+// outright.
+func on_exit(f func()) {
+  exitMutex.Lock()
+  defer exitMutex.Unlock()
+  if exitHooks == nil {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+    go func() {
+      <-sig
+      exitMutex.Lock()
+      for _, hook := range exitHooks {
+        hook()
+      }
+      os.Exit(0)
+    }()
+  }
+  exitHooks = append(exitHooks, f)
 }
 
-func get_homeplug_netinfo(iface *net.Interface, conn *raw.Conn, dest net.HardwareAddr) ([]HomeplugNetworkInfo, error) {
-  ni := make([]HomeplugNetworkInfo, 0)
-  ch := make(chan HomeplugFrame, 1)
-  go read_homeplug(iface, conn, ch)
+// queryTimeout is how long to wait for more replies by default.
+const queryTimeout = time.Second
 
-  err := write_homeplug(iface, conn, dest)
-  if err != nil{
-    return nil, fmt.Errorf("write_homeplug failed: %v", err)
+// Request sends each of the request frames to dest, and returns every frame
+// received until no more have arrived for timeout, or until complete, if
+// given, reports that everything expected has arrived. If ctx is done first,
+// the frames received so far are returned with its error. The time from the
+// last request being sent to the first confirm of each station is recorded
+// as its round trip.
+func (t *Transport) Request(ctx context.Context, dest net.HardwareAddr, requests []homeplug.Frame, timeout time.Duration, complete func([]homeplug.Message) bool) ([]homeplug.Message, error) {
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  if err := t.Ready(); err != nil {
+    return nil, err
   }
+  msgs := make([]homeplug.Message, 0)
+  ch := make(chan homeplug.Message, 1)
+  done := make(chan struct{})
+  go read_homeplug(t, ch, done, timeout)
+  // Stop the reader and wait for it to exit, so that it cannot take replies
+  // meant for the next query.
+  defer func() {
+    close(done)
+    t.conn.SetReadDeadline(time.Now())
+    for range ch {
+    }
+  }()
+
+  for i := range requests {
+    err := write_homeplug(t, dest, &requests[i])
+    if err != nil{
+      return nil, fmt.Errorf("write_homeplug failed: %v", err)
+    }
+  }
+  sent := time.Now()
+  answered := map[string]bool{}
 
 ChanLoop:
   for {
     select {
-    case h := <-ch:
-      if h.MMEType == nwInfoCnf {
-        var n HomeplugNetworkInfo
-        err := (&n).UnmarshalBinary(h.Payload)
-        if err != nil{
-          log.Errorf("failed to unmarshal network info frame: %v", err)
-        } else {
-          ni = append(ni, n)
-        }
-      } else {
-        log.Errorf("got unhandled mmetype: %v", h.MMEType)
+    case m, ok := <-ch:
+      if !ok {
+        break ChanLoop
+      }
+      if m.Legacy == nil && m.Frame.Type() & 0x03 == 0x01 && !answered[m.Source.String()] {
+        answered[m.Source.String()] = true
+        t.roundTrip(m.Source, time.Since(sent))
       }
-    case <- time.After(time.Second):
+      msgs = append(msgs, m)
+      if complete != nil && complete(msgs) {
+        break ChanLoop
+      }
+      if cacheMaxEntries > 0 && len(msgs) >= cacheMaxEntries {
+        logDedup.Errorf(transportLog, "truncated", "stopped waiting for replies from %v after %d frames", dest, len(msgs))
+        queryTruncated.Inc()
+        break ChanLoop
+      }
+    case <- time.After(timeout):
       break ChanLoop
+    case <- ctx.Done():
+      return msgs, ctx.Err()
     }
   }
 
-  return ni, nil
-}
-
-func write_homeplug(iface *net.Interface, conn *raw.Conn, dest net.HardwareAddr) error {
-  h := &HomeplugFrame{
-    Version: hpVersion,
-    MMEType: nwInfoReq,
-    Vendor:  hpVendor,
+  cacheEntries.WithLabelValues("replies").Set(float64(len(msgs)))
+  if state := t.State(); state != transportUp {
+    return nil, fmt.Errorf("transport is %s", transportStates[state])
   }
+  return msgs, nil
+}
 
+func write_homeplug(t *Transport, dest net.HardwareAddr, h *homeplug.Frame) error {
   b, err := h.MarshalBinary()
   if err != nil {
     return fmt.Errorf("failed to marshal homeplug frame: %v", err)
@@ -319,8 +1499,9 @@ func write_homeplug(iface *net.Interface, conn *raw.Conn, dest net.HardwareAddr)
 
   f := &ethernet.Frame{
     Destination: dest,
-    Source:      iface.HardwareAddr,
-    EtherType:   etherType,
+    Source:      t.source(dest),
+    VLAN:        t.vlan,
+    EtherType:   homeplug.EtherType,
     Payload:     b,
   }
 
@@ -333,46 +1514,150 @@ func write_homeplug(iface *net.Interface, conn *raw.Conn, dest net.HardwareAddr)
     return fmt.Errorf("failed to marshal ethernet frame: %v", err)
   }
 
-  _, err = conn.WriteTo(b, a)
+  record_frame("tx", b)
+  _, err = t.writer.WriteTo(b, a)
   if err != nil {
+    t.fail(err)
     return fmt.Errorf("failed to send message: %v", err)
   }
 
   return nil
 }
 
-func read_homeplug(iface *net.Interface, conn *raw.Conn, ch chan<- HomeplugFrame) {
-    b := make([]byte, iface.MTU)
+func read_homeplug(t *Transport, ch chan<- homeplug.Message, done <-chan struct{}, timeout time.Duration) {
+    defer close(ch)
+    b := make([]byte, frame_size(t.iface, t.vlan != nil))
+    fragments := homeplug.Reassembler{Max: cacheMaxEntries}
 
     for {
-      conn.SetReadDeadline(time.Now().Add(time.Second))
-      n, addr, err := conn.ReadFrom(b)
+      select {
+      case <-done:
+        return
+      default:
+      }
+      t.conn.SetReadDeadline(time.Now().Add(timeout))
+      n, addr, err := t.conn.ReadFrom(b)
       if err != nil {
-        log.Debugf("failed to receive message: %v", err)
-        break
+        if t.fail(err) {
+          transportLog.Debugf("failed to receive message: %v", err)
+        }
+        return
       }
+      record_frame("rx", b[:n])
 
       var f ethernet.Frame
       err = (&f).UnmarshalBinary(b[:n])
       if err != nil {
-        log.Errorf("failed to unmarshal ethernet frame: %v", err)
+        logDedup.Errorf(transportLog, "unmarshal_ethernet", "failed to unmarshal ethernet frame: %v", err)
+        continue
+      }
+
+      if f.EtherType == homeplug.LegacyEtherType {
+        var l homeplug.LegacyFrame
+        if err := (&l).UnmarshalBinary(f.Payload); err != nil {
+          logDedup.Errorf(transportLog, "unmarshal_legacy", "failed to unmarshal HomePlug 1.0 frame: %v", err)
+          continue
+        }
+        for _, e := range l.Entries {
+          framesReceived.WithLabelValues(t.iface.Name, "", fmt.Sprintf("%02x", e.Type)).Inc()
+        }
+        select {
+        case ch <- homeplug.Message{
+          Source: append(net.HardwareAddr(nil), f.Source...),
+          Legacy: &l,
+        }:
+        case <-done:
+          return
+        }
         continue
       }
 
-      var h HomeplugFrame
+      var h homeplug.Frame
       err = (&h).UnmarshalBinary(f.Payload)
       if err != nil {
-        log.Errorf("failed to unmarshal homeplug frame: %v", err)
+        logDedup.Errorf(transportLog, "unmarshal_homeplug", "failed to unmarshal homeplug frame: %v", err)
+        continue
+      }
+      if t.own(f.Source) {
+        transportEchoes.WithLabelValues(t.iface.Name, fmt.Sprintf("%04x", h.Type())).Inc()
+        logDedup.Errorf(transportLog, "echo", "received our own %04x frame back from %v on %s; the interface may be bridged in a loop, or an adapter echoes frames", h.Type(), f.Source, t.iface.Name)
         continue
       }
 
-      log.Debugf("[%v] %+v", addr, h)
-      ch <- h
+      // Frames are only logged once per source and type each interval, as
+      // their contents differ even when nothing of interest has changed.
+      logDedup.limit(transportLog.Debugf, "frame", fmt.Sprintf("%v\x00%04x", addr, h.Type()), fmt.Sprintf("[%v] %+v", addr, h))
+      oui := ""
+      if h.IsVendorSpecific() {
+        oui = hex.EncodeToString(h.Vendor[:])
+      }
+      framesReceived.WithLabelValues(t.iface.Name, oui, fmt.Sprintf("%04x", h.Type())).Inc()
+      // Fragments are held back until the last of their MME arrives, and
+      // only the whole MME is passed on.
+      m, whole, err := fragments.Add(homeplug.Message{
+        Source: append(net.HardwareAddr(nil), f.Source...),
+        Frame:  h,
+      })
+      if err != nil {
+        transportFragments.WithLabelValues(t.iface.Name, "discarded").Inc()
+        logDedup.Errorf(transportLog, "fragment", "discarded fragment: %v", err)
+        continue
+      }
+      if !whole {
+        continue
+      }
+      if h.IsFragment() {
+        count, _, _ := h.Fragments()
+        transportFragments.WithLabelValues(t.iface.Name, "reassembled").Add(float64(count))
+      }
+      select {
+      case ch <- m:
+      case <-done:
+        return
+      }
     }
   }
 
+// parse_destinations converts the addresses given by --destaddr or
+// --local-alias, each written as six bytes in hex, separated by colons or
+// hyphens or not at all, and several of which may be given as a
+// comma-separated list. Repeats are left out.
+func parse_destinations(values []string) ([]net.HardwareAddr, error) {
+  var dests []net.HardwareAddr
+  seen := map[string]bool{}
+  for _, value := range values {
+    for _, s := range strings.Split(value, ",") {
+      b, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(strings.TrimSpace(s)))
+      if err != nil || len(b) != 6 {
+        return nil, fmt.Errorf("invalid MAC address %q", s)
+      }
+      dest := net.HardwareAddr(b)
+      if seen[dest.String()] {
+        continue
+      }
+      seen[dest.String()] = true
+      dests = append(dests, dest)
+    }
+  }
+  return dests, nil
+}
+
+// join_addresses returns the string forms of addrs, separated by commas.
+func join_addresses(addrs []net.HardwareAddr) string {
+  s := make([]string, len(addrs))
+  for i, a := range addrs {
+    s[i] = a.String()
+  }
+  return strings.Join(s, ", ")
+}
+
 func get_interface_or_default(name string) (*net.Interface, error) {
-  if *interfaceName == "" {
+  if name == "" {
+    for _, name := range buildDefaults.interfaces {
+      if iface, err := net.InterfaceByName(name); err == nil && iface.Flags & net.FlagUp != 0 {
+        return iface, nil
+      }
+    }
     ifaces, err := net.Interfaces()
     if err != nil {
       return nil, err
@@ -386,8 +1671,10 @@ func get_interface_or_default(name string) (*net.Interface, error) {
       }
       return &iface, nil
     }
+  } else if name == autoMacvlan {
+    return find_macvlan_interface()
   } else {
-    iface, err := net.InterfaceByName(*interfaceName)
+    iface, err := net.InterfaceByName(name)
     if err != nil {
       return nil, err
     }
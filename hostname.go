@@ -0,0 +1,242 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "errors"
+  "context"
+  "strings"
+  "math/rand"
+  "encoding/binary"
+)
+
+const (
+  mdnsPort    = 5353
+  dnsTypePTR  = 12
+  dnsClassIN  = 1
+  // hostNameTTL is how long a name, or the lack of one, is remembered, so
+  // that each poll does not query every host again.
+  hostNameTTL = 10 * time.Minute
+)
+
+// HostResolver names the hosts bridged behind each adapter. Each host's IPv4
+// address is looked up by its MAC address in the kernel's neighbour table,
+// as for ARPProber, and its name by asking the host itself over mDNS for the
+// PTR record of the address, falling back to a reverse lookup with the
+// system resolver, which on a router usually knows the names its DHCP
+// clients gave.
+type HostResolver struct {
+  iface   *net.Interface
+  timeout time.Duration
+
+  mutex sync.Mutex
+  names map[string]hostName
+  lru   lruIndex
+}
+
+// hostName is a name looked up for an address, empty if there was none.
+type hostName struct {
+  name    string
+  expires time.Time
+}
+
+func NewHostResolver(iface *net.Interface) *HostResolver {
+  return &HostResolver{
+    iface:   iface,
+    timeout: time.Second,
+    names:   map[string]hostName{},
+    lru:     lruIndex{cache: "host_names"},
+  }
+}
+
+// ResolveSnapshot sets the name of the bridged host of every station in the
+// snapshot that has one in the neighbour table, and a name.
+func (r *HostResolver) ResolveSnapshot(ctx context.Context, s *Snapshot) error {
+  neighbours, err := read_arp_table(arpTable, r.iface.Name)
+  if err != nil {
+    return err
+  }
+
+  var wg sync.WaitGroup
+  for i := range s.Stations {
+    station := &s.Stations[i]
+    if station.BridgedAddress == nil {
+      continue
+    }
+    ip, ok := neighbours[station.BridgedAddress.String()]
+    if !ok {
+      continue
+    }
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      station.BridgedHostName = r.lookup(ctx, ip)
+    }()
+  }
+  wg.Wait()
+  return nil
+}
+
+// lookup returns the name of ip, from the cache if it has not expired.
+func (r *HostResolver) lookup(ctx context.Context, ip net.IP) string {
+  key := ip.String()
+  r.mutex.Lock()
+  cached, ok := r.names[key]
+  r.mutex.Unlock()
+  if ok && time.Now().Before(cached.expires) {
+    return cached.name
+  }
+
+  name, err := query_mdns_ptr(ctx, ip, r.timeout)
+  if err != nil {
+    transportLog.Debugf("no mDNS name for %v: %v", ip, err)
+    ctx, cancel := context.WithTimeout(ctx, r.timeout)
+    names, err := net.DefaultResolver.LookupAddr(ctx, key)
+    cancel()
+    if err != nil {
+      transportLog.Debugf("no DNS name for %v: %v", ip, err)
+    } else if len(names) > 0 {
+      name = names[0]
+    }
+  }
+  name = strings.TrimSuffix(name, ".")
+
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  r.names[key] = hostName{name: name, expires: time.Now().Add(hostNameTTL)}
+  if evicted, ok := r.lru.touch(key); ok {
+    delete(r.names, evicted)
+  }
+  return name
+}
+
+// query_mdns_ptr asks the mDNS responder at ip for the name of ip. The query
+// is sent to the host rather than the multicast group, from an ephemeral
+// port, which responders answer directly, so that the answer can only come
+// from the host itself.
+func query_mdns_ptr(ctx context.Context, ip net.IP, timeout time.Duration) (string, error) {
+  ip4 := ip.To4()
+  if ip4 == nil {
+    return "", fmt.Errorf("%v is not an IPv4 address", ip)
+  }
+  qname := fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+
+  conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip4, Port: mdnsPort})
+  if err != nil {
+    return "", err
+  }
+  defer conn.Close()
+  deadline := time.Now().Add(timeout)
+  if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+    deadline = d
+  }
+  conn.SetDeadline(deadline)
+
+  id := uint16(rand.Intn(0x10000))
+  if _, err := conn.Write(dns_ptr_query(id, qname)); err != nil {
+    return "", err
+  }
+  b := make([]byte, 9000)
+  for {
+    n, err := conn.Read(b)
+    if err != nil {
+      return "", err
+    }
+    if name, ok := dns_ptr_answer(b[:n], qname); ok {
+      return name, nil
+    }
+  }
+}
+
+// dns_ptr_query returns a DNS query for the PTR record of qname.
+func dns_ptr_query(id uint16, qname string) []byte {
+  b := make([]byte, 12)
+  binary.BigEndian.PutUint16(b[0:], id)
+  binary.BigEndian.PutUint16(b[4:], 1)
+  for _, label := range strings.Split(strings.TrimSuffix(qname, "."), ".") {
+    b = append(b, byte(len(label)))
+    b = append(b, label...)
+  }
+  b = append(b, 0, 0, dnsTypePTR, 0, dnsClassIN)
+  return b
+}
+
+// dns_ptr_answer returns the name in the first PTR record for qname among
+// the answers of the DNS response in b.
+func dns_ptr_answer(b []byte, qname string) (string, bool) {
+  if len(b) < 12 || b[2] & 0x80 == 0 {
+    return "", false
+  }
+  questions := binary.BigEndian.Uint16(b[4:])
+  answers := binary.BigEndian.Uint16(b[6:])
+  off := 12
+  for i := 0; i < int(questions); i++ {
+    var err error
+    if _, off, err = dns_name(b, off); err != nil || off + 4 > len(b) {
+      return "", false
+    }
+    off += 4
+  }
+  for i := 0; i < int(answers); i++ {
+    name, next, err := dns_name(b, off)
+    if err != nil || next + 10 > len(b) {
+      return "", false
+    }
+    rrType := binary.BigEndian.Uint16(b[next:])
+    // The top bit of the class is mDNS's cache flush bit.
+    rrClass := binary.BigEndian.Uint16(b[next + 2:]) & 0x7FFF
+    length := int(binary.BigEndian.Uint16(b[next + 8:]))
+    data := next + 10
+    if data + length > len(b) {
+      return "", false
+    }
+    if rrType == dnsTypePTR && rrClass == dnsClassIN && strings.EqualFold(name, qname) {
+      if target, _, err := dns_name(b, data); err == nil && target != "." {
+        return target, true
+      }
+    }
+    off = data + length
+  }
+  return "", false
+}
+
+// dns_name decodes the possibly compressed name at off in the DNS message
+// b, and returns it with the offset of what follows it.
+func dns_name(b []byte, off int) (string, int, error) {
+  var labels []string
+  next := -1
+  for jumps := 0; ; {
+    if off >= len(b) {
+      return "", 0, errors.New("truncated name")
+    }
+    n := int(b[off])
+    switch {
+    case n == 0:
+      if next < 0 {
+        next = off + 1
+      }
+      return strings.Join(labels, ".") + ".", next, nil
+    case n & 0xC0 == 0xC0:
+      if off + 1 >= len(b) {
+        return "", 0, errors.New("truncated name")
+      }
+      if jumps++; jumps > 16 {
+        return "", 0, errors.New("compression loop")
+      }
+      if next < 0 {
+        next = off + 2
+      }
+      off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+    case n & 0xC0 != 0:
+      return "", 0, fmt.Errorf("unsupported label type %#x", n & 0xC0)
+    default:
+      if off + 1 + n > len(b) {
+        return "", 0, errors.New("truncated name")
+      }
+      labels = append(labels, string(b[off + 1:off + 1 + n]))
+      off += 1 + n
+    }
+  }
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+  "net/http"
+
+  "github.com/prometheus/common/config"
+)
+
+// new_http_client returns a client for sending requests to target. When no
+// proxy_url is configured, the proxy is taken from the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables, as most other HTTP clients
+// do; the Prometheus client configuration otherwise ignores them.
+func new_http_client(cfg config.HTTPClientConfig, name string, target string) (*http.Client, error) {
+  if cfg.ProxyURL.URL == nil {
+    req, err := http.NewRequest(http.MethodPost, target, nil)
+    if err != nil {
+      return nil, err
+    }
+    proxy, err := http.ProxyFromEnvironment(req)
+    if err != nil {
+      return nil, err
+    }
+    cfg.ProxyURL.URL = proxy
+  }
+  return config.NewClientFromConfig(cfg, name, false)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "net"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+// operStates are the operational states of an interface, as named by
+// RFC 2863 and Linux.
+var operStates = []string{"unknown", "notpresent", "down", "lowerlayerdown", "testing", "dormant", "up"}
+
+// linkState is the state of an interface's link, as far as the operating
+// system tells it. Speed is in bytes per second, and negative if it is not
+// known; CarrierChanges is negative if it is not counted.
+type linkState struct {
+  OperState      string
+  Speed          float64
+  CarrierChanges float64
+}
+
+// interfaceCollector exports the state of the interfaces the devices are
+// reached on, so that gaps in the HomePlug metrics can be told apart from the
+// host's own link going down. The interfaces are looked up on each scrape, as
+// they may be recreated.
+type interfaceCollector struct {
+  names          []string
+  mtu            *prometheus.Desc
+  operState      *prometheus.Desc
+  speed          *prometheus.Desc
+  carrierChanges *prometheus.Desc
+}
+
+func new_interface_collector(names []string) *interfaceCollector {
+  return &interfaceCollector{
+    names: names,
+    mtu: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "interface", "mtu_bytes"),
+      "MTU of the interface the devices are reached on",
+      []string{"interface"},
+      nil),
+    operState: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "interface", "operstate"),
+      "Operational state of the interface the devices are reached on, 1 for the current state and 0 for the others",
+      []string{"interface", "state"},
+      nil),
+    speed: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "interface", "speed_bytes"),
+      "Link speed of the interface the devices are reached on, in bytes per second, if it is known",
+      []string{"interface"},
+      nil),
+    carrierChanges: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "interface", "carrier_changes_total"),
+      "Times the link of the interface the devices are reached on went up or down",
+      []string{"interface"},
+      nil),
+  }
+}
+
+func (c *interfaceCollector) Describe(ch chan<- *prometheus.Desc) {
+  ch <- c.mtu
+  ch <- c.operState
+  ch <- c.speed
+  ch <- c.carrierChanges
+}
+
+func (c *interfaceCollector) Collect(ch chan<- prometheus.Metric) {
+  for _, name := range c.names {
+    c.collect(ch, name)
+  }
+}
+
+func (c *interfaceCollector) collect(ch chan<- prometheus.Metric, name string) {
+  state := linkState{OperState: "notpresent", Speed: -1, CarrierChanges: -1}
+  if iface, err := net.InterfaceByName(name); err == nil {
+    ch <- prometheus.MustNewConstMetric(c.mtu, prometheus.GaugeValue, float64(iface.MTU), name)
+    state = read_link_state(iface)
+  }
+  for _, s := range operStates {
+    value := 0.0
+    if s == state.OperState {
+      value = 1
+    }
+    ch <- prometheus.MustNewConstMetric(c.operState, prometheus.GaugeValue, value, name, s)
+  }
+  if state.Speed >= 0 {
+    ch <- prometheus.MustNewConstMetric(c.speed, prometheus.GaugeValue, state.Speed, name)
+  }
+  if state.CarrierChanges >= 0 {
+    ch <- prometheus.MustNewConstMetric(c.carrierChanges, prometheus.CounterValue, state.CarrierChanges, name)
+  }
+}
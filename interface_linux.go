@@ -0,0 +1,32 @@
+package main
+
+import (
+  "net"
+  "strconv"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+)
+
+// read_link_state reads the state of iface from sysfs. The speed can't be
+// read while the link is down, and virtual interfaces report it as -1.
+func read_link_state(iface *net.Interface) linkState {
+  dir := filepath.Join("/sys/class/net", iface.Name)
+  state := linkState{OperState: "unknown", Speed: -1, CarrierChanges: -1}
+  if b, err := ioutil.ReadFile(filepath.Join(dir, "operstate")); err == nil {
+    state.OperState = strings.TrimSpace(string(b))
+  } else if iface.Flags & net.FlagUp == 0 {
+    state.OperState = "down"
+  }
+  if b, err := ioutil.ReadFile(filepath.Join(dir, "speed")); err == nil {
+    if mbps, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil && mbps >= 0 {
+      state.Speed = float64(mbps) * 1e6 / 8
+    }
+  }
+  if b, err := ioutil.ReadFile(filepath.Join(dir, "carrier_changes")); err == nil {
+    if n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err == nil {
+      state.CarrierChanges = float64(n)
+    }
+  }
+  return state
+}
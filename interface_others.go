@@ -0,0 +1,17 @@
+// +build !linux
+
+package main
+
+import (
+  "net"
+)
+
+// read_link_state only tells whether iface is up, as its speed and carrier
+// changes are only read from sysfs on Linux.
+func read_link_state(iface *net.Interface) linkState {
+  state := linkState{OperState: "down", Speed: -1, CarrierChanges: -1}
+  if iface.Flags & net.FlagUp != 0 {
+    state.OperState = "up"
+  }
+  return state
+}
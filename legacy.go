@@ -0,0 +1,52 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "strconv"
+
+  "github.com/mdlayher/raw"
+)
+
+// parse_ethertypes converts the hexadecimal EtherTypes given by
+// --transport.ethertype, leaving out repeats.
+func parse_ethertypes(names []string) []uint16 {
+  var etherTypes []uint16
+  seen := map[uint64]bool{}
+  for _, name := range names {
+    et, err := strconv.ParseUint(name, 16, 16)
+    if err != nil || seen[et] {
+      continue
+    }
+    seen[et] = true
+    etherTypes = append(etherTypes, uint16(et))
+  }
+  return etherTypes
+}
+
+// listen_ethertypes opens a raw socket on iface for each of the EtherTypes,
+// merged into one if there are several.
+func listen_ethertypes(iface *net.Interface, etherTypes []uint16, promiscuous bool) (net.PacketConn, error) {
+  var conns []net.PacketConn
+  for _, et := range etherTypes {
+    conn, err := raw.ListenPacket(iface, et, nil)
+    if err == nil && promiscuous {
+      if err = conn.SetPromiscuous(true); err != nil {
+        conn.Close()
+        err = fmt.Errorf("failed to enable promiscuous mode: %v", err)
+      }
+    }
+    if err != nil {
+      for _, c := range conns {
+        c.Close()
+      }
+      return nil, err
+    }
+    conns = append(conns, conn)
+  }
+  if len(conns) == 1 {
+    return conns[0], nil
+  }
+  // The frames are passed on whole, tagged or not.
+  return new_multi_conn(conns, frame_size(iface, true)), nil
+}
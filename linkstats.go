@@ -0,0 +1,55 @@
+package main
+
+import (
+  "sync"
+)
+
+// counterTracker turns counters that restart from zero when a device reboots
+// into counters that only increase, by adding up what each one has counted
+// since it was last seen.
+type counterTracker struct {
+  mutex    sync.Mutex
+  counters map[string]*trackedCounter
+  lru      lruIndex
+}
+
+type trackedCounter struct {
+  last  uint64
+  total uint64
+}
+
+// adjust records the latest raw value of the counter, and returns its total
+// and whether it restarted. A value lower than the last one is taken as a
+// restart.
+func (t *counterTracker) adjust(key string, v uint64) (uint64, bool) {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  if t.counters == nil {
+    t.counters = map[string]*trackedCounter{}
+  }
+  if evicted, ok := t.lru.touch(key); ok {
+    delete(t.counters, evicted)
+  }
+  c, ok := t.counters[key]
+  if !ok {
+    t.counters[key] = &trackedCounter{last: v, total: v}
+    return v, false
+  }
+  restarted := v < c.last
+  if restarted {
+    c.total += v
+  } else {
+    c.total += v - c.last
+  }
+  c.last = v
+  return c.total, restarted
+}
+
+// seen reports whether the counter has a value from an earlier call to
+// adjust.
+func (t *counterTracker) seen(key string) bool {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  _, ok := t.counters[key]
+  return ok
+}
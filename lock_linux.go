@@ -0,0 +1,13 @@
+package main
+
+import (
+  "io"
+  "net"
+)
+
+// acquire_interface_lock binds an abstract unix socket named after the
+// interface. The kernel releases it when the process exits, however it exits,
+// so there is no stale lock to clean up.
+func acquire_interface_lock(name string) (io.Closer, error) {
+  return net.Listen("unix", "@homeplug_exporter/" + name)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "fmt"
+  "sync"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+  logSuppressed = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+      Namespace: namespace,
+      Name:      "log_messages_suppressed_total",
+      Help:      "Log messages not written because an identical one was written recently, by call site.",
+    },
+    []string{"site"})
+
+  // logDedup limits the messages logged on paths that can run once per
+  // frame, such as decode failures.
+  logDedup = &logLimiter{entries: map[string]*limitedEntry{}}
+)
+
+// logLimiter writes the first of a run of identical messages, and counts the
+// rest until the end of the interval, when a summary is written in their
+// place. If the interval is 0, every message is written.
+type logLimiter struct {
+  mutex    sync.Mutex
+  interval time.Duration
+  entries  map[string]*limitedEntry
+}
+
+type limitedEntry struct {
+  emit       func(format string, args ...interface{})
+  msg        string
+  suppressed uint64
+}
+
+func (l *logLimiter) Errorf(c *componentLogger, site, format string, args ...interface{}) {
+  msg := fmt.Sprintf(format, args...)
+  l.limit(c.Errorf, site, site + "\x00" + msg, msg)
+}
+
+func (l *logLimiter) Debugf(c *componentLogger, site, format string, args ...interface{}) {
+  msg := fmt.Sprintf(format, args...)
+  l.limit(c.Debugf, site, site + "\x00" + msg, msg)
+}
+
+// limit writes msg with emit, unless a message with the same key was written
+// during the current interval.
+func (l *logLimiter) limit(emit func(string, ...interface{}), site, key, msg string) {
+  l.mutex.Lock()
+  if l.interval == 0 {
+    l.mutex.Unlock()
+    emit("%s", msg)
+    return
+  }
+  if e, ok := l.entries[key]; ok {
+    e.msg = msg
+    e.suppressed++
+    l.mutex.Unlock()
+    logSuppressed.WithLabelValues(site).Inc()
+    return
+  }
+  l.entries[key] = &limitedEntry{emit: emit, msg: msg}
+  l.mutex.Unlock()
+  emit("%s", msg)
+}
+
+// Run writes a summary of the suppressed messages every interval.
+func (l *logLimiter) Run(interval time.Duration) {
+  l.mutex.Lock()
+  l.interval = interval
+  l.mutex.Unlock()
+  if interval == 0 {
+    return
+  }
+
+  for range time.Tick(interval) {
+    l.mutex.Lock()
+    entries := l.entries
+    l.entries = map[string]*limitedEntry{}
+    l.mutex.Unlock()
+
+    for _, e := range entries {
+      if e.suppressed > 0 {
+        e.emit("%s (repeated %d more times in the last %s)", e.msg, e.suppressed, interval)
+      }
+    }
+  }
+}
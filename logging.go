@@ -0,0 +1,104 @@
+package main
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+
+  "github.com/prometheus/common/log"
+  "github.com/sirupsen/logrus"
+)
+
+// Each subsystem logs with a component field, and its level can be set apart
+// from the others with --log.component-level.
+var (
+  mainLog      = newComponentLogger("main")
+  transportLog = newComponentLogger("transport")
+  decoderLog   = newComponentLogger("decoder")
+  pollerLog    = newComponentLogger("poller")
+  httpLog      = newComponentLogger("http")
+
+  componentLoggers = []*componentLogger{mainLog, transportLog, decoderLog, pollerLog, httpLog}
+)
+
+// componentLogger holds the logging functions of one component. They are
+// method values of the underlying logger rather than wrappers, so that the
+// source field still names the caller; the functions of levels below the
+// component's are replaced by ones that discard the message.
+type componentLogger struct {
+  name   string
+  Debugf func(format string, args ...interface{})
+  Infof  func(format string, args ...interface{})
+  Warnf  func(format string, args ...interface{})
+  Errorf func(format string, args ...interface{})
+  Fatalf func(format string, args ...interface{})
+}
+
+func newComponentLogger(name string) *componentLogger {
+  c := &componentLogger{name: name}
+  c.setLevel(logrus.DebugLevel)
+  return c
+}
+
+func discard(format string, args ...interface{}) {}
+
+func (c *componentLogger) setLevel(level logrus.Level) {
+  l := log.With("component", c.name)
+  c.Debugf, c.Infof, c.Warnf, c.Errorf = discard, discard, discard, discard
+  c.Fatalf = l.Fatalf
+  if level >= logrus.ErrorLevel {
+    c.Errorf = l.Errorf
+  }
+  if level >= logrus.WarnLevel {
+    c.Warnf = l.Warnf
+  }
+  if level >= logrus.InfoLevel {
+    c.Infof = l.Infof
+  }
+  if level >= logrus.DebugLevel {
+    c.Debugf = l.Debugf
+  }
+}
+
+// configure_component_logs sets the level of each component to its override,
+// or to the global level otherwise. The underlying logger is set to the most
+// verbose of them, leaving the components to filter their own messages.
+func configure_component_logs(global string, overrides map[string]string) error {
+  base, err := logrus.ParseLevel(global)
+  if err != nil {
+    return err
+  }
+  verbose := base
+  levels := map[string]logrus.Level{}
+  for name, value := range overrides {
+    level, err := logrus.ParseLevel(value)
+    if err != nil {
+      return fmt.Errorf("component %s: %v", name, err)
+    }
+    levels[name] = level
+    if level > verbose {
+      verbose = level
+    }
+  }
+
+  known := map[string]bool{}
+  for _, c := range componentLoggers {
+    known[c.name] = true
+    level, ok := levels[c.name]
+    if !ok {
+      level = base
+    }
+    c.setLevel(level)
+  }
+  for name := range levels {
+    if !known[name] {
+      names := []string{}
+      for _, c := range componentLoggers {
+        names = append(names, c.name)
+      }
+      sort.Strings(names)
+      return fmt.Errorf("unknown component %q, expected one of %s", name, strings.Join(names, ", "))
+    }
+  }
+  return log.Base().SetLevel(verbose.String())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+  "container/list"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+  cacheEntries = prometheus.NewGaugeVec(
+    prometheus.GaugeOpts{
+      Namespace: namespace,
+      Name:      "cache_entries",
+      Help:      "Entries held by each bounded cache of the state kept per station or link, and the replies buffered by the last query.",
+    },
+    []string{"cache"})
+  cacheEvictions = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+      Namespace: namespace,
+      Name:      "cache_evictions_total",
+      Help:      "Entries evicted from each bounded cache because it held --cache.max-entries, least recently used first.",
+    },
+    []string{"cache"})
+  queryTruncated = prometheus.NewCounter(
+    prometheus.CounterOpts{
+      Namespace: namespace,
+      Name:      "query_truncated_total",
+      Help:      "Queries that stopped waiting for replies because they had buffered --cache.max-entries frames, as the segment kept sending them.",
+    })
+)
+
+// cacheMaxEntries bounds each of the caches, so that a segment with a
+// great many stations, or one forging their addresses, cannot run a small
+// router out of memory.
+var cacheMaxEntries = 10000
+
+// lruIndex keeps the keys of a cache in the order they were last used, so
+// that the least recently used is evicted when it is full. It is not safe
+// for concurrent use; the cache's own lock covers it.
+type lruIndex struct {
+  cache string
+  order list.List
+  elems map[string]*list.Element
+}
+
+// touch marks key as the most recently used, adding it if it is new. If the
+// cache was full, it returns the key to evict from it.
+func (l *lruIndex) touch(key string) (string, bool) {
+  if l.elems == nil {
+    l.elems = map[string]*list.Element{}
+  }
+  if e, ok := l.elems[key]; ok {
+    l.order.MoveToFront(e)
+    return "", false
+  }
+  l.elems[key] = l.order.PushFront(key)
+
+  var evicted string
+  var ok bool
+  if cacheMaxEntries > 0 && l.order.Len() > cacheMaxEntries {
+    evicted, ok = l.order.Remove(l.order.Back()).(string), true
+    delete(l.elems, evicted)
+    cacheEvictions.WithLabelValues(l.cache).Inc()
+  }
+  cacheEntries.WithLabelValues(l.cache).Set(float64(l.order.Len()))
+  return evicted, ok
+}
+
+// remove drops key from the index, once the cache has dropped it.
+func (l *lruIndex) remove(key string) {
+  if e, ok := l.elems[key]; ok {
+    l.order.Remove(e)
+    delete(l.elems, key)
+    cacheEntries.WithLabelValues(l.cache).Set(float64(l.order.Len()))
+  }
+}
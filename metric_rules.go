@@ -0,0 +1,121 @@
+package main
+
+import (
+  "fmt"
+  "regexp"
+
+  "github.com/prometheus/client_golang/prometheus"
+  dto "github.com/prometheus/client_model/go"
+)
+
+// Actions of metric rules.
+const (
+  metricRuleDrop = "drop"
+  metricRuleKeep = "keep"
+)
+
+// MetricRuleConfig drops the series that match it, or keeps only those, from
+// everything the exporter exposes or pushes. A series matches if its metric
+// name matches Name and each label in Labels matches; both are anchored
+// regular expressions, and either may be left out.
+type MetricRuleConfig struct {
+  Action string            `yaml:"action"`
+  Name   string            `yaml:"name,omitempty"`
+  Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+type metricRule struct {
+  action string
+  name   *regexp.Regexp
+  labels map[string]*regexp.Regexp
+}
+
+// metricRules are applied in order, each to the series left by the previous.
+type metricRules []metricRule
+
+func compile_metric_rules(cfgs []MetricRuleConfig) (metricRules, error) {
+  rules := metricRules{}
+  for i, cfg := range cfgs {
+    rule := metricRule{action: cfg.Action, labels: map[string]*regexp.Regexp{}}
+    switch cfg.Action {
+    case metricRuleDrop, metricRuleKeep:
+    default:
+      return nil, fmt.Errorf("metric_rules %d: unknown action %q", i, cfg.Action)
+    }
+    if cfg.Name != "" {
+      re, err := regexp.Compile("^(?:" + cfg.Name + ")$")
+      if err != nil {
+        return nil, fmt.Errorf("metric_rules %d: name: %v", i, err)
+      }
+      rule.name = re
+    }
+    for label, value := range cfg.Labels {
+      re, err := regexp.Compile("^(?:" + value + ")$")
+      if err != nil {
+        return nil, fmt.Errorf("metric_rules %d: label %s: %v", i, label, err)
+      }
+      rule.labels[label] = re
+    }
+    rules = append(rules, rule)
+  }
+  return rules, nil
+}
+
+func (r *metricRule) matches(name string, m *dto.Metric) bool {
+  if r.name != nil && !r.name.MatchString(name) {
+    return false
+  }
+  for label, re := range r.labels {
+    value := ""
+    for _, l := range m.GetLabel() {
+      if l.GetName() == label {
+        value = l.GetValue()
+        break
+      }
+    }
+    if !re.MatchString(value) {
+      return false
+    }
+  }
+  return true
+}
+
+// filter removes the series dropped by the rules, and any families left
+// empty.
+func (rules metricRules) filter(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+  if len(rules) == 0 {
+    return mfs
+  }
+  kept := mfs[:0]
+  for _, mf := range mfs {
+    metrics := mf.Metric[:0]
+    for _, m := range mf.Metric {
+      keep := true
+      for i := range rules {
+        if rules[i].matches(mf.GetName(), m) != (rules[i].action == metricRuleKeep) {
+          keep = false
+          break
+        }
+      }
+      if keep {
+        metrics = append(metrics, m)
+      }
+    }
+    mf.Metric = metrics
+    if len(metrics) > 0 {
+      kept = append(kept, mf)
+    }
+  }
+  return kept
+}
+
+// gatherer returns g with the rules applied to what it gathers.
+func (rules metricRules) gatherer(g prometheus.Gatherer) prometheus.Gatherer {
+  if len(rules) == 0 {
+    return g
+  }
+  return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+    mfs, err := g.Gather()
+    return rules.filter(mfs), err
+  })
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "bytes"
+  "strings"
+  "net/http"
+  "compress/gzip"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+  "github.com/prometheus/common/expfmt"
+)
+
+// metricsOptions control how the metrics endpoint answers scrapes.
+type metricsOptions struct {
+  // OpenMetrics serves the OpenMetrics format to scrapers that ask for it.
+  OpenMetrics         bool
+  DisableCompression  bool
+  // MaxRequestsInFlight limits concurrent scrapes; further ones are
+  // answered with 503. If 0, there is no limit.
+  MaxRequestsInFlight int
+}
+
+// metrics_handler serves what g gathers. The promhttp handler of this
+// client_golang version can't negotiate OpenMetrics, so scrapes asking for
+// it are encoded here instead.
+func metrics_handler(g prometheus.Gatherer, opts metricsOptions) http.Handler {
+  text := promhttp.HandlerFor(g, promhttp.HandlerOpts{DisableCompression: opts.DisableCompression})
+  var inFlight chan struct{}
+  if opts.MaxRequestsInFlight > 0 {
+    inFlight = make(chan struct{}, opts.MaxRequestsInFlight)
+  }
+
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if inFlight != nil {
+      select {
+      case inFlight <- struct{}{}:
+        defer func() { <-inFlight }()
+      default:
+        http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", opts.MaxRequestsInFlight), http.StatusServiceUnavailable)
+        return
+      }
+    }
+    if !opts.OpenMetrics || expfmt.NegotiateIncludingOpenMetrics(r.Header) != expfmt.FmtOpenMetrics {
+      text.ServeHTTP(w, r)
+      return
+    }
+
+    mfs, err := g.Gather()
+    if err != nil {
+      httpLog.Errorf("error gathering metrics: %v", err)
+      http.Error(w, "An error has occurred while gathering metrics:\n\n" + err.Error(), http.StatusInternalServerError)
+      return
+    }
+    var b bytes.Buffer
+    enc := expfmt.NewEncoder(&b, expfmt.FmtOpenMetrics)
+    for _, mf := range mfs {
+      if err := enc.Encode(mf); err != nil {
+        httpLog.Errorf("error encoding metric family %s: %v", mf.GetName(), err)
+        http.Error(w, "An error has occurred while encoding metrics:\n\n" + err.Error(), http.StatusInternalServerError)
+        return
+      }
+    }
+    if closer, ok := enc.(expfmt.Closer); ok {
+      closer.Close()
+    }
+
+    w.Header().Set("Content-Type", string(expfmt.FmtOpenMetrics))
+    var out io.Writer = w
+    if !opts.DisableCompression && accepts_gzip(r) {
+      w.Header().Set("Content-Encoding", "gzip")
+      gz := gzip.NewWriter(w)
+      defer gz.Close()
+      out = gz
+    }
+    if _, err := out.Write(b.Bytes()); err != nil {
+      httpLog.Debugf("failed to write metrics: %v", err)
+    }
+  })
+}
+
+func accepts_gzip(r *http.Request) bool {
+  for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+    part = strings.TrimSpace(part)
+    if part == "gzip" || strings.HasPrefix(part, "gzip;") {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+  "sort"
+  "sync"
+  "regexp"
+  "strconv"
+  "strings"
+  "net/http"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+// describedCollector is a collector whose metrics /api/v1/metrics-schema
+// lists, along with the part of the exporter that produces them.
+type describedCollector struct {
+  name      string
+  collector prometheus.Collector
+}
+
+var (
+  schemaMutex      sync.Mutex
+  schemaCollectors []describedCollector
+)
+
+// register_collector registers c with the default registry, and lists its
+// metrics in the schema as produced by the named collector.
+func register_collector(name string, c prometheus.Collector) {
+  prometheus.MustRegister(c)
+  describe_collector(name, c)
+}
+
+// describe_collector lists the metrics of c in the schema without
+// registering it, for collectors registered with registries of their own.
+func describe_collector(name string, c prometheus.Collector) {
+  schemaMutex.Lock()
+  defer schemaMutex.Unlock()
+  schemaCollectors = append(schemaCollectors, describedCollector{name, c})
+}
+
+type apiMetricsSchema struct {
+  APIVersion string      `json:"api_version"`
+  Metrics    []apiMetric `json:"metrics"`
+}
+
+type apiMetric struct {
+  Name        string            `json:"name"`
+  Type        string            `json:"type"`
+  Help        string            `json:"help"`
+  Labels      []string          `json:"labels"`
+  ConstLabels map[string]string `json:"const_labels,omitempty"`
+  Collector   string            `json:"collector"`
+}
+
+// descPattern matches the String of a prometheus.Desc, which has no other
+// way of reading its contents.
+var descPattern = regexp.MustCompile(`^Desc\{fqName: ("(?:[^"\\]|\\.)*"), help: ("(?:[^"\\]|\\.)*"), constLabels: \{(.*)\}, variableLabels: \[(.*)\]\}$`)
+
+var constLabelPattern = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)=("(?:[^"\\]|\\.)*")`)
+
+// parse_desc returns the metric that d describes.
+func parse_desc(d *prometheus.Desc) (apiMetric, bool) {
+  m := descPattern.FindStringSubmatch(d.String())
+  if m == nil {
+    return apiMetric{}, false
+  }
+  name, err := strconv.Unquote(m[1])
+  if err != nil {
+    return apiMetric{}, false
+  }
+  help, err := strconv.Unquote(m[2])
+  if err != nil {
+    return apiMetric{}, false
+  }
+  metric := apiMetric{
+    Name:   name,
+    Type:   metric_type(name),
+    Help:   help,
+    Labels: strings.Fields(m[4]),
+  }
+  if metric.Labels == nil {
+    metric.Labels = []string{}
+  }
+  for _, l := range constLabelPattern.FindAllStringSubmatch(m[3], -1) {
+    value, err := strconv.Unquote(l[2])
+    if err != nil {
+      continue
+    }
+    if metric.ConstLabels == nil {
+      metric.ConstLabels = map[string]string{}
+    }
+    metric.ConstLabels[l[1]] = value
+  }
+  return metric, true
+}
+
+// metric_type returns the type of the named metric. Descriptors don't carry
+// one, but every counter the exporter has ends in _total, and every other
+// metric is a gauge.
+func metric_type(name string) string {
+  if strings.HasSuffix(name, "_total") {
+    return "counter"
+  }
+  return "gauge"
+}
+
+// metrics_schema describes every metric of the collectors in the schema, as
+// the exporter is configured.
+func metrics_schema() apiMetricsSchema {
+  schemaMutex.Lock()
+  collectors := append([]describedCollector{}, schemaCollectors...)
+  schemaMutex.Unlock()
+
+  metrics := []apiMetric{}
+  seen := map[string]bool{}
+  for _, dc := range collectors {
+    ch := make(chan *prometheus.Desc)
+    go func(c prometheus.Collector) {
+      c.Describe(ch)
+      close(ch)
+    }(dc.collector)
+    for d := range ch {
+      m, ok := parse_desc(d)
+      if !ok || seen[m.Name] {
+        continue
+      }
+      seen[m.Name] = true
+      m.Collector = dc.name
+      metrics = append(metrics, m)
+    }
+  }
+  sort.Slice(metrics, func(i, j int) bool {
+    return metrics[i].Name < metrics[j].Name
+  })
+  return apiMetricsSchema{APIVersion: apiVersion, Metrics: metrics}
+}
+
+func (a *API) serveMetricsSchema(w http.ResponseWriter, r *http.Request) {
+  write_api_json(w, http.StatusOK, metrics_schema())
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "bytes"
+  "encoding/hex"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// Network is a HomePlug AV logical network (AVLN).
+type Network struct {
+  ID         string
+  ShortID    uint8
+  CCoAddress net.HardwareAddr
+  CCoTEI     uint8
+  // Schedule is the CCo's beacon schedule, and Mode the network mode stated
+  // in its beacon, if it was asked for it.
+  Schedule   *Schedule
+  Mode       string
+}
+
+// Membership is a station's association with a network, as it stated in a
+// standard CM_NW_INFO confirm.
+type Membership struct {
+  Address   net.HardwareAddr
+  NetworkID string
+  TEI       uint8
+  Role      uint8
+}
+
+// RoleName returns the name of the station's role in the network.
+func (m *Membership) RoleName() string {
+  if int(m.Role) < len(homeplug.Roles) {
+    return homeplug.Roles[m.Role]
+  }
+  return fmt.Sprintf("unknown-%d", m.Role)
+}
+
+// Station is a HomePlug device that is a member of a network, either because
+// it answered a query itself or because it was listed by a station that did.
+type Station struct {
+  Address          net.HardwareAddr
+  TEI              uint8
+  BridgedAddress   net.HardwareAddr
+  NetworkID        string
+  Reporter         bool
+  Role             uint8
+  // Protocol is the protocol family the station answered with, if it is a
+  // reporter.
+  Protocol         string
+  // Responded is set for stations that answered a query, even if only with
+  // an error.
+  Responded        bool
+  // BridgedIP is the IPv4 address of the bridged host, if it was probed, and
+  // BridgedReachable whether it answered.
+  BridgedIP        net.IP
+  BridgedReachable bool
+  // BridgedHostName is the name of the bridged host, if it was resolved.
+  BridgedHostName  string
+  // Phase is the electrical phase the station is wired to, if it is known
+  // from the configuration or from a decoder of vendor diagnostics.
+  Phase            string
+  // Vendor is the maker of the station, known from the OUI of its address.
+  Vendor           string
+  // Capability is what the station reported it supports, if it answered
+  // CM_STA_CAP.
+  Capability       *Capability
+  // Legacy is set for HomePlug 1.0 stations, which are only known from the
+  // frames they sent on the HomePlug 1.0 EtherType.
+  Legacy           bool
+  // Asleep is set for AV2 stations that the CCo's beacon lists as in power
+  // save.
+  Asleep           bool
+  // Firmware is what the station reported of its firmware, if it answered
+  // VS_SW_VER.
+  Firmware         *Firmware
+  // MMEVersions are the MMV of the layout each type of confirm the station
+  // sent was decoded as, keyed by MME type.
+  MMEVersions      map[string]uint8
+  // RoundTrip is the lowest time the station took to answer a request in
+  // the poll, if it answered one.
+  RoundTrip        time.Duration
+  // DeviceType is greenphy, av, av2 or homeplug_1.0, if it is configured or
+  // known from the station's capabilities.
+  DeviceType       string
+  // Reboots are the reboots of the station noticed since the exporter
+  // started.
+  Reboots          uint64
+}
+
+// Firmware is the firmware a Qualcomm station runs, as reported in
+// VS_SW_VER.
+type Firmware struct {
+  Version     string
+  DeviceClass string
+}
+
+// Capability is what a station supports, as reported in CM_STA_CAP.
+type Capability struct {
+  AVVersion             uint8
+  CCoCapability         uint8
+  ImplementationVersion uint16
+}
+
+// Version returns the HomePlug AV specification version the station
+// implements.
+func (c *Capability) Version() string {
+  switch c.AVVersion {
+  case 0x00:
+    return "1.1"
+  case 0x01:
+    return "2.0"
+  }
+  return fmt.Sprintf("unknown-%d", c.AVVersion)
+}
+
+// MaxFrequency returns the upper edge of the widest band the station can
+// use, in Hz. HomePlug AV uses 1.8 to 30 MHz, and AV2 extends it to 86 MHz.
+func (c *Capability) MaxFrequency() float64 {
+  if c.AVVersion >= 0x01 {
+    return 86e6
+  }
+  return 30e6
+}
+
+// ObservedOnly reports whether the station only appeared in what other
+// stations reported, such as a neighbour's adapter that the CCo can hear,
+// and never answered a query itself.
+func (s *Station) ObservedOnly() bool {
+  return !s.Responded
+}
+
+// Capabilities describes what the station can be queried with: the protocol
+// family it answered with, "homeplug_1.0" for HomePlug 1.0 stations, or
+// "unknown" if it only answered with errors.
+func (s *Station) Capabilities() string {
+  if s.Reporter {
+    return s.Protocol
+  }
+  if s.Legacy {
+    return "homeplug_1.0"
+  }
+  if s.Responded {
+    return "unknown"
+  }
+  return ""
+}
+
+// Link is the average PHY data rate from Source to Destination, as seen by
+// the Reporter. The reporter is always one of the two ends of the link.
+type Link struct {
+  Reporter    net.HardwareAddr
+  Protocol    string
+  Source      net.HardwareAddr
+  Destination net.HardwareAddr
+  Rate        float64
+  // RawRate is the rate as reported, in Mbit/s.
+  RawRate     uint16
+  // Saturated is set if RawRate is 255, the most an 8-bit rate can tell,
+  // so that the link may well be faster.
+  Saturated   bool
+}
+
+// LinkStats are the MAC-level counters that Reporter keeps for one direction
+// ("tx" or "rx") of its link to Peer. They only increase, even if the
+// reporter restarts and its own counters start again from zero.
+type LinkStats struct {
+  Reporter     net.HardwareAddr
+  Peer         net.HardwareAddr
+  Direction    string
+  MPDUAcked    uint64
+  MPDUCollided uint64
+  MPDUFailed   uint64
+  PBPassed     uint64
+  PBFailed     uint64
+}
+
+// mbps_to_bytes converts a rate in Mbit/s, as reported on the wire, to the
+// bytes per second used throughout the data model.
+func mbps_to_bytes(rate uint16) float64 {
+  return float64(uint64(rate) * 1024 * 1024 / 8)
+}
+
+// AddNetworkInfo merges a Qualcomm network info confirm sent by reporter into
+// the snapshot.
+func (s *Snapshot) AddNetworkInfo(protocol string, reporter net.HardwareAddr, info *homeplug.NetworkInfo) {
+  self := Station{
+    Address:   reporter,
+    Reporter:  true,
+    Protocol:  protocol,
+    Responded: true,
+  }
+
+  for _, ns := range info.Networks {
+    id := hex.EncodeToString(ns.NetworkID[:])
+    if self.NetworkID == "" {
+      self.NetworkID = id
+      self.TEI = ns.TEI
+      self.Role = ns.Role
+    }
+    s.addNetwork(Network{
+      ID:         id,
+      ShortID:    ns.ShortID,
+      CCoAddress: ns.CCoAddress,
+      CCoTEI:     ns.CCoTEI,
+    })
+  }
+  s.addStation(self)
+
+  for _, ss := range info.Stations {
+    s.addStation(Station{
+      Address:        ss.Address,
+      TEI:            ss.TEI,
+      BridgedAddress: ss.BridgedAddress,
+      NetworkID:      self.NetworkID,
+    })
+    if ss.Extended {
+      s.addLinks(protocol, reporter, ss.Address, ss.ExtendedTxRate, ss.ExtendedRxRate, true)
+    } else {
+      s.addLinks(protocol, reporter, ss.Address, uint16(ss.TxRate), uint16(ss.RxRate), false)
+    }
+  }
+}
+
+// AddAVNetworkInfo merges a standard CM_NW_INFO confirm sent by reporter
+// into the snapshot. Unlike the Qualcomm network info, it does not give the
+// coordinator's TEI.
+func (s *Snapshot) AddAVNetworkInfo(protocol string, reporter net.HardwareAddr, info *homeplug.AVNetworkInfo) {
+  self := Station{
+    Address:   reporter,
+    Reporter:  true,
+    Protocol:  protocol,
+    Responded: true,
+  }
+
+  for _, ns := range info.Networks {
+    id := hex.EncodeToString(ns.NetworkID[:])
+    if self.NetworkID == "" {
+      self.NetworkID = id
+      self.TEI = ns.TEI
+      self.Role = ns.Role
+    }
+    s.addNetwork(Network{
+      ID:         id,
+      ShortID:    ns.ShortID,
+      CCoAddress: ns.CCoAddress,
+    })
+  }
+  s.addStation(self)
+}
+
+// AddMemberships records the networks that a standard CM_NW_INFO confirm
+// sent by reporter lists it as a member of.
+func (s *Snapshot) AddMemberships(reporter net.HardwareAddr, info *homeplug.AVNetworkInfo) {
+NetworkLoop:
+  for _, ns := range info.Networks {
+    id := hex.EncodeToString(ns.NetworkID[:])
+    for _, m := range s.Memberships {
+      if bytes.Equal(m.Address, reporter) && m.NetworkID == id {
+        continue NetworkLoop
+      }
+    }
+    s.Memberships = append(s.Memberships, Membership{
+      Address:   reporter,
+      NetworkID: id,
+      TEI:       ns.TEI,
+      Role:      ns.Role,
+    })
+  }
+}
+
+// AddAVNetworkStats merges a standard CM_NW_STATS confirm sent by reporter
+// into the snapshot. The peers are identified by address only.
+func (s *Snapshot) AddAVNetworkStats(protocol string, reporter net.HardwareAddr, stats *homeplug.AVNetworkStats) {
+  s.addStation(Station{
+    Address:   reporter,
+    Reporter:  true,
+    Protocol:  protocol,
+    Responded: true,
+  })
+
+  for _, ss := range stats.Stations {
+    s.addStation(Station{
+      Address: ss.Address,
+    })
+    s.addLinks(protocol, reporter, ss.Address, uint16(ss.TxRate), uint16(ss.RxRate), false)
+  }
+}
+
+// AddMMEError records that reporter exists, although it could not answer
+// one of the requests.
+func (s *Snapshot) AddMMEError(reporter net.HardwareAddr) {
+  s.addStation(Station{
+    Address:   reporter,
+    Responded: true,
+  })
+}
+
+// AddStationCapability merges a CM_STA_CAP confirm sent by reporter into the
+// snapshot.
+func (s *Snapshot) AddStationCapability(reporter net.HardwareAddr, c *homeplug.StationCapability) {
+  s.addStation(Station{
+    Address:   reporter,
+    Responded: true,
+    Capability: &Capability{
+      AVVersion:             c.AVVersion,
+      CCoCapability:         c.CCoCapability,
+      ImplementationVersion: c.ImplementationVersion,
+    },
+  })
+}
+
+// addLinks adds the links in both directions between reporter and peer.
+func (s *Snapshot) addLinks(protocol string, reporter, peer net.HardwareAddr, txRate, rxRate uint16, extended bool) {
+  s.Links = append(s.Links, Link{
+    Reporter:    reporter,
+    Protocol:    protocol,
+    Source:      reporter,
+    Destination: peer,
+    Rate:        mbps_to_bytes(txRate),
+    RawRate:     txRate,
+    Saturated:   !extended && txRate == 255,
+  }, Link{
+    Reporter:    reporter,
+    Protocol:    protocol,
+    Source:      peer,
+    Destination: reporter,
+    Rate:        mbps_to_bytes(rxRate),
+    RawRate:     rxRate,
+    Saturated:   !extended && rxRate == 255,
+  })
+}
+
+func (s *Snapshot) addNetwork(network Network) {
+  if s.Network(network.ID) == nil {
+    s.Networks = append(s.Networks, network)
+  }
+}
+
+// SetAsleep marks the stations of the network with the given TEIs as in power
+// save.
+func (s *Snapshot) SetAsleep(networkID string, teis []uint8) {
+  for i := range s.Stations {
+    station := &s.Stations[i]
+    if station.NetworkID != networkID {
+      continue
+    }
+    for _, tei := range teis {
+      if station.TEI == tei {
+        station.Asleep = true
+      }
+    }
+  }
+}
+
+// AddLegacyStation adds a HomePlug 1.0 station that sent a frame during the
+// poll.
+func (s *Snapshot) AddLegacyStation(address net.HardwareAddr) {
+  s.addStation(Station{
+    Address:   address,
+    Responded: true,
+    Legacy:    true,
+  })
+}
+
+// addStation adds a station to the snapshot, or fills in what was missing
+// from an existing entry for the same address.
+func (s *Snapshot) addStation(station Station) {
+  existing := s.Station(station.Address)
+  if existing == nil {
+    s.Stations = append(s.Stations, station)
+    return
+  }
+  if station.Reporter {
+    existing.Reporter = true
+    existing.Protocol = station.Protocol
+  }
+  if station.Responded {
+    existing.Responded = true
+  }
+  if station.Legacy {
+    existing.Legacy = true
+  }
+  if existing.Capability == nil {
+    existing.Capability = station.Capability
+  }
+  if existing.BridgedAddress == nil {
+    existing.BridgedAddress = station.BridgedAddress
+  }
+  // A station's own report of its membership beats the lists of others,
+  // which don't give its role.
+  if station.NetworkID != "" && (existing.NetworkID == "" || station.Reporter) {
+    existing.NetworkID = station.NetworkID
+    existing.TEI = station.TEI
+    existing.Role = station.Role
+  }
+}
+
+// DecodedAs records the MMV of the layout that m, a confirm from a station
+// in the snapshot, was decoded as.
+func (s *Snapshot) DecodedAs(m *homeplug.Message) {
+  station := s.Station(m.Source)
+  if station == nil || m.Legacy != nil {
+    return
+  }
+  if station.MMEVersions == nil {
+    station.MMEVersions = map[string]uint8{}
+  }
+  station.MMEVersions[fmt.Sprintf("%04x", m.Frame.Type())] = m.Frame.Version[0]
+}
+
+// assign_round_trips sets the round trip of every station in rtts, keyed by
+// the string form of the address.
+func assign_round_trips(s *Snapshot, rtts map[string]time.Duration) {
+  for i := range s.Stations {
+    if rtt, ok := rtts[s.Stations[i].Address.String()]; ok {
+      s.Stations[i].RoundTrip = rtt
+    }
+  }
+}
+
+func (s *Snapshot) Network(id string) *Network {
+  for i := range s.Networks {
+    if s.Networks[i].ID == id {
+      return &s.Networks[i]
+    }
+  }
+  return nil
+}
+
+func (s *Snapshot) Station(address net.HardwareAddr) *Station {
+  for i := range s.Stations {
+    if bytes.Equal(s.Stations[i].Address, address) {
+      return &s.Stations[i]
+    }
+  }
+  return nil
+}
+
+// LinkPair is the rate between two stations regardless of which of them
+// reported it. A is always the lower of the two addresses. If Direction is
+// set, the pair only covers links in that direction, from A to B ("a_to_b")
+// or from B to A ("b_to_a"); otherwise it covers both.
+type LinkPair struct {
+  A         net.HardwareAddr
+  B         net.HardwareAddr
+  Protocol  string
+  Direction string
+  Rate      float64
+  RawRate   uint16
+  Saturated bool
+}
+
+// LinkPairs collapses the links of the snapshot into undirected pairs, using
+// the lowest rate reported for each pair.
+func (s *Snapshot) LinkPairs(directional bool) []LinkPair {
+  var pairs []LinkPair
+  index := map[string]int{}
+  for _, link := range s.Links {
+    p := LinkPair{A: link.Source, B: link.Destination, Protocol: link.Protocol, Rate: link.Rate, RawRate: link.RawRate, Saturated: link.Saturated}
+    if directional {
+      p.Direction = "a_to_b"
+    }
+    if bytes.Compare(p.A, p.B) > 0 {
+      p.A, p.B = p.B, p.A
+      if directional {
+        p.Direction = "b_to_a"
+      }
+    }
+
+    key := p.A.String() + p.B.String() + p.Protocol + p.Direction
+    if i, ok := index[key]; ok {
+      if p.Rate < pairs[i].Rate {
+        pairs[i].Rate, pairs[i].RawRate, pairs[i].Saturated = p.Rate, p.RawRate, p.Saturated
+      }
+      continue
+    }
+    index[key] = len(pairs)
+    pairs = append(pairs, p)
+  }
+  return pairs
+}
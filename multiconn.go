@@ -0,0 +1,146 @@
+package main
+
+import (
+  "net"
+  "errors"
+  "sync"
+  "time"
+)
+
+// multiConn receives the frames of several sockets as one. Each socket is
+// read by a goroutine of its own, so a frame may be taken from a socket
+// before it is asked for; it is kept until the next read, as it would have
+// been by the socket. Frames are sent on the first socket.
+type multiConn struct {
+  conns    []net.PacketConn
+  frames   chan multiFrame
+  closed   chan struct{}
+  once     sync.Once
+  mutex    sync.Mutex
+  deadline time.Time
+  // wake is closed when the deadline changes.
+  wake     chan struct{}
+}
+
+var errMultiConnClosed = errors.New("use of closed connection")
+
+type multiFrame struct {
+  b    []byte
+  addr net.Addr
+  err  error
+}
+
+func new_multi_conn(conns []net.PacketConn, size int) *multiConn {
+  c := &multiConn{
+    conns:  conns,
+    frames: make(chan multiFrame, 16),
+    closed: make(chan struct{}),
+    wake:   make(chan struct{}),
+  }
+  for _, conn := range conns {
+    go c.read(conn, size)
+  }
+  return c
+}
+
+// read passes on the frames received on conn, of up to size bytes, until
+// it fails.
+func (c *multiConn) read(conn net.PacketConn, size int) {
+  for {
+    b := make([]byte, size)
+    n, addr, err := conn.ReadFrom(b)
+    // A raw socket that has been closed returns -1.
+    if err != nil {
+      n = 0
+    }
+    select {
+    case c.frames <- multiFrame{b[:n], addr, err}:
+    case <-c.closed:
+      return
+    }
+    if err != nil {
+      return
+    }
+  }
+}
+
+func (c *multiConn) ReadFrom(b []byte) (int, net.Addr, error) {
+  for {
+    c.mutex.Lock()
+    deadline, wake := c.deadline, c.wake
+    c.mutex.Unlock()
+
+    var timer *time.Timer
+    var expired <-chan time.Time
+    if !deadline.IsZero() {
+      d := time.Until(deadline)
+      if d <= 0 {
+        return 0, nil, readTimeout{}
+      }
+      timer = time.NewTimer(d)
+      expired = timer.C
+    }
+    var f *multiFrame
+    var err error
+    select {
+    case frame := <-c.frames:
+      f = &frame
+    case <-expired:
+      err = readTimeout{}
+    case <-wake:
+    case <-c.closed:
+      err = errMultiConnClosed
+    }
+    if timer != nil {
+      timer.Stop()
+    }
+    switch {
+    case err != nil:
+      return 0, nil, err
+    case f == nil:
+      continue
+    case f.err != nil:
+      return 0, nil, f.err
+    }
+    return copy(b, f.b), f.addr, nil
+  }
+}
+
+func (c *multiConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+  return c.conns[0].WriteTo(b, addr)
+}
+
+func (c *multiConn) Close() error {
+  var err error
+  c.once.Do(func() {
+    close(c.closed)
+    for _, conn := range c.conns {
+      if e := conn.Close(); e != nil && err == nil {
+        err = e
+      }
+    }
+  })
+  return err
+}
+
+func (c *multiConn) LocalAddr() net.Addr {
+  return c.conns[0].LocalAddr()
+}
+
+func (c *multiConn) SetDeadline(t time.Time) error {
+  c.SetReadDeadline(t)
+  return c.SetWriteDeadline(t)
+}
+
+func (c *multiConn) SetReadDeadline(t time.Time) error {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  c.deadline = t
+  close(c.wake)
+  c.wake = make(chan struct{})
+  return nil
+}
+
+func (c *multiConn) SetWriteDeadline(t time.Time) error {
+  return c.conns[0].SetWriteDeadline(t)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+  "net"
+  "time"
+  "sync/atomic"
+)
+
+// Snapshot holds the results of a single poll of the Homeplug devices.
+type Snapshot struct {
+  Target   net.HardwareAddr
+  Time     time.Time
+  // Local is the adapter attached to the interface, if it is known.
+  Local    net.HardwareAddr
+  Networks []Network
+  Stations []Station
+  Links    []Link
+  // LinkStats are the MAC-level counters of each link, if they were asked
+  // for.
+  LinkStats []LinkStats
+  // ToneMaps are the tone maps of each link, if they were asked for.
+  ToneMaps []ToneMap
+  // Discovered are the stations each reporter hears, and Neighbours the
+  // networks, if their discover lists were asked for.
+  Discovered []DiscoveredStation
+  Neighbours []DiscoveredNetwork
+  // Memberships are the networks each station stated it belongs to in a
+  // standard CM_NW_INFO confirm, whichever family it was decoded with.
+  Memberships []Membership
+  // Retransmissions are the requests sent again to each destination during
+  // the poll, keyed by the string form of its address, because nothing
+  // answered them the first time.
+  Retransmissions map[string]int
+  // Collectors are the collectors that ran during the poll, keyed by name.
+  // Heavy collectors that were not due are left out.
+  Collectors map[string]CollectorRun
+}
+
+// CollectorRun is how long a collector took during a poll, and whether it
+// got every answer it asked for.
+type CollectorRun struct {
+  Duration time.Duration
+  Success  bool
+}
+
+// Collected records that collector ran from start until now, failing unless
+// err is nil.
+func (s *Snapshot) Collected(collector string, start time.Time, err error) {
+  if s.Collectors == nil {
+    s.Collectors = map[string]CollectorRun{}
+  }
+  s.Collectors[collector] = CollectorRun{time.Since(start), err == nil}
+}
+
+// Output receives every snapshot produced by the Poller. Outputs must not
+// modify the snapshot, as it is shared between all of them; the Poller never
+// touches a snapshot again once it has been published.
+type Output interface {
+  Name() string
+  Publish(s *Snapshot) error
+}
+
+// snapshotStore holds the latest published snapshot for outputs that serve
+// it on request. Since published snapshots are never modified, a reader that
+// loads one sees a single poll throughout, however many polls complete while
+// it is reading, and publishing never waits for readers.
+type snapshotStore struct {
+  v atomic.Value
+}
+
+func (st *snapshotStore) Load() *Snapshot {
+  s, _ := st.v.Load().(*Snapshot)
+  return s
+}
+
+func (st *snapshotStore) Store(s *Snapshot) {
+  st.v.Store(s)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "encoding/json"
+)
+
+// EventLogOutput appends the topology events between consecutive snapshots
+// to a file as JSON lines. When the file would grow beyond the size limit, it
+// is rotated to path.1, path.1 to path.2, and so on, keeping at most the
+// configured number of old files.
+type EventLogOutput struct {
+  path       string
+  maxSize    int64
+  maxFiles   int
+  thresholds []float64
+  prev       *Snapshot
+}
+
+func NewEventLogOutput(cfg EventLogConfig) *EventLogOutput {
+  return &EventLogOutput{
+    path:       cfg.Path,
+    maxSize:    cfg.MaxSize,
+    maxFiles:   cfg.MaxFiles,
+    thresholds: cfg.RateThresholds,
+  }
+}
+
+func (o *EventLogOutput) Name() string {
+  return "event-log"
+}
+
+func (o *EventLogOutput) Publish(s *Snapshot) error {
+  prev := o.prev
+  o.prev = s
+  if prev == nil {
+    return nil
+  }
+
+  b := []byte{}
+  for _, e := range diff_snapshots(prev, s, o.thresholds) {
+    line, err := json.Marshal(e)
+    if err != nil {
+      return err
+    }
+    b = append(append(b, line...), '\n')
+  }
+  if len(b) == 0 {
+    return nil
+  }
+
+  if err := o.rotate(int64(len(b))); err != nil {
+    return fmt.Errorf("failed to rotate %s: %v", o.path, err)
+  }
+  f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+  if err != nil {
+    return err
+  }
+  if _, err := f.Write(b); err != nil {
+    f.Close()
+    return err
+  }
+  return f.Close()
+}
+
+// rotate makes room for n more bytes in the file.
+func (o *EventLogOutput) rotate(n int64) error {
+  if o.maxSize <= 0 {
+    return nil
+  }
+  fi, err := os.Stat(o.path)
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  if fi.Size() == 0 || fi.Size() + n <= o.maxSize {
+    return nil
+  }
+
+  if o.maxFiles <= 0 {
+    return os.Remove(o.path)
+  }
+  for i := o.maxFiles - 1; i > 0; i-- {
+    err := os.Rename(fmt.Sprintf("%s.%d", o.path, i), fmt.Sprintf("%s.%d", o.path, i + 1))
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+  }
+  return os.Rename(o.path, o.path + ".1")
+}
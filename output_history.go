@@ -0,0 +1,132 @@
+package main
+
+import (
+  "sort"
+  "sync"
+  "time"
+  "bytes"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+  // historyResolution is the least time between two kept rates of a link;
+  // polls in between are not recorded.
+  historyResolution = time.Minute
+  // historyCompare is how far back the current rates are compared with.
+  historyCompare    = 24 * time.Hour
+  // historyTolerance is how far from exactly historyCompare ago a kept rate
+  // may be and still be compared with.
+  historyTolerance  = 10 * time.Minute
+)
+
+var historyChange = prometheus.NewDesc(
+  prometheus.BuildFQName(namespace, "station", "rate_change_24h_bytes"),
+  "Change in the average PHY data rate reported for a station since 24 hours earlier, from the in-memory history",
+  []string{"mac_address", "direction", "protocol", "reporter_mac"},
+  nil)
+
+// HistoryOutput keeps the rate of every link in memory for the retention
+// period, and exports the change in each current rate since a day earlier,
+// so that daily patterns can be told apart without long-range queries.
+type HistoryOutput struct {
+  retention time.Duration
+  mutex     sync.Mutex
+  rates     map[historyKey][]rateSample
+  // current are the rates of the last published snapshot.
+  current   map[historyKey]rateSample
+}
+
+// historyKey identifies one direction of a link, as seen by its reporter.
+type historyKey struct {
+  reporter  string
+  peer      string
+  direction string
+  protocol  string
+}
+
+type rateSample struct {
+  time time.Time
+  rate float64
+}
+
+func NewHistoryOutput(retention time.Duration) *HistoryOutput {
+  return &HistoryOutput{
+    retention: retention,
+    rates:     map[historyKey][]rateSample{},
+    current:   map[historyKey]rateSample{},
+  }
+}
+
+func (o *HistoryOutput) Name() string {
+  return "history"
+}
+
+func (o *HistoryOutput) Publish(s *Snapshot) error {
+  o.mutex.Lock()
+  defer o.mutex.Unlock()
+
+  o.current = map[historyKey]rateSample{}
+  for _, link := range s.Links {
+    key := historyKey{reporter: link.Reporter.String(), direction: "rx", protocol: link.Protocol}
+    if bytes.Equal(link.Source, link.Reporter) {
+      key.peer, key.direction = link.Destination.String(), "tx"
+    } else {
+      key.peer = link.Source.String()
+    }
+    sample := rateSample{s.Time, link.Rate}
+    o.current[key] = sample
+    samples := o.rates[key]
+    if n := len(samples); n == 0 || s.Time.Sub(samples[n - 1].time) >= historyResolution {
+      o.rates[key] = append(samples, sample)
+    }
+  }
+
+  cutoff := s.Time.Add(-o.retention)
+  for key, samples := range o.rates {
+    i := sort.Search(len(samples), func(i int) bool { return samples[i].time.After(cutoff) })
+    if i == len(samples) {
+      delete(o.rates, key)
+    } else if i > 0 {
+      o.rates[key] = append([]rateSample(nil), samples[i:]...)
+    }
+  }
+  return nil
+}
+
+// at returns the kept rate of the link closest to t, if one is within
+// historyTolerance of it.
+func (o *HistoryOutput) at(key historyKey, t time.Time) (float64, bool) {
+  samples := o.rates[key]
+  i := sort.Search(len(samples), func(i int) bool { return !samples[i].time.Before(t) })
+  best, found := time.Duration(0), false
+  var rate float64
+  for _, j := range []int{i - 1, i} {
+    if j < 0 || j >= len(samples) {
+      continue
+    }
+    d := samples[j].time.Sub(t)
+    if d < 0 {
+      d = -d
+    }
+    if d <= historyTolerance && (!found || d < best) {
+      best, found, rate = d, true, samples[j].rate
+    }
+  }
+  return rate, found
+}
+
+func (o *HistoryOutput) Describe(ch chan<- *prometheus.Desc) {
+  ch <- historyChange
+}
+
+func (o *HistoryOutput) Collect(ch chan<- prometheus.Metric) {
+  o.mutex.Lock()
+  defer o.mutex.Unlock()
+  for key, sample := range o.current {
+    if old, ok := o.at(key, sample.time.Add(-historyCompare)); ok {
+      ch <- prometheus.MustNewConstMetric(historyChange, prometheus.GaugeValue,
+            sample.rate - old, key.peer, key.direction, key.protocol, key.reporter)
+    }
+  }
+}
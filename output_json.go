@@ -0,0 +1,52 @@
+package main
+
+import (
+  "os"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+)
+
+// JSONFileOutput writes each snapshot to a file as an API topology document,
+// replacing it atomically so readers never observe a partially written one.
+type JSONFileOutput struct {
+  path string
+}
+
+func NewJSONFileOutput(path string) *JSONFileOutput {
+  return &JSONFileOutput{path: path}
+}
+
+func (o *JSONFileOutput) Name() string {
+  return "json-file"
+}
+
+func (o *JSONFileOutput) Publish(s *Snapshot) error {
+  b, err := json.MarshalIndent(new_api_topology(s), "", "  ")
+  if err != nil {
+    return err
+  }
+  return write_file_atomic(o.path, b)
+}
+
+// write_file_atomic replaces the file at path with b, by writing a temporary
+// file next to it and renaming it into place.
+func write_file_atomic(path string, b []byte) error {
+  f, err := ioutil.TempFile(filepath.Dir(path), "." + filepath.Base(path))
+  if err != nil {
+    return err
+  }
+  defer os.Remove(f.Name())
+  if err := f.Chmod(0644); err != nil {
+    f.Close()
+    return err
+  }
+  if _, err := f.Write(b); err != nil {
+    f.Close()
+    return err
+  }
+  if err := f.Close(); err != nil {
+    return err
+  }
+  return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "time"
+  "errors"
+  "sync"
+  "crypto/tls"
+  "encoding/json"
+  "encoding/binary"
+
+  "github.com/prometheus/common/config"
+)
+
+// MQTT 3.1.1 control packet types, in the high nibble of the first byte.
+const (
+  mqttConnect    = 0x10
+  mqttConnack    = 0x20
+  mqttPublish    = 0x30
+  mqttPuback     = 0x40
+  mqttDisconnect = 0xE0
+)
+
+// MQTTOutput publishes each snapshot to an MQTT broker, as an API topology
+// document on <topic>/topology and the API document of each station on
+// <topic>/stations/<mac>. It keeps one connection to the broker, opened on
+// the first snapshot and again once it is lost, and publishes with QoS 1,
+// so that a broker that does not acknowledge every message fails the
+// publish.
+type MQTTOutput struct {
+  broker   string
+  clientID string
+  topic    string
+  username string
+  password string
+  retain   bool
+  timeout  time.Duration
+  tls      *tls.Config
+
+  mutex    sync.Mutex
+  conn     net.Conn
+  // nextID is the packet identifier of the next PUBLISH. It is never 0.
+  nextID   uint16
+}
+
+func NewMQTTOutput(cfg MQTTConfig) (*MQTTOutput, error) {
+  o := &MQTTOutput{
+    broker:   cfg.Broker,
+    clientID: cfg.ClientID,
+    topic:    cfg.Topic,
+    username: cfg.Username,
+    password: string(cfg.Password),
+    retain:   cfg.Retain,
+    timeout:  time.Duration(cfg.Timeout),
+  }
+  port := "1883"
+  if cfg.TLSConfig != nil {
+    c, err := config.NewTLSConfig(cfg.TLSConfig)
+    if err != nil {
+      return nil, err
+    }
+    o.tls = c
+    port = "8883"
+  }
+  if _, _, err := net.SplitHostPort(o.broker); err != nil {
+    o.broker = net.JoinHostPort(o.broker, port)
+  }
+  if o.tls != nil && o.tls.ServerName == "" {
+    o.tls.ServerName, _, _ = net.SplitHostPort(o.broker)
+  }
+  if o.clientID == "" {
+    o.clientID = "homeplug_exporter"
+  }
+  if o.topic == "" {
+    o.topic = "homeplug"
+  }
+  if o.timeout == 0 {
+    o.timeout = 10 * time.Second
+  }
+  return o, nil
+}
+
+func (o *MQTTOutput) Name() string {
+  return "mqtt " + o.broker
+}
+
+func (o *MQTTOutput) Publish(s *Snapshot) error {
+  t := new_api_topology(s)
+  b, err := json.Marshal(t)
+  if err != nil {
+    return err
+  }
+  msgs := []mqttMessage{{o.topic + "/topology", b}}
+  for _, st := range t.Stations {
+    b, err := json.Marshal(st)
+    if err != nil {
+      return err
+    }
+    msgs = append(msgs, mqttMessage{o.topic + "/stations/" + st.Address, b})
+  }
+  return o.send(msgs)
+}
+
+type mqttMessage struct {
+  topic   string
+  payload []byte
+}
+
+// send publishes msgs on the open connection, or on a new one if there is
+// none. If the open one turns out to have been lost, msgs are published
+// again on a new one. A connection that fails is closed, for the next
+// snapshot to open another.
+func (o *MQTTOutput) send(msgs []mqttMessage) error {
+  o.mutex.Lock()
+  defer o.mutex.Unlock()
+  reused := o.conn != nil
+  if !reused {
+    if err := o.connect(); err != nil {
+      return err
+    }
+  }
+  err := o.publish(msgs)
+  if err != nil && reused {
+    o.close()
+    pollerLog.Debugf("connection to %s lost, reconnecting: %v", o.broker, err)
+    if err = o.connect(); err != nil {
+      return err
+    }
+    err = o.publish(msgs)
+  }
+  if err != nil {
+    o.close()
+  }
+  return err
+}
+
+// connect opens the connection, for a clean session without keep-alive, as
+// the broker is only sent anything once per snapshot.
+func (o *MQTTOutput) connect() error {
+  dialer := &net.Dialer{Timeout: o.timeout}
+  var conn net.Conn
+  var err error
+  if o.tls != nil {
+    conn, err = tls.DialWithDialer(dialer, "tcp", o.broker, o.tls)
+  } else {
+    conn, err = dialer.Dial("tcp", o.broker)
+  }
+  if err != nil {
+    return err
+  }
+  if err := conn.SetDeadline(time.Now().Add(o.timeout)); err != nil {
+    conn.Close()
+    return err
+  }
+  if _, err := conn.Write(mqtt_connect(o.clientID, o.username, o.password)); err != nil {
+    conn.Close()
+    return err
+  }
+  kind, b, err := mqtt_read(conn)
+  if err == nil && (kind != mqttConnack || len(b) != 2) {
+    err = fmt.Errorf("broker sent packet type %#x instead of CONNACK", kind)
+  } else if err == nil && b[1] != 0 {
+    err = fmt.Errorf("broker refused the connection with return code %d", b[1])
+  }
+  if err != nil {
+    conn.Close()
+    return err
+  }
+  o.conn = conn
+  return nil
+}
+
+// publish sends msgs and waits for the PUBACK of each. A PUBACK for a packet
+// identifier that is not outstanding, whether it was never sent or has
+// already been acknowledged, fails the publish.
+func (o *MQTTOutput) publish(msgs []mqttMessage) error {
+  if err := o.conn.SetDeadline(time.Now().Add(o.timeout)); err != nil {
+    return err
+  }
+  outstanding := map[uint16]bool{}
+  for _, m := range msgs {
+    id := o.packetID()
+    if outstanding[id] {
+      return fmt.Errorf("more than %d messages in a snapshot", len(outstanding))
+    }
+    outstanding[id] = true
+    if _, err := o.conn.Write(mqtt_publish(m.topic, m.payload, id, o.retain)); err != nil {
+      return err
+    }
+  }
+  for len(outstanding) > 0 {
+    kind, b, err := mqtt_read(o.conn)
+    if err != nil {
+      return fmt.Errorf("%d of %d messages acknowledged: %v", len(msgs) - len(outstanding), len(msgs), err)
+    }
+    if kind != mqttPuback || len(b) != 2 {
+      return fmt.Errorf("broker sent packet type %#x instead of PUBACK", kind)
+    }
+    id := binary.BigEndian.Uint16(b)
+    if !outstanding[id] {
+      return fmt.Errorf("broker sent a PUBACK for packet %d, which is not awaiting one", id)
+    }
+    delete(outstanding, id)
+  }
+  return nil
+}
+
+// packetID returns the next packet identifier, skipping 0.
+func (o *MQTTOutput) packetID() uint16 {
+  o.nextID++
+  if o.nextID == 0 {
+    o.nextID = 1
+  }
+  return o.nextID
+}
+
+func (o *MQTTOutput) close() {
+  if o.conn != nil {
+    o.conn.Close()
+    o.conn = nil
+  }
+}
+
+// Close disconnects from the broker.
+func (o *MQTTOutput) Close() {
+  o.mutex.Lock()
+  defer o.mutex.Unlock()
+  if o.conn != nil {
+    o.conn.SetDeadline(time.Now().Add(o.timeout))
+    o.conn.Write([]byte{mqttDisconnect, 0})
+  }
+  o.close()
+}
+
+// mqtt_connect is a CONNECT packet for a clean session without keep-alive.
+func mqtt_connect(clientID, username, password string) []byte {
+  b := mqtt_string(nil, "MQTT")
+  flags := byte(0x02)
+  if username != "" {
+    flags |= 0x80
+  }
+  if password != "" {
+    flags |= 0x40
+  }
+  b = append(b, 4, flags, 0, 0)
+  b = mqtt_string(b, clientID)
+  if username != "" {
+    b = mqtt_string(b, username)
+  }
+  if password != "" {
+    b = mqtt_string(b, password)
+  }
+  return mqtt_packet(mqttConnect, b)
+}
+
+// mqtt_publish is a QoS 1 PUBLISH packet.
+func mqtt_publish(topic string, payload []byte, id uint16, retain bool) []byte {
+  flags := byte(0x02)
+  if retain {
+    flags |= 0x01
+  }
+  b := mqtt_string(nil, topic)
+  b = append(b, byte(id >> 8), byte(id))
+  return mqtt_packet(mqttPublish | flags, append(b, payload...))
+}
+
+func mqtt_string(b []byte, s string) []byte {
+  return append(append(b, byte(len(s) >> 8), byte(len(s))), s...)
+}
+
+// mqtt_packet prepends the fixed header, whose remaining length is encoded
+// seven bits at a time, least significant first.
+func mqtt_packet(first byte, body []byte) []byte {
+  b := []byte{first}
+  n := len(body)
+  for {
+    c := byte(n & 0x7F)
+    n >>= 7
+    if n > 0 {
+      c |= 0x80
+    }
+    b = append(b, c)
+    if n == 0 {
+      break
+    }
+  }
+  return append(b, body...)
+}
+
+// mqtt_read reads a packet, returning its type and the rest of it. Brokers
+// only send short packets to a publisher, so longer ones are refused.
+func mqtt_read(r io.Reader) (byte, []byte, error) {
+  var h [1]byte
+  if _, err := io.ReadFull(r, h[:]); err != nil {
+    return 0, nil, err
+  }
+  n := 0
+  for shift := uint(0); ; shift += 7 {
+    if shift > 21 {
+      return 0, nil, errors.New("broker sent an invalid remaining length")
+    }
+    var c [1]byte
+    if _, err := io.ReadFull(r, c[:]); err != nil {
+      return 0, nil, err
+    }
+    n |= int(c[0] & 0x7F) << shift
+    if c[0] & 0x80 == 0 {
+      break
+    }
+  }
+  if n > 64 * 1024 {
+    return 0, nil, fmt.Errorf("broker sent a %d-byte packet", n)
+  }
+  b := make([]byte, n)
+  if _, err := io.ReadFull(r, b); err != nil {
+    return 0, nil, err
+  }
+  return h[0] & 0xF0, b, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+  "net"
+  "time"
+  "bytes"
+  "testing"
+  "encoding/binary"
+
+  "github.com/prometheus/common/model"
+)
+
+// fakeBroker accepts connections one at a time, acknowledges the CONNECT and
+// every PUBLISH on each, and hands what it read over on done once a
+// connection ends. ack, if given, picks the packet identifier each PUBACK
+// carries, from the one the PUBLISH carried; it returns false to drop the
+// connection instead.
+type fakeBroker struct {
+  connect chan []byte
+  done    chan map[string][]byte
+  ack     func(id uint16) (uint16, bool)
+}
+
+func new_fake_broker(t *testing.T, conns int, ack func(id uint16) (uint16, bool)) (*fakeBroker, string) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  f := &fakeBroker{make(chan []byte, conns), make(chan map[string][]byte, conns), ack}
+  go func() {
+    defer l.Close()
+    for i := 0; i < conns; i++ {
+      conn, err := l.Accept()
+      if err != nil {
+        t.Error(err)
+        return
+      }
+      f.serve(t, conn)
+    }
+  }()
+  return f, l.Addr().String()
+}
+
+func (f *fakeBroker) serve(t *testing.T, conn net.Conn) {
+  defer conn.Close()
+  conn.SetDeadline(time.Now().Add(5 * time.Second))
+  kind, b, err := mqtt_read(conn)
+  if err != nil || kind != mqttConnect {
+    t.Errorf("read %#x, %v instead of CONNECT", kind, err)
+    return
+  }
+  f.connect <- b
+  conn.Write([]byte{mqttConnack, 2, 0, 0})
+  published := map[string][]byte{}
+  defer func() { f.done <- published }()
+  for {
+    kind, b, err := mqtt_read(conn)
+    if err != nil || kind == mqttDisconnect {
+      return
+    }
+    if kind != mqttPublish {
+      t.Errorf("read packet type %#x instead of PUBLISH", kind)
+      return
+    }
+    n := int(binary.BigEndian.Uint16(b))
+    topic, id := string(b[2:2 + n]), binary.BigEndian.Uint16(b[2 + n:4 + n])
+    published[topic] = b[4 + n:]
+    if f.ack != nil {
+      var ok bool
+      if id, ok = f.ack(id); !ok {
+        return
+      }
+    }
+    conn.Write([]byte{mqttPuback, 2, byte(id >> 8), byte(id)})
+  }
+}
+
+func mqtt_test_snapshot() *Snapshot {
+  return &Snapshot{
+    Target:   net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+    Time:     time.Unix(1000000, 0),
+    Stations: []Station{{Address: net.HardwareAddr{0x00, 0xB0, 0x52, 0xAA, 0x00, 0x01}}},
+  }
+}
+
+func TestMQTTOutputPublish(t *testing.T) {
+  f, addr := new_fake_broker(t, 1, nil)
+  o, err := NewMQTTOutput(MQTTConfig{Broker: addr, Topic: "site", Username: "homeplug", Password: "secret"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Both snapshots go over the one connection.
+  for i := 0; i < 2; i++ {
+    if err := o.Publish(mqtt_test_snapshot()); err != nil {
+      t.Fatal(err)
+    }
+  }
+  o.Close()
+
+  want := mqtt_string(nil, "MQTT")
+  want = append(want, 4, 0xC2, 0, 0)
+  for _, s := range []string{"homeplug_exporter", "homeplug", "secret"} {
+    want = mqtt_string(want, s)
+  }
+  if b := <-f.connect; !bytes.Equal(b, want) {
+    t.Errorf("CONNECT = %x, want %x", b, want)
+  }
+  published := <-f.done
+  for _, topic := range []string{"site/topology", "site/stations/00:b0:52:aa:00:01"} {
+    if len(published[topic]) == 0 {
+      t.Errorf("nothing published to %s", topic)
+    }
+  }
+  if len(published) != 2 {
+    t.Errorf("published to %d topics, want 2", len(published))
+  }
+}
+
+func TestMQTTOutputPuback(t *testing.T) {
+  for _, c := range []struct {
+    name string
+    ack  func(id uint16) (uint16, bool)
+  }{
+    {"wrong", func(id uint16) (uint16, bool) { return id + 100, true }},
+    // Each message acknowledged as the first, so the second ack is a duplicate.
+    {"duplicate", func(id uint16) (uint16, bool) { return 1, true }},
+  } {
+    f, addr := new_fake_broker(t, 1, c.ack)
+    o, err := NewMQTTOutput(MQTTConfig{Broker: addr, Timeout: model.Duration(time.Second)})
+    if err != nil {
+      t.Fatal(err)
+    }
+    if err := o.Publish(mqtt_test_snapshot()); err == nil {
+      t.Errorf("%s packet identifier acknowledged without an error", c.name)
+    }
+    <-f.done
+  }
+}
+
+func TestMQTTOutputReconnect(t *testing.T) {
+  // The first connection is dropped after the first snapshot has been
+  // acknowledged, so the second is published on a new one.
+  n := 0
+  f, addr := new_fake_broker(t, 2, func(id uint16) (uint16, bool) {
+    n++
+    return id, n != 3
+  })
+  o, err := NewMQTTOutput(MQTTConfig{Broker: addr})
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 2; i++ {
+    if err := o.Publish(mqtt_test_snapshot()); err != nil {
+      t.Fatalf("snapshot %d: %v", i, err)
+    }
+  }
+  o.Close()
+  <-f.done
+  if published := <-f.done; len(published) != 2 {
+    t.Errorf("published to %d topics after reconnecting, want 2", len(published))
+  }
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+  for _, c := range []struct {
+    n    int
+    want []byte
+  }{
+    {0, []byte{0}},
+    {127, []byte{0x7F}},
+    {128, []byte{0x80, 0x01}},
+    {16383, []byte{0xFF, 0x7F}},
+    {16384, []byte{0x80, 0x80, 0x01}},
+  } {
+    b := mqtt_packet(mqttPublish, make([]byte, c.n))
+    if !bytes.Equal(b[1:len(b) - c.n], c.want) {
+      t.Errorf("remaining length of %d = %x, want %x", c.n, b[1:len(b) - c.n], c.want)
+    }
+    kind, body, err := mqtt_read(bytes.NewReader(b))
+    if err != nil || kind != mqttPublish || len(body) != c.n {
+      t.Errorf("mqtt_read of %d bytes = %#x, %d bytes, %v", c.n, kind, len(body), err)
+    }
+  }
+}
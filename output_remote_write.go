@@ -0,0 +1,134 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "math"
+  "sort"
+  "time"
+  "bytes"
+  "context"
+  "net/http"
+  "io/ioutil"
+  "encoding/binary"
+
+  "github.com/golang/snappy"
+  dto "github.com/prometheus/client_model/go"
+)
+
+// RemoteWriteOutput pushes the metrics for each snapshot to a Prometheus
+// remote write endpoint, timestamped with the time of the poll.
+type RemoteWriteOutput struct {
+  exporter *Exporter
+  url      string
+  timeout  time.Duration
+  client   *http.Client
+}
+
+func NewRemoteWriteOutput(exporter *Exporter, cfg RemoteWriteConfig, client *http.Client) *RemoteWriteOutput {
+  timeout := time.Duration(cfg.Timeout)
+  if timeout == 0 {
+    timeout = 30 * time.Second
+  }
+  return &RemoteWriteOutput{
+    exporter: exporter,
+    url:      cfg.URL,
+    timeout:  timeout,
+    client:   client,
+  }
+}
+
+func (o *RemoteWriteOutput) Name() string {
+  return "remote-write " + o.url
+}
+
+func (o *RemoteWriteOutput) Publish(s *Snapshot) error {
+  mfs, err := o.exporter.gatherSnapshot(s)
+  if err != nil {
+    return err
+  }
+
+  b := encode_write_request(mfs, s.Time.UnixNano() / int64(time.Millisecond))
+  req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(snappy.Encode(nil, b)))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Encoding", "snappy")
+  req.Header.Set("Content-Type", "application/x-protobuf")
+  req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+  ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+  defer cancel()
+  resp, err := o.client.Do(req.WithContext(ctx))
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode / 100 != 2 {
+    body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+    return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(body))
+  }
+  return nil
+}
+
+// encode_write_request encodes the gauges and counters in mfs as a remote
+// write WriteRequest protobuf message. The message is simple enough that it
+// is encoded by hand rather than pulling in the Prometheus server's types.
+func encode_write_request(mfs []*dto.MetricFamily, timestamp int64) []byte {
+  var req []byte
+  for _, mf := range mfs {
+    for _, m := range mf.Metric {
+      var value float64
+      switch {
+      case m.Gauge != nil:
+        value = m.Gauge.GetValue()
+      case m.Counter != nil:
+        value = m.Counter.GetValue()
+      case m.Untyped != nil:
+        value = m.Untyped.GetValue()
+      default:
+        continue
+      }
+
+      labels := map[string]string{"__name__": mf.GetName()}
+      for _, lp := range m.Label {
+        labels[lp.GetName()] = lp.GetValue()
+      }
+      names := make([]string, 0, len(labels))
+      for name := range labels {
+        names = append(names, name)
+      }
+      sort.Strings(names)
+
+      var ts []byte
+      for _, name := range names {
+        var label []byte
+        label = append_proto_bytes(label, 1, []byte(name))
+        label = append_proto_bytes(label, 2, []byte(labels[name]))
+        ts = append_proto_bytes(ts, 1, label)
+      }
+      var sample []byte
+      sample = append(sample, 1 << 3 | 1)
+      sample = append(sample, make([]byte, 8)...)
+      binary.LittleEndian.PutUint64(sample[len(sample)-8:], math.Float64bits(value))
+      sample = append(sample, 2 << 3)
+      sample = append_uvarint(sample, uint64(timestamp))
+      ts = append_proto_bytes(ts, 2, sample)
+
+      req = append_proto_bytes(req, 1, ts)
+    }
+  }
+  return req
+}
+
+func append_proto_bytes(b []byte, field int, v []byte) []byte {
+  b = append_uvarint(b, uint64(field) << 3 | 2)
+  b = append_uvarint(b, uint64(len(v)))
+  return append(b, v...)
+}
+
+func append_uvarint(b []byte, v uint64) []byte {
+  var buf [binary.MaxVarintLen64]byte
+  n := binary.PutUvarint(buf[:], v)
+  return append(b, buf[:n]...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+  "os"
+  "bytes"
+  "path/filepath"
+
+  "github.com/prometheus/common/expfmt"
+)
+
+// TextfileOutput maintains a file for the node_exporter textfile collector,
+// holding the metrics for the latest snapshot. The file is replaced
+// atomically; its temporary name does not end in .prom, so node_exporter
+// never reads a partially written one.
+type TextfileOutput struct {
+  exporter *Exporter
+  path     string
+}
+
+func NewTextfileOutput(exporter *Exporter, dir string) *TextfileOutput {
+  return &TextfileOutput{
+    exporter: exporter,
+    path:     filepath.Join(dir, "homeplug.prom"),
+  }
+}
+
+func (o *TextfileOutput) Name() string {
+  return "textfile"
+}
+
+func (o *TextfileOutput) Publish(s *Snapshot) error {
+  mfs, err := o.exporter.gatherSnapshot(s)
+  if err != nil {
+    return err
+  }
+
+  var b bytes.Buffer
+  for _, mf := range mfs {
+    if _, err := expfmt.MetricFamilyToText(&b, mf); err != nil {
+      return err
+    }
+  }
+  return write_file_atomic(o.path, b.Bytes())
+}
+
+// Remove deletes the file, so that node_exporter stops serving stale metrics.
+func (o *TextfileOutput) Remove() error {
+  err := os.Remove(o.path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  return err
+}
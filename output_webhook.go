@@ -0,0 +1,118 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "time"
+  "bytes"
+  "context"
+  "net/http"
+  "io/ioutil"
+  "text/template"
+  "encoding/json"
+)
+
+var defaultWebhookEvents = []string{eventStationJoined, eventStationLeft}
+
+// WebhookOutput posts the topology events between consecutive snapshots to a
+// URL, one request per event. The body is the event as JSON, or the result of
+// executing the configured template with the Event.
+type WebhookOutput struct {
+  url     string
+  events  map[string]bool
+  body    *template.Template
+  timeout time.Duration
+  client  *http.Client
+  prev    *Snapshot
+}
+
+// parse_webhook_template parses a webhook body template. Besides the usual
+// functions, templates have json, which encodes its argument as JSON so that
+// values can be quoted safely.
+func parse_webhook_template(text string) (*template.Template, error) {
+  return template.New("body").Funcs(template.FuncMap{
+    "json": func(v interface{}) (string, error) {
+      b, err := json.Marshal(v)
+      return string(b), err
+    },
+  }).Parse(text)
+}
+
+func NewWebhookOutput(cfg WebhookConfig, client *http.Client) (*WebhookOutput, error) {
+  o := &WebhookOutput{
+    url:     cfg.URL,
+    events:  map[string]bool{},
+    timeout: time.Duration(cfg.Timeout),
+    client:  client,
+  }
+  if o.timeout == 0 {
+    o.timeout = 10 * time.Second
+  }
+  events := cfg.Events
+  if len(events) == 0 {
+    events = defaultWebhookEvents
+  }
+  for _, e := range events {
+    o.events[e] = true
+  }
+  if cfg.Body != "" {
+    t, err := parse_webhook_template(cfg.Body)
+    if err != nil {
+      return nil, err
+    }
+    o.body = t
+  }
+  return o, nil
+}
+
+func (o *WebhookOutput) Name() string {
+  return "webhook " + o.url
+}
+
+func (o *WebhookOutput) Publish(s *Snapshot) error {
+  prev := o.prev
+  o.prev = s
+  if prev == nil {
+    return nil
+  }
+
+  for _, e := range diff_snapshots(prev, s, nil) {
+    if !o.events[e.Type] {
+      continue
+    }
+    if err := o.send(&e); err != nil {
+      return fmt.Errorf("failed to send %s event for %s: %v", e.Type, e.Address, err)
+    }
+  }
+  return nil
+}
+
+func (o *WebhookOutput) send(e *Event) error {
+  var body bytes.Buffer
+  if o.body != nil {
+    if err := o.body.Execute(&body, e); err != nil {
+      return err
+    }
+  } else if err := json.NewEncoder(&body).Encode(e); err != nil {
+    return err
+  }
+
+  req, err := http.NewRequest(http.MethodPost, o.url, &body)
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+
+  ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+  defer cancel()
+  resp, err := o.client.Do(req.WithContext(ctx))
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode / 100 != 2 {
+    b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+    return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(b))
+  }
+  return nil
+}
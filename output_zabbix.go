@@ -0,0 +1,219 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "sort"
+  "time"
+  "bytes"
+  "errors"
+  "strconv"
+  "strings"
+  "io/ioutil"
+  "text/template"
+  "encoding/json"
+  "encoding/binary"
+
+  dto "github.com/prometheus/client_model/go"
+)
+
+// zabbixHeader starts every message of the Zabbix sender protocol, followed
+// by the length of the JSON data as a little-endian uint64.
+const zabbixHeader = "ZBXD\x01"
+
+// ZabbixOutput pushes the metrics for each snapshot to a Zabbix server or
+// proxy as trapper items, the way zabbix_sender does. Each series becomes an
+// item of the configured host whose key is given by the first item mapping
+// for its metric, or is the metric name with the label values as parameters
+// if there are no mappings.
+type ZabbixOutput struct {
+  exporter *Exporter
+  server   string
+  host     string
+  timeout  time.Duration
+  items    map[string]*template.Template
+}
+
+type zabbixItem struct {
+  Host  string `json:"host"`
+  Key   string `json:"key"`
+  Value string `json:"value"`
+  Clock int64  `json:"clock"`
+  NS    int    `json:"ns"`
+}
+
+func NewZabbixOutput(exporter *Exporter, cfg ZabbixConfig) (*ZabbixOutput, error) {
+  o := &ZabbixOutput{
+    exporter: exporter,
+    server:   cfg.Server,
+    host:     cfg.Host,
+    timeout:  time.Duration(cfg.Timeout),
+  }
+  if _, _, err := net.SplitHostPort(o.server); err != nil {
+    o.server = net.JoinHostPort(o.server, "10051")
+  }
+  if o.timeout == 0 {
+    o.timeout = 10 * time.Second
+  }
+  if len(cfg.Items) > 0 {
+    o.items = map[string]*template.Template{}
+  }
+  for _, item := range cfg.Items {
+    if o.items[item.Metric] != nil {
+      continue
+    }
+    t, err := template.New(item.Metric).Option("missingkey=zero").Parse(item.Key)
+    if err != nil {
+      return nil, fmt.Errorf("item %s: %v", item.Metric, err)
+    }
+    o.items[item.Metric] = t
+  }
+  return o, nil
+}
+
+func (o *ZabbixOutput) Name() string {
+  return "zabbix " + o.host + "@" + o.server
+}
+
+func (o *ZabbixOutput) Publish(s *Snapshot) error {
+  mfs, err := o.exporter.gatherSnapshot(s)
+  if err != nil {
+    return err
+  }
+  items, err := o.items_for(mfs, s.Time)
+  if err != nil {
+    return err
+  }
+  if len(items) == 0 {
+    return nil
+  }
+  return o.send(items)
+}
+
+// items_for maps the gauges and counters in mfs to the items sent.
+func (o *ZabbixOutput) items_for(mfs []*dto.MetricFamily, t time.Time) ([]zabbixItem, error) {
+  var items []zabbixItem
+  for _, mf := range mfs {
+    tmpl := o.items[mf.GetName()]
+    if o.items != nil && tmpl == nil {
+      continue
+    }
+    for _, m := range mf.Metric {
+      var value float64
+      switch {
+      case m.Gauge != nil:
+        value = m.Gauge.GetValue()
+      case m.Counter != nil:
+        value = m.Counter.GetValue()
+      case m.Untyped != nil:
+        value = m.Untyped.GetValue()
+      default:
+        continue
+      }
+
+      var key string
+      if tmpl != nil {
+        labels := map[string]string{}
+        for _, lp := range m.Label {
+          labels[lp.GetName()] = lp.GetValue()
+        }
+        var b strings.Builder
+        if err := tmpl.Execute(&b, labels); err != nil {
+          return nil, fmt.Errorf("item %s: %v", mf.GetName(), err)
+        }
+        key = b.String()
+      } else {
+        key = zabbix_default_key(mf.GetName(), m.Label)
+      }
+      items = append(items, zabbixItem{
+        Host:  o.host,
+        Key:   key,
+        Value: strconv.FormatFloat(value, 'f', -1, 64),
+        Clock: t.Unix(),
+        NS:    t.Nanosecond(),
+      })
+    }
+  }
+  return items, nil
+}
+
+// zabbix_default_key is the metric name, with the label values in order of
+// label name as its parameters. Empty labels are left out, as they are in
+// Prometheus.
+func zabbix_default_key(name string, labels []*dto.LabelPair) string {
+  var sorted []*dto.LabelPair
+  for _, lp := range labels {
+    if lp.GetValue() != "" {
+      sorted = append(sorted, lp)
+    }
+  }
+  if len(sorted) == 0 {
+    return name
+  }
+  sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+  params := make([]string, len(sorted))
+  for i, lp := range sorted {
+    params[i] = zabbix_quote(lp.GetValue())
+  }
+  return name + "[" + strings.Join(params, ",") + "]"
+}
+
+// zabbix_quote quotes a key parameter if it contains characters that would
+// otherwise end it.
+func zabbix_quote(v string) string {
+  if !strings.ContainsAny(v, `,[]" `) {
+    return v
+  }
+  return `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+}
+
+func (o *ZabbixOutput) send(items []zabbixItem) error {
+  data, err := json.Marshal(struct {
+    Request string       `json:"request"`
+    Data    []zabbixItem `json:"data"`
+    Clock   int64        `json:"clock"`
+  }{"sender data", items, time.Now().Unix()})
+  if err != nil {
+    return err
+  }
+
+  conn, err := net.DialTimeout("tcp", o.server, o.timeout)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  if err := conn.SetDeadline(time.Now().Add(o.timeout)); err != nil {
+    return err
+  }
+  msg := make([]byte, len(zabbixHeader) + 8, len(zabbixHeader) + 8 + len(data))
+  copy(msg, zabbixHeader)
+  binary.LittleEndian.PutUint64(msg[len(zabbixHeader):], uint64(len(data)))
+  if _, err := conn.Write(append(msg, data...)); err != nil {
+    return err
+  }
+
+  b, err := ioutil.ReadAll(io.LimitReader(conn, 64 * 1024))
+  if err != nil {
+    return err
+  }
+  if len(b) < len(zabbixHeader) + 8 || !bytes.HasPrefix(b, []byte(zabbixHeader)) {
+    return errors.New("server sent an invalid response")
+  }
+  var resp struct {
+    Response string `json:"response"`
+    Info     string `json:"info"`
+  }
+  if err := json.Unmarshal(b[len(zabbixHeader) + 8:], &resp); err != nil {
+    return fmt.Errorf("server sent an invalid response: %v", err)
+  }
+  if resp.Response != "success" {
+    return fmt.Errorf("server returned %q: %s", resp.Response, resp.Info)
+  }
+  // Items that the server has no trapper item for are counted as failed,
+  // rather than failing the request.
+  if !strings.Contains(resp.Info, "failed: 0;") {
+    return fmt.Errorf("server did not accept every item: %s", resp.Info)
+  }
+  return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "sort"
+  "sync"
+  "time"
+  "bytes"
+  "strconv"
+  "sync/atomic"
+
+  "github.com/mdlayher/ethernet"
+  "github.com/mdlayher/raw"
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// PassiveListener counts the management frames sent by other stations on the
+// interface, including indications that are never asked for. It has a raw
+// socket of its own, so it sees every frame regardless of polling; on busy
+// segments, several sockets in a fanout group share the frames, each with a
+// reader of its own. Counts are kept in atomics and read directly by
+// Collect, so that neither side waits for the other.
+type PassiveListener struct {
+  iface   *net.Interface
+  readers []passiveReader
+  // sources maps a source address and MME type to its *passiveCounter.
+  // Adding one takes addMutex, and entries of them are kept, up to
+  // cacheMaxEntries.
+  sources  sync.Map
+  addMutex sync.Mutex
+  entries  int
+
+  frames   *prometheus.Desc
+  lastSeen *prometheus.Desc
+  drops    *prometheus.Desc
+}
+
+// passiveReader is a socket the passive listener receives frames on.
+type passiveReader interface {
+  ReadFrom(b []byte) (int, net.Addr, error)
+  Stats() (*raw.Stats, error)
+  Close() error
+}
+
+type passiveCounter struct {
+  source  string
+  mmeType string
+  frames  uint64
+  // lastSeen is in Unix nanoseconds.
+  lastSeen int64
+}
+
+// NewPassiveListener listens on iface for each of the EtherTypes, with the
+// given number of readers each.
+func NewPassiveListener(iface *net.Interface, readers int, etherTypes []uint16) (*PassiveListener, error) {
+  var conns []passiveReader
+  for _, et := range etherTypes {
+    if readers > 1 {
+      fanout, err := listen_fanout(iface, readers, et)
+      if err != nil {
+        for _, c := range conns {
+          c.Close()
+        }
+        return nil, err
+      }
+      conns = append(conns, fanout...)
+      continue
+    }
+    conn, err := raw.ListenPacket(iface, et, nil)
+    if err != nil {
+      for _, c := range conns {
+        c.Close()
+      }
+      return nil, err
+    }
+    conns = append(conns, conn)
+  }
+  return &PassiveListener{
+    iface:   iface,
+    readers: conns,
+    frames: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "passive", "frames_total"),
+      "Management frames observed from other stations, by source and MME type",
+      []string{"source_mac_address", "mme_type"},
+      nil),
+    lastSeen: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "passive", "last_frame_timestamp_seconds"),
+      "Time the last management frame was observed from other stations, by source and MME type",
+      []string{"source_mac_address", "mme_type"},
+      nil),
+    drops: prometheus.NewDesc(
+      prometheus.BuildFQName(namespace, "passive", "dropped_frames_total"),
+      "Frames the kernel dropped because the passive reader did not keep up, by reader",
+      []string{"reader"},
+      nil),
+  }, nil
+}
+
+// Run starts a goroutine receiving frames on each reader, until its socket
+// fails.
+func (l *PassiveListener) Run() {
+  for i, r := range l.readers {
+    go l.read(i, r)
+  }
+}
+
+func (l *PassiveListener) read(i int, r passiveReader) {
+  b := make([]byte, frame_size(l.iface, true))
+  for {
+    n, _, err := r.ReadFrom(b)
+    if err != nil {
+      transportLog.Errorf("passive reader %d stopped: %v", i, err)
+      return
+    }
+
+    var f ethernet.Frame
+    if err := (&f).UnmarshalBinary(b[:n]); err != nil {
+      continue
+    }
+    if bytes.Equal(f.Source, l.iface.HardwareAddr) {
+      continue
+    }
+    if f.EtherType == homeplug.LegacyEtherType {
+      var lf homeplug.LegacyFrame
+      if err := (&lf).UnmarshalBinary(f.Payload); err != nil {
+        continue
+      }
+      for _, e := range lf.Entries {
+        l.observe(f.Source.String(), fmt.Sprintf("%02x", e.Type))
+      }
+      continue
+    }
+    var h homeplug.Frame
+    if err := (&h).UnmarshalBinary(f.Payload); err != nil {
+      continue
+    }
+    l.observe(f.Source.String(), fmt.Sprintf("%04x", h.Type()))
+  }
+}
+
+func (l *PassiveListener) observe(source, mmeType string) {
+  key := source + "/" + mmeType
+  v, ok := l.sources.Load(key)
+  if !ok {
+    v = l.add(key, source, mmeType)
+  }
+  c := v.(*passiveCounter)
+  atomic.AddUint64(&c.frames, 1)
+  atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+}
+
+// add adds the counter of a source and MME type. If there are as many as
+// may be kept, the least recently seen tenth are evicted first: frames are
+// counted without keeping the counters in order, so they are found by
+// sorting them all.
+func (l *PassiveListener) add(key, source, mmeType string) *passiveCounter {
+  l.addMutex.Lock()
+  defer l.addMutex.Unlock()
+  if v, ok := l.sources.Load(key); ok {
+    return v.(*passiveCounter)
+  }
+
+  if cacheMaxEntries > 0 && l.entries >= cacheMaxEntries {
+    type seen struct {
+      key      interface{}
+      lastSeen int64
+    }
+    var all []seen
+    l.sources.Range(func(k, v interface{}) bool {
+      all = append(all, seen{k, atomic.LoadInt64(&v.(*passiveCounter).lastSeen)})
+      return true
+    })
+    sort.Slice(all, func(i, j int) bool { return all[i].lastSeen < all[j].lastSeen })
+    n := len(all) / 10 + 1
+    if n > len(all) {
+      n = len(all)
+    }
+    for _, s := range all[:n] {
+      l.sources.Delete(s.key)
+    }
+    l.entries = len(all) - n
+    cacheEvictions.WithLabelValues("passive").Add(float64(n))
+  }
+
+  c := &passiveCounter{source: source, mmeType: mmeType}
+  l.sources.Store(key, c)
+  l.entries++
+  cacheEntries.WithLabelValues("passive").Set(float64(l.entries))
+  return c
+}
+
+func (l *PassiveListener) Describe(ch chan<- *prometheus.Desc) {
+  ch <- l.frames
+  ch <- l.lastSeen
+  ch <- l.drops
+}
+
+func (l *PassiveListener) Collect(ch chan<- prometheus.Metric) {
+  l.sources.Range(func(_, v interface{}) bool {
+    c := v.(*passiveCounter)
+    ch <- prometheus.MustNewConstMetric(l.frames, prometheus.CounterValue,
+          float64(atomic.LoadUint64(&c.frames)), c.source, c.mmeType)
+    ch <- prometheus.MustNewConstMetric(l.lastSeen, prometheus.GaugeValue,
+          float64(atomic.LoadInt64(&c.lastSeen)) / 1e9, c.source, c.mmeType)
+    return true
+  })
+  for i, r := range l.readers {
+    stats, err := r.Stats()
+    if err != nil {
+      continue
+    }
+    ch <- prometheus.MustNewConstMetric(l.drops, prometheus.CounterValue,
+          float64(stats.Drops), strconv.Itoa(i))
+  }
+}
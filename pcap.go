@@ -0,0 +1,111 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "time"
+  "errors"
+  "encoding/binary"
+)
+
+// pcapLinkTypeEthernet is the only link type that can be read.
+const pcapLinkTypeEthernet = 1
+
+// pcapSnapLen is the longest frame written to a pcap stream.
+const pcapSnapLen = 65535
+
+// pcapReader reads the frames of a capture in the classic pcap format, of
+// either byte order and timestamp resolution, as they are written.
+type pcapReader struct {
+  r     io.Reader
+  order binary.ByteOrder
+}
+
+// new_pcap_reader reads the header of the capture in r.
+func new_pcap_reader(r io.Reader) (*pcapReader, error) {
+  var header [24]byte
+  if _, err := io.ReadFull(r, header[:]); err != nil {
+    return nil, fmt.Errorf("not a pcap file: %v", err)
+  }
+  p := &pcapReader{r: r}
+  switch binary.LittleEndian.Uint32(header[0:]) {
+  case 0xa1b2c3d4, 0xa1b23c4d:
+    p.order = binary.LittleEndian
+  case 0xd4c3b2a1, 0x4d3cb2a1:
+    p.order = binary.BigEndian
+  case 0x0a0d0d0a:
+    return nil, errors.New("pcapng files are not supported; convert with editcap -F pcap")
+  default:
+    return nil, errors.New("not a pcap file")
+  }
+  if linkType := p.order.Uint32(header[20:]) & 0xFFFF; linkType != pcapLinkTypeEthernet {
+    return nil, fmt.Errorf("link type %d is not Ethernet", linkType)
+  }
+  return p, nil
+}
+
+// Next returns the next frame, or io.EOF at the end of the capture.
+func (p *pcapReader) Next() ([]byte, error) {
+  var record [16]byte
+  if _, err := io.ReadFull(p.r, record[:]); err == io.EOF {
+    return nil, io.EOF
+  } else if err != nil {
+    return nil, fmt.Errorf("truncated record: %v", err)
+  }
+  n := p.order.Uint32(record[8:])
+  if n > 256 * 1024 {
+    return nil, fmt.Errorf("implausible record length %d", n)
+  }
+  b := make([]byte, n)
+  if _, err := io.ReadFull(p.r, b); err != nil {
+    return nil, fmt.Errorf("truncated record: %v", err)
+  }
+  return b, nil
+}
+
+// read_pcap returns the frames in a capture.
+func read_pcap(r io.Reader) ([][]byte, error) {
+  p, err := new_pcap_reader(r)
+  if err != nil {
+    return nil, err
+  }
+  var frames [][]byte
+  for {
+    b, err := p.Next()
+    if err == io.EOF {
+      return frames, nil
+    } else if err != nil {
+      return nil, err
+    }
+    frames = append(frames, b)
+  }
+}
+
+// write_pcap_header starts a capture of Ethernet frames in w, in the
+// microsecond pcap format.
+func write_pcap_header(w io.Writer) error {
+  var header [24]byte
+  binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+  binary.LittleEndian.PutUint16(header[4:], 2)
+  binary.LittleEndian.PutUint16(header[6:], 4)
+  binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+  binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeEthernet)
+  _, err := w.Write(header[:])
+  return err
+}
+
+// write_pcap_record adds frame b, sent at t, to the capture in w with a
+// single write.
+func write_pcap_record(w io.Writer, t time.Time, b []byte) error {
+  if len(b) > pcapSnapLen {
+    return fmt.Errorf("frame of %d bytes is too long", len(b))
+  }
+  record := make([]byte, 16 + len(b))
+  binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+  binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond() / 1000))
+  binary.LittleEndian.PutUint32(record[8:], uint32(len(b)))
+  binary.LittleEndian.PutUint32(record[12:], uint32(len(b)))
+  copy(record[16:], b)
+  _, err := w.Write(record)
+  return err
+}
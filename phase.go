@@ -0,0 +1,39 @@
+package main
+
+// How a link between two stations crosses the wiring, if the phases of both
+// are known.
+const (
+  couplingSamePhase  = "same_phase"
+  couplingCrossPhase = "cross_phase"
+)
+
+// coupling_path returns the coupling of the link between a and b, or "" if
+// the phase of either is unknown. Signals between phases only couple through
+// the distribution board or the neighbours' wiring, which is the usual
+// reason for a link to be much slower in one direction than the other.
+func coupling_path(a, b *Station) string {
+  if a == nil || b == nil || a.Phase == "" || b.Phase == "" {
+    return ""
+  }
+  if a.Phase == b.Phase {
+    return couplingSamePhase
+  }
+  return couplingCrossPhase
+}
+
+// link_coupling returns the coupling of the link between source and
+// destination in s.
+func link_coupling(s *Snapshot, l Link) string {
+  return coupling_path(s.Station(l.Source), s.Station(l.Destination))
+}
+
+// assign_phases sets the phase of every station listed in phases, keyed by
+// the string form of the address. Configured phases replace those that a
+// decoder inferred from vendor diagnostics, which are only hints.
+func assign_phases(s *Snapshot, phases map[string]string) {
+  for i := range s.Stations {
+    if phase, ok := phases[s.Stations[i].Address.String()]; ok {
+      s.Stations[i].Phase = phase
+    }
+  }
+}
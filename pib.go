@@ -0,0 +1,171 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "bytes"
+  "context"
+  "strconv"
+  "strings"
+  "net/http"
+  "encoding/binary"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// modulePIB is the VS_RD_MOD module of the PIB. The firmware is module 1,
+// but its length is only known by walking the chain of image headers, so it
+// can't be dumped yet.
+const modulePIB = 0x02
+
+const (
+  // moduleChunkSize is the most read with each VS_RD_MOD.REQ, as in
+  // open-plc-utils.
+  moduleChunkSize = 1024
+  // moduleReadRetries is how many times a chunk is asked for again before
+  // the read fails.
+  moduleReadRetries = 3
+  // pibMaxLength is the largest PIB length believed, well above that of
+  // any known adapter.
+  pibMaxLength = 1 << 20
+)
+
+// ReadModule reads length bytes at offset of a module of the Qualcomm
+// station dest, asking again for chunks that are lost or corrupted. The
+// poller is only held for each chunk, so that polls carry on during long
+// reads. Reading stops with the error of ctx once it is done.
+func (p *Poller) ReadModule(ctx context.Context, dest net.HardwareAddr, module uint8, offset uint32, length uint16) ([]byte, error) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+
+  if err := p.acquire(); err != nil {
+    return nil, err
+  }
+  var err error
+  for attempt := 0; attempt <= moduleReadRetries; attempt++ {
+    if attempt > 0 {
+      p.retransmitted(nil, dest, 1)
+    }
+    var data []byte
+    if data, err = p.readModule(ctx, dest, module, offset, length); err == nil {
+      return data, nil
+    }
+    if ctx.Err() != nil {
+      return nil, err
+    }
+    pollerLog.Debugf("failed to read module %d of %v at offset %d: %v", module, dest, offset, err)
+  }
+  return nil, err
+}
+
+func (p *Poller) readModule(ctx context.Context, dest net.HardwareAddr, module uint8, offset uint32, length uint16) ([]byte, error) {
+  // The reply is not matched on its source, so that the local alias can be
+  // read from as well.
+  matches := func(m *homeplug.Message) bool {
+    return m.Frame.MMEType == homeplug.RdModCnf && len(m.Frame.Payload) >= 12 && binary.LittleEndian.Uint32(m.Frame.Payload[8:]) == offset
+  }
+  msgs, err := p.transport.Request(ctx, dest, []homeplug.Frame{homeplug.ReadModuleRequest(module, offset, length)}, queryTimeout, func(msgs []homeplug.Message) bool {
+    return matches(&msgs[len(msgs) - 1])
+  })
+  if err != nil {
+    return nil, err
+  }
+  for i := range msgs {
+    if !matches(&msgs[i]) {
+      continue
+    }
+    var c homeplug.ModuleChunk
+    if err := (&c).UnmarshalBinary(msgs[i].Frame.Payload); err != nil {
+      return nil, err
+    }
+    if c.Module != module || len(c.Data) != int(length) {
+      return nil, fmt.Errorf("got %d bytes of module %d, asked for %d of module %d", len(c.Data), c.Module, length, module)
+    }
+    return c.Data, nil
+  }
+  return nil, fmt.Errorf("no reply")
+}
+
+// pib_length returns the length of the PIB that starts with header.
+func pib_length(header []byte) (int, error) {
+  if len(header) < 8 {
+    return 0, io.ErrUnexpectedEOF
+  }
+  length := int(binary.LittleEndian.Uint16(header[4:]))
+  if length < 8 || length > pibMaxLength {
+    return 0, fmt.Errorf("implausible PIB length %d", length)
+  }
+  return length, nil
+}
+
+// pib_dump_handler serves the PIB of the station given by the target
+// parameter as a download. A single "bytes=N-" range is honoured, so that
+// interrupted downloads can be resumed, as by curl -C -.
+func pib_dump_handler(p *Poller) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    dest, err := net.ParseMAC(r.URL.Query().Get("target"))
+    if err != nil || len(dest) != 6 || dest[0] & 0x01 != 0 {
+      http.Error(w, "target must be a unicast MAC address", http.StatusBadRequest)
+      return
+    }
+    header, err := p.ReadModule(r.Context(), dest, modulePIB, 0, 8)
+    if err != nil {
+      http.Error(w, fmt.Sprintf("failed to read the PIB of %v: %v", dest, err), http.StatusBadGateway)
+      return
+    }
+    length, err := pib_length(header)
+    if err != nil {
+      http.Error(w, fmt.Sprintf("failed to read the PIB of %v: %v", dest, err), http.StatusBadGateway)
+      return
+    }
+    start, err := parse_byte_range(r.Header.Get("Range"), length)
+    if err != nil {
+      w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+      http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+      return
+    }
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.pib\"", strings.Replace(dest.String(), ":", "", -1)))
+    w.Header().Set("Content-Length", strconv.Itoa(length - start))
+    w.Header().Set("Accept-Ranges", "bytes")
+    if start > 0 {
+      w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, length - 1, length))
+      w.WriteHeader(http.StatusPartialContent)
+    }
+    for offset := start; offset < length; offset += moduleChunkSize {
+      n := length - offset
+      if n > moduleChunkSize {
+        n = moduleChunkSize
+      }
+      data, err := p.ReadModule(r.Context(), dest, modulePIB, uint32(offset), uint16(n))
+      if err != nil {
+        // The download is cut short, rather than completed with a bad
+        // PIB, so that it can be resumed from here.
+        httpLog.Errorf("Failed to read the PIB of %v at offset %d: %v", dest, offset, err)
+        panic(http.ErrAbortHandler)
+      }
+      if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+        return
+      }
+    }
+  }
+}
+
+// parse_byte_range returns the start of the range asked for by a Range
+// header, of the form "bytes=N-", or 0 if there is none.
+func parse_byte_range(header string, length int) (int, error) {
+  if header == "" {
+    return 0, nil
+  }
+  spec := strings.TrimPrefix(header, "bytes=")
+  if spec == header || !strings.HasSuffix(spec, "-") {
+    return 0, fmt.Errorf("only ranges of the form bytes=N- are supported")
+  }
+  start, err := strconv.Atoi(strings.TrimSuffix(spec, "-"))
+  if err != nil || start < 0 || start >= length {
+    return 0, fmt.Errorf("range %q is outside the PIB of %d bytes", header, length)
+  }
+  return start, nil
+}
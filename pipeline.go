@@ -0,0 +1,111 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "bytes"
+  "context"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// prefetch sends each Qualcomm reporter the requests of the firmware, link
+// stats and discover list collectors that are to run, back to back, and
+// keeps its confirms for the collectors to take with prefetched instead of
+// asking again. Link stats are only asked for links to peers of known TEI,
+// which is all that tells their confirms apart. It returns an error if a
+// reporter did not answer every request.
+func (p *Poller) prefetch(ctx context.Context, s *Snapshot, timeout time.Duration, firmware, linkStats, discover bool) error {
+  p.pipelined = map[string][]homeplug.Message{}
+  var failed error
+  for _, station := range s.Stations {
+    if !station.Reporter || station.Protocol != "qualcomm" {
+      continue
+    }
+    reporter := station.Address
+    if p.quarantine.Suspended(reporter) {
+      continue
+    }
+    if ctx.Err() != nil {
+      return ctx.Err()
+    }
+    var requests []homeplug.Frame
+    if firmware && !p.backoff.Suspended("firmware", reporter) {
+      requests = append(requests, homeplug.Frame{Version: homeplug.HPVersion, MMEType: homeplug.SwVerReq, Vendor: homeplug.HPVendor})
+    }
+    if linkStats && !p.backoff.Suspended("link_stats", reporter) {
+      for _, link := range s.Links {
+        if !bytes.Equal(link.Reporter, reporter) || !bytes.Equal(link.Source, reporter) {
+          continue
+        }
+        if peer := s.Station(link.Destination); peer != nil && peer.TEI != 0 {
+          requests = append(requests, homeplug.LinkStatsRequest(homeplug.LinkStatsTx, peer.Address), homeplug.LinkStatsRequest(homeplug.LinkStatsRx, peer.Address))
+        }
+      }
+    }
+    if discover && !p.backoff.Suspended("discover_list", reporter) {
+      requests = append(requests, homeplug.Frame{Version: homeplug.AVVersion, MMEType: homeplug.CCDiscoverListReq})
+    }
+    // A single request gains nothing from being sent ahead.
+    if len(requests) < 2 {
+      continue
+    }
+    msgs, err := p.transport.Request(ctx, reporter, requests, timeout, func(msgs []homeplug.Message) bool {
+      n := 0
+      for i := range msgs {
+        if bytes.Equal(msgs[i].Source, reporter) {
+          n++
+        }
+      }
+      return n >= len(requests)
+    })
+    if err != nil {
+      pollerLog.Errorf("Error sending pipelined requests to %v: %v", reporter, err)
+      if failed == nil {
+        failed = err
+      }
+      continue
+    }
+    answered := 0
+    p.pipelined[reporter.String()] = []homeplug.Message{}
+    for _, m := range msgs {
+      if bytes.Equal(m.Source, reporter) {
+        p.pipelined[reporter.String()] = append(p.pipelined[reporter.String()], m)
+        answered++
+      }
+    }
+    if answered < len(requests) && failed == nil {
+      failed = fmt.Errorf("%v answered %d of %d pipelined requests", reporter, answered, len(requests))
+    }
+  }
+  return failed
+}
+
+// prefetched returns the confirms of type cnf that prefetch kept from
+// reporter and that match, if there are want of them, or else nil, in which
+// case the collector asks for them itself. A reporter that answered none of
+// the pipelined requests would only time out again, so none are returned
+// for it, but not nil.
+func (p *Poller) prefetched(reporter net.HardwareAddr, cnf [2]byte, want int, match func(*homeplug.Message) bool) []homeplug.Message {
+  kept, ok := p.pipelined[reporter.String()]
+  if ok && len(kept) == 0 {
+    return []homeplug.Message{}
+  }
+  var msgs []homeplug.Message
+  for _, m := range kept {
+    if m.Legacy == nil && m.Frame.MMEType == cnf && (match == nil || match(&m)) {
+      msgs = append(msgs, m)
+    }
+  }
+  if len(msgs) < want {
+    return nil
+  }
+  return msgs
+}
+
+// link_stats_of reports whether m is a VS_LNK_STATS confirm for the link to
+// the station of TEI tei.
+func link_stats_of(m *homeplug.Message, tei uint8) bool {
+  return len(m.Frame.Payload) >= 4 && m.Frame.Payload[3] == tei
+}
@@ -0,0 +1,59 @@
+package homeplug
+
+import (
+  "fmt"
+  "strings"
+)
+
+// Anomalies lists the fields of a confirm that hold values the specification
+// reserves, and the bytes after its last entry that aren't padding. Decoders
+// return it once they have decoded everything else, so that the caller can
+// decide whether to keep what was decoded; vendor firmware is full of them.
+type Anomalies []Anomaly
+
+// Anomaly is a field of a confirm, and what is wrong with it.
+type Anomaly struct {
+  Field  string
+  Detail string
+}
+
+func (a Anomalies) Error() string {
+  parts := make([]string, len(a))
+  for i, x := range a {
+    parts[i] = x.Field + ": " + x.Detail
+  }
+  return "anomalous " + strings.Join(parts, ", ")
+}
+
+func (a *Anomalies) add(field, format string, args ...interface{}) {
+  *a = append(*a, Anomaly{field, fmt.Sprintf(format, args...)})
+}
+
+// merge adds the anomalies of an entry's decoder, and returns its error if
+// it is anything else.
+func (a *Anomalies) merge(err error) error {
+  if more, ok := err.(Anomalies); ok {
+    *a = append(*a, more...)
+    return nil
+  }
+  return err
+}
+
+// padding adds an anomaly if rest, what follows the last entry of a
+// confirm, is anything but the zeros that pad it to the minimum Ethernet
+// frame size.
+func (a *Anomalies) padding(rest []byte) {
+  for _, c := range rest {
+    if c != 0 {
+      a.add("trailing", "%d bytes after the last entry", len(rest))
+      return
+    }
+  }
+}
+
+func (a Anomalies) err() error {
+  if len(a) == 0 {
+    return nil
+  }
+  return a
+}
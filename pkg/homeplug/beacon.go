@@ -0,0 +1,118 @@
+package homeplug
+
+import (
+  "io"
+  "fmt"
+)
+
+// Beacon entry types carrying a schedule.
+const (
+  beNonPersistentSchedule = 0x00
+  bePersistentSchedule    = 0x01
+)
+
+// bePowerSave is the AV2 power save entry: a count of the stations that are
+// in power save, followed by their TEIs. They are still members of the
+// network, but don't answer until they wake.
+const bePowerSave = 0x0F
+
+// NetworkModes are the names of the network modes, indexed by the NM field
+// of the beacon header.
+var NetworkModes = []string{"uncoordinated", "coordinated", "csma_only"}
+
+// Beacon is the part of the beacon payload returned by the standard
+// CM_GET_BEACON.CNF that describes the CCo's schedule. Only the network mode,
+// the schedule entries and the power save entry are decoded; the rest of the
+// beacon header is skipped.
+type Beacon struct {
+  NetworkMode uint8
+  Allocations []Allocation
+  // Sleeping are the TEIs of the stations in power save.
+  Sleeping    []uint8
+}
+
+// Allocation is a session allocation: the time from Start to End,
+// in ATUs from the start of the beacon period, given to a link (GLID) or to
+// one of the special GLIDs.
+type Allocation struct {
+  GLID  uint8
+  Start uint16
+  End   uint16
+}
+
+func (b *Beacon) UnmarshalBinary(p []byte) error {
+  if len(p) < 13 {
+    return io.ErrUnexpectedEOF
+  }
+  b.NetworkMode = p[11] & 0x03
+  o := 13
+  for i := 0; i < int(p[12]); i++ {
+    if len(p) < o + 2 {
+      return io.ErrUnexpectedEOF
+    }
+    header, length := p[o], int(p[o + 1])
+    o += 2
+    if len(p) < o + length {
+      return io.ErrUnexpectedEOF
+    }
+    entry := p[o:o + length]
+    o += length
+
+    switch header {
+    case bePersistentSchedule:
+      if len(entry) < 1 {
+        return io.ErrUnexpectedEOF
+      }
+      entry = entry[1:]
+      fallthrough
+    case beNonPersistentSchedule:
+      if err := b.unmarshalSchedule(entry); err != nil {
+        return fmt.Errorf("schedule entry %d: %v", i, err)
+      }
+    case bePowerSave:
+      if len(entry) < 1 || len(entry) < 1 + int(entry[0]) {
+        return fmt.Errorf("power save entry %d: %v", i, io.ErrUnexpectedEOF)
+      }
+      b.Sleeping = append(b.Sleeping, entry[1:1 + int(entry[0])]...)
+    }
+  }
+  if int(b.NetworkMode) >= len(NetworkModes) {
+    return Anomalies{{"network_mode", fmt.Sprintf("reserved network mode %d", b.NetworkMode)}}
+  }
+  return nil
+}
+
+// unmarshalSchedule decodes the session allocations of a schedule entry.
+// An allocation without a start time starts where the previous one ended.
+func (b *Beacon) unmarshalSchedule(p []byte) error {
+  if len(p) < 1 {
+    return io.ErrUnexpectedEOF
+  }
+  n := int(p[0] & 0x3F)
+  o := 1
+  var end uint16
+  for i := 0; i < n; i++ {
+    if len(p) < o + 2 {
+      return io.ErrUnexpectedEOF
+    }
+    a := Allocation{GLID: p[o + 1], Start: end}
+    if p[o] & 0x01 != 0 {
+      if len(p) < o + 5 {
+        return io.ErrUnexpectedEOF
+      }
+      t := uint32(p[o + 2]) | uint32(p[o + 3]) << 8 | uint32(p[o + 4]) << 16
+      a.Start = uint16(t & 0xFFF)
+      a.End = uint16(t >> 12)
+      o += 5
+    } else {
+      if len(p) < o + 4 {
+        return io.ErrUnexpectedEOF
+      }
+      a.End = (uint16(p[o + 2]) | uint16(p[o + 3]) << 8) & 0xFFF
+      o += 4
+    }
+    end = a.End
+    b.Allocations = append(b.Allocations, a)
+  }
+  return nil
+}
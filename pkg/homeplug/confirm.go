@@ -0,0 +1,329 @@
+package homeplug
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "encoding/binary"
+)
+
+// Roles are the names of the roles of a station in a network, as given by
+// the Role of NetworkStatus and AVNetworkStatus.
+var Roles = []string{"station", "proxy_coordinator", "coordinator"}
+
+// NetworkInfo is the payload of the Qualcomm VS_NW_INFO.CNF, which describes
+// the networks the sending station is a member of and the stations in them.
+type NetworkInfo struct {
+  Networks []NetworkStatus
+  Stations []StationStatus
+}
+
+func (n *NetworkInfo) UnmarshalBinary(b []byte) error {
+  var anomalies Anomalies
+  o := 0
+
+  if o >= len(b) {
+    return io.ErrUnexpectedEOF
+  }
+  var num_networks = int(b[o])
+  o++
+  for i := 0; i < num_networks; i++ {
+    var ns NetworkStatus
+    size, err := (&ns).UnmarshalBinary(b[o:])
+    if err = anomalies.merge(err); err != nil {
+      return err
+    }
+    n.Networks = append(n.Networks, ns)
+    o += size
+  }
+
+  if o >= len(b) {
+    return io.ErrUnexpectedEOF
+  }
+  var num_stations = int(b[o])
+  o++
+  for i := 0; i < num_stations; i++ {
+    var ss StationStatus
+    size, err := (&ss).UnmarshalBinary(b[o:])
+    if err != nil {
+      return err
+    }
+    n.Stations = append(n.Stations, ss)
+    o += size
+  }
+
+  anomalies.padding(b[o:])
+  return anomalies.err()
+}
+
+// UnmarshalExtended decodes the MMV 1 layout of VS_NW_INFO.CNF, which AR7400
+// and later chips answer a request of MMV 1 with. It lists the stations of
+// each network after it, and has 16-bit rates.
+func (n *NetworkInfo) UnmarshalExtended(b []byte) error {
+  var anomalies Anomalies
+  // The sub-version and a reserved byte come first.
+  if len(b) < 3 {
+    return io.ErrUnexpectedEOF
+  }
+  o := 2
+
+  var num_networks = int(b[o])
+  o++
+  for i := 0; i < num_networks; i++ {
+    if len(b) < o + 32 {
+      return io.ErrUnexpectedEOF
+    }
+    var ns NetworkStatus
+    copy(ns.NetworkID[:], b[o:o + 7])
+    ns.ShortID = b[o + 9]
+    ns.TEI = b[o + 10]
+    ns.Role = b[o + 15]
+    ns.CCoAddress = b[o + 16:o + 22]
+    ns.CCoTEI = b[o + 22]
+    if int(ns.Role) >= len(Roles) {
+      anomalies.add("role", "reserved role %d", ns.Role)
+    }
+    n.Networks = append(n.Networks, ns)
+    var num_stations = int(b[o + 26])
+    o += 32
+
+    for j := 0; j < num_stations; j++ {
+      if len(b) < o + 24 {
+        return io.ErrUnexpectedEOF
+      }
+      ss := StationStatus{
+        Address:        b[o:o + 6],
+        TEI:            b[o + 6],
+        BridgedAddress: b[o + 10:o + 16],
+        Extended:       true,
+        ExtendedTxRate: binary.LittleEndian.Uint16(b[o + 16:o + 18]),
+        ExtendedRxRate: binary.LittleEndian.Uint16(b[o + 20:o + 22]),
+      }
+      ss.TxRate, ss.RxRate = capped_rate(ss.ExtendedTxRate), capped_rate(ss.ExtendedRxRate)
+      n.Stations = append(n.Stations, ss)
+      o += 24
+    }
+  }
+
+  anomalies.padding(b[o:])
+  return anomalies.err()
+}
+
+func capped_rate(rate uint16) uint8 {
+  if rate > 255 {
+    return 255
+  }
+  return uint8(rate)
+}
+
+type NetworkStatus struct {
+  NetworkID  [7]byte
+  ShortID    uint8
+  TEI        uint8
+  Role       uint8
+  CCoAddress net.HardwareAddr
+  CCoTEI     uint8
+}
+
+func (s *NetworkStatus) UnmarshalBinary(b []byte) (int, error) {
+  if len(b) < 17 {
+    return 0, io.ErrUnexpectedEOF
+  }
+  copy(s.NetworkID[:], b[0:7])
+  s.ShortID = b[7]
+  s.TEI = b[8]
+  s.Role = b[9]
+  s.CCoAddress = b[10:16]
+  s.CCoTEI = b[16]
+  if int(s.Role) >= len(Roles) {
+    return 17, Anomalies{{"role", fmt.Sprintf("reserved role %d", s.Role)}}
+  }
+  return 17, nil
+}
+
+type StationStatus struct {
+  Address        net.HardwareAddr
+  TEI            uint8
+  BridgedAddress net.HardwareAddr
+  TxRate         uint8
+  RxRate         uint8
+  // Extended is set for the MMV 1 layout, whose rates are in ExtendedTxRate
+  // and ExtendedRxRate, and only capped at 255 in TxRate and RxRate.
+  Extended       bool
+  ExtendedTxRate uint16
+  ExtendedRxRate uint16
+}
+
+func (s *StationStatus) UnmarshalBinary(b []byte) (int, error) {
+  if len(b) < 15 {
+    return 0, io.ErrUnexpectedEOF
+  }
+  s.Address = b[0:6]
+  s.TEI = b[6]
+  s.BridgedAddress = b[7:13]
+  s.TxRate = b[13]
+  s.RxRate = b[14]
+  return 15, nil
+}
+
+// StationCapability is the payload of the standard CM_STA_CAP.CNF,
+// which describes what the sending station supports.
+type StationCapability struct {
+  AVVersion             uint8
+  Address               net.HardwareAddr
+  OUI                   [3]byte
+  CCoCapability         uint8
+  ImplementationVersion uint16
+}
+
+func (c *StationCapability) UnmarshalBinary(b []byte) error {
+  if len(b) < 25 {
+    return io.ErrUnexpectedEOF
+  }
+  c.AVVersion = b[0]
+  c.Address = b[1:7]
+  copy(c.OUI[:], b[7:10])
+  c.CCoCapability = b[12]
+  c.ImplementationVersion = binary.LittleEndian.Uint16(b[23:25])
+  var anomalies Anomalies
+  if c.AVVersion > 0x01 {
+    anomalies.add("av_version", "reserved version %d", c.AVVersion)
+  }
+  if c.CCoCapability > 0x03 {
+    anomalies.add("cco_capability", "reserved level %d", c.CCoCapability)
+  }
+  anomalies.padding(b[25:])
+  return anomalies.err()
+}
+
+// AVNetworkInfo is the payload of the standard CM_NW_INFO.CNF, which
+// describes the networks the sending station is a member of.
+type AVNetworkInfo struct {
+  Networks []AVNetworkStatus
+}
+
+func (n *AVNetworkInfo) UnmarshalBinary(b []byte) error {
+  if len(b) < 1 {
+    return io.ErrUnexpectedEOF
+  }
+  var anomalies Anomalies
+  o := 1
+  for i := 0; i < int(b[0]); i++ {
+    var ns AVNetworkStatus
+    size, err := (&ns).UnmarshalBinary(b[o:])
+    if err = anomalies.merge(err); err != nil {
+      return err
+    }
+    n.Networks = append(n.Networks, ns)
+    o += size
+  }
+  anomalies.padding(b[o:])
+  return anomalies.err()
+}
+
+type AVNetworkStatus struct {
+  NetworkID   [7]byte
+  ShortID     uint8
+  TEI         uint8
+  Role        uint8
+  CCoAddress  net.HardwareAddr
+  Access      uint8
+  NumCoordNWs uint8
+}
+
+func (s *AVNetworkStatus) UnmarshalBinary(b []byte) (int, error) {
+  if len(b) < 18 {
+    return 0, io.ErrUnexpectedEOF
+  }
+  copy(s.NetworkID[:], b[0:7])
+  s.ShortID = b[7]
+  s.TEI = b[8]
+  s.Role = b[9]
+  s.CCoAddress = b[10:16]
+  s.Access = b[16]
+  s.NumCoordNWs = b[17]
+  var anomalies Anomalies
+  if int(s.Role) >= len(Roles) {
+    anomalies.add("role", "reserved role %d", s.Role)
+  }
+  if s.Access > 0x01 {
+    anomalies.add("access", "reserved access %d", s.Access)
+  }
+  return 18, anomalies.err()
+}
+
+// AVNetworkStats is the payload of the standard CM_NW_STATS.CNF,
+// which lists the average PHY rates between the sending station and each of
+// its peers.
+type AVNetworkStats struct {
+  Stations []AVStationStats
+}
+
+func (n *AVNetworkStats) UnmarshalBinary(b []byte) error {
+  if len(b) < 1 {
+    return io.ErrUnexpectedEOF
+  }
+  o := 1
+  for i := 0; i < int(b[0]); i++ {
+    var ss AVStationStats
+    size, err := (&ss).UnmarshalBinary(b[o:])
+    if err != nil {
+      return err
+    }
+    n.Stations = append(n.Stations, ss)
+    o += size
+  }
+  var anomalies Anomalies
+  anomalies.padding(b[o:])
+  return anomalies.err()
+}
+
+type AVStationStats struct {
+  Address net.HardwareAddr
+  TxRate  uint8
+  RxRate  uint8
+}
+
+func (s *AVStationStats) UnmarshalBinary(b []byte) (int, error) {
+  if len(b) < 8 {
+    return 0, io.ErrUnexpectedEOF
+  }
+  s.Address = b[0:6]
+  s.TxRate = b[6]
+  s.RxRate = b[7]
+  return 8, nil
+}
+
+// MMEError is the payload of a CM_MME_ERROR indication, sent by a
+// station in place of a confirm for a request it could not process.
+type MMEError struct {
+  Reason  uint8
+  MMV     uint8
+  MMEType [2]byte
+  Offset  uint16
+}
+
+func (e *MMEError) UnmarshalBinary(b []byte) error {
+  if len(b) < 6 {
+    return io.ErrUnexpectedEOF
+  }
+  e.Reason = b[0]
+  e.MMV = b[1]
+  e.MMEType[0] = b[3]
+  e.MMEType[1] = b[2]
+  e.Offset = binary.LittleEndian.Uint16(b[4:6])
+  if e.Reason > 0x01 {
+    return Anomalies{{"reason", fmt.Sprintf("reserved reason %d", e.Reason)}}
+  }
+  return nil
+}
+
+func (e *MMEError) Error() string {
+  switch e.Reason {
+  case 0x00:
+    return fmt.Sprintf("mmetype %04x not supported", e.MMEType)
+  case 0x01:
+    return fmt.Sprintf("mmetype %04x has an invalid field at offset %d", e.MMEType, e.Offset)
+  }
+  return fmt.Sprintf("mmetype %04x rejected with reason %d", e.MMEType, e.Reason)
+}
@@ -0,0 +1,68 @@
+package homeplug
+
+import (
+  "io"
+  "testing"
+  "math/rand"
+)
+
+// decoders are the confirm decoders fed untrusted payloads by the exporter.
+var decoders = map[string]func([]byte) error{
+  "NetworkInfo":          func(b []byte) error { return (&NetworkInfo{}).UnmarshalBinary(b) },
+  "NetworkInfo/extended": func(b []byte) error { return (&NetworkInfo{}).UnmarshalExtended(b) },
+  "AVNetworkInfo":        func(b []byte) error { return (&AVNetworkInfo{}).UnmarshalBinary(b) },
+  "AVNetworkStats":       func(b []byte) error { return (&AVNetworkStats{}).UnmarshalBinary(b) },
+  "StationCapability":    func(b []byte) error { return (&StationCapability{}).UnmarshalBinary(b) },
+  "MMEError":             func(b []byte) error { return (&MMEError{}).UnmarshalBinary(b) },
+  "LinkStats":            func(b []byte) error { return (&LinkStats{}).UnmarshalBinary(b) },
+  "ToneMap":              func(b []byte) error { return (&ToneMap{}).UnmarshalBinary(b) },
+  "Beacon":               func(b []byte) error { return (&Beacon{}).UnmarshalBinary(b) },
+  "DiscoverList":         func(b []byte) error { return (&DiscoverList{}).UnmarshalBinary(b) },
+  "SoftwareVersion":      func(b []byte) error { return (&SoftwareVersion{}).UnmarshalBinary(b) },
+  "LegacyFrame":          func(b []byte) error { return (&LegacyFrame{}).UnmarshalBinary(b) },
+  "Frame":                func(b []byte) error { return (&Frame{}).UnmarshalBinary(b) },
+}
+
+// decode calls decoder, turning a panic into a test failure.
+func decode(t *testing.T, name string, decoder func([]byte) error, b []byte) (err error) {
+  defer func() {
+    if r := recover(); r != nil {
+      t.Errorf("%s panicked on % x: %v", name, b, r)
+    }
+  }()
+  return decoder(b)
+}
+
+func TestTruncatedPayloads(t *testing.T) {
+  r := rand.New(rand.NewSource(1))
+  payloads := [][]byte{
+    // One network and one station, in the MMV 0 layout of VS_NW_INFO.CNF.
+    append(append([]byte{1}, make([]byte, 17)...), append([]byte{1}, make([]byte, 15)...)...),
+  }
+  for i := 0; i < 64; i++ {
+    b := make([]byte, 1 + r.Intn(600))
+    r.Read(b)
+    // Small counts make the entries they count end inside the payload.
+    b[0] %= 4
+    payloads = append(payloads, b)
+  }
+  for name, decoder := range decoders {
+    for _, payload := range payloads {
+      for n := 0; n <= len(payload); n++ {
+        decode(t, name, decoder, payload[:n])
+      }
+    }
+  }
+}
+
+func TestNetworkInfoTruncated(t *testing.T) {
+  for _, b := range [][]byte{
+    {},
+    // A network, and no station count after it.
+    append([]byte{1}, make([]byte, 17)...),
+  } {
+    if err := (&NetworkInfo{}).UnmarshalBinary(b); err != io.ErrUnexpectedEOF {
+      t.Errorf("UnmarshalBinary(% x) = %v, want %v", b, err, io.ErrUnexpectedEOF)
+    }
+  }
+}
@@ -0,0 +1,47 @@
+package homeplug
+
+// DecoderFunc decodes an MME that the package has no decoder for, such as a
+// proprietary vendor-specific confirm, into one of the confirm types of the
+// package that the exporter merges: *NetworkInfo, *AVNetworkInfo,
+// *AVNetworkStats or *StationCapability.
+type DecoderFunc func(m *Message) (interface{}, error)
+
+type decoderKey struct {
+  oui     [3]byte
+  mmeType [2]byte
+}
+
+var (
+  registeredDecoders = map[decoderKey]DecoderFunc{}
+  registeredRequests []Frame
+)
+
+// RegisterDecoder adds a decoder for frames of the given MME type, so that
+// proprietary MMEs can be decoded by code of its own instead of patching the
+// exporter. The OUI is only compared for vendor-specific MME types, and
+// should be zero otherwise. It must be called from an init function.
+func RegisterDecoder(oui [3]byte, mmeType [2]byte, fn DecoderFunc) {
+  registeredDecoders[decoderKey{oui, mmeType}] = fn
+}
+
+// RegisterRequest adds a request for the exporter to send on every poll
+// along with its own, for a registered decoder to decode the replies of. It
+// must be called from an init function.
+func RegisterRequest(h Frame) {
+  registeredRequests = append(registeredRequests, h)
+}
+
+// RegisteredDecoder returns the registered decoder for the frame, if any.
+func RegisteredDecoder(h *Frame) (DecoderFunc, bool) {
+  key := decoderKey{mmeType: h.MMEType}
+  if h.IsVendorSpecific() {
+    key.oui = h.Vendor
+  }
+  fn, ok := registeredDecoders[key]
+  return fn, ok
+}
+
+// RegisteredRequests returns the registered requests.
+func RegisteredRequests() []Frame {
+  return append([]Frame(nil), registeredRequests...)
+}
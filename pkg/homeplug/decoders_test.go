@@ -0,0 +1,35 @@
+package homeplug
+
+import (
+  "testing"
+)
+
+func TestRegisteredDecoder(t *testing.T) {
+  vendor := [3]byte{0x00, 0x1F, 0x84}
+  RegisterDecoder(vendor, [2]byte{0xA0, 0x71}, func(m *Message) (interface{}, error) {
+    return &StationCapability{}, nil
+  })
+  RegisterDecoder([3]byte{}, [2]byte{0x60, 0x71}, func(m *Message) (interface{}, error) {
+    return nil, nil
+  })
+  defer func() {
+    delete(registeredDecoders, decoderKey{vendor, [2]byte{0xA0, 0x71}})
+    delete(registeredDecoders, decoderKey{[3]byte{}, [2]byte{0x60, 0x71}})
+  }()
+
+  for _, c := range []struct {
+    frame Frame
+    want  bool
+  }{
+    {Frame{MMEType: [2]byte{0xA0, 0x71}, Vendor: vendor}, true},
+    // The OUI of vendor-specific MMEs is part of the key.
+    {Frame{MMEType: [2]byte{0xA0, 0x71}, Vendor: HPVendor}, false},
+    // That of others is not.
+    {Frame{MMEType: [2]byte{0x60, 0x71}, Vendor: vendor}, true},
+    {Frame{MMEType: [2]byte{0x60, 0x75}}, false},
+  } {
+    if _, ok := RegisteredDecoder(&c.frame); ok != c.want {
+      t.Errorf("RegisteredDecoder(%04x from %x) = %v, want %v", c.frame.Type(), c.frame.Vendor, ok, c.want)
+    }
+  }
+}
@@ -0,0 +1,95 @@
+package homeplug
+
+import (
+  "io"
+  "net"
+)
+
+// DiscoverList is the payload of the standard CC_DISCOVER_LIST.CNF: the
+// stations and networks the sending station hears, including those of
+// neighbouring networks whose beacons or discover beacons reach it.
+type DiscoverList struct {
+  Stations []DiscoveredStation
+  Networks []DiscoveredNetwork
+}
+
+// DiscoveredStation is a station in a CC_DISCOVER_LIST.CNF. SignalLevel is
+// 0 if it is not known, 1 above -10 dB, and each level after 5 dB less,
+// down to 15 at -75 dB or less.
+type DiscoveredStation struct {
+  Address     net.HardwareAddr
+  TEI         uint8
+  SameNetwork bool
+  ShortID     uint8
+  Status      uint8
+  SignalLevel uint8
+  AverageBLE  uint8
+}
+
+// DiscoveredNetwork is a network in a CC_DISCOVER_LIST.CNF.
+type DiscoveredNetwork struct {
+  NetworkID    [7]byte
+  ShortID      uint8
+  HybridMode   uint8
+  BeaconSlots  uint8
+  CCoStatus    uint8
+  // BeaconOffset is the offset of its beacon from the sender's, in units
+  // of the allocation time.
+  BeaconOffset uint16
+}
+
+func (d *DiscoverList) UnmarshalBinary(b []byte) error {
+  var anomalies Anomalies
+  if len(b) < 1 {
+    return io.ErrUnexpectedEOF
+  }
+  o := 0
+
+  var num_stations = int(b[o])
+  o++
+  for i := 0; i < num_stations; i++ {
+    if len(b) < o + 12 {
+      return io.ErrUnexpectedEOF
+    }
+    ds := DiscoveredStation{
+      Address:     b[o:o + 6],
+      TEI:         b[o + 6],
+      SameNetwork: b[o + 7] != 0,
+      ShortID:     b[o + 8] & 0x0F,
+      Status:      b[o + 9],
+      SignalLevel: b[o + 10],
+      AverageBLE:  b[o + 11],
+    }
+    if b[o + 7] > 1 {
+      anomalies.add("same_network", "reserved value %d", b[o + 7])
+    }
+    if ds.SignalLevel > 15 {
+      anomalies.add("signal_level", "reserved level %d", ds.SignalLevel)
+    }
+    d.Stations = append(d.Stations, ds)
+    o += 12
+  }
+
+  if len(b) < o + 1 {
+    return io.ErrUnexpectedEOF
+  }
+  var num_networks = int(b[o])
+  o++
+  for i := 0; i < num_networks; i++ {
+    if len(b) < o + 13 {
+      return io.ErrUnexpectedEOF
+    }
+    var dn DiscoveredNetwork
+    copy(dn.NetworkID[:], b[o:o + 7])
+    dn.ShortID = b[o + 7] & 0x0F
+    dn.HybridMode = b[o + 8]
+    dn.BeaconSlots = b[o + 9]
+    dn.CCoStatus = b[o + 10]
+    dn.BeaconOffset = uint16(b[o + 11]) | uint16(b[o + 12]) << 8
+    d.Networks = append(d.Networks, dn)
+    o += 13
+  }
+
+  anomalies.padding(b[o:])
+  return anomalies.err()
+}
@@ -0,0 +1,94 @@
+package homeplug
+
+import (
+  "fmt"
+)
+
+// Fragments returns the number of fragments of the MME that the frame is one
+// of, its number among them from 0, and the sequence number that the
+// fragments of that MME share, from the NF_MI, FN_MI and FMSN fields of its
+// fragmentation header. Frames of MMV 0 have no such header, and are always
+// whole.
+func (h *Frame) Fragments() (count, number int, sequence byte) {
+  if h.Version[0] == 0 {
+    return 1, 0, 0
+  }
+  return int(h.Fragment[0] >> 4) + 1, int(h.Fragment[0] & 0x0F), h.Fragment[1]
+}
+
+// IsFragment reports whether the frame is one fragment of an MME too long to
+// fit in one frame.
+func (h *Frame) IsFragment() bool {
+  count, _, _ := h.Fragments()
+  return count > 1
+}
+
+// Reassembler puts the fragments of MMEs back together, keyed by their
+// source, MME type and sequence number. The zero value is ready to use. It is
+// meant to last one query, so that the fragments of MMEs that never complete
+// go with it.
+type Reassembler struct {
+  // Max is the most MMEs whose fragments are kept at a time. If 0, there is
+  // no limit.
+  Max     int
+  partial map[string]*partialMME
+}
+
+type partialMME struct {
+  first     Frame
+  fragments [][]byte
+  received  int
+}
+
+// Add returns m itself if it is whole, or the reassembled MME if m is the
+// last of its fragments to arrive. Otherwise it keeps m and returns false. A
+// fragment that contradicts the ones before it, with another fragment count
+// or a number that was already received, is an error, and drops the
+// fragments of its MME received so far.
+func (r *Reassembler) Add(m Message) (Message, bool, error) {
+  count, number, sequence := m.Frame.Fragments()
+  if m.Legacy != nil || count == 1 {
+    return m, true, nil
+  }
+  if number >= count {
+    return Message{}, false, fmt.Errorf("[%v] fragment %d of an %04x MME of %d fragments", m.Source, number, m.Frame.Type(), count)
+  }
+  if r.partial == nil {
+    r.partial = map[string]*partialMME{}
+  }
+  key := fmt.Sprintf("%v/%04x/%d", m.Source, m.Frame.Type(), sequence)
+  p, ok := r.partial[key]
+  if !ok {
+    if r.Max > 0 && len(r.partial) >= r.Max {
+      return Message{}, false, fmt.Errorf("[%v] more than %d fragmented MMEs are incomplete", m.Source, r.Max)
+    }
+    p = &partialMME{fragments: make([][]byte, count)}
+    r.partial[key] = p
+  }
+  if len(p.fragments) != count || p.fragments[number] != nil {
+    delete(r.partial, key)
+    return Message{}, false, fmt.Errorf("[%v] fragment %d of %d of %04x MME %d contradicts those received before", m.Source, number, count, m.Frame.Type(), sequence)
+  }
+  // The vendor OUI of a vendor-specific MME is the start of its entry, so
+  // only the first fragment has one, and what UnmarshalBinary took for the
+  // OUI of the others is data.
+  data := m.Frame.Payload
+  if number == 0 {
+    p.first = m.Frame
+  } else if m.Frame.IsVendorSpecific() {
+    data = append(append([]byte(nil), m.Frame.Vendor[:]...), data...)
+  }
+  p.fragments[number] = data
+  p.received++
+  if p.received < count {
+    return Message{}, false, nil
+  }
+  delete(r.partial, key)
+  whole := p.first
+  whole.Fragment = [2]byte{0x00, sequence}
+  whole.Payload = nil
+  for _, b := range p.fragments {
+    whole.Payload = append(whole.Payload, b...)
+  }
+  return Message{Source: m.Source, Frame: whole}, true, nil
+}
@@ -0,0 +1,160 @@
+// Package homeplug encodes and decodes the HomePlug AV management messages
+// (MMEs) that homeplug_exporter exchanges with powerline adapters: the
+// standard CM_* confirms, the Qualcomm vendor-specific ones, and the
+// management frames of HomePlug 1.0 stations. It only deals with the bytes
+// of the Ethernet payload; sending requests and collecting the replies is
+// left to a Requester.
+package homeplug
+
+import (
+  "io"
+  "net"
+  "time"
+  "context"
+)
+
+// EtherTypes of HomePlug AV and HomePlug 1.0 management frames. HomePlug 1.0
+// stations, and some vendor tools, send theirs with an EtherType of their
+// own.
+const (
+  EtherType       = 0x88E1
+  LegacyEtherType = 0x887B
+)
+
+// MME versions, vendor OUI and types. The HP ones are Qualcomm vendor-specific
+// (VS_*) MMEs, and the CM and CC ones standard HomePlug AV MMEs.
+var (
+  HPVersion      = [...]byte{0x00}
+  NwInfoReq      = [...]byte{0xA0, 0x38}
+  NwInfoCnf      = [...]byte{0xA0, 0x39}
+  HPVendor       = [...]byte{0x00, 0xB0, 0x52}
+  LnkStatsReq    = [...]byte{0xA0, 0xB8}
+  LnkStatsCnf    = [...]byte{0xA0, 0xB9}
+  RdModReq       = [...]byte{0xA0, 0x24}
+  RdModCnf       = [...]byte{0xA0, 0x25}
+  SwVerReq       = [...]byte{0xA0, 0x00}
+  SwVerCnf       = [...]byte{0xA0, 0x01}
+  ToneMapReq     = [...]byte{0xA0, 0xA0}
+  ToneMapCnf     = [...]byte{0xA0, 0xA1}
+
+  AVVersion      = [...]byte{0x01}
+  CMNwInfoReq    = [...]byte{0x60, 0x38}
+  CMNwInfoCnf    = [...]byte{0x60, 0x39}
+  CMNwStatsReq   = [...]byte{0x60, 0x48}
+  CMNwStatsCnf   = [...]byte{0x60, 0x49}
+  CMMmeErrorInd  = [...]byte{0x60, 0x46}
+  CMStaCapReq    = [...]byte{0x60, 0x34}
+  CMStaCapCnf    = [...]byte{0x60, 0x35}
+  CMGetBeaconReq = [...]byte{0x60, 0x3C}
+  CMGetBeaconCnf = [...]byte{0x60, 0x3D}
+  CCDiscoverListReq = [...]byte{0x00, 0x14}
+  CCDiscoverListCnf = [...]byte{0x00, 0x15}
+)
+
+// Frame is a Homeplug management message (MME). The fragmentation header is
+// only present from MMV 1 onwards, and the vendor OUI only for
+// vendor-specific MME types.
+type Frame struct {
+  Version  [1]byte
+  MMEType  [2]byte
+  Fragment [2]byte
+  Vendor   [3]byte
+  Payload  []byte
+}
+
+func (h *Frame) MarshalBinary() ([]byte, error) {
+  b := make([]byte, h.length())
+  _, err := h.read(b)
+  return b, err
+}
+
+func (h *Frame) read(b []byte) (int, error) {
+  b[0] = h.Version[0]
+  b[1] = h.MMEType[1]
+  b[2] = h.MMEType[0]
+  o := 3
+  if h.Version[0] > 0 {
+    b[o] = h.Fragment[0]
+    b[o+1] = h.Fragment[1]
+    o += 2
+  }
+  if h.IsVendorSpecific() {
+    b[o] = h.Vendor[0]
+    b[o+1] = h.Vendor[1]
+    b[o+2] = h.Vendor[2]
+    o += 3
+  }
+  copy(b[o:], h.Payload[:])
+  return len(b), nil
+}
+
+func (h *Frame) headerLength() int {
+  l := 3
+  if h.Version[0] > 0 {
+    l += 2
+  }
+  if h.IsVendorSpecific() {
+    l += 3
+  }
+  return l
+}
+
+func (h *Frame) length() int {
+  return h.headerLength() + len(h.Payload)
+}
+
+// Type returns the MME type as a single value, e.g. 0xA039.
+func (h *Frame) Type() uint16 {
+  return uint16(h.MMEType[0]) << 8 | uint16(h.MMEType[1])
+}
+
+// IsVendorSpecific reports whether the MME type is in the vendor-specific
+// range, in which case the frame carries a vendor OUI.
+func (h *Frame) IsVendorSpecific() bool {
+  return h.Type() >= 0xA000 && h.Type() < 0xC000
+}
+
+func (h *Frame) UnmarshalBinary(b []byte) error {
+  if len(b) < 3 {
+    return io.ErrUnexpectedEOF
+  }
+
+  h.Version[0] = b[0]
+  h.MMEType[1] = b[1]
+  h.MMEType[0] = b[2]
+
+  o := h.headerLength()
+  if len(b) < o {
+    return io.ErrUnexpectedEOF
+  }
+  if h.Version[0] > 0 {
+    h.Fragment[0] = b[3]
+    h.Fragment[1] = b[4]
+  }
+  if h.IsVendorSpecific() {
+    copy(h.Vendor[:], b[o-3:o])
+  }
+
+  bb := make([]byte, len(b) - o)
+  copy(bb[:], b[o:])
+  h.Payload = bb
+  return nil
+}
+
+// Message is a Homeplug frame along with the address of the station that
+// sent it. Frames received on the HomePlug 1.0 EtherType are in Legacy
+// instead.
+type Message struct {
+  Source net.HardwareAddr
+  Frame  Frame
+  Legacy *LegacyFrame
+}
+
+// Requester sends request frames to the station dest, or to every station
+// if it is the broadcast address, and returns every message received until
+// none have arrived for timeout, or until complete, if given, reports that
+// everything expected has arrived. If ctx is done first, the messages
+// received so far are returned with its error.
+type Requester interface {
+  Request(ctx context.Context, dest net.HardwareAddr, requests []Frame, timeout time.Duration, complete func([]Message) bool) ([]Message, error)
+}
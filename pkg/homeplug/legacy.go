@@ -0,0 +1,47 @@
+package homeplug
+
+import (
+  "io"
+)
+
+// LegacyFrame is a HomePlug 1.0 management frame: a count of the entries in
+// its low 7 bits, followed by the entries.
+type LegacyFrame struct {
+  Entries []LegacyEntry
+}
+
+// LegacyEntry is one management entry of a HomePlug 1.0 frame: the version in
+// the top 3 bits of its header and the type in the low 5, followed by the
+// length of its data.
+type LegacyEntry struct {
+  Version uint8
+  Type    uint8
+  Data    []byte
+}
+
+func (l *LegacyFrame) UnmarshalBinary(b []byte) error {
+  if len(b) < 1 {
+    return io.ErrUnexpectedEOF
+  }
+  n := int(b[0] & 0x7f)
+  o := 1
+  l.Entries = make([]LegacyEntry, 0, n)
+  for i := 0; i < n; i++ {
+    if len(b) < o + 2 {
+      return io.ErrUnexpectedEOF
+    }
+    length := int(b[o + 1])
+    if len(b) < o + 2 + length {
+      return io.ErrUnexpectedEOF
+    }
+    data := make([]byte, length)
+    copy(data, b[o + 2:])
+    l.Entries = append(l.Entries, LegacyEntry{
+      Version: b[o] >> 5,
+      Type:    b[o] & 0x1f,
+      Data:    data,
+    })
+    o += 2 + length
+  }
+  return nil
+}
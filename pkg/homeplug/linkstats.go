@@ -0,0 +1,71 @@
+package homeplug
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "encoding/binary"
+)
+
+// Directions of VS_LNK_STATS.
+const (
+  LinkStatsTx = 0x00
+  LinkStatsRx = 0x01
+)
+
+// lnkStatsCSMA is the link ID of the CSMA link between two stations, which
+// carries all traffic that has no TDMA allocation.
+const lnkStatsCSMA = 0xF8
+
+// LinkStats is a Qualcomm VS_LNK_STATS.CNF: the MAC-level counters a
+// station keeps in one direction of its link to another. The counters are
+// cumulative since the station started.
+type LinkStats struct {
+  Status    uint8
+  Direction uint8
+  LID       uint8
+  TEI       uint8
+  // MPDUAcked, MPDUCollided (tx only) and MPDUFailed count MAC frames, and
+  // PBPassed and PBFailed the PHY blocks they carried.
+  MPDUAcked    uint64
+  MPDUCollided uint64
+  MPDUFailed   uint64
+  PBPassed     uint64
+  PBFailed     uint64
+}
+
+func (l *LinkStats) UnmarshalBinary(p []byte) error {
+  if len(p) < 4 {
+    return io.ErrUnexpectedEOF
+  }
+  l.Status, l.Direction, l.LID, l.TEI = p[0], p[1], p[2], p[3]
+  if l.Status != 0 {
+    return fmt.Errorf("link stats status %d", l.Status)
+  }
+  var fields []*uint64
+  switch l.Direction {
+  case LinkStatsTx:
+    fields = []*uint64{&l.MPDUAcked, &l.MPDUCollided, &l.MPDUFailed, &l.PBPassed, &l.PBFailed}
+  case LinkStatsRx:
+    fields = []*uint64{&l.MPDUAcked, &l.MPDUFailed, &l.PBPassed, &l.PBFailed}
+  default:
+    return fmt.Errorf("unknown link stats direction %d", l.Direction)
+  }
+  if len(p) < 4 + 8 * len(fields) {
+    return io.ErrUnexpectedEOF
+  }
+  for i, f := range fields {
+    *f = binary.LittleEndian.Uint64(p[4 + 8 * i:])
+  }
+  var anomalies Anomalies
+  anomalies.padding(p[4 + 8 * len(fields):])
+  return anomalies.err()
+}
+
+// LinkStatsRequest returns the VS_LNK_STATS.REQ for one direction of the
+// CSMA link to peer.
+func LinkStatsRequest(direction uint8, peer net.HardwareAddr) Frame {
+  payload := []byte{0x00, direction, lnkStatsCSMA}
+  payload = append(payload, peer...)
+  return Frame{Version: HPVersion, MMEType: LnkStatsReq, Vendor: HPVendor, Payload: payload}
+}
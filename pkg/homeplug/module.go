@@ -0,0 +1,64 @@
+package homeplug
+
+import (
+  "io"
+  "fmt"
+  "encoding/binary"
+)
+
+// ModuleChunk is a Qualcomm VS_RD_MOD.CNF: part of one of the
+// modules kept in the NVM of a station.
+type ModuleChunk struct {
+  Status   uint8
+  Module   uint8
+  Offset   uint32
+  Checksum uint32
+  Data     []byte
+}
+
+func (c *ModuleChunk) UnmarshalBinary(p []byte) error {
+  if len(p) < 16 {
+    return io.ErrUnexpectedEOF
+  }
+  c.Status, c.Module = p[0], p[4]
+  length := int(binary.LittleEndian.Uint16(p[6:]))
+  c.Offset = binary.LittleEndian.Uint32(p[8:])
+  c.Checksum = binary.LittleEndian.Uint32(p[12:])
+  if c.Status != 0 {
+    return fmt.Errorf("read module status 0x%02x", c.Status)
+  }
+  if len(p) < 16 + length {
+    return io.ErrUnexpectedEOF
+  }
+  c.Data = p[16:16 + length]
+  if Checksum32(c.Data) != c.Checksum {
+    return fmt.Errorf("checksum mismatch at offset %d", c.Offset)
+  }
+  return nil
+}
+
+// Checksum32 is the complement of the XOR of the little-endian 32-bit words
+// of b, padded with zeros, which Qualcomm uses for modules and their chunks.
+func Checksum32(b []byte) uint32 {
+  var sum uint32
+  for len(b) >= 4 {
+    sum ^= binary.LittleEndian.Uint32(b)
+    b = b[4:]
+  }
+  if len(b) > 0 {
+    var tail [4]byte
+    copy(tail[:], b)
+    sum ^= binary.LittleEndian.Uint32(tail[:])
+  }
+  return ^sum
+}
+
+// ReadModuleRequest returns the VS_RD_MOD.REQ for length bytes at offset
+// of a module.
+func ReadModuleRequest(module uint8, offset uint32, length uint16) Frame {
+  payload := make([]byte, 8)
+  payload[0] = module
+  binary.LittleEndian.PutUint16(payload[2:], length)
+  binary.LittleEndian.PutUint32(payload[4:], offset)
+  return Frame{Version: HPVersion, MMEType: RdModReq, Vendor: HPVendor, Payload: payload}
+}
@@ -0,0 +1,98 @@
+package homeplug
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "context"
+
+  "github.com/mdlayher/ethernet"
+  "github.com/mdlayher/raw"
+)
+
+// RawRequester is a Requester that sends and receives frames on a raw socket
+// of an interface, which needs CAP_NET_RAW. Replies can't be told apart
+// from those of another query, so its queries are sent one at a time.
+type RawRequester struct {
+  iface *net.Interface
+  conn  net.PacketConn
+  mutex sync.Mutex
+}
+
+func NewRawRequester(iface *net.Interface) (*RawRequester, error) {
+  conn, err := raw.ListenPacket(iface, EtherType, nil)
+  if err != nil {
+    return nil, fmt.Errorf("failed to open raw socket on %s: %v", iface.Name, err)
+  }
+  return &RawRequester{iface: iface, conn: conn}, nil
+}
+
+func (r *RawRequester) Close() error {
+  return r.conn.Close()
+}
+
+// Request implements Requester. A ctx that is done is only noticed between
+// replies, or once no more have arrived for timeout.
+func (r *RawRequester) Request(ctx context.Context, dest net.HardwareAddr, requests []Frame, timeout time.Duration, complete func([]Message) bool) ([]Message, error) {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+
+  for i := range requests {
+    payload, err := requests[i].MarshalBinary()
+    if err != nil {
+      return nil, err
+    }
+    f := &ethernet.Frame{
+      Destination: dest,
+      Source:      r.iface.HardwareAddr,
+      EtherType:   EtherType,
+      Payload:     payload,
+    }
+    b, err := f.MarshalBinary()
+    if err != nil {
+      return nil, err
+    }
+    if _, err := r.conn.WriteTo(b, &raw.Addr{HardwareAddr: dest}); err != nil {
+      return nil, fmt.Errorf("failed to send request: %v", err)
+    }
+  }
+
+  var msgs []Message
+  var fragments Reassembler
+  b := make([]byte, r.iface.MTU + 14)
+  for {
+    if err := ctx.Err(); err != nil {
+      return msgs, err
+    }
+    deadline := time.Now().Add(timeout)
+    if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+      deadline = d
+    }
+    r.conn.SetReadDeadline(deadline)
+    n, _, err := r.conn.ReadFrom(b)
+    if err, ok := err.(net.Error); ok && err.Timeout() {
+      return msgs, ctx.Err()
+    }
+    if err != nil {
+      return msgs, err
+    }
+
+    var f ethernet.Frame
+    var h Frame
+    if (&f).UnmarshalBinary(b[:n]) != nil || f.EtherType != EtherType || (&h).UnmarshalBinary(f.Payload) != nil {
+      continue
+    }
+    if f.Source.String() == r.iface.HardwareAddr.String() {
+      continue
+    }
+    m, whole, err := fragments.Add(Message{Source: append(net.HardwareAddr(nil), f.Source...), Frame: h})
+    if err != nil || !whole {
+      continue
+    }
+    msgs = append(msgs, m)
+    if complete != nil && complete(msgs) {
+      return msgs, nil
+    }
+  }
+}
@@ -0,0 +1,68 @@
+package homeplug
+
+import (
+  "io"
+  "fmt"
+  "net"
+)
+
+// The carriers of a HomePlug AV tone map, from 1.8 to 30 MHz. Carrier i of a
+// tone map is at (ToneMapFirstCarrier + i) * CarrierSpacing.
+const (
+  ToneMapCarriers     = 1155
+  ToneMapFirstCarrier = 74
+  CarrierSpacing      = 100e6 / 4096
+)
+
+// Modulations are the names of the modulations of the carriers of a tone
+// map, and ModulationBits the bits each carries, by code.
+var (
+  Modulations    = []string{"off", "bpsk", "qpsk", "8qam", "16qam", "64qam", "256qam", "1024qam"}
+  ModulationBits = []int{0, 1, 2, 3, 4, 6, 8, 10}
+)
+
+// ToneMap is a Qualcomm VS_TONE_MAP_CHAR.CNF: one slot of the tone map that
+// a station uses to send to a peer, which gives the modulation of each
+// carrier that the peer chose from the SNR it measured on it. A link has a
+// slot for each interval of the mains cycle with noise of its own.
+type ToneMap struct {
+  Status         uint8
+  Slot           uint8
+  Slots          uint8
+  ActiveCarriers uint16
+  // Modulations are the codes of the modulation of each carrier.
+  Modulations    []uint8
+}
+
+func (t *ToneMap) UnmarshalBinary(p []byte) error {
+  if len(p) < 5 {
+    return io.ErrUnexpectedEOF
+  }
+  t.Status, t.Slot, t.Slots = p[0], p[1], p[2]
+  if t.Status != 0 {
+    return fmt.Errorf("tone map status %d", t.Status)
+  }
+  t.ActiveCarriers = uint16(p[3]) | uint16(p[4]) << 8
+  if len(p) < 5 + (ToneMapCarriers + 1) / 2 {
+    return io.ErrUnexpectedEOF
+  }
+  // Each byte holds two carriers, the first in its low nibble.
+  t.Modulations = make([]uint8, ToneMapCarriers)
+  var anomalies Anomalies
+  for i := range t.Modulations {
+    m := p[5 + i / 2] >> (4 * uint(i % 2)) & 0x0F
+    if int(m) >= len(Modulations) {
+      anomalies.add("modulation", "reserved modulation %d of carrier %d", m, i)
+      m = 0
+    }
+    t.Modulations[i] = m
+  }
+  return anomalies.err()
+}
+
+// ToneMapRequest returns the VS_TONE_MAP_CHAR.REQ for a slot of the tone map
+// used to send to peer.
+func ToneMapRequest(peer net.HardwareAddr, slot uint8) Frame {
+  payload := append(append([]byte{}, peer...), slot, 0x00)
+  return Frame{Version: HPVersion, MMEType: ToneMapReq, Vendor: HPVendor, Payload: payload}
+}
@@ -0,0 +1,285 @@
+package homeplug
+
+import (
+  "net"
+  "time"
+  "bytes"
+  "context"
+  "encoding/hex"
+)
+
+// BroadcastAddress sends a query to every station that can hear it.
+var BroadcastAddress = net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// TopologyOptions are the settings of Topology.
+type TopologyOptions struct {
+  // Requester sends the queries. If nil, a RawRequester is opened on
+  // Interface for the duration of the call.
+  Requester     Requester
+  Interface     string
+  // Destination is the address the discovery query is sent to, the
+  // broadcast address if nil.
+  Destination   net.HardwareAddr
+  // Timeout is how long to wait for more replies to each query, a second if
+  // 0.
+  Timeout       time.Duration
+  // ExtendedRates sends VS_NW_INFO with MMV 1, which AR7400 and later chips
+  // answer with 16-bit rates. Other stations give rates of 255 Mbit/s or
+  // more as 255.
+  ExtendedRates bool
+}
+
+// TopologySnapshot is the networks and stations found by Topology, and the
+// links between the stations.
+type TopologySnapshot struct {
+  Networks []TopologyNetwork
+  Stations []TopologyStation
+  Links    []TopologyLink
+}
+
+// TopologyNetwork is a HomePlug AV network (AVLN). The CCo's TEI is only
+// known if a Qualcomm station reported the network.
+type TopologyNetwork struct {
+  ID         string
+  ShortID    uint8
+  CCoAddress net.HardwareAddr
+  CCoTEI     uint8
+}
+
+// TopologyStation is a station that answered a query itself, in which case
+// it is a Reporter, or was listed by one that did. TEI and Role are only
+// known for reporters and for the peers Qualcomm reporters list.
+type TopologyStation struct {
+  Address        net.HardwareAddr
+  TEI            uint8
+  BridgedAddress net.HardwareAddr
+  NetworkID      string
+  Role           string
+  Reporter       bool
+}
+
+// TopologyLink is the average PHY rate in Mbit/s from Source to Destination,
+// as reported by Reporter, which is one of them.
+type TopologyLink struct {
+  Reporter    net.HardwareAddr
+  Source      net.HardwareAddr
+  Destination net.HardwareAddr
+  Rate        uint16
+}
+
+// discoveryRequests are sent to discover the stations: the Qualcomm network
+// info, and the standard network info and stats for other chipsets.
+var discoveryRequests = []Frame{
+  {Version: HPVersion, MMEType: NwInfoReq, Vendor: HPVendor},
+  {Version: AVVersion, MMEType: CMNwInfoReq},
+  {Version: AVVersion, MMEType: CMNwStatsReq},
+}
+
+// Topology discovers the stations that answer opts.Destination, then asks
+// each station they list that did not answer for its own view, and returns
+// everything merged. A station that answers both the Qualcomm and the
+// standard queries is described by its Qualcomm confirms. Confirms that
+// can't be decoded are left out; those with anomalies are kept. If ctx is
+// done first, what was found so far is returned with its error.
+func Topology(ctx context.Context, opts TopologyOptions) (*TopologySnapshot, error) {
+  requester := opts.Requester
+  if requester == nil {
+    iface, err := net.InterfaceByName(opts.Interface)
+    if err != nil {
+      return nil, err
+    }
+    r, err := NewRawRequester(iface)
+    if err != nil {
+      return nil, err
+    }
+    defer r.Close()
+    requester = r
+  }
+  dest := opts.Destination
+  if dest == nil {
+    dest = BroadcastAddress
+  }
+  timeout := opts.Timeout
+  if timeout == 0 {
+    timeout = time.Second
+  }
+
+  requests := discoveryRequests
+  if opts.ExtendedRates {
+    requests = append([]Frame(nil), discoveryRequests...)
+    requests[0].Version = AVVersion
+  }
+
+  t := &TopologySnapshot{}
+  msgs, err := requester.Request(ctx, dest, requests, timeout, nil)
+  t.merge(msgs)
+  if err != nil {
+    return t, err
+  }
+  for i := 0; i < len(t.Stations); i++ {
+    station := t.Stations[i]
+    if station.Reporter || bytes.Equal(station.Address, dest) {
+      continue
+    }
+    address := station.Address
+    msgs, err := requester.Request(ctx, address, requests, timeout, func(msgs []Message) bool {
+      n := 0
+      for _, m := range msgs {
+        if bytes.Equal(m.Source, address) {
+          n++
+        }
+      }
+      return n == len(requests)
+    })
+    t.merge(msgs)
+    if err != nil {
+      return t, err
+    }
+  }
+  return t, nil
+}
+
+// merge adds what the confirms in msgs describe.
+func (t *TopologySnapshot) merge(msgs []Message) {
+  qualcomm := map[string]bool{}
+  for _, m := range msgs {
+    if m.Frame.MMEType != NwInfoCnf {
+      continue
+    }
+    var info NetworkInfo
+    unmarshal := (&info).UnmarshalBinary
+    if m.Frame.Version[0] >= 1 {
+      unmarshal = (&info).UnmarshalExtended
+    }
+    if !decoded(unmarshal(m.Frame.Payload)) {
+      continue
+    }
+    qualcomm[m.Source.String()] = true
+    self := TopologyStation{Address: m.Source, Reporter: true}
+    for _, ns := range info.Networks {
+      id := hex.EncodeToString(ns.NetworkID[:])
+      if self.NetworkID == "" {
+        self.NetworkID, self.TEI, self.Role = id, ns.TEI, role_name(ns.Role)
+      }
+      t.addNetwork(TopologyNetwork{ID: id, ShortID: ns.ShortID, CCoAddress: ns.CCoAddress, CCoTEI: ns.CCoTEI})
+    }
+    t.addStation(self)
+    for _, ss := range info.Stations {
+      t.addStation(TopologyStation{Address: ss.Address, TEI: ss.TEI, BridgedAddress: ss.BridgedAddress, NetworkID: self.NetworkID})
+      if ss.Extended {
+        t.addLinks(m.Source, ss.Address, ss.ExtendedTxRate, ss.ExtendedRxRate)
+      } else {
+        t.addLinks(m.Source, ss.Address, uint16(ss.TxRate), uint16(ss.RxRate))
+      }
+    }
+  }
+
+  for _, m := range msgs {
+    if qualcomm[m.Source.String()] {
+      continue
+    }
+    switch m.Frame.MMEType {
+    case CMNwInfoCnf:
+      var info AVNetworkInfo
+      if !decoded((&info).UnmarshalBinary(m.Frame.Payload)) {
+        continue
+      }
+      self := TopologyStation{Address: m.Source, Reporter: true}
+      for _, ns := range info.Networks {
+        id := hex.EncodeToString(ns.NetworkID[:])
+        if self.NetworkID == "" {
+          self.NetworkID, self.TEI, self.Role = id, ns.TEI, role_name(ns.Role)
+        }
+        t.addNetwork(TopologyNetwork{ID: id, ShortID: ns.ShortID, CCoAddress: ns.CCoAddress})
+      }
+      t.addStation(self)
+    case CMNwStatsCnf:
+      var stats AVNetworkStats
+      if !decoded((&stats).UnmarshalBinary(m.Frame.Payload)) {
+        continue
+      }
+      t.addStation(TopologyStation{Address: m.Source, Reporter: true})
+      for _, ss := range stats.Stations {
+        t.addStation(TopologyStation{Address: ss.Address})
+        t.addLinks(m.Source, ss.Address, uint16(ss.TxRate), uint16(ss.RxRate))
+      }
+    }
+  }
+}
+
+// decoded reports whether a decoder's err leaves what it decoded usable.
+func decoded(err error) bool {
+  _, ok := err.(Anomalies)
+  return err == nil || ok
+}
+
+func role_name(role uint8) string {
+  if int(role) < len(Roles) {
+    return Roles[role]
+  }
+  return ""
+}
+
+// addNetwork adds a network, or fills in what was not yet known of it.
+func (t *TopologySnapshot) addNetwork(network TopologyNetwork) {
+  for i := range t.Networks {
+    n := &t.Networks[i]
+    if n.ID != network.ID {
+      continue
+    }
+    if n.CCoAddress == nil {
+      n.CCoAddress = network.CCoAddress
+    }
+    if n.CCoTEI == 0 {
+      n.CCoTEI = network.CCoTEI
+    }
+    return
+  }
+  t.Networks = append(t.Networks, network)
+}
+
+// addStation adds a station, or fills in what was not yet known of it. What
+// a reporter says of itself takes precedence over what others say of it.
+func (t *TopologySnapshot) addStation(station TopologyStation) {
+  for i := range t.Stations {
+    s := &t.Stations[i]
+    if !bytes.Equal(s.Address, station.Address) {
+      continue
+    }
+    if station.Reporter && !s.Reporter {
+      bridged := s.BridgedAddress
+      *s = station
+      if s.BridgedAddress == nil {
+        s.BridgedAddress = bridged
+      }
+      return
+    }
+    if s.TEI == 0 {
+      s.TEI = station.TEI
+    }
+    if s.BridgedAddress == nil {
+      s.BridgedAddress = station.BridgedAddress
+    }
+    if s.NetworkID == "" {
+      s.NetworkID = station.NetworkID
+    }
+    if s.Role == "" {
+      s.Role = station.Role
+    }
+    return
+  }
+  t.Stations = append(t.Stations, station)
+}
+
+// addLinks adds the links in both directions between reporter and peer,
+// unless reporter has already reported them.
+func (t *TopologySnapshot) addLinks(reporter, peer net.HardwareAddr, txRate, rxRate uint16) {
+  for _, l := range t.Links {
+    if bytes.Equal(l.Reporter, reporter) && bytes.Equal(l.Destination, peer) {
+      return
+    }
+  }
+  t.Links = append(t.Links,
+    TopologyLink{Reporter: reporter, Source: reporter, Destination: peer, Rate: txRate},
+    TopologyLink{Reporter: reporter, Source: peer, Destination: reporter, Rate: rxRate})
+}
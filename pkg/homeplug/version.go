@@ -0,0 +1,54 @@
+package homeplug
+
+import (
+  "io"
+  "fmt"
+  "bytes"
+)
+
+// DeviceClasses are the names of the chips of Qualcomm stations, by the
+// device ID of VS_SW_VER.CNF, as in open-plc-utils.
+var DeviceClasses = map[uint8]string{
+  0x01: "INT6000",
+  0x02: "INT6300",
+  0x03: "INT6400",
+  0x04: "AR7400",
+  0x05: "AR6405",
+}
+
+// SoftwareVersion is a Qualcomm VS_SW_VER.CNF: the firmware a station runs,
+// and the chip it runs on.
+type SoftwareVersion struct {
+  Status   uint8
+  DeviceID uint8
+  Version  string
+}
+
+func (v *SoftwareVersion) UnmarshalBinary(p []byte) error {
+  if len(p) < 3 {
+    return io.ErrUnexpectedEOF
+  }
+  v.Status, v.DeviceID = p[0], p[1]
+  if v.Status != 0 {
+    return fmt.Errorf("software version status %d", v.Status)
+  }
+  length := int(p[2])
+  if len(p) < 3 + length {
+    return io.ErrUnexpectedEOF
+  }
+  // The length counts the NUL the version ends with, and some firmware pads
+  // it with more.
+  if i := bytes.IndexByte(p[3:3 + length], 0); i >= 0 {
+    length = i
+  }
+  v.Version = string(p[3:3 + length])
+  return nil
+}
+
+// DeviceClass returns the name of the station's chip.
+func (v *SoftwareVersion) DeviceClass() string {
+  if name, ok := DeviceClasses[v.DeviceID]; ok {
+    return name
+  }
+  return fmt.Sprintf("unknown-%d", v.DeviceID)
+}
@@ -0,0 +1,183 @@
+package homeplug
+
+import (
+  "net"
+  "time"
+  "context"
+)
+
+// Types of Watch events.
+const (
+  EventStationJoined = "station_joined"
+  EventStationLeft   = "station_left"
+  EventRateChanged   = "rate_changed"
+  EventCCoChanged    = "cco_changed"
+)
+
+// WatchOptions are the settings of Watch. The TopologyOptions are those of
+// each poll.
+type WatchOptions struct {
+  TopologyOptions
+  // Interval is the time between polls, a minute if 0.
+  Interval      time.Duration
+  // MinRateChange is the least change of the rate of a link, in Mbit/s,
+  // that is a rate change event. If 0, every change is.
+  MinRateChange uint16
+}
+
+// Event is a change in the topology between two consecutive polls of
+// Watch. Address is set for station events, Source, Destination and the
+// rates for rate changes, and the coordinator addresses for CCo changes.
+type Event struct {
+  Time               time.Time
+  Type               string
+  Address            net.HardwareAddr
+  NetworkID          string
+  CCoAddress         net.HardwareAddr
+  PreviousCCoAddress net.HardwareAddr
+  Source             net.HardwareAddr
+  Destination        net.HardwareAddr
+  Rate               uint16
+  PreviousRate       uint16
+}
+
+// Watch polls the topology every opts.Interval, and sends the events between
+// each poll and the last on the returned channel, which is closed once ctx
+// is done. The first poll is made before it returns, and its error returned
+// if it fails; later polls that fail are left out, so that a station that
+// missed one isn't taken to have left. Events are only sent as fast as they
+// are received, and polling waits meanwhile.
+func Watch(ctx context.Context, opts WatchOptions) (<-chan Event, error) {
+  var raw *RawRequester
+  if opts.Requester == nil {
+    iface, err := net.InterfaceByName(opts.Interface)
+    if err != nil {
+      return nil, err
+    }
+    if raw, err = NewRawRequester(iface); err != nil {
+      return nil, err
+    }
+    opts.Requester = raw
+  }
+  interval := opts.Interval
+  if interval == 0 {
+    interval = time.Minute
+  }
+
+  prev, err := Topology(ctx, opts.TopologyOptions)
+  if err != nil {
+    if raw != nil {
+      raw.Close()
+    }
+    return nil, err
+  }
+  ch := make(chan Event)
+  go func() {
+    defer close(ch)
+    if raw != nil {
+      defer raw.Close()
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+      select {
+      case <-ctx.Done():
+        return
+      case <-ticker.C:
+      }
+      cur, err := Topology(ctx, opts.TopologyOptions)
+      if err != nil {
+        continue
+      }
+      for _, e := range diff_topology(prev, cur, opts.MinRateChange, time.Now()) {
+        select {
+        case ch <- e:
+        case <-ctx.Done():
+          return
+        }
+      }
+      prev = cur
+    }
+  }()
+  return ch, nil
+}
+
+// diff_topology returns the events that turn prev into cur. Rates are
+// compared per direction, using the lowest rate reported for it.
+func diff_topology(prev, cur *TopologySnapshot, minRateChange uint16, now time.Time) []Event {
+  var events []Event
+  for _, station := range cur.Stations {
+    if prev.station(station.Address) == nil {
+      events = append(events, Event{Time: now, Type: EventStationJoined, Address: station.Address, NetworkID: station.NetworkID})
+    }
+  }
+  for _, station := range prev.Stations {
+    if cur.station(station.Address) == nil {
+      events = append(events, Event{Time: now, Type: EventStationLeft, Address: station.Address, NetworkID: station.NetworkID})
+    }
+  }
+
+  for _, network := range cur.Networks {
+    for _, old := range prev.Networks {
+      if old.ID == network.ID && old.CCoAddress.String() != network.CCoAddress.String() {
+        events = append(events, Event{
+          Time:               now,
+          Type:               EventCCoChanged,
+          NetworkID:          network.ID,
+          CCoAddress:         network.CCoAddress,
+          PreviousCCoAddress: old.CCoAddress,
+        })
+      }
+    }
+  }
+
+  oldRates, rates := prev.rates(), cur.rates()
+  for _, link := range cur.Links {
+    key := link.Source.String() + ">" + link.Destination.String()
+    old, ok := oldRates[key]
+    if !ok {
+      continue
+    }
+    // Each direction is only compared once, however many report it.
+    delete(oldRates, key)
+    rate := rates[key]
+    change := int(rate) - int(old)
+    if change < 0 {
+      change = -change
+    }
+    if change == 0 || change < int(minRateChange) {
+      continue
+    }
+    events = append(events, Event{
+      Time:         now,
+      Type:         EventRateChanged,
+      Source:       link.Source,
+      Destination:  link.Destination,
+      Rate:         rate,
+      PreviousRate: old,
+    })
+  }
+  return events
+}
+
+func (t *TopologySnapshot) station(address net.HardwareAddr) *TopologyStation {
+  for i := range t.Stations {
+    if t.Stations[i].Address.String() == address.String() {
+      return &t.Stations[i]
+    }
+  }
+  return nil
+}
+
+// rates returns the lowest rate reported from each source to each
+// destination, keyed by "source>destination".
+func (t *TopologySnapshot) rates() map[string]uint16 {
+  rates := map[string]uint16{}
+  for _, link := range t.Links {
+    key := link.Source.String() + ">" + link.Destination.String()
+    if r, ok := rates[key]; !ok || link.Rate < r {
+      rates[key] = link.Rate
+    }
+  }
+  return rates
+}
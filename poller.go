@@ -0,0 +1,1230 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "bytes"
+  "context"
+  "encoding/hex"
+  "net"
+  "sync"
+  "time"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// localAliases are answered only by the adapter attached to the interface,
+// and are asked in turn until one is: by default only the local management
+// address of Qualcomm chips, as no other vendor documents one. Each is sent
+// the requests of every enabled family, so an adapter that answers it is
+// asked the standard ones.
+var localAliases = []net.HardwareAddr{
+  {0x00, 0xB0, 0x52, 0x00, 0x00, 0x01},
+}
+
+// is_local_alias reports whether a is one of localAliases.
+func is_local_alias(a net.HardwareAddr) bool {
+  for _, alias := range localAliases {
+    if bytes.Equal(a, alias) {
+      return true
+    }
+  }
+  return false
+}
+
+// Poller queries the Homeplug devices and publishes the results to every
+// registered Output.
+type Poller struct {
+  transport  *Transport
+  // dests are queried in turn on each poll, into the same snapshot.
+  dests      []net.HardwareAddr
+  families   []ProtocolFamily
+  mutex      sync.Mutex
+  outputs    []Output
+  // dialects is the family that each unicast destination answered with on
+  // the last poll.
+  dialects   map[string]string
+  dialectLRU lruIndex
+  prober     *ARPProber
+  resolver   *HostResolver
+  schedules  bool
+  linkStats  bool
+  firmware   bool
+  toneMaps   bool
+  discover   bool
+  // pipeline sends the requests of the heavy collectors to each station
+  // back to back, and pipelined keeps their confirms during a poll.
+  pipeline   bool
+  pipelined  map[string][]homeplug.Message
+  // counters keeps the link stats counters increasing across restarts of
+  // the stations.
+  counters   counterTracker
+  // backoff suspends the heavy collectors for devices that stop answering
+  // them.
+  backoff    collectorBackoff
+  // quarantine suspends them for stations that send malformed confirms.
+  quarantine stationQuarantine
+  // reboots counts the reboots of the stations.
+  reboots    rebootTracker
+  // local is the adapter attached to the interface, once it has answered
+  // one of the local aliases.
+  local      net.HardwareAddr
+  // lock is held once the poller has made sure that no other exporter is
+  // polling on the same interface.
+  lock       io.Closer
+  closed     bool
+  synthetic  *syntheticTarget
+  // phases are the configured phases of the stations, and vendors the
+  // configured vendors of OUIs.
+  phases     map[string]string
+  vendors    map[string]string
+  // types are the configured device types of stations and OUIs.
+  types      map[string]string
+  // filter drops the replies of stations outside the accepted networks and
+  // reporters.
+  filter     replyFilter
+  // crons restrict the heavy collectors they name to the polls due under
+  // their schedule. Between those, snapshots keep the results of the last
+  // run in beacons and lastStats.
+  crons      map[string]*cronRun
+  beacons    map[string]Network
+  lastStats  []LinkStats
+  firmwares  map[string]*Firmware
+  lastMaps   []ToneMap
+  discovered []DiscoveredStation
+  neighbours []DiscoveredNetwork
+  burst      pollBurst
+}
+
+func NewPoller(transport *Transport, dests []net.HardwareAddr, families []ProtocolFamily) *Poller {
+  p := &Poller{
+    transport:  transport,
+    dests:      dests,
+    families:   families,
+    dialects:   map[string]string{},
+    dialectLRU: lruIndex{cache: "dialects"},
+    counters:   counterTracker{lru: lruIndex{cache: "link_counters"}},
+    backoff:    collectorBackoff{lru: lruIndex{cache: "collector_backoff"}},
+    quarantine: stationQuarantine{lru: lruIndex{cache: "quarantine"}},
+    reboots:    rebootTracker{lru: lruIndex{cache: "reboots"}},
+  }
+  p.burst.wake = make(chan struct{}, 1)
+  if err := p.acquire(); err != nil {
+    pollerConflict.WithLabelValues(p.transport.iface.Name).Set(1)
+    pollerLog.Warnf("%v", err)
+  }
+  return p
+}
+
+func (p *Poller) AddOutput(o Output) {
+  p.outputs = append(p.outputs, o)
+}
+
+// SetCollectSchedules enables asking the CCo of each network for its beacon
+// schedule on every poll.
+func (p *Poller) SetCollectSchedules(enabled bool) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.schedules = enabled
+}
+
+// SetCollectLinkStats enables asking each Qualcomm station for the MAC-level
+// counters of its links on every poll.
+func (p *Poller) SetCollectLinkStats(enabled bool) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.linkStats = enabled
+}
+
+// SetCollectFirmware enables asking each Qualcomm station for its firmware
+// version on every poll.
+func (p *Poller) SetCollectFirmware(enabled bool) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.firmware = enabled
+}
+
+// SetCollectToneMaps enables asking each Qualcomm station for the tone maps
+// of its links on every poll.
+func (p *Poller) SetCollectToneMaps(enabled bool) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.toneMaps = enabled
+}
+
+// SetCollectDiscoverList enables asking each station for the stations and
+// networks it hears on every poll.
+func (p *Poller) SetCollectDiscoverList(enabled bool) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.discover = enabled
+}
+
+// SetPipeline enables sending the requests of the firmware, link stats and
+// discover list collectors to each Qualcomm station back to back, instead of
+// waiting for the confirm of each before sending the next.
+func (p *Poller) SetPipeline(enabled bool) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.pipeline = enabled
+}
+
+// SetProber enables probing the hosts bridged behind each station on every
+// poll.
+func (p *Poller) SetProber(prober *ARPProber) {
+  p.prober = prober
+}
+
+// SetResolver enables naming the hosts bridged behind each station on every
+// poll.
+func (p *Poller) SetResolver(resolver *HostResolver) {
+  p.resolver = resolver
+}
+
+// SetQuarantine sets after how many polls in a row with malformed confirms a
+// station is quarantined, and how often it is re-probed. If threshold is 0,
+// stations are never quarantined.
+func (p *Poller) SetQuarantine(threshold int, reprobe time.Duration) {
+  p.quarantine.threshold = threshold
+  p.quarantine.reprobe = reprobe
+}
+
+// SetCollectorSchedules restricts the named heavy collectors, enabling them,
+// to the first poll at or after each time their schedule matches. Probes
+// are not restricted. Collectors whose schedule is removed are no longer
+// restricted, but stay enabled until their SetCollect setter disables them.
+func (p *Poller) SetCollectorSchedules(schedules map[string]*cronSchedule) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  for name := range p.crons {
+    if _, ok := schedules[name]; !ok {
+      collectorNextRun.DeleteLabelValues(name)
+    }
+  }
+  p.crons = map[string]*cronRun{}
+  for name, schedule := range schedules {
+    switch name {
+    case "schedule":
+      p.schedules = true
+    case "link_stats":
+      p.linkStats = true
+    case "firmware":
+      p.firmware = true
+    case "tone_maps":
+      p.toneMaps = true
+    case "discover_list":
+      p.discover = true
+    }
+    r := &cronRun{schedule: schedule, next: schedule.Next(time.Now())}
+    p.crons[name] = r
+    collectorNextRun.WithLabelValues(name).Set(float64(r.next.Unix()))
+  }
+}
+
+// SetPhases sets the electrical phase of the stations, keyed by the string
+// form of their address.
+func (p *Poller) SetPhases(phases map[string]string) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.phases = phases
+}
+
+// SetVendors adds vendors to the built-in ones, keyed by the string form of
+// their OUI.
+func (p *Poller) SetVendors(vendors map[string]string) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.vendors = vendors
+}
+
+// SetDeviceTypes sets the device types of stations, keyed by the string form
+// of their address or OUI.
+func (p *Poller) SetDeviceTypes(types map[string]string) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.types = types
+}
+
+// SetReplyFilter pins the replies that are decoded to the accepted networks
+// and reporters of f.
+func (p *Poller) SetReplyFilter(f replyFilter) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.filter = f
+}
+
+// Poll queries the devices once and publishes the resulting snapshot.
+// Concurrent calls are serialized, since responses cannot be told apart. If
+// ctx is done before the poll is, what was collected so far is returned
+// with its error, and not published.
+func (p *Poller) Poll(ctx context.Context) (*Snapshot, error) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+
+  if err := p.acquire(); err != nil {
+    pollerConflict.WithLabelValues(p.transport.iface.Name).Set(1)
+    return nil, err
+  }
+  pollerConflict.WithLabelValues(p.transport.iface.Name).Set(0)
+  p.transport.TakeRoundTrips()
+
+  s := &Snapshot{
+    Target: p.dests[0],
+    Time:   time.Now(),
+  }
+  // The local adapter is queried on its own first, so that its data is
+  // published even if the destinations cannot be reached.
+  start := time.Now()
+  local := p.localAdapter(ctx)
+  if local != nil {
+    if err := p.gather(ctx, s, local, queryTimeout, 0, nil); err != nil {
+      s.Collected("discovery", start, err)
+      return partial(ctx, s, err)
+    }
+    if s.Station(local) == nil {
+      pollerLog.Infof("local adapter %v did not answer", local)
+      p.local, local = nil, nil
+    }
+    s.Local = local
+  }
+  // Each destination's replies are merged into s, less those of stations
+  // that already answered another, which would only repeat them. The poll
+  // fails if none of them can be queried.
+  var err error
+  queried, failed := 0, 0
+  for _, dest := range p.dests {
+    if local != nil && (is_local_alias(dest) || bytes.Equal(dest, local)) {
+      continue
+    }
+    queried++
+    if derr := p.gather(ctx, s, dest, queryTimeout, 0, responded(s)); derr != nil {
+      if ctx.Err() != nil {
+        s.Collected("discovery", start, derr)
+        return partial(ctx, s, derr)
+      }
+      failed++
+      if err == nil {
+        err = derr
+      }
+      if len(p.dests) > 1 || local != nil {
+        pollerLog.Errorf("Error querying %v: %v", dest, derr)
+      }
+    }
+  }
+  if queried > 0 && failed == queried {
+    if local == nil {
+      s.Collected("discovery", start, err)
+      return partial(ctx, s, err)
+    }
+    pollerLog.Errorf("No destination could be queried, publishing the local adapter only")
+  }
+  s.Collected("discovery", start, err)
+  if err := p.complete(ctx, s, true, queryTimeout, nil); err != nil {
+    return s, err
+  }
+
+  for _, o := range p.outputs {
+    if err := o.Publish(s); err != nil {
+      pollerLog.Errorf("Error publishing to %s output: %v", o.Name(), err)
+    }
+  }
+  return s, nil
+}
+
+// partial returns s along with err if the error is that ctx is done, so that
+// callers get what was collected before it was, and only err otherwise.
+func partial(ctx context.Context, s *Snapshot, err error) (*Snapshot, error) {
+  if ctx.Err() != nil {
+    return s, err
+  }
+  return nil, err
+}
+
+// SetSyntheticTarget makes probes of the target's address answered by the
+// target itself.
+func (p *Poller) SetSyntheticTarget(t *syntheticTarget) {
+  p.synthetic = t
+}
+
+// Probe queries dest like Poll, but without publishing the snapshot. Replies
+// to the query and to each request of the collectors are waited for until
+// none have arrived for timeout, and the query is retried up to retries times if nothing answers. If collectors is not nil,
+// the heavy collectors it names are run in place of those enabled on the
+// poller. The synthetic target is answered without touching the interface.
+// Like Poll, it returns what was collected so far if ctx is done first.
+func (p *Poller) Probe(ctx context.Context, dest net.HardwareAddr, timeout time.Duration, retries int, collectors []string) (*Snapshot, error) {
+  if p.synthetic.Is(dest) {
+    return p.synthetic.Probe(p.families, p.requests()), nil
+  }
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+
+  if err := p.acquire(); err != nil {
+    return nil, err
+  }
+  return p.collect(ctx, dest, timeout, retries, collectors)
+}
+
+// collect queries dest and decodes the replies into a new snapshot.
+func (p *Poller) collect(ctx context.Context, dest net.HardwareAddr, timeout time.Duration, retries int, collectors []string) (*Snapshot, error) {
+  p.transport.TakeRoundTrips()
+  s := &Snapshot{
+    Target: dest,
+    Time:   time.Now(),
+  }
+  start := time.Now()
+  err := p.gather(ctx, s, dest, timeout, retries, nil)
+  s.Collected("discovery", start, err)
+  if err != nil {
+    return partial(ctx, s, err)
+  }
+  if err := p.complete(ctx, s, false, timeout, collectors); err != nil {
+    return s, err
+  }
+  return s, nil
+}
+
+// responded returns the addresses of the stations of s, for gather to skip.
+func responded(s *Snapshot) map[string]bool {
+  addrs := make(map[string]bool, len(s.Stations))
+  for _, station := range s.Stations {
+    addrs[station.Address.String()] = true
+  }
+  return addrs
+}
+
+// gather queries dest and decodes the replies into s, ignoring those from
+// the stations whose addresses are in skip, which have already been decoded.
+// If ctx is done first, the replies received so far are decoded before its
+// error is returned.
+func (p *Poller) gather(ctx context.Context, s *Snapshot, dest net.HardwareAddr, timeout time.Duration, retries int, skip map[string]bool) error {
+  var msgs []homeplug.Message
+  var families []ProtocolFamily
+  var err error
+  // Destinations that need no retransmissions are counted too, as 0.
+  p.retransmitted(s, dest, 0)
+  for attempt := 0; ; attempt++ {
+    if attempt > 0 {
+      p.retransmitted(s, dest, len(p.requestsFor(dest)))
+    }
+    msgs, families, err = p.query(ctx, dest, timeout)
+    if err != nil && ctx.Err() == nil {
+      return err
+    }
+    if err != nil {
+      break
+    }
+    if len(msgs) > 0 || attempt >= retries {
+      break
+    }
+    pollerLog.Debugf("no reply from %v, retrying", dest)
+  }
+
+  if len(skip) > 0 {
+    kept := msgs[:0]
+    for _, m := range msgs {
+      if !skip[m.Source.String()] {
+        kept = append(kept, m)
+      }
+    }
+    msgs = kept
+  }
+  msgs = p.filter.Filter(msgs)
+  claimed := p.decode(s, families, msgs)
+  if err != nil {
+    // Partial replies say nothing about the dialect of dest.
+    return err
+  }
+  p.learn(dest, claimed)
+  return nil
+}
+
+// complete adds what is collected per network or station rather than from
+// the replies to the query, waiting for the replies of each station for up
+// to timeout. In a poll, the heavy collectors with a schedule
+// only run when they are due, and every one runs during a burst. A probe
+// runs those named by collectors instead, unless it is nil. It stops,
+// returning its error, once ctx is done.
+func (p *Poller) complete(ctx context.Context, s *Snapshot, poll bool, timeout time.Duration, collectors []string) error {
+  assign_phases(s, p.phases)
+  assign_vendors(s, p.vendors)
+  assign_device_types(s, p.types)
+  _, _, burst := p.bursting()
+  burst = burst && poll
+  schedules, linkStats, firmware, toneMaps, discover := p.schedules, p.linkStats, p.firmware, p.toneMaps, p.discover
+  if collectors != nil {
+    schedules, linkStats, firmware, toneMaps, discover = false, false, false, false, false
+    for _, collector := range collectors {
+      schedules = schedules || collector == "schedule"
+      linkStats = linkStats || collector == "link_stats"
+      firmware = firmware || collector == "firmware"
+      toneMaps = toneMaps || collector == "tone_maps"
+      discover = discover || collector == "discover_list"
+    }
+  }
+  run := func(enabled bool, collector string) bool {
+    return (enabled || burst) && (!poll || burst || p.due(collector))
+  }
+  if f, l, d := run(firmware, "firmware"), run(linkStats, "link_stats"), run(discover, "discover_list"); p.pipeline && (f || l || d) {
+    start := time.Now()
+    s.Collected("pipeline", start, p.prefetch(ctx, s, timeout, f, l, d))
+    defer func() { p.pipelined = nil }()
+  }
+  if schedules || burst {
+    if !poll || burst || p.due("schedule") {
+      start := time.Now()
+      s.Collected("schedule", start, p.querySchedules(ctx, s, timeout))
+      if poll {
+        p.ran(ctx, "schedule")
+        p.keepSchedules(s)
+      }
+    } else {
+      p.restoreSchedules(s)
+    }
+  }
+  if linkStats || burst {
+    if !poll || burst || p.due("link_stats") {
+      start := time.Now()
+      s.Collected("link_stats", start, p.queryLinkStats(ctx, s, timeout))
+      if poll {
+        p.ran(ctx, "link_stats")
+        p.lastStats = s.LinkStats
+      }
+    } else {
+      p.restoreLinkStats(s)
+    }
+  }
+  if firmware || burst {
+    if !poll || burst || p.due("firmware") {
+      start := time.Now()
+      s.Collected("firmware", start, p.queryFirmware(ctx, s, timeout))
+      if poll {
+        p.ran(ctx, "firmware")
+        p.keepFirmware(s)
+      }
+    } else {
+      p.restoreFirmware(s)
+    }
+  }
+  if toneMaps || burst {
+    if !poll || burst || p.due("tone_maps") {
+      start := time.Now()
+      s.Collected("tone_maps", start, p.queryToneMaps(ctx, s, timeout))
+      if poll {
+        p.ran(ctx, "tone_maps")
+        p.lastMaps = s.ToneMaps
+      }
+    } else {
+      p.restoreToneMaps(s)
+    }
+  }
+  if discover || burst {
+    if !poll || burst || p.due("discover_list") {
+      start := time.Now()
+      s.Collected("discover_list", start, p.queryDiscoverLists(ctx, s, timeout))
+      if poll {
+        p.ran(ctx, "discover_list")
+        p.discovered, p.neighbours = s.Discovered, s.Neighbours
+      }
+    } else {
+      p.restoreDiscoverLists(s)
+    }
+  }
+  p.quarantine.Advance()
+  p.reboots.assign(s)
+  assign_round_trips(s, p.transport.TakeRoundTrips())
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  if p.prober != nil {
+    start := time.Now()
+    err := p.prober.ProbeSnapshot(s)
+    s.Collected("bridged_hosts", start, err)
+    if err != nil {
+      pollerLog.Errorf("Error probing bridged hosts: %v", err)
+    }
+  }
+  if p.resolver != nil {
+    start := time.Now()
+    err := p.resolver.ResolveSnapshot(ctx, s)
+    s.Collected("host_names", start, err)
+    if err != nil {
+      pollerLog.Errorf("Error resolving bridged host names: %v", err)
+    }
+  }
+  return nil
+}
+
+// due reports whether the heavy collector is to run in this poll, which it is
+// unless its schedule has not matched since it last ran.
+func (p *Poller) due(collector string) bool {
+  r, ok := p.crons[collector]
+  return !ok || !time.Now().Before(r.next)
+}
+
+// ran schedules the next run of a heavy collector that was due and has run in
+// a poll, unless ctx was done before it could finish, in which case the next
+// poll runs it again. Runs during a burst that weren't due leave the schedule
+// as it was.
+func (p *Poller) ran(ctx context.Context, collector string) {
+  if !p.due(collector) || ctx.Err() != nil {
+    return
+  }
+  r, ok := p.crons[collector]
+  if !ok {
+    return
+  }
+  r.next = r.schedule.Next(time.Now())
+  collectorNextRun.WithLabelValues(collector).Set(float64(r.next.Unix()))
+  pollerLog.Infof("ran scheduled %s collector, next due at %s", collector, r.next.Format(time.RFC3339))
+}
+
+// keepSchedules records the beacon schedules in s, for the polls before the
+// schedule collector next runs.
+func (p *Poller) keepSchedules(s *Snapshot) {
+  p.beacons = map[string]Network{}
+  for _, network := range s.Networks {
+    if network.Schedule != nil {
+      p.beacons[network.ID] = network
+    }
+  }
+}
+
+// restoreSchedules sets the schedule of each network in s to the one last
+// collected for it.
+func (p *Poller) restoreSchedules(s *Snapshot) {
+  for i := range s.Networks {
+    network := &s.Networks[i]
+    if kept, ok := p.beacons[network.ID]; ok && network.Schedule == nil {
+      network.Schedule, network.Mode = kept.Schedule, kept.Mode
+    }
+  }
+}
+
+// restoreLinkStats adds the link stats last collected from the reporters that
+// are still in s.
+func (p *Poller) restoreLinkStats(s *Snapshot) {
+  for _, l := range p.lastStats {
+    if s.Station(l.Reporter) != nil {
+      s.LinkStats = append(s.LinkStats, l)
+    }
+  }
+}
+
+// restoreToneMaps adds the tone maps last collected from the reporters that
+// are still in s.
+func (p *Poller) restoreToneMaps(s *Snapshot) {
+  for _, t := range p.lastMaps {
+    if s.Station(t.Reporter) != nil {
+      s.ToneMaps = append(s.ToneMaps, t)
+    }
+  }
+}
+
+// keepFirmware records the firmware of the stations in s, for the polls
+// before the firmware collector next runs.
+func (p *Poller) keepFirmware(s *Snapshot) {
+  p.firmwares = map[string]*Firmware{}
+  for _, station := range s.Stations {
+    if station.Firmware != nil {
+      p.firmwares[station.Address.String()] = station.Firmware
+    }
+  }
+}
+
+// restoreFirmware sets the firmware of each station in s to the one last
+// collected for it.
+func (p *Poller) restoreFirmware(s *Snapshot) {
+  for i := range s.Stations {
+    station := &s.Stations[i]
+    if kept, ok := p.firmwares[station.Address.String()]; ok && station.Firmware == nil {
+      station.Firmware = kept
+    }
+  }
+}
+
+// localAdapter returns the adapter attached to the interface, asking the
+// local aliases for it in turn if it is not yet known. Only the attached
+// adapter answers them, so the first reply identifies it.
+func (p *Poller) localAdapter(ctx context.Context) net.HardwareAddr {
+  if p.local != nil {
+    return p.local
+  }
+  requests := p.requests()
+  // Only a confirm of one of the requests sent is an answer; anything else
+  // received meanwhile may be from any station.
+  answer := func(msgs []homeplug.Message) *homeplug.Message {
+    for i := range msgs {
+      if !p.transport.own(msgs[i].Source) && answers(&msgs[i].Frame, requests) {
+        return &msgs[i]
+      }
+    }
+    return nil
+  }
+  for _, alias := range localAliases {
+    msgs, err := p.transport.Request(ctx, alias, requests, queryTimeout, func(msgs []homeplug.Message) bool {
+      return answer(msgs) != nil
+    })
+    if err != nil {
+      pollerLog.Errorf("Error querying the local adapter: %v", err)
+      return nil
+    }
+    m := answer(msgs)
+    if m == nil {
+      pollerLog.Debugf("no adapter answered the local alias %v", alias)
+      continue
+    }
+    p.local = m.Source
+    pollerLog.Infof("local adapter is %v, answering %v", p.local, alias)
+    return p.local
+  }
+  return nil
+}
+
+// answers reports whether h is the confirm of one of requests: the MME type
+// after the request's, with the same OUI if it is vendor-specific.
+func answers(h *homeplug.Frame, requests []homeplug.Frame) bool {
+  for i := range requests {
+    if h.Type() != requests[i].Type() + 1 {
+      continue
+    }
+    if !h.IsVendorSpecific() || h.Vendor == requests[i].Vendor {
+      return true
+    }
+  }
+  return false
+}
+
+// Query sends a single request to dest and decodes the replies with family,
+// without publishing them. It waits for the first reply from dest if it is a
+// unicast address, or for the replies to stop otherwise. If ctx is done
+// first, the replies received so far are decoded and returned with its
+// error.
+func (p *Poller) Query(ctx context.Context, dest net.HardwareAddr, family *ProtocolFamily, request homeplug.Frame) (*Snapshot, error) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+
+  if err := p.acquire(); err != nil {
+    return nil, err
+  }
+
+  var complete func([]homeplug.Message) bool
+  if dest[0] & 0x01 == 0 {
+    complete = func(msgs []homeplug.Message) bool {
+      for i := range msgs {
+        if bytes.Equal(msgs[i].Source, dest) && family.Handles(&msgs[i].Frame) {
+          return true
+        }
+      }
+      return false
+    }
+  }
+  msgs, err := p.transport.Request(ctx, dest, []homeplug.Frame{request}, queryTimeout, complete)
+  if err != nil && ctx.Err() == nil {
+    return nil, err
+  }
+
+  s := &Snapshot{
+    Target: dest,
+    Time:   time.Now(),
+  }
+  _, malformed := decode(s, []ProtocolFamily{*family}, msgs)
+  log_malformed(malformed)
+  return s, err
+}
+
+// querySchedules asks the CCo of each network in the snapshot for its
+// beacon, and records the schedule it describes. It returns the first error,
+// or an error if a CCo did not answer, after querying the others.
+func (p *Poller) querySchedules(ctx context.Context, s *Snapshot, timeout time.Duration) error {
+  var failed error
+  for i := range s.Networks {
+    if ctx.Err() != nil {
+      return ctx.Err()
+    }
+    network := &s.Networks[i]
+    nid, err := hex.DecodeString(network.ID)
+    if err != nil || network.CCoAddress == nil {
+      continue
+    }
+    cco := network.CCoAddress
+    if p.backoff.Suspended("schedule", cco) || p.quarantine.Suspended(cco) {
+      continue
+    }
+    request := homeplug.Frame{Version: homeplug.AVVersion, MMEType: homeplug.CMGetBeaconReq, Payload: nid}
+    msgs, err := p.transport.Request(ctx, cco, []homeplug.Frame{request}, timeout, func(msgs []homeplug.Message) bool {
+      return bytes.Equal(msgs[len(msgs) - 1].Source, cco) && msgs[len(msgs) - 1].Frame.MMEType == homeplug.CMGetBeaconCnf
+    })
+    if err != nil {
+      pollerLog.Errorf("Error querying beacon of %s: %v", network.ID, err)
+      if failed == nil {
+        failed = err
+      }
+      continue
+    }
+    answered := false
+    for _, m := range msgs {
+      if !bytes.Equal(m.Source, cco) || m.Frame.MMEType != homeplug.CMGetBeaconCnf {
+        continue
+      }
+      answered = true
+      var b homeplug.Beacon
+      if err := accept(&m.Frame, (&b).UnmarshalBinary(m.Frame.Payload)); err != nil {
+        logDedup.Errorf(decoderLog, "decode", "[%v] failed to unmarshal CM_GET_BEACON frame: %v", m.Source, err)
+        continue
+      }
+      network.Schedule = new_schedule(&b)
+      network.Mode = network_mode_name(b.NetworkMode)
+      s.SetAsleep(network.ID, b.Sleeping)
+      s.DecodedAs(&m)
+    }
+    p.backoff.Record("schedule", cco, answered)
+    if !answered && failed == nil {
+      failed = fmt.Errorf("%v did not answer the beacon query of %s", cco, network.ID)
+    }
+  }
+  return failed
+}
+
+// queryLinkStats asks each Qualcomm reporter in the snapshot for the counters
+// of both directions of its link to each of its peers. Like querySchedules,
+// it returns the first error or missing answer.
+func (p *Poller) queryLinkStats(ctx context.Context, s *Snapshot, timeout time.Duration) error {
+  var failed error
+  for _, station := range s.Stations {
+    if !station.Reporter || station.Protocol != "qualcomm" {
+      continue
+    }
+    reporter := station.Address
+    if p.backoff.Suspended("link_stats", reporter) || p.quarantine.Suspended(reporter) {
+      continue
+    }
+    for _, link := range s.Links {
+      if !bytes.Equal(link.Reporter, reporter) || !bytes.Equal(link.Source, reporter) {
+        continue
+      }
+      if ctx.Err() != nil {
+        return ctx.Err()
+      }
+      peer := link.Destination
+      requests := []homeplug.Frame{homeplug.LinkStatsRequest(homeplug.LinkStatsTx, peer), homeplug.LinkStatsRequest(homeplug.LinkStatsRx, peer)}
+      var msgs []homeplug.Message
+      if station := s.Station(peer); station != nil && station.TEI != 0 {
+        msgs = p.prefetched(reporter, homeplug.LnkStatsCnf, len(requests), func(m *homeplug.Message) bool {
+          return link_stats_of(m, station.TEI)
+        })
+      }
+      if msgs == nil {
+        var err error
+        msgs, err = p.transport.Request(ctx, reporter, requests, timeout, func(msgs []homeplug.Message) bool {
+          n := 0
+          for i := range msgs {
+            if bytes.Equal(msgs[i].Source, reporter) && msgs[i].Frame.MMEType == homeplug.LnkStatsCnf {
+              n++
+            }
+          }
+          return n == len(requests)
+        })
+        if err != nil {
+          pollerLog.Errorf("Error querying link stats of %v: %v", reporter, err)
+          if failed == nil {
+            failed = err
+          }
+          continue
+        }
+      }
+      answered := false
+      for _, m := range msgs {
+        if !bytes.Equal(m.Source, reporter) || m.Frame.MMEType != homeplug.LnkStatsCnf {
+          continue
+        }
+        answered = true
+        var l homeplug.LinkStats
+        if err := accept(&m.Frame, (&l).UnmarshalBinary(m.Frame.Payload)); err != nil {
+          logDedup.Errorf(decoderLog, "decode", "[%v] failed to unmarshal VS_LNK_STATS frame: %v", m.Source, err)
+          continue
+        }
+        s.LinkStats = append(s.LinkStats, p.adjustLinkStats(reporter, peer, &l))
+        s.DecodedAs(&m)
+      }
+      p.backoff.Record("link_stats", reporter, answered)
+      if !answered {
+        if failed == nil {
+          failed = fmt.Errorf("%v did not answer the link stats query of %v", reporter, peer)
+        }
+        // The rest of its links are left for the next poll rather than
+        // sent to a device that may have locked up.
+        break
+      }
+    }
+  }
+  return failed
+}
+
+// queryFirmware asks each Qualcomm reporter in the snapshot for the version of
+// its firmware. Like querySchedules, it returns the first error or missing
+// answer.
+func (p *Poller) queryFirmware(ctx context.Context, s *Snapshot, timeout time.Duration) error {
+  var failed error
+  for i := range s.Stations {
+    if ctx.Err() != nil {
+      return ctx.Err()
+    }
+    station := &s.Stations[i]
+    if !station.Reporter || station.Protocol != "qualcomm" {
+      continue
+    }
+    reporter := station.Address
+    if p.backoff.Suspended("firmware", reporter) || p.quarantine.Suspended(reporter) {
+      continue
+    }
+    msgs := p.prefetched(reporter, homeplug.SwVerCnf, 1, nil)
+    if msgs == nil {
+      request := homeplug.Frame{Version: homeplug.HPVersion, MMEType: homeplug.SwVerReq, Vendor: homeplug.HPVendor}
+      var err error
+      msgs, err = p.transport.Request(ctx, reporter, []homeplug.Frame{request}, timeout, func(msgs []homeplug.Message) bool {
+        return bytes.Equal(msgs[len(msgs) - 1].Source, reporter) && msgs[len(msgs) - 1].Frame.MMEType == homeplug.SwVerCnf
+      })
+      if err != nil {
+        pollerLog.Errorf("Error querying firmware version of %v: %v", reporter, err)
+        if failed == nil {
+          failed = err
+        }
+        continue
+      }
+    }
+    answered := false
+    for _, m := range msgs {
+      if !bytes.Equal(m.Source, reporter) || m.Frame.MMEType != homeplug.SwVerCnf {
+        continue
+      }
+      answered = true
+      var v homeplug.SoftwareVersion
+      if err := accept(&m.Frame, (&v).UnmarshalBinary(m.Frame.Payload)); err != nil {
+        logDedup.Errorf(decoderLog, "decode", "[%v] failed to unmarshal VS_SW_VER frame: %v", m.Source, err)
+        continue
+      }
+      station.Firmware = &Firmware{Version: v.Version, DeviceClass: v.DeviceClass()}
+      s.DecodedAs(&m)
+    }
+    p.backoff.Record("firmware", reporter, answered)
+    if !answered && failed == nil {
+      failed = fmt.Errorf("%v did not answer the firmware version query", reporter)
+    }
+  }
+  return failed
+}
+
+// adjustLinkStats converts the raw counters of a confirm to ones that only
+// increase, and tells the reboot tracker whether they restarted.
+func (p *Poller) adjustLinkStats(reporter, peer net.HardwareAddr, l *homeplug.LinkStats) LinkStats {
+  direction := "tx"
+  if l.Direction == homeplug.LinkStatsRx {
+    direction = "rx"
+  }
+  key := reporter.String() + "/" + peer.String() + "/" + direction + "/"
+  seen := p.counters.seen(key + "mpdu_acked")
+  restarted := false
+  adjust := func(counter string, v uint64) uint64 {
+    total, reset := p.counters.adjust(key + counter, v)
+    restarted = restarted || reset
+    return total
+  }
+  stats := LinkStats{
+    Reporter:     reporter,
+    Peer:         peer,
+    Direction:    direction,
+    MPDUAcked:    adjust("mpdu_acked", l.MPDUAcked),
+    MPDUCollided: adjust("mpdu_collided", l.MPDUCollided),
+    MPDUFailed:   adjust("mpdu_failed", l.MPDUFailed),
+    PBPassed:     adjust("pb_passed", l.PBPassed),
+    PBFailed:     adjust("pb_failed", l.PBFailed),
+  }
+  if seen {
+    p.reboots.counted(reporter, restarted)
+  }
+  return stats
+}
+
+// acquire takes the interface lock, unless it is already held. Replies can't
+// be told apart, so two exporters polling at once would each see the other's
+// replies, and the devices would be sent twice the traffic.
+func (p *Poller) acquire() error {
+  if p.closed {
+    return fmt.Errorf("the poller on %s has been closed", p.transport.iface.Name)
+  }
+  if p.lock != nil {
+    return nil
+  }
+  lock, err := acquire_interface_lock(p.transport.iface.Name)
+  if err != nil {
+    return errInterfaceLocked{p.transport.iface.Name, err}
+  }
+  p.lock = lock
+  return nil
+}
+
+// errInterfaceLocked is the error of a poller whose interface another
+// exporter holds the lock of.
+type errInterfaceLocked struct {
+  iface string
+  err   error
+}
+
+func (e errInterfaceLocked) Error() string {
+  return fmt.Sprintf("another exporter is already polling on %s, not sending requests: %v", e.iface, e.err)
+}
+
+// Close closes the transport and the prober, once the poll or probe in
+// progress is done, and releases the interface lock. Polls and probes fail
+// from then on.
+func (p *Poller) Close() error {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  if p.closed {
+    return nil
+  }
+  p.closed = true
+  if p.prober != nil {
+    p.prober.Close()
+  }
+  if p.lock != nil {
+    p.lock.Close()
+  }
+  return p.transport.Close()
+}
+
+// query sends the requests of every family, and returns the replies along
+// with the families they are to be decoded with. A unicast destination is
+// only sent the requests of the family it answered last time, and the query
+// ends as soon as all of them have been answered. If they are not, every
+// family is queried instead.
+func (p *Poller) query(ctx context.Context, dest net.HardwareAddr, timeout time.Duration) ([]homeplug.Message, []ProtocolFamily, error) {
+  if family := p.dialect(dest); family != nil {
+    msgs, err := p.transport.Request(ctx, dest, p.requestsFor(dest), timeout, family.Complete)
+    if err != nil {
+      return msgs, []ProtocolFamily{*family}, err
+    }
+    if family.Answered(msgs) {
+      return msgs, []ProtocolFamily{*family}, nil
+    }
+    pollerLog.Infof("%v did not answer %s, querying all protocol families", dest, family.Name)
+    delete(p.dialects, dest.String())
+    p.dialectLRU.remove(dest.String())
+  }
+
+  msgs, err := p.transport.Request(ctx, dest, p.requests(), timeout, nil)
+  return msgs, p.families, err
+}
+
+// requestsFor returns the requests that query sends to dest first.
+func (p *Poller) requestsFor(dest net.HardwareAddr) []homeplug.Frame {
+  if family := p.dialect(dest); family != nil {
+    return append(append([]homeplug.Frame{}, family.Requests...), homeplug.RegisteredRequests()...)
+  }
+  return p.requests()
+}
+
+// retransmitted counts n requests sent to dest again, in s as well if they
+// are part of a poll.
+func (p *Poller) retransmitted(s *Snapshot, dest net.HardwareAddr, n int) {
+  mmeRetransmissions.WithLabelValues(p.transport.iface.Name, dest.String()).Add(float64(n))
+  if s == nil {
+    return
+  }
+  if s.Retransmissions == nil {
+    s.Retransmissions = map[string]int{}
+  }
+  s.Retransmissions[dest.String()] += n
+}
+
+// requests returns the requests of every family. Families may share standard
+// requests, which only need to be sent once.
+func (p *Poller) requests() []homeplug.Frame {
+  requests := []homeplug.Frame{}
+  sent := map[[2]byte]bool{}
+  for _, family := range p.families {
+    for _, r := range family.Requests {
+      if !sent[r.MMEType] {
+        sent[r.MMEType] = true
+        requests = append(requests, r)
+      }
+    }
+  }
+  return append(requests, homeplug.RegisteredRequests()...)
+}
+
+// dialect returns the family the destination is known to answer, if it is
+// a unicast address.
+func (p *Poller) dialect(dest net.HardwareAddr) *ProtocolFamily {
+  if dest[0] & 0x01 != 0 {
+    return nil
+  }
+  name, ok := p.dialects[dest.String()]
+  if !ok {
+    return nil
+  }
+  for i := range p.families {
+    if p.families[i].Name == name {
+      return &p.families[i]
+    }
+  }
+  return nil
+}
+
+// learn remembers the family a unicast destination answered with. It is only
+// known if a single station answered.
+func (p *Poller) learn(dest net.HardwareAddr, claimed map[string]string) {
+  if dest[0] & 0x01 != 0 || len(claimed) != 1 {
+    return
+  }
+  for _, name := range claimed {
+    if p.dialects[dest.String()] != name {
+      pollerLog.Debugf("%v answers %s", dest, name)
+    }
+    p.dialects[dest.String()] = name
+    if evicted, ok := p.dialectLRU.touch(dest.String()); ok {
+      delete(p.dialects, evicted)
+    }
+  }
+}
+
+// decode merges the messages into the snapshot. A station answering more than
+// one family is only decoded using the first of them, so that its data is not
+// exported twice. It returns the family each station was decoded with, and
+// the last error decoding the messages of each station that sent malformed
+// ones.
+func decode(s *Snapshot, families []ProtocolFamily, msgs []homeplug.Message) (map[string]string, map[string]error) {
+  handled := make([]bool, len(msgs))
+  claimed := map[string]string{}
+  malformed := map[string]error{}
+  decode_memberships(s, msgs)
+  for i := range msgs {
+    if msgs[i].Legacy != nil {
+      handled[i] = true
+      s.AddLegacyStation(msgs[i].Source)
+    }
+  }
+  for i := range msgs {
+    m := &msgs[i]
+    if handled[i] || m.Frame.MMEType != homeplug.CMMmeErrorInd {
+      continue
+    }
+    handled[i] = true
+    var e homeplug.MMEError
+    if err := accept(&m.Frame, (&e).UnmarshalBinary(m.Frame.Payload)); err != nil {
+      malformed[m.Source.String()] = err
+      continue
+    }
+    logDedup.Debugf(decoderLog, "mme_error", "[%v] %v", m.Source, &e)
+    s.AddMMEError(m.Source)
+    s.DecodedAs(m)
+  }
+  // Stations are claimed by the families of their required confirms first,
+  // as optional confirms may be answered by stations of any family.
+  for _, family := range families {
+    for i := range msgs {
+      m := &msgs[i]
+      if _, ok := claimed[m.Source.String()]; !ok && family.handles(&m.Frame, family.Confirms) {
+        claimed[m.Source.String()] = family.Name
+      }
+    }
+  }
+  for _, family := range families {
+    for i := range msgs {
+      m := &msgs[i]
+      if !family.Handles(&m.Frame) {
+        continue
+      }
+      handled[i] = true
+      if owner, ok := claimed[m.Source.String()]; ok && owner != family.Name {
+        continue
+      }
+      claimed[m.Source.String()] = family.Name
+      if err := family.Decode(s, m); err != nil {
+        malformed[m.Source.String()] = err
+        continue
+      }
+      s.DecodedAs(m)
+    }
+  }
+
+  for i := range msgs {
+    if handled[i] {
+      continue
+    }
+    ok, err := decode_registered(s, &msgs[i])
+    if !ok {
+      continue
+    }
+    handled[i] = true
+    if err != nil {
+      malformed[msgs[i].Source.String()] = err
+      continue
+    }
+    s.DecodedAs(&msgs[i])
+  }
+
+  for i := range msgs {
+    if !handled[i] {
+      logDedup.Errorf(decoderLog, "unhandled_mmetype", "got unhandled mmetype: %v", msgs[i].Frame.MMEType)
+    }
+  }
+  return claimed, malformed
+}
+
+// log_malformed logs the errors returned by decode.
+func log_malformed(malformed map[string]error) {
+  for station, err := range malformed {
+    logDedup.Errorf(decoderLog, "decode", "[%s] %v", station, err)
+  }
+}
+
+// decode decodes the replies to a poll, counting the stations that sent
+// malformed ones towards their quarantine.
+func (p *Poller) decode(s *Snapshot, families []ProtocolFamily, msgs []homeplug.Message) map[string]string {
+  claimed, malformed := decode(s, families, msgs)
+  answered := map[string]bool{}
+  for i := range msgs {
+    answered[msgs[i].Source.String()] = true
+  }
+  p.quarantine.Record(answered, malformed)
+  return claimed
+}
+
+// Run polls the devices every interval, or every burst interval during a
+// burst. If interval is 0, it only polls during bursts. Outputs retain the
+// data from the last successful poll when a poll fails.
+func (p *Poller) Run(interval time.Duration) {
+  for {
+    wait := interval
+    burstInterval, until, burst := p.bursting()
+    if burst || interval > 0 {
+      if _, err := p.Poll(context.Background()); err != nil {
+        pollerLog.Errorf("Error polling Homeplug: %v", err)
+      }
+    }
+    if burst {
+      wait = burstInterval
+      if d := time.Until(until); d < wait {
+        wait = d
+      }
+      if wait <= 0 {
+        continue
+      }
+    }
+    var timer *time.Timer
+    var expired <-chan time.Time
+    if wait > 0 {
+      timer = time.NewTimer(wait)
+      expired = timer.C
+    }
+    select {
+    case <-expired:
+    case <-p.burst.wake:
+    }
+    if timer != nil {
+      timer.Stop()
+    }
+  }
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+  "testing"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+func TestAnswers(t *testing.T) {
+  requests := []homeplug.Frame{
+    {MMEType: homeplug.NwInfoReq, Vendor: homeplug.HPVendor},
+    {MMEType: homeplug.CMNwInfoReq},
+  }
+  for _, c := range []struct {
+    frame homeplug.Frame
+    want  bool
+  }{
+    {homeplug.Frame{MMEType: homeplug.NwInfoCnf, Vendor: homeplug.HPVendor}, true},
+    {homeplug.Frame{MMEType: homeplug.CMNwInfoCnf}, true},
+    // A request, such as one of our own coming back, is not an answer.
+    {homeplug.Frame{MMEType: homeplug.NwInfoReq, Vendor: homeplug.HPVendor}, false},
+    // Nor is a confirm of something that was not asked.
+    {homeplug.Frame{MMEType: homeplug.CMStaCapCnf}, false},
+    // Nor one under another vendor's OUI.
+    {homeplug.Frame{MMEType: homeplug.NwInfoCnf, Vendor: [3]byte{0x00, 0x1F, 0x84}}, false},
+  } {
+    if got := answers(&c.frame, requests); got != c.want {
+      t.Errorf("answers(%04x from %x) = %v, want %v", c.frame.Type(), c.frame.Vendor, got, c.want)
+    }
+  }
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+  "net"
+  "time"
+  "errors"
+
+  "github.com/mdlayher/raw"
+  "golang.org/x/sys/unix"
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// priorityConn is a send-only packet socket with SO_PRIORITY set. It is not
+// bound to any protocol, so it never receives frames.
+type priorityConn struct {
+  iface *net.Interface
+  fd    int
+}
+
+func listen_priority(iface *net.Interface, priority int) (net.PacketConn, error) {
+  fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+  if err != nil {
+    return nil, err
+  }
+  if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PRIORITY, priority); err != nil {
+    unix.Close(fd)
+    return nil, err
+  }
+  return &priorityConn{iface: iface, fd: fd}, nil
+}
+
+func (c *priorityConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+  a, ok := addr.(*raw.Addr)
+  if !ok || len(a.HardwareAddr) > 8 {
+    return 0, unix.EINVAL
+  }
+  sa := &unix.SockaddrLinklayer{
+    Ifindex:  c.iface.Index,
+    Halen:    uint8(len(a.HardwareAddr)),
+    Protocol: homeplug.EtherType >> 8 | (homeplug.EtherType & 0xff) << 8,
+  }
+  copy(sa.Addr[:], a.HardwareAddr)
+  if err := unix.Sendto(c.fd, b, 0, sa); err != nil {
+    return 0, err
+  }
+  return len(b), nil
+}
+
+func (c *priorityConn) ReadFrom(b []byte) (int, net.Addr, error) {
+  return 0, nil, errors.New("priority socket is send-only")
+}
+
+func (c *priorityConn) Close() error {
+  return unix.Close(c.fd)
+}
+
+func (c *priorityConn) LocalAddr() net.Addr {
+  return &raw.Addr{HardwareAddr: c.iface.HardwareAddr}
+}
+
+func (c *priorityConn) SetDeadline(t time.Time) error {
+  return nil
+}
+
+func (c *priorityConn) SetReadDeadline(t time.Time) error {
+  return nil
+}
+
+func (c *priorityConn) SetWriteDeadline(t time.Time) error {
+  return nil
+}
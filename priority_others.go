@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+  "net"
+  "errors"
+)
+
+func listen_priority(iface *net.Interface, priority int) (net.PacketConn, error) {
+  return nil, errors.New("socket priority is only supported on Linux")
+}
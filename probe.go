@@ -0,0 +1,297 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "context"
+  "strconv"
+  "net/url"
+  "net/http"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+  "github.com/prometheus/common/model"
+)
+
+var (
+  probeSuccess = prometheus.NewDesc(
+    prometheus.BuildFQName(namespace, "probe", "success"),
+    "Whether any station answered the probe",
+    nil, nil)
+  probeDuration = prometheus.NewDesc(
+    prometheus.BuildFQName(namespace, "probe", "duration_seconds"),
+    "How long the probe took",
+    nil, nil)
+)
+
+// probeInterfaces are the interfaces /probe may query. Those of the poller
+// and the segments of the other --interface are probed with their pollers,
+// as a second transport on one of them would fail its lock. Each of the
+// others gets a poller of its own, with its own transport, the first time
+// it is asked for.
+type probeInterfaces struct {
+  mutex    sync.Mutex
+  primary  *Poller
+  segments map[string]*Poller
+  allowed  map[string]bool
+  pollers  map[string]*Poller
+  open     func(iface *net.Interface) (*Poller, error)
+}
+
+// new_probe_interfaces allows the named interfaces besides the primary
+// poller's, whose pollers open returns.
+func new_probe_interfaces(primary *Poller, names []string, open func(iface *net.Interface) (*Poller, error)) *probeInterfaces {
+  p := &probeInterfaces{
+    primary:  primary,
+    segments: map[string]*Poller{},
+    allowed:  map[string]bool{},
+    pollers:  map[string]*Poller{},
+    open:     open,
+  }
+  for _, name := range names {
+    p.allowed[name] = true
+  }
+  return p
+}
+
+// errProbeInterface is an interface the interface parameter may not ask
+// for.
+type errProbeInterface string
+
+func (e errProbeInterface) Error() string {
+  return fmt.Sprintf("interface %q is not in probe.interfaces or those of the targets", string(e))
+}
+
+// AddSegment probes the interface of segment with it, whether or not the
+// interface is allowed.
+func (p *probeInterfaces) AddSegment(segment *Poller) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.segments[segment.transport.iface.Name] = segment
+}
+
+// Poller returns the poller for the named interface, or the primary one if
+// name is empty.
+func (p *probeInterfaces) Poller(name string) (*Poller, error) {
+  if name == "" || name == p.primary.transport.iface.Name {
+    return p.primary, nil
+  }
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  if poller, ok := p.segments[name]; ok {
+    return poller, nil
+  }
+  if !p.allowed[name] {
+    return nil, errProbeInterface(name)
+  }
+  if poller, ok := p.pollers[name]; ok {
+    return poller, nil
+  }
+  iface, err := net.InterfaceByName(name)
+  if err != nil {
+    return nil, err
+  }
+  poller, err := p.open(iface)
+  if err != nil {
+    return nil, fmt.Errorf("failed to listen on %s: %v", name, err)
+  }
+  transportLog.Infof("probing on %s", name)
+  p.pollers[name] = poller
+  return poller, nil
+}
+
+// SetAllowed replaces the interfaces that may be probed with names, and
+// closes the pollers of those that are no longer among them. The pollers of
+// new ones are opened the first time they are probed.
+func (p *probeInterfaces) SetAllowed(names []string) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.allowed = map[string]bool{}
+  for _, name := range names {
+    p.allowed[name] = true
+  }
+  for name, poller := range p.pollers {
+    if !p.allowed[name] {
+      poller.Close()
+      delete(p.pollers, name)
+      transportLog.Infof("no longer probing on %s", name)
+    }
+  }
+}
+
+// Pollers returns the primary poller and those opened for other
+// interfaces, but not those of the segments.
+func (p *probeInterfaces) Pollers() []*Poller {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  pollers := []*Poller{p.primary}
+  for _, poller := range p.pollers {
+    pollers = append(pollers, poller)
+  }
+  return pollers
+}
+
+// probeTarget is what a probe queries, and how.
+type probeTarget struct {
+  dest       net.HardwareAddr
+  iface      string
+  timeout    time.Duration
+  retries    int
+  collectors []string
+}
+
+// apply overrides the settings of t with those that m sets.
+func (t *probeTarget) apply(m ModuleConfig) {
+  if m.Timeout > 0 {
+    t.timeout = time.Duration(m.Timeout)
+  }
+  if m.Retries != nil {
+    t.retries = *m.Retries
+  }
+  if m.Collectors != nil {
+    t.collectors = m.Collectors
+  }
+}
+
+// probe_target returns the target of a probe with the given parameters.
+// The target parameter is a MAC address or the name of a configured target,
+// and the settings are the probe defaults, overridden by those of the module
+// parameter or else the target's module, then by the target's own, then by
+// the interface, timeout and retries parameters, up to the configured
+// maxima. Its errors are the client's.
+func probe_target(cfg *Config, params url.Values) (probeTarget, error) {
+  t := probeTarget{
+    timeout: time.Duration(cfg.Probe.Timeout),
+    retries: cfg.Probe.Retries,
+  }
+  var named *TargetConfig
+  name := params.Get("target")
+  if a, err := net.ParseMAC(name); err == nil && len(a) == 6 {
+    t.dest = a
+  } else if named = cfg.target(name); named != nil {
+    t.dest, _ = net.ParseMAC(named.Destination)
+    t.iface = named.Interface
+  } else {
+    return t, fmt.Errorf("target must be a MAC address or the name of a target")
+  }
+
+  module := params.Get("module")
+  if module == "" && named != nil {
+    module = named.Module
+  }
+  if module != "" {
+    m, ok := cfg.Modules[module]
+    if !ok {
+      return t, fmt.Errorf("unknown module %q", module)
+    }
+    t.apply(m)
+  }
+  if named != nil {
+    t.apply(named.ModuleConfig)
+  }
+
+  if v := params.Get("interface"); v != "" {
+    t.iface = v
+  }
+  if v := params.Get("timeout"); v != "" {
+    d, err := model.ParseDuration(v)
+    if err != nil || d <= 0 {
+      return t, fmt.Errorf("invalid timeout %s", strconv.Quote(v))
+    }
+    t.timeout = time.Duration(d)
+    if t.timeout > time.Duration(cfg.Probe.MaxTimeout) {
+      t.timeout = time.Duration(cfg.Probe.MaxTimeout)
+    }
+  }
+  if v := params.Get("retries"); v != "" {
+    n, err := strconv.Atoi(v)
+    if err != nil || n < 0 {
+      return t, fmt.Errorf("invalid retries %s", strconv.Quote(v))
+    }
+    t.retries = n
+    if t.retries > cfg.Probe.MaxRetries {
+      t.retries = cfg.Probe.MaxRetries
+    }
+  }
+  return t, nil
+}
+
+// probe_handler serves /probe, which queries the device given by the target
+// parameter and returns the metrics for it alone, in the manner of the
+// blackbox exporter. The target is a MAC address or the name of one of the
+// configured targets, and its settings are given by probe_target with the
+// configuration in use.
+func probe_handler(exporter *Exporter, pollers *probeInterfaces, config func() *Config) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    target, err := probe_target(config(), r.URL.Query())
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+    poller, err := pollers.Poller(target.iface)
+    if _, ok := err.(errProbeInterface); ok {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+
+    start := time.Now()
+    ctx := r.Context()
+    if d, ok := scrape_timeout(r); ok {
+      var cancel context.CancelFunc
+      ctx, cancel = context.WithTimeout(ctx, d)
+      defer cancel()
+    }
+    var s *Snapshot
+    if err == nil {
+      s, err = poller.Probe(ctx, target.dest, target.timeout, target.retries, target.collectors)
+    }
+    success := 0.0
+    if err != nil {
+      httpLog.Errorf("Error probing %v: %v", target.dest, err)
+    } else if len(s.Stations) > 0 {
+      success = 1
+    }
+
+    registry := prometheus.NewRegistry()
+    registry.MustRegister(probeCollector{
+      success:  success,
+      duration: time.Since(start).Seconds(),
+    })
+    if err == nil {
+      registry.MustRegister(exporter.snapshotCollector(s))
+    }
+    promhttp.HandlerFor(exporter.Gatherer(registry), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+  }
+}
+
+// scrape_timeout returns how long a probe may take for its metrics to reach
+// Prometheus in time: the scrape timeout it sends, less half a second for
+// the response.
+func scrape_timeout(r *http.Request) (time.Duration, bool) {
+  v, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+  if err != nil || v <= 0 {
+    return 0, false
+  }
+  d := time.Duration(v * float64(time.Second)) - 500 * time.Millisecond
+  if d < 100 * time.Millisecond {
+    d = 100 * time.Millisecond
+  }
+  return d, true
+}
+
+type probeCollector struct {
+  success  float64
+  duration float64
+}
+
+func (c probeCollector) Describe(ch chan<- *prometheus.Desc) {
+  ch <- probeSuccess
+  ch <- probeDuration
+}
+
+func (c probeCollector) Collect(ch chan<- prometheus.Metric) {
+  ch <- prometheus.MustNewConstMetric(probeSuccess, prometheus.GaugeValue, c.success)
+  ch <- prometheus.MustNewConstMetric(probeDuration, prometheus.GaugeValue, c.duration)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+  "net"
+  "sync"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+var stationQuarantined = prometheus.NewGaugeVec(
+  prometheus.GaugeOpts{
+    Namespace: namespace,
+    Name:      "station_quarantined",
+    Help:      "Whether a station is quarantined for sending malformed confirms. Its confirms are still decoded, but it is only sent the heavy collectors' queries when it is re-probed.",
+  },
+  []string{"mac_address"})
+
+// stationQuarantine tracks the stations whose confirms cannot be decoded. A
+// station that sent malformed confirms in threshold polls in a row is
+// quarantined until it sends a poll's worth of confirms that decode: its
+// errors are only logged at debug level, and the heavy collectors skip it
+// except for once every reprobe.
+type stationQuarantine struct {
+  mutex     sync.Mutex
+  threshold int
+  reprobe   time.Duration
+  stations  map[string]*quarantineState
+  lru       lruIndex
+}
+
+type quarantineState struct {
+  failures    int
+  quarantined bool
+  // next is when the heavy collectors are next to query the station.
+  next        time.Time
+}
+
+// Record counts the replies from the stations in answered, and logs the
+// errors of those in malformed.
+func (q *stationQuarantine) Record(answered map[string]bool, malformed map[string]error) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  if q.stations == nil {
+    q.stations = map[string]*quarantineState{}
+  }
+  for station := range answered {
+    st, ok := q.stations[station]
+    err, bad := malformed[station]
+    if !bad {
+      if ok {
+        if st.quarantined {
+          pollerLog.Infof("%s sends confirms that decode again, releasing it from quarantine", station)
+          stationQuarantined.DeleteLabelValues(station)
+        }
+        delete(q.stations, station)
+        q.lru.remove(station)
+      }
+      continue
+    }
+    if ok && st.quarantined {
+      q.touch(station)
+      logDedup.Debugf(decoderLog, "quarantined", "[%s] %v", station, err)
+      continue
+    }
+    logDedup.Errorf(decoderLog, "decode", "[%s] %v", station, err)
+    if q.threshold <= 0 {
+      continue
+    }
+    if !ok {
+      st = &quarantineState{}
+      q.stations[station] = st
+    }
+    q.touch(station)
+    st.failures++
+    if st.failures < q.threshold {
+      continue
+    }
+    st.quarantined = true
+    st.next = time.Now().Add(q.reprobe)
+    pollerLog.Warnf("%s sent malformed confirms in %d polls in a row, quarantining it", station, st.failures)
+    stationQuarantined.WithLabelValues(station).Set(1)
+  }
+}
+
+// touch marks the state of station as used, evicting the least recently
+// used station's if there are too many.
+func (q *stationQuarantine) touch(station string) {
+  evicted, ok := q.lru.touch(station)
+  if !ok {
+    return
+  }
+  if st := q.stations[evicted]; st != nil && st.quarantined {
+    stationQuarantined.DeleteLabelValues(evicted)
+  }
+  delete(q.stations, evicted)
+}
+
+// Suspended reports whether the heavy collectors should skip the station for
+// now.
+func (q *stationQuarantine) Suspended(station net.HardwareAddr) bool {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  st, ok := q.stations[station.String()]
+  return ok && st.quarantined && time.Now().Before(st.next)
+}
+
+// Advance schedules the next re-probe of the quarantined stations that were
+// due one, once the heavy collectors have run.
+func (q *stationQuarantine) Advance() {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  now := time.Now()
+  for station, st := range q.stations {
+    if st.quarantined && !now.Before(st.next) {
+      pollerLog.Debugf("re-probed quarantined station %s", station)
+      st.next = now.Add(q.reprobe)
+    }
+  }
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "time"
+  "context"
+  "strings"
+  "net/http"
+  "encoding/json"
+
+  "github.com/prometheus/common/config"
+)
+
+// Exit codes of the rates and check commands, as Nagios plugins use them.
+const (
+  nagiosOK       = 0
+  nagiosWarning  = 1
+  nagiosCritical = 2
+  nagiosUnknown  = 3
+)
+
+var nagiosStatus = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// bytes_to_mbps converts a rate from the data model back to Mbit/s, as
+// reported on the wire.
+func bytes_to_mbps(rate float64) float64 {
+  return rate * 8 / (1024 * 1024)
+}
+
+// run_rates polls the devices once and prints every link whose rate is below
+// minMbps, after a status line in the format of a Nagios plugin. It returns
+// the exit code: OK if there are no such links, CRITICAL if there are, or
+// UNKNOWN if the poll failed or found no links at all.
+func run_rates(poll func(context.Context) (*Snapshot, error), minMbps float64, w io.Writer) int {
+  s, err := poll(context.Background())
+  if err != nil {
+    fmt.Fprintf(w, "UNKNOWN - polling failed: %v\n", err)
+    return nagiosUnknown
+  }
+  if len(s.Links) == 0 {
+    fmt.Fprintf(w, "UNKNOWN - no links found from %v\n", s.Target)
+    return nagiosUnknown
+  }
+
+  var offenders []Link
+  for _, link := range s.Links {
+    if bytes_to_mbps(link.Rate) < minMbps {
+      offenders = append(offenders, link)
+    }
+  }
+  if len(offenders) == 0 {
+    fmt.Fprintf(w, "OK - %d links at or above %g Mbps\n", len(s.Links), minMbps)
+    return nagiosOK
+  }
+  fmt.Fprintf(w, "CRITICAL - %d of %d links below %g Mbps\n", len(offenders), len(s.Links), minMbps)
+  for _, link := range offenders {
+    fmt.Fprintf(w, "%v -> %v %g Mbps (%s, reported by %v)\n",
+                link.Source, link.Destination, bytes_to_mbps(link.Rate), link.Protocol, link.Reporter)
+  }
+  return nagiosCritical
+}
+
+// run_check polls the devices once and prints the result as a Nagios plugin
+// would: a status line with performance data for the number of stations and
+// the rate of every pair of stations, then the problems found. A pair whose
+// lowest rate is below critMbps, or an expected device that did not answer,
+// is CRITICAL, and a pair below warnMbps is a WARNING. A threshold of 0 is
+// not checked.
+func run_check(poll func(context.Context) (*Snapshot, error), warnMbps, critMbps float64, expected []net.HardwareAddr, w io.Writer) int {
+  s, err := poll(context.Background())
+  if err != nil {
+    fmt.Fprintf(w, "HOMEPLUG UNKNOWN - polling failed: %v\n", err)
+    return nagiosUnknown
+  }
+
+  status := nagiosOK
+  var problems, summary []string
+  for _, address := range expected {
+    if station := s.Station(address); station == nil || !station.Responded {
+      problems = append(problems, fmt.Sprintf("CRITICAL: device %v did not answer", address))
+      status = nagiosCritical
+    }
+  }
+  if n := len(problems); n > 0 {
+    summary = append(summary, fmt.Sprintf("%d of %d expected devices missing", n, len(expected)))
+  }
+
+  pairs := s.LinkPairs(false)
+  perfdata := []string{fmt.Sprintf("stations=%d;;;0", len(s.Stations))}
+  var low int
+  for _, p := range pairs {
+    mbps := bytes_to_mbps(p.Rate)
+    perfdata = append(perfdata, fmt.Sprintf("'%v %v %s'=%g;%s;%s;0",
+                      p.A, p.B, p.Protocol, mbps, nagios_threshold(warnMbps), nagios_threshold(critMbps)))
+    pairStatus := nagiosOK
+    switch {
+    case critMbps > 0 && mbps < critMbps:
+      pairStatus = nagiosCritical
+    case warnMbps > 0 && mbps < warnMbps:
+      pairStatus = nagiosWarning
+    default:
+      continue
+    }
+    low++
+    problems = append(problems, fmt.Sprintf("%s: %v - %v %g Mbps (%s)", nagiosStatus[pairStatus], p.A, p.B, mbps, p.Protocol))
+    if pairStatus > status {
+      status = pairStatus
+    }
+  }
+  if low > 0 {
+    summary = append(summary, fmt.Sprintf("%d of %d links below threshold", low, len(pairs)))
+  }
+  if len(summary) == 0 {
+    summary = append(summary, fmt.Sprintf("%d stations, %d links", len(s.Stations), len(pairs)))
+  }
+
+  fmt.Fprintf(w, "HOMEPLUG %s - %s | %s\n", nagiosStatus[status], strings.Join(summary, ", "), strings.Join(perfdata, " "))
+  for _, p := range problems {
+    fmt.Fprintln(w, p)
+  }
+  return status
+}
+
+// nagios_threshold formats a threshold for performance data, in which a
+// threshold that is not checked is left empty. The ranges are inverted, as
+// the rates alert when they fall below them.
+func nagios_threshold(mbps float64) string {
+  if mbps <= 0 {
+    return ""
+  }
+  return fmt.Sprintf("%g:", mbps)
+}
+
+// command_poll returns how the rates and check commands poll: with poller,
+// unless another exporter holds the lock of the interface, in which case
+// they can't, and the topology of that exporter's last poll is read from its
+// API at apiURL instead.
+func command_poll(poller *Poller, apiURL, tokenFile string) func(context.Context) (*Snapshot, error) {
+  return func(ctx context.Context) (*Snapshot, error) {
+    s, err := poller.Poll(ctx)
+    locked, ok := err.(errInterfaceLocked)
+    if !ok {
+      return s, err
+    }
+    s, err = read_api_topology(ctx, apiURL, tokenFile)
+    if err != nil {
+      return nil, fmt.Errorf("%v, and its API at %s could not be read: %v; give its address with --command.api-url, or stop it", locked, apiURL, err)
+    }
+    mainLog.Infof("%s is polled by the exporter at %s; using its last poll, from %s", locked.iface, apiURL, s.Time.Format(time.RFC3339))
+    return s, nil
+  }
+}
+
+// command_api_url is the URL of the exporter on this host, from the listen
+// address, for when --command.api-url is not given.
+func command_api_url(listen string) string {
+  host, port, err := net.SplitHostPort(listen)
+  if err != nil {
+    return "http://localhost:9702"
+  }
+  if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+    host = "localhost"
+  }
+  return "http://" + net.JoinHostPort(host, port)
+}
+
+// read_api_topology reads /api/v1/topology from the exporter at apiURL, with
+// the bearer token in tokenFile if it is given, into a snapshot.
+func read_api_topology(ctx context.Context, apiURL, tokenFile string) (*Snapshot, error) {
+  target := strings.TrimSuffix(apiURL, "/") + "/api/" + apiVersion + "/topology"
+  client, err := new_http_client(config.HTTPClientConfig{BearerTokenFile: tokenFile}, "command_api", target)
+  if err != nil {
+    return nil, err
+  }
+  ctx, cancel := context.WithTimeout(ctx, 30 * time.Second)
+  defer cancel()
+  req, err := http.NewRequest(http.MethodGet, target, nil)
+  if err != nil {
+    return nil, err
+  }
+  resp, err := client.Do(req.WithContext(ctx))
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("%s returned %s", target, resp.Status)
+  }
+  var t apiTopology
+  if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+    return nil, fmt.Errorf("invalid topology: %v", err)
+  }
+  return snapshot_from_api(&t)
+}
+
+// snapshot_from_api returns the stations and links of an API topology, which
+// is all that the rates and check commands look at.
+func snapshot_from_api(t *apiTopology) (*Snapshot, error) {
+  s := &Snapshot{Time: t.Time}
+  s.Target, _ = net.ParseMAC(t.Target)
+  for _, as := range t.Stations {
+    address, err := net.ParseMAC(as.Address)
+    if err != nil {
+      return nil, fmt.Errorf("invalid topology: %v", err)
+    }
+    s.Stations = append(s.Stations, Station{
+      Address:   address,
+      TEI:       as.TEI,
+      NetworkID: as.NetworkID,
+      Reporter:  as.Reporter,
+      Protocol:  as.Protocol,
+      Responded: !as.ObservedOnly,
+    })
+  }
+  for _, al := range t.Links {
+    var addresses [3]net.HardwareAddr
+    for i, a := range []string{al.Reporter, al.Source, al.Destination} {
+      address, err := net.ParseMAC(a)
+      if err != nil {
+        return nil, fmt.Errorf("invalid topology: %v", err)
+      }
+      addresses[i] = address
+    }
+    s.Links = append(s.Links, Link{
+      Reporter:    addresses[0],
+      Protocol:    al.Protocol,
+      Source:      addresses[1],
+      Destination: addresses[2],
+      Rate:        al.Rate,
+      Saturated:   al.Saturated,
+    })
+  }
+  return s, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+  "net"
+  "time"
+  "testing"
+)
+
+func TestSnapshotFromAPI(t *testing.T) {
+  a, b := net.HardwareAddr{0x00, 0xB0, 0x52, 0xAA, 0x00, 0x01}, net.HardwareAddr{0x00, 0xB0, 0x52, 0xAA, 0x00, 0x02}
+  s := &Snapshot{
+    Target:   net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+    Time:     time.Unix(1000000, 0).UTC(),
+    Stations: []Station{{Address: a, Reporter: true, Protocol: "qualcomm", Responded: true}, {Address: b}},
+    Links:    []Link{{Reporter: a, Protocol: "qualcomm", Source: a, Destination: b, Rate: 1e7, Saturated: true}},
+  }
+  got, err := snapshot_from_api(new_api_topology(s))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if station := got.Station(a); station == nil || !station.Responded || !station.Reporter {
+    t.Errorf("reporter = %+v, want one that responded", station)
+  }
+  if station := got.Station(b); station == nil || station.Responded {
+    t.Errorf("observed station = %+v, want one that did not respond", station)
+  }
+  pairs, want := got.LinkPairs(false), s.LinkPairs(false)
+  if len(pairs) != 1 || pairs[0].Rate != want[0].Rate || !pairs[0].Saturated {
+    t.Errorf("link pairs = %+v, want %+v", pairs, want)
+  }
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "bufio"
+  "bytes"
+  "strings"
+  "os"
+  "encoding/binary"
+
+  "github.com/mdlayher/ethernet"
+  "github.com/mdlayher/raw"
+)
+
+const (
+  arpEtherType = 0x0806
+  arpTable     = "/proc/net/arp"
+)
+
+// ARPProber checks whether the hosts bridged behind each adapter are
+// reachable, by sending them ARP requests. Hosts are found by looking up
+// their MAC address in the kernel's neighbour table, so only hosts that the
+// exporter's host has talked to before can be probed.
+type ARPProber struct {
+  iface *net.Interface
+  conn  *raw.Conn
+  ip    net.IP
+}
+
+func NewARPProber(iface *net.Interface) (*ARPProber, error) {
+  addrs, err := iface.Addrs()
+  if err != nil {
+    return nil, err
+  }
+  var ip net.IP
+  for _, addr := range addrs {
+    if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil {
+      ip = n.IP.To4()
+      break
+    }
+  }
+  if ip == nil {
+    return nil, fmt.Errorf("interface %s has no IPv4 address", iface.Name)
+  }
+
+  conn, err := raw.ListenPacket(iface, arpEtherType, nil)
+  if err != nil {
+    return nil, err
+  }
+  return &ARPProber{iface: iface, conn: conn, ip: ip}, nil
+}
+
+func (p *ARPProber) Close() error {
+  return p.conn.Close()
+}
+
+// ProbeSnapshot sets the IP address and reachability of the bridged host of
+// every station in the snapshot that has one in the neighbour table.
+func (p *ARPProber) ProbeSnapshot(s *Snapshot) error {
+  neighbours, err := read_arp_table(arpTable, p.iface.Name)
+  if err != nil {
+    return err
+  }
+
+  hosts := map[string]net.IP{}
+  for i := range s.Stations {
+    station := &s.Stations[i]
+    if station.BridgedAddress == nil {
+      continue
+    }
+    if ip, ok := neighbours[station.BridgedAddress.String()]; ok {
+      station.BridgedIP = ip
+      hosts[station.BridgedAddress.String()] = ip
+    }
+  }
+  if len(hosts) == 0 {
+    return nil
+  }
+
+  reachable, err := p.probe(hosts)
+  if err != nil {
+    return err
+  }
+  for i := range s.Stations {
+    station := &s.Stations[i]
+    if station.BridgedIP != nil {
+      station.BridgedReachable = reachable[station.BridgedAddress.String()]
+    }
+  }
+  return nil
+}
+
+// probe sends an ARP request to each host, and returns the hosts that
+// answered within a second from the expected MAC address.
+func (p *ARPProber) probe(hosts map[string]net.IP) (map[string]bool, error) {
+  for mac, ip := range hosts {
+    hw, _ := net.ParseMAC(mac)
+    if err := p.request(hw, ip); err != nil {
+      return nil, err
+    }
+  }
+
+  reachable := map[string]bool{}
+  b := make([]byte, p.iface.MTU)
+  p.conn.SetReadDeadline(time.Now().Add(time.Second))
+  for len(reachable) < len(hosts) {
+    n, _, err := p.conn.ReadFrom(b)
+    if err != nil {
+      break
+    }
+    var f ethernet.Frame
+    if err := (&f).UnmarshalBinary(b[:n]); err != nil {
+      continue
+    }
+    a := f.Payload
+    if len(a) < 28 || binary.BigEndian.Uint16(a[6:8]) != 2 {
+      continue
+    }
+    sender := net.HardwareAddr(a[8:14]).String()
+    if ip, ok := hosts[sender]; ok && bytes.Equal(ip, a[14:18]) {
+      reachable[sender] = true
+    }
+  }
+  return reachable, nil
+}
+
+// request sends an ARP request for ip to hw.
+func (p *ARPProber) request(hw net.HardwareAddr, ip net.IP) error {
+  a := make([]byte, 28)
+  binary.BigEndian.PutUint16(a[0:2], 1)
+  binary.BigEndian.PutUint16(a[2:4], 0x0800)
+  a[4] = 6
+  a[5] = 4
+  binary.BigEndian.PutUint16(a[6:8], 1)
+  copy(a[8:14], p.iface.HardwareAddr)
+  copy(a[14:18], p.ip)
+  copy(a[24:28], ip.To4())
+
+  f := &ethernet.Frame{
+    Destination: hw,
+    Source:      p.iface.HardwareAddr,
+    EtherType:   arpEtherType,
+    Payload:     a,
+  }
+  b, err := f.MarshalBinary()
+  if err != nil {
+    return err
+  }
+  _, err = p.conn.WriteTo(b, &raw.Addr{HardwareAddr: hw})
+  return err
+}
+
+// read_arp_table returns the IPv4 address of each MAC address in the
+// neighbour table for the interface.
+func read_arp_table(path, device string) (map[string]net.IP, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  neighbours := map[string]net.IP{}
+  scanner := bufio.NewScanner(f)
+  scanner.Scan()
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) < 6 || fields[5] != device {
+      continue
+    }
+    ip := net.ParseIP(fields[0]).To4()
+    hw, err := net.ParseMAC(fields[3])
+    if ip == nil || err != nil || bytes.Equal(hw, make([]byte, 6)) {
+      transportLog.Debugf("skipping neighbour table entry %q", scanner.Text())
+      continue
+    }
+    neighbours[hw.String()] = ip
+  }
+  return neighbours, scanner.Err()
+}
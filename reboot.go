@@ -0,0 +1,75 @@
+package main
+
+import (
+  "net"
+  "sync"
+)
+
+// rebootTracker counts the reboots of stations. The chips don't report their
+// uptime, so a reboot is told by what it resets: the link stats counters of
+// every link of a reporter starting again from zero, or the station coming
+// back with another TEI from the CCo.
+type rebootTracker struct {
+  mutex    sync.Mutex
+  stations map[string]*rebootState
+  lru      lruIndex
+  // links and resets are, for each reporter, the links whose counters were
+  // read again since the last assign, and those of them that restarted.
+  links    map[string]int
+  resets   map[string]int
+}
+
+type rebootState struct {
+  tei     uint8
+  reboots uint64
+}
+
+// counted records that the link stats counters of a link of reporter, known
+// from an earlier poll, were read again, and whether they restarted.
+func (t *rebootTracker) counted(reporter net.HardwareAddr, restarted bool) {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  if t.links == nil {
+    t.links, t.resets = map[string]int{}, map[string]int{}
+  }
+  t.links[reporter.String()]++
+  if restarted {
+    t.resets[reporter.String()]++
+  }
+}
+
+// assign counts a reboot of each station of s whose TEI changed, or whose
+// counters all restarted since the last assign, and sets the reboots of
+// every station. A station is counted once however many of them tell of it.
+func (t *rebootTracker) assign(s *Snapshot) {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  if t.stations == nil {
+    t.stations = map[string]*rebootState{}
+  }
+  for i := range s.Stations {
+    station := &s.Stations[i]
+    key := station.Address.String()
+    if evicted, ok := t.lru.touch(key); ok {
+      delete(t.stations, evicted)
+    }
+    st, ok := t.stations[key]
+    if !ok {
+      st = &rebootState{}
+      t.stations[key] = st
+    }
+    switch {
+    case t.links[key] > 0 && t.resets[key] == t.links[key]:
+      st.reboots++
+      pollerLog.Infof("%s rebooted: the link stats counters of all its links started again from zero", key)
+    case st.tei != 0 && station.TEI != 0 && station.TEI != st.tei:
+      st.reboots++
+      pollerLog.Infof("%s rebooted: it came back with TEI %d, after %d", key, station.TEI, st.tei)
+    }
+    if station.TEI != 0 {
+      st.tei = station.TEI
+    }
+    station.Reboots = st.reboots
+  }
+  t.links, t.resets = nil, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+  "os"
+  "sync"
+  "time"
+  "reflect"
+  "strings"
+  "syscall"
+  "net/http"
+  "os/signal"
+  "sync/atomic"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+// reloadPath reloads the configuration file when it is posted to.
+const reloadPath = "/-/reload"
+
+var (
+  configReloadSuccess = prometheus.NewGauge(
+    prometheus.GaugeOpts{
+      Namespace: namespace,
+      Name:      "config_last_reload_successful",
+      Help:      "Whether the last reload of the configuration file succeeded.",
+    })
+  configReloadTime = prometheus.NewGauge(
+    prometheus.GaugeOpts{
+      Namespace: namespace,
+      Name:      "config_last_reload_success_timestamp_seconds",
+      Help:      "When the configuration file was last loaded successfully, as a Unix time.",
+    })
+)
+
+// reloadableSections are the sections of the configuration file that a
+// reload applies. The others are only read at startup.
+var reloadableSections = map[string]bool{
+  "auth":                true,
+  "probe":               true,
+  "modules":             true,
+  "targets":             true,
+  "metric_rules":        true,
+  "phases":              true,
+  "vendors":             true,
+  "collector_schedules": true,
+}
+
+// ConfigReloader holds the configuration loaded from --config.file, and
+// loads it again on SIGHUP or a POST to /-/reload.
+type ConfigReloader struct {
+  path    string
+  // mutex serializes reloads.
+  mutex   sync.Mutex
+  current atomic.Value
+  apply   []func(*Config) error
+}
+
+func NewConfigReloader(path string, cfg *Config) *ConfigReloader {
+  r := &ConfigReloader{path: path}
+  r.current.Store(cfg)
+  configReloadSuccess.Set(1)
+  configReloadTime.Set(float64(time.Now().Unix()))
+  return r
+}
+
+// Config returns the configuration in use.
+func (r *ConfigReloader) Config() *Config {
+  return r.current.Load().(*Config)
+}
+
+// OnReload adds f to the functions that apply a reloaded configuration, in
+// the order they were added. If one fails, the reload stops there, so those
+// that can fail are added first, before any that change anything.
+func (r *ConfigReloader) OnReload(f func(*Config) error) {
+  r.apply = append(r.apply, f)
+}
+
+// Reload loads the configuration file again and applies it. If it is
+// invalid, the configuration in use is kept. Changes to the sections that
+// are only read at startup are logged, and left for the next restart.
+func (r *ConfigReloader) Reload() error {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+
+  cfg, err := LoadConfig(r.path)
+  if err == nil {
+    for _, f := range r.apply {
+      if err = f(cfg); err != nil {
+        break
+      }
+    }
+  }
+  if err != nil {
+    configReloadSuccess.Set(0)
+    mainLog.Errorf("failed to reload config, keeping the one in use: %v", err)
+    return err
+  }
+
+  if changed := restart_sections(r.Config(), cfg); len(changed) > 0 {
+    mainLog.Warnf("reloaded config, but changes to %s only take effect after a restart", strings.Join(changed, ", "))
+  } else {
+    mainLog.Infof("reloaded config from %s", r.path)
+  }
+  r.current.Store(cfg)
+  configReloadSuccess.Set(1)
+  configReloadTime.Set(float64(time.Now().Unix()))
+  return nil
+}
+
+// restart_sections returns the sections that differ between old and new
+// but are not reloadable.
+func restart_sections(old, new *Config) []string {
+  var changed []string
+  t := reflect.TypeOf(*old)
+  for i := 0; i < t.NumField(); i++ {
+    name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+    if reloadableSections[name] {
+      continue
+    }
+    if !reflect.DeepEqual(reflect.ValueOf(*old).Field(i).Interface(), reflect.ValueOf(*new).Field(i).Interface()) {
+      changed = append(changed, name)
+    }
+  }
+  return changed
+}
+
+// Run reloads the configuration on every SIGHUP.
+func (r *ConfigReloader) Run() {
+  hup := make(chan os.Signal, 1)
+  signal.Notify(hup, syscall.SIGHUP)
+  for range hup {
+    r.Reload()
+  }
+}
+
+// Handler reloads the configuration on a POST, and answers with whether it
+// succeeded.
+func (r *ConfigReloader) Handler() http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    if req.Method != http.MethodPost && req.Method != http.MethodPut {
+      w.Header().Set("Allow", "POST, PUT")
+      http.Error(w, "POST or PUT to reload the configuration", http.StatusMethodNotAllowed)
+      return
+    }
+    if err := r.Reload(); err != nil {
+      http.Error(w, "failed to reload config: " + err.Error(), http.StatusInternalServerError)
+      return
+    }
+    w.Write([]byte("OK\n"))
+  })
+}
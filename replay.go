@@ -0,0 +1,227 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "bytes"
+  "errors"
+
+  "github.com/mdlayher/ethernet"
+  "github.com/mdlayher/raw"
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// replayInterface stands in for the interface when replaying a capture, as
+// nothing is sent or received on a real one.
+var replayInterface = &net.Interface{Name: "pcap-replay", MTU: 65535, HardwareAddr: net.HardwareAddr{0, 0, 0, 0, 0, 0}}
+
+// replayConn answers the requests written to it with the confirmations in
+// a capture, in place of the raw socket. Each request gets the next
+// recorded confirmation of its type from every station it was sent to, in
+// the order they were captured, starting again from the first once they
+// run out. Requests to the local alias are answered by the station that
+// answered it in the capture, or else by the first station captured.
+type replayConn struct {
+  // replies are the frames of each confirmation type from each source, and
+  // next the one to send next.
+  replies map[replayKey][][]byte
+  next    map[replayKey]int
+  sources [][]byte
+  local   []byte
+
+  mutex    sync.Mutex
+  queue    [][]byte
+  notify   chan struct{}
+  deadline time.Time
+  closed   bool
+}
+
+type replayKey struct {
+  mmeType uint16
+  source  string
+}
+
+// readTimeout is returned by reads of the emulated sockets that reach the
+// deadline, like the timeouts of a real one.
+type readTimeout struct{}
+
+func (readTimeout) Error() string   { return "i/o timeout" }
+func (readTimeout) Timeout() bool   { return true }
+func (readTimeout) Temporary() bool { return true }
+
+func open_pcap_replay(path string) (*replayConn, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  frames, err := read_pcap(f)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %v", path, err)
+  }
+
+  c := &replayConn{
+    replies: map[replayKey][][]byte{},
+    next:    map[replayKey]int{},
+    notify:  make(chan struct{}, 1),
+  }
+  // aliased are the confirmation types last requested from the local
+  // alias, whose next confirmation identifies the local adapter.
+  aliased := map[uint16]bool{}
+  for _, b := range frames {
+    var f ethernet.Frame
+    var h homeplug.Frame
+    if (&f).UnmarshalBinary(b) != nil || f.EtherType != homeplug.EtherType || (&h).UnmarshalBinary(f.Payload) != nil {
+      continue
+    }
+    switch h.Type() & 0x03 {
+    case 0x00:
+      aliased[h.Type() | 0x01] = is_local_alias(f.Destination)
+    case 0x01:
+      key := replayKey{h.Type(), f.Source.String()}
+      if len(c.replies[key]) == 0 && !contains_address(c.sources, f.Source) {
+        c.sources = append(c.sources, f.Source)
+      }
+      c.replies[key] = append(c.replies[key], b)
+      if aliased[h.Type()] && c.local == nil {
+        c.local = f.Source
+      }
+    }
+  }
+  if len(c.sources) == 0 {
+    return nil, fmt.Errorf("%s: no Homeplug confirmations captured", path)
+  }
+  if c.local == nil {
+    c.local = c.sources[0]
+  }
+  return c, nil
+}
+
+func contains_address(addrs [][]byte, a []byte) bool {
+  for _, b := range addrs {
+    if bytes.Equal(a, b) {
+      return true
+    }
+  }
+  return false
+}
+
+// WriteTo queues the replies to a request.
+func (c *replayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+  var f ethernet.Frame
+  var h homeplug.Frame
+  if err := (&f).UnmarshalBinary(b); err != nil {
+    return 0, err
+  }
+  if err := (&h).UnmarshalBinary(f.Payload); err != nil {
+    return 0, err
+  }
+
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  if c.closed {
+    return 0, errors.New("use of closed replay")
+  }
+  for _, source := range c.sources {
+    switch {
+    case is_local_alias(f.Destination):
+      if !bytes.Equal(source, c.local) {
+        continue
+      }
+    case f.Destination[0] & 0x01 == 0:
+      if !bytes.Equal(source, f.Destination) {
+        continue
+      }
+    }
+    key := replayKey{h.Type() | 0x01, net.HardwareAddr(source).String()}
+    replies := c.replies[key]
+    if len(replies) == 0 {
+      continue
+    }
+    c.queue = append(c.queue, replies[c.next[key] % len(replies)])
+    c.next[key]++
+  }
+  select {
+  case c.notify <- struct{}{}:
+  default:
+  }
+  return len(b), nil
+}
+
+// ReadFrom returns the next queued reply, waiting for one until the read
+// deadline.
+func (c *replayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+  for {
+    c.mutex.Lock()
+    if c.closed {
+      c.mutex.Unlock()
+      return 0, nil, errors.New("use of closed replay")
+    }
+    if len(c.queue) > 0 {
+      frame := c.queue[0]
+      c.queue = c.queue[1:]
+      c.mutex.Unlock()
+      n := copy(b, frame)
+      return n, &raw.Addr{HardwareAddr: net.HardwareAddr(frame[6:12])}, nil
+    }
+    deadline := c.deadline
+    c.mutex.Unlock()
+
+    var timer *time.Timer
+    var timeout <-chan time.Time
+    if !deadline.IsZero() {
+      wait := time.Until(deadline)
+      if wait <= 0 {
+        return 0, nil, readTimeout{}
+      }
+      timer = time.NewTimer(wait)
+      timeout = timer.C
+    }
+    select {
+    case <-c.notify:
+      if timer != nil {
+        timer.Stop()
+      }
+    case <-timeout:
+      return 0, nil, readTimeout{}
+    }
+  }
+}
+
+func (c *replayConn) SetReadDeadline(t time.Time) error {
+  c.mutex.Lock()
+  c.deadline = t
+  c.mutex.Unlock()
+  // Wake up a read waiting on the old deadline.
+  select {
+  case c.notify <- struct{}{}:
+  default:
+  }
+  return nil
+}
+
+func (c *replayConn) SetDeadline(t time.Time) error {
+  return c.SetReadDeadline(t)
+}
+
+func (c *replayConn) SetWriteDeadline(t time.Time) error {
+  return nil
+}
+
+func (c *replayConn) LocalAddr() net.Addr {
+  return &raw.Addr{HardwareAddr: replayInterface.HardwareAddr}
+}
+
+func (c *replayConn) Close() error {
+  c.mutex.Lock()
+  c.closed = true
+  c.mutex.Unlock()
+  select {
+  case c.notify <- struct{}{}:
+  default:
+  }
+  return nil
+}
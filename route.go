@@ -0,0 +1,92 @@
+package main
+
+import (
+  "bytes"
+  "net"
+)
+
+// roleProxyCoordinator is the role of a proxy coordinator (PCo), which
+// relays the beacons of the CCo to stations that cannot hear it.
+const roleProxyCoordinator = 0x01
+
+// Route is how a station reaches the CCo of its network ("uplink"), or is
+// reached by it ("downlink"): directly, or through the proxy coordinator
+// Proxy.
+type Route struct {
+  Address   net.HardwareAddr
+  NetworkID string
+  Direction string
+  Proxy     net.HardwareAddr
+}
+
+// link_rate returns the best rate reported for the link from source to
+// destination, or 0 if none was.
+func link_rate(s *Snapshot, source, destination net.HardwareAddr) float64 {
+  rate := 0.0
+  for _, l := range s.Links {
+    if bytes.Equal(l.Source, source) && bytes.Equal(l.Destination, destination) && l.Rate > rate {
+      rate = l.Rate
+    }
+  }
+  return rate
+}
+
+// station_routes returns the route in each direction between every station
+// and the CCo of its network, for the networks that have proxy coordinators.
+// A station with a link to the CCo reaches it directly; one without reaches
+// it through the proxy coordinator with the fastest links to both, and has
+// no route if no proxy coordinator links it to the CCo.
+func station_routes(s *Snapshot) []Route {
+  var routes []Route
+  for _, network := range s.Networks {
+    var proxies []net.HardwareAddr
+    for _, station := range s.Stations {
+      if station.NetworkID == network.ID && station.Reporter && station.Role == roleProxyCoordinator {
+        proxies = append(proxies, station.Address)
+      }
+    }
+    if len(proxies) == 0 {
+      continue
+    }
+    cco := network.CCoAddress
+    for _, station := range s.Stations {
+      if station.NetworkID != network.ID || bytes.Equal(station.Address, cco) {
+        continue
+      }
+      for _, direction := range []string{"uplink", "downlink"} {
+        // from and to are the ends of the route in the direction of the
+        // data.
+        from, to := station.Address, cco
+        if direction == "downlink" {
+          from, to = cco, station.Address
+        }
+        r := Route{
+          Address:   station.Address,
+          NetworkID: network.ID,
+          Direction: direction,
+        }
+        if link_rate(s, from, to) == 0 {
+          best := 0.0
+          for _, proxy := range proxies {
+            if bytes.Equal(proxy, station.Address) {
+              continue
+            }
+            rate := link_rate(s, from, proxy)
+            if second := link_rate(s, proxy, to); second < rate {
+              rate = second
+            }
+            if rate > best {
+              best = rate
+              r.Proxy = proxy
+            }
+          }
+          if r.Proxy == nil {
+            continue
+          }
+        }
+        routes = append(routes, r)
+      }
+    }
+  }
+  return routes
+}
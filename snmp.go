@@ -0,0 +1,356 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "sort"
+  "sync"
+  "errors"
+  "strconv"
+  "strings"
+)
+
+// SNMP versions, PDU types and error statuses that the agent knows.
+const (
+  snmpV1  = 0
+  snmpV2c = 1
+
+  pduGetRequest     = 0xA0
+  pduGetNextRequest = 0xA1
+  pduResponse       = 0xA2
+  pduSetRequest     = 0xA3
+  pduGetBulkRequest = 0xA5
+
+  snmpTooBig      = 1
+  snmpNoSuchName  = 2
+  snmpNotWritable = 17
+)
+
+// snmpDefaultBaseOID is the net-snmp experimental arc, for use until the
+// tables are given a home of their own.
+const snmpDefaultBaseOID = "1.3.6.1.4.1.8072.9999.9999.1"
+
+// snmpMaxMessageSize is the largest response sent, that of a UDP datagram.
+const snmpMaxMessageSize = 65507
+
+// snmpMaxRepetitions caps the rows returned for each repeater of a
+// GetBulkRequest.
+const snmpMaxRepetitions = 32
+
+// SNMPAgent serves the stations, networks and links of the last published
+// snapshot to SNMP managers, as the tables of HOMEPLUG-EXPORTER-MIB under
+// the configured base OID. It is a read-only SNMPv1 and v2c agent of its
+// own; it does not speak AgentX.
+type SNMPAgent struct {
+  conn      net.PacketConn
+  community string
+  base      []uint32
+  snapshot  snapshotStore
+
+  mutex sync.Mutex
+  // tree is the MIB view of treeFor, sorted by OID.
+  tree    []snmpVarBind
+  treeFor *Snapshot
+}
+
+type snmpVarBind struct {
+  oid   []uint32
+  value []byte
+}
+
+func NewSNMPAgent(cfg SNMPConfig) (*SNMPAgent, error) {
+  base, err := parse_oid(cfg.BaseOID)
+  if err != nil {
+    return nil, err
+  }
+  conn, err := net.ListenPacket("udp", cfg.ListenAddress)
+  if err != nil {
+    return nil, err
+  }
+  return &SNMPAgent{conn: conn, community: cfg.Community, base: base}, nil
+}
+
+func (a *SNMPAgent) Name() string {
+  return "snmp"
+}
+
+func (a *SNMPAgent) Publish(s *Snapshot) error {
+  a.snapshot.Store(s)
+  return nil
+}
+
+// Run answers requests until the socket fails.
+func (a *SNMPAgent) Run() {
+  b := make([]byte, 65535)
+  for {
+    n, addr, err := a.conn.ReadFrom(b)
+    if err != nil {
+      mainLog.Errorf("SNMP agent stopped: %v", err)
+      return
+    }
+    response, err := a.handle(b[:n])
+    if err != nil {
+      logDedup.Debugf(mainLog, "snmp", "ignoring SNMP request from %v: %v", addr, err)
+      continue
+    }
+    if _, err := a.conn.WriteTo(response, addr); err != nil {
+      mainLog.Debugf("failed to answer SNMP request from %v: %v", addr, err)
+    }
+  }
+}
+
+// handle decodes a request and returns the encoded response. Requests with
+// the wrong community are not answered, as is usual.
+func (a *SNMPAgent) handle(b []byte) ([]byte, error) {
+  msg, _, err := ber_expect(berSequence, b)
+  if err != nil {
+    return nil, err
+  }
+  v, msg, err := ber_expect(berInteger, msg)
+  if err != nil {
+    return nil, err
+  }
+  version, err := ber_parse_int(v)
+  if err != nil {
+    return nil, err
+  }
+  if version != snmpV1 && version != snmpV2c {
+    return nil, fmt.Errorf("unsupported SNMP version %d", version)
+  }
+  community, msg, err := ber_expect(berOctetString, msg)
+  if err != nil {
+    return nil, err
+  }
+  if string(community) != a.community {
+    return nil, errors.New("wrong community")
+  }
+  pduType, pdu, _, err := ber_read(msg)
+  if err != nil {
+    return nil, err
+  }
+
+  var fields [3]int64
+  for i := range fields {
+    var f []byte
+    if f, pdu, err = ber_expect(berInteger, pdu); err != nil {
+      return nil, err
+    }
+    if fields[i], err = ber_parse_int(f); err != nil {
+      return nil, err
+    }
+  }
+  list, _, err := ber_expect(berSequence, pdu)
+  if err != nil {
+    return nil, err
+  }
+  var oids [][]uint32
+  for len(list) > 0 {
+    var vb []byte
+    if vb, list, err = ber_expect(berSequence, list); err != nil {
+      return nil, err
+    }
+    o, _, err := ber_expect(berOID, vb)
+    if err != nil {
+      return nil, err
+    }
+    oid, err := ber_parse_oid(o)
+    if err != nil {
+      return nil, err
+    }
+    oids = append(oids, oid)
+  }
+
+  requestID := fields[0]
+  tree := a.view()
+  var results []snmpVarBind
+  var status, index int64
+  switch {
+  case pduType == pduGetRequest:
+    for i, oid := range oids {
+      vb, ok := snmp_get(tree, oid)
+      if !ok && version == snmpV1 {
+        status, index = snmpNoSuchName, int64(i + 1)
+      }
+      results = append(results, vb)
+    }
+  case pduType == pduGetNextRequest:
+    for i, oid := range oids {
+      vb, ok := snmp_next(tree, oid)
+      if !ok && version == snmpV1 {
+        status, index = snmpNoSuchName, int64(i + 1)
+      }
+      results = append(results, vb)
+    }
+  case pduType == pduGetBulkRequest && version == snmpV2c:
+    nonRepeaters, repetitions := int(fields[1]), int(fields[2])
+    if nonRepeaters < 0 {
+      nonRepeaters = 0
+    }
+    if repetitions > snmpMaxRepetitions {
+      repetitions = snmpMaxRepetitions
+    }
+    for i, oid := range oids {
+      if i < nonRepeaters {
+        vb, _ := snmp_next(tree, oid)
+        results = append(results, vb)
+        continue
+      }
+      for r := 0; r < repetitions; r++ {
+        vb, ok := snmp_next(tree, oid)
+        results = append(results, vb)
+        if !ok {
+          break
+        }
+        oid = vb.oid
+      }
+    }
+  case pduType == pduSetRequest:
+    // SNMPv1 has no notWritable, and RFC 1157 answers noSuchName instead.
+    status, index = snmpNotWritable, 1
+    if version == snmpV1 {
+      status = snmpNoSuchName
+    }
+    for _, oid := range oids {
+      results = append(results, snmpVarBind{oid, ber_tlv(berNull)})
+    }
+  default:
+    return nil, fmt.Errorf("unsupported PDU type 0x%02x", pduType)
+  }
+  if status != 0 && version == snmpV1 {
+    // SNMPv1 errors return the request's variable bindings unchanged.
+    results = results[:0]
+    for _, oid := range oids {
+      results = append(results, snmpVarBind{oid, ber_tlv(berNull)})
+    }
+  }
+
+  var vbs [][]byte
+  for _, vb := range results {
+    vbs = append(vbs, ber_tlv(berSequence, ber_oid(vb.oid), vb.value))
+  }
+  response := snmp_response(version, community, requestID, status, index, vbs)
+  if len(response) > snmpMaxMessageSize {
+    response = snmp_response(version, community, requestID, snmpTooBig, 0, nil)
+  }
+  return response, nil
+}
+
+func snmp_response(version int64, community []byte, requestID, status, index int64, vbs [][]byte) []byte {
+  pdu := ber_tlv(pduResponse,
+    ber_int(berInteger, requestID),
+    ber_int(berInteger, status),
+    ber_int(berInteger, index),
+    ber_tlv(berSequence, vbs...))
+  return ber_tlv(berSequence, ber_int(berInteger, version), ber_tlv(berOctetString, community), pdu)
+}
+
+func snmp_get(tree []snmpVarBind, oid []uint32) (snmpVarBind, bool) {
+  i := sort.Search(len(tree), func(i int) bool { return compare_oid(tree[i].oid, oid) >= 0 })
+  if i < len(tree) && compare_oid(tree[i].oid, oid) == 0 {
+    return tree[i], true
+  }
+  return snmpVarBind{oid, ber_tlv(berNoSuchObject)}, false
+}
+
+func snmp_next(tree []snmpVarBind, oid []uint32) (snmpVarBind, bool) {
+  i := sort.Search(len(tree), func(i int) bool { return compare_oid(tree[i].oid, oid) > 0 })
+  if i < len(tree) {
+    return tree[i], true
+  }
+  return snmpVarBind{oid, ber_tlv(berEndOfMibView)}, false
+}
+
+func compare_oid(a, b []uint32) int {
+  for i := 0; i < len(a) && i < len(b); i++ {
+    if a[i] != b[i] {
+      if a[i] < b[i] {
+        return -1
+      }
+      return 1
+    }
+  }
+  return len(a) - len(b)
+}
+
+func parse_oid(s string) ([]uint32, error) {
+  var oid []uint32
+  for _, part := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+    id, err := strconv.ParseUint(part, 10, 32)
+    if err != nil {
+      return nil, fmt.Errorf("invalid OID %q", s)
+    }
+    oid = append(oid, uint32(id))
+  }
+  if len(oid) < 2 {
+    return nil, fmt.Errorf("invalid OID %q", s)
+  }
+  return oid, nil
+}
+
+// view returns the MIB view of the last published snapshot, building it the
+// first time it is asked for.
+func (a *SNMPAgent) view() []snmpVarBind {
+  s := a.snapshot.Load()
+  a.mutex.Lock()
+  defer a.mutex.Unlock()
+  if s != nil && s != a.treeFor {
+    a.tree = a.build(s)
+    a.treeFor = s
+  }
+  return a.tree
+}
+
+// build lays out the snapshot as the tables of the MIB. Rows are indexed
+// from 1 in the order of the snapshot, so indexes are only stable between
+// polls that find the same devices. The index columns are not-accessible,
+// and so not served.
+func (a *SNMPAgent) build(s *Snapshot) []snmpVarBind {
+  var tree []snmpVarBind
+  add := func(table, column, row int, value []byte) {
+    oid := append(append([]uint32(nil), a.base...), uint32(table), 1, uint32(column), uint32(row))
+    tree = append(tree, snmpVarBind{oid, value})
+  }
+  str := func(s string) []byte {
+    return ber_tlv(berOctetString, []byte(s))
+  }
+  mac := func(m net.HardwareAddr) []byte {
+    return ber_tlv(berOctetString, m)
+  }
+  truth := func(b bool) []byte {
+    if b {
+      return ber_int(berInteger, 1)
+    }
+    return ber_int(berInteger, 2)
+  }
+
+  for i, n := range s.Networks {
+    row := i + 1
+    add(1, 2, row, str(n.ID))
+    add(1, 3, row, ber_int(berInteger, int64(n.ShortID)))
+    add(1, 4, row, mac(n.CCoAddress))
+    add(1, 5, row, str(n.Mode))
+  }
+  for i, st := range s.Stations {
+    row := i + 1
+    add(2, 2, row, mac(st.Address))
+    add(2, 3, row, ber_int(berInteger, int64(st.TEI)))
+    add(2, 4, row, str(st.NetworkID))
+    add(2, 5, row, mac(st.BridgedAddress))
+    add(2, 6, row, str(st.Protocol))
+    add(2, 7, row, truth(st.Responded))
+  }
+  for i, l := range s.Links {
+    row := i + 1
+    add(3, 2, row, mac(l.Reporter))
+    add(3, 3, row, mac(l.Source))
+    add(3, 4, row, mac(l.Destination))
+    add(3, 5, row, str(l.Protocol))
+    add(3, 6, row, ber_uint(berGauge32, uint64(bytes_to_mbps(l.Rate))))
+  }
+  // The poll time, in seconds since the epoch. It is a Gauge32 rather than
+  // a Counter64 so that SNMPv1 managers can read it.
+  tree = append(tree, snmpVarBind{append(append([]uint32(nil), a.base...), 4, 0), ber_uint(berGauge32, uint64(s.Time.Unix()))})
+
+  sort.Slice(tree, func(i, j int) bool { return compare_oid(tree[i].oid, tree[j].oid) < 0 })
+  return tree
+}
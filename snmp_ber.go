@@ -0,0 +1,174 @@
+package main
+
+import (
+  "fmt"
+  "errors"
+)
+
+// The subset of BER that SNMP messages use.
+const (
+  berInteger     = 0x02
+  berOctetString = 0x04
+  berNull        = 0x05
+  berOID         = 0x06
+  berSequence    = 0x30
+  berCounter32   = 0x41
+  berGauge32     = 0x42
+  berTimeTicks   = 0x43
+  berCounter64   = 0x46
+
+  berNoSuchObject   = 0x80
+  berNoSuchInstance = 0x81
+  berEndOfMibView   = 0x82
+)
+
+var errBERTruncated = errors.New("truncated BER element")
+
+// ber_read splits the first element off b, returning its tag, its contents
+// and what follows it.
+func ber_read(b []byte) (byte, []byte, []byte, error) {
+  if len(b) < 2 {
+    return 0, nil, nil, errBERTruncated
+  }
+  tag, n, o := b[0], int(b[1]), 2
+  if n & 0x80 != 0 {
+    size := n & 0x7f
+    if size == 0 || size > 3 || len(b) < 2 + size {
+      return 0, nil, nil, fmt.Errorf("unsupported BER length of %d bytes", size)
+    }
+    n = 0
+    for _, c := range b[2:2 + size] {
+      n = n << 8 | int(c)
+    }
+    o += size
+  }
+  if len(b) < o + n {
+    return 0, nil, nil, errBERTruncated
+  }
+  return tag, b[o:o + n], b[o + n:], nil
+}
+
+// ber_expect reads the first element of b, which must have the given tag.
+func ber_expect(tag byte, b []byte) ([]byte, []byte, error) {
+  t, content, rest, err := ber_read(b)
+  if err != nil {
+    return nil, nil, err
+  }
+  if t != tag {
+    return nil, nil, fmt.Errorf("expected BER tag 0x%02x, got 0x%02x", tag, t)
+  }
+  return content, rest, nil
+}
+
+func ber_tlv(tag byte, content ...[]byte) []byte {
+  n := 0
+  for _, c := range content {
+    n += len(c)
+  }
+  b := []byte{tag}
+  switch {
+  case n < 0x80:
+    b = append(b, byte(n))
+  case n < 0x100:
+    b = append(b, 0x81, byte(n))
+  case n < 0x10000:
+    b = append(b, 0x82, byte(n >> 8), byte(n))
+  default:
+    b = append(b, 0x83, byte(n >> 16), byte(n >> 8), byte(n))
+  }
+  for _, c := range content {
+    b = append(b, c...)
+  }
+  return b
+}
+
+// ber_int encodes v with the given tag, in as few bytes as two's complement
+// allows. Unsigned types are encoded the same way, so high values get a
+// leading zero.
+func ber_int(tag byte, v int64) []byte {
+  var b []byte
+  for {
+    b = append([]byte{byte(v)}, b...)
+    if (v < 0x80 && v >= -0x80) || len(b) == 8 {
+      break
+    }
+    v >>= 8
+  }
+  return ber_tlv(tag, b)
+}
+
+func ber_uint(tag byte, v uint64) []byte {
+  b := []byte{byte(v)}
+  for v >>= 8; v > 0; v >>= 8 {
+    b = append([]byte{byte(v)}, b...)
+  }
+  if b[0] & 0x80 != 0 {
+    b = append([]byte{0}, b...)
+  }
+  return ber_tlv(tag, b)
+}
+
+func ber_parse_int(b []byte) (int64, error) {
+  if len(b) == 0 || len(b) > 8 {
+    return 0, fmt.Errorf("invalid BER integer of %d bytes", len(b))
+  }
+  v := int64(int8(b[0]))
+  for _, c := range b[1:] {
+    v = v << 8 | int64(c)
+  }
+  return v, nil
+}
+
+func ber_oid(oid []uint32) []byte {
+  if len(oid) < 2 {
+    return ber_tlv(berOID, []byte{0})
+  }
+  b := ber_subidentifier(nil, oid[0] * 40 + oid[1])
+  for _, id := range oid[2:] {
+    b = ber_subidentifier(b, id)
+  }
+  return ber_tlv(berOID, b)
+}
+
+func ber_subidentifier(b []byte, id uint32) []byte {
+  var groups []byte
+  for {
+    groups = append([]byte{byte(id & 0x7f)}, groups...)
+    id >>= 7
+    if id == 0 {
+      break
+    }
+  }
+  for i := 0; i < len(groups) - 1; i++ {
+    groups[i] |= 0x80
+  }
+  return append(b, groups...)
+}
+
+func ber_parse_oid(b []byte) ([]uint32, error) {
+  var oid []uint32
+  var id uint32
+  for i, c := range b {
+    id = id << 7 | uint32(c & 0x7f)
+    if c & 0x80 != 0 {
+      if i == len(b) - 1 {
+        return nil, errBERTruncated
+      }
+      continue
+    }
+    if oid == nil {
+      first := id / 40
+      if first > 2 {
+        first = 2
+      }
+      oid = append(oid, first, id - first * 40)
+    } else {
+      oid = append(oid, id)
+    }
+    id = 0
+  }
+  if oid == nil {
+    return nil, errors.New("empty OID")
+  }
+  return oid, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "context"
+  "runtime"
+  "io/ioutil"
+
+  "github.com/prometheus/client_golang/prometheus"
+)
+
+// soakReportInterval is how often the soak test logs resource usage.
+const soakReportInterval = time.Minute
+
+var soakOperations = prometheus.NewCounterVec(
+  prometheus.CounterOpts{
+    Namespace: namespace,
+    Name:      "soak_operations_total",
+    Help:      "Operations performed by the soak test, by operation and result.",
+  },
+  []string{"operation", "result"})
+
+// soakTest keeps the poller busy with discovery polls and unicast queries of
+// the stations that were discovered, to find leaks and lockups that only
+// show up after days of running against real hardware.
+type soakTest struct {
+  poller   *Poller
+  mutex    sync.Mutex
+  stations []net.HardwareAddr
+  limits   soakLimits
+  // baseline is the usage after the first discovery poll, which later
+  // usage is compared with.
+  baseline *soakUsage
+}
+
+// soakLimits are how much the goroutines and the heap in use may grow from
+// the baseline before the soak test fails.
+type soakLimits struct {
+  goroutines int
+  heapBytes  uint64
+}
+
+type soakUsage struct {
+  goroutines  int
+  heapInuse   uint64
+  heapObjects uint64
+  fds         int
+}
+
+// run_soak polls every discovery interval and queries one of the discovered
+// stations every query interval. It exits the process with an error as soon
+// as usage grows past limits, or after duration, if it is not 0, checking
+// usage a last time.
+func run_soak(poller *Poller, discovery, query, duration time.Duration, limits soakLimits) {
+  register_collector("soak", soakOperations)
+  t := &soakTest{poller: poller, limits: limits}
+  t.discover()
+  t.mutex.Lock()
+  t.baseline = soak_usage()
+  t.mutex.Unlock()
+  pollerLog.Infof("soak: baseline goroutines=%d heap_inuse_bytes=%d", t.baseline.goroutines, t.baseline.heapInuse)
+  go t.report()
+  go t.queries(query)
+  if duration > 0 {
+    time.AfterFunc(duration, func() {
+      t.check()
+      pollerLog.Infof("soak: passed after %s", duration)
+      os.Exit(0)
+    })
+  }
+  for {
+    time.Sleep(discovery)
+    t.discover()
+  }
+}
+
+func (t *soakTest) discover() {
+  s, err := t.poller.Poll(context.Background())
+  if err != nil {
+    soakOperations.WithLabelValues("discovery", "error").Inc()
+    pollerLog.Errorf("soak: discovery failed: %v", err)
+    return
+  }
+  soakOperations.WithLabelValues("discovery", "success").Inc()
+
+  stations := []net.HardwareAddr{}
+  for _, station := range s.Stations {
+    if station.Responded {
+      stations = append(stations, station.Address)
+    }
+  }
+  t.mutex.Lock()
+  t.stations = stations
+  t.mutex.Unlock()
+}
+
+// queries probes the discovered stations in turn.
+func (t *soakTest) queries(interval time.Duration) {
+  for i := 0; ; i++ {
+    time.Sleep(interval)
+    t.mutex.Lock()
+    var dest net.HardwareAddr
+    if len(t.stations) > 0 {
+      dest = t.stations[i % len(t.stations)]
+    }
+    t.mutex.Unlock()
+    if dest == nil {
+      continue
+    }
+
+    if _, err := t.poller.Probe(context.Background(), dest, queryTimeout, 0, nil); err != nil {
+      soakOperations.WithLabelValues("query", "error").Inc()
+      pollerLog.Errorf("soak: query of %v failed: %v", dest, err)
+      continue
+    }
+    soakOperations.WithLabelValues("query", "success").Inc()
+  }
+}
+
+// report logs resource usage and checks it against the limits, so that
+// growth can be followed in the log even without a Prometheus server
+// scraping the process metrics.
+func (t *soakTest) report() {
+  for range time.Tick(soakReportInterval) {
+    t.check()
+  }
+}
+
+// check logs the usage, and exits the process with an error if it has grown
+// past the limits since the baseline.
+func (t *soakTest) check() {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  u := soak_usage()
+  pollerLog.Infof("soak: goroutines=%d heap_inuse_bytes=%d heap_objects=%d open_fds=%d",
+    u.goroutines, u.heapInuse, u.heapObjects, u.fds)
+  if err := t.limits.exceeded(t.baseline, u); err != nil {
+    pollerLog.Fatalf("soak: failed: %v", err)
+  }
+}
+
+// exceeded returns an error if u has grown past the limits since baseline.
+func (l soakLimits) exceeded(baseline, u *soakUsage) error {
+  if n := u.goroutines - baseline.goroutines; n > l.goroutines {
+    return fmt.Errorf("goroutines grew by %d, from %d to %d, more than %d", n, baseline.goroutines, u.goroutines, l.goroutines)
+  }
+  if u.heapInuse > baseline.heapInuse && u.heapInuse - baseline.heapInuse > l.heapBytes {
+    return fmt.Errorf("heap in use grew by %d bytes, from %d to %d, more than %d", u.heapInuse - baseline.heapInuse, baseline.heapInuse, u.heapInuse, l.heapBytes)
+  }
+  return nil
+}
+
+// soak_usage collects garbage, so that the heap in use is what is still
+// referenced, and returns the resources in use.
+func soak_usage() *soakUsage {
+  runtime.GC()
+  var m runtime.MemStats
+  runtime.ReadMemStats(&m)
+  u := &soakUsage{
+    goroutines:  runtime.NumGoroutine(),
+    heapInuse:   m.HeapInuse,
+    heapObjects: m.HeapObjects,
+    fds:         -1,
+  }
+  if entries, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+    u.fds = len(entries)
+  }
+  return u
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestSoakLimitsExceeded(t *testing.T) {
+  l := soakLimits{goroutines: 10, heapBytes: 1000}
+  baseline := &soakUsage{goroutines: 20, heapInuse: 5000}
+  for _, c := range []struct {
+    usage soakUsage
+    fail  bool
+  }{
+    {soakUsage{goroutines: 30, heapInuse: 6000}, false},
+    // Shrinking is never a failure.
+    {soakUsage{goroutines: 5, heapInuse: 100}, false},
+    {soakUsage{goroutines: 31, heapInuse: 5000}, true},
+    {soakUsage{goroutines: 20, heapInuse: 6001}, true},
+  } {
+    if err := l.exceeded(baseline, &c.usage); (err != nil) != c.fail {
+      t.Errorf("exceeded(%+v) = %v, want failure %v", c.usage, err, c.fail)
+    }
+  }
+}
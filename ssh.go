@@ -0,0 +1,331 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "bufio"
+  "errors"
+  "context"
+  "strings"
+  "os/exec"
+
+  "github.com/mdlayher/raw"
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// sshStartTimeout is how long the remote commands get to start, before
+// the transport gives up on them.
+const sshStartTimeout = 30 * time.Second
+
+// SSHOptions reach a segment through a host that the devices are on, such
+// as a router or ISP CPE, by running tcpdump on it to capture their frames
+// and an injector to send them, over SSH. Both carry the frames as pcap
+// streams.
+type SSHOptions struct {
+  // Command is the ssh program, and Args the arguments it is given before
+  // the destination.
+  Command     string
+  Args        []string
+  Destination string
+  // Interface is the interface on the remote host.
+  Interface   string
+  // Tcpdump and Injector are the remote commands, given the interface and
+  // the rest of their arguments.
+  Tcpdump     string
+  Injector    string
+}
+
+// sshConn is a packet connection to the devices through the remote
+// commands, in place of the raw socket. Frames captured by tcpdump are
+// queued until they are read, and written frames are added to the capture
+// the injector reads on its stdin.
+type sshConn struct {
+  opts    SSHOptions
+  local   net.HardwareAddr
+  capture *exec.Cmd
+  inject  *exec.Cmd
+  stdin   io.WriteCloser
+
+  writeMutex sync.Mutex
+
+  mutex    sync.Mutex
+  queue    [][]byte
+  // err is why the capture ended, returned once the queue is drained.
+  err      error
+  notify   chan struct{}
+  deadline time.Time
+  closed   bool
+}
+
+// ssh_interface returns an interface standing in for the remote one, with
+// its address. Its name is the destination and the remote interface, so
+// that it is not mistaken for a local one.
+func ssh_interface(opts SSHOptions) (*net.Interface, error) {
+  ctx, cancel := context.WithTimeout(context.Background(), sshStartTimeout)
+  defer cancel()
+  cmd := exec.CommandContext(ctx, opts.Command, ssh_args(opts, "cat /sys/class/net/" + shell_quote(opts.Interface) + "/address")...)
+  out, err := cmd.Output()
+  if err != nil {
+    if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+      err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(ee.Stderr)))
+    }
+    return nil, fmt.Errorf("failed to get the address of %s on %s: %v", opts.Interface, opts.Destination, err)
+  }
+  addr, err := net.ParseMAC(strings.TrimSpace(string(out)))
+  if err != nil {
+    return nil, fmt.Errorf("failed to get the address of %s on %s: %v", opts.Interface, opts.Destination, err)
+  }
+  return &net.Interface{Name: opts.Destination + ":" + opts.Interface, MTU: pcapSnapLen, HardwareAddr: addr}, nil
+}
+
+// open_ssh starts the remote commands, and returns once tcpdump is
+// capturing. Frames from the addresses in own are left out of the capture,
+// as they are the ones the injector sends.
+func open_ssh(opts SSHOptions, etherTypes []uint16, own []net.HardwareAddr) (*sshConn, error) {
+  c := &sshConn{
+    opts:   opts,
+    local:  own[0],
+    notify: make(chan struct{}, 1),
+  }
+
+  var protos, sources []string
+  for _, et := range etherTypes {
+    protos = append(protos, fmt.Sprintf("ether proto 0x%04x", et))
+  }
+  for _, addr := range own {
+    sources = append(sources, "ether src " + addr.String())
+  }
+  filter := fmt.Sprintf("(%s) and not (%s)", strings.Join(protos, " or "), strings.Join(sources, " or "))
+  capture := fmt.Sprintf("%s -i %s -U -s %d -w - %s", opts.Tcpdump, shell_quote(opts.Interface), pcapSnapLen, shell_quote(filter))
+  inject := fmt.Sprintf("%s --interface=%s", opts.Injector, shell_quote(opts.Interface))
+
+  c.capture = exec.Command(opts.Command, ssh_args(opts, capture)...)
+  stdout, err := c.capture.StdoutPipe()
+  if err != nil {
+    return nil, err
+  }
+  c.inject = exec.Command(opts.Command, ssh_args(opts, inject)...)
+  if c.stdin, err = c.inject.StdinPipe(); err != nil {
+    return nil, err
+  }
+  for name, cmd := range map[string]*exec.Cmd{"tcpdump": c.capture, "injector": c.inject} {
+    stderr, err := cmd.StderrPipe()
+    if err != nil {
+      return nil, err
+    }
+    go log_ssh_stderr(opts.Destination, name, stderr)
+  }
+
+  if err := c.capture.Start(); err != nil {
+    return nil, err
+  }
+  if err := c.inject.Start(); err != nil {
+    c.capture.Process.Kill()
+    c.capture.Wait()
+    return nil, err
+  }
+  if err := write_pcap_header(c.stdin); err != nil {
+    c.Close()
+    return nil, fmt.Errorf("failed to start the injector on %s: %v", opts.Destination, err)
+  }
+
+  // tcpdump writes the header of the capture once it is capturing, and
+  // replies to frames sent before then would be missed.
+  started := make(chan error, 1)
+  go c.run_capture(stdout, started)
+  select {
+  case err = <-started:
+  case <-time.After(sshStartTimeout):
+    err = errors.New("timed out")
+  }
+  if err != nil {
+    c.Close()
+    return nil, fmt.Errorf("failed to start tcpdump on %s: %v", opts.Destination, err)
+  }
+  return c, nil
+}
+
+// ssh_args returns the arguments of the ssh command that runs command on
+// the destination. It is run without a terminal, and never asks for a
+// password, as there is no one to type it.
+func ssh_args(opts SSHOptions, command string) []string {
+  args := append([]string{}, opts.Args...)
+  return append(args, "-T", "-o", "BatchMode=yes", opts.Destination, command)
+}
+
+// shell_quote quotes s for the remote shell.
+func shell_quote(s string) string {
+  return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func log_ssh_stderr(destination, command string, r io.Reader) {
+  scanner := bufio.NewScanner(r)
+  for scanner.Scan() {
+    transportLog.Infof("%s (%s): %s", destination, command, scanner.Text())
+  }
+}
+
+// run_capture queues the frames tcpdump captures, until it exits.
+func (c *sshConn) run_capture(stdout io.Reader, started chan<- error) {
+  p, err := new_pcap_reader(stdout)
+  started <- err
+  for err == nil {
+    var b []byte
+    if b, err = p.Next(); err == nil {
+      c.mutex.Lock()
+      c.queue = append(c.queue, b)
+      c.mutex.Unlock()
+      c.wake()
+    }
+  }
+  if err == io.EOF {
+    err = errors.New("tcpdump exited")
+  }
+  c.mutex.Lock()
+  c.err = fmt.Errorf("capture on %s ended: %v", c.opts.Destination, err)
+  c.mutex.Unlock()
+  c.wake()
+}
+
+func (c *sshConn) wake() {
+  select {
+  case c.notify <- struct{}{}:
+  default:
+  }
+}
+
+// WriteTo sends b through the injector.
+func (c *sshConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+  c.writeMutex.Lock()
+  defer c.writeMutex.Unlock()
+  if err := write_pcap_record(c.stdin, time.Now(), b); err != nil {
+    return 0, fmt.Errorf("injector on %s: %v", c.opts.Destination, err)
+  }
+  return len(b), nil
+}
+
+// ReadFrom returns the next captured frame, waiting for one until the read
+// deadline.
+func (c *sshConn) ReadFrom(b []byte) (int, net.Addr, error) {
+  for {
+    c.mutex.Lock()
+    if c.closed {
+      c.mutex.Unlock()
+      return 0, nil, errors.New("use of closed ssh transport")
+    }
+    if len(c.queue) > 0 {
+      frame := c.queue[0]
+      c.queue = c.queue[1:]
+      c.mutex.Unlock()
+      n := copy(b, frame)
+      var source net.HardwareAddr
+      if len(frame) >= 12 {
+        source = net.HardwareAddr(frame[6:12])
+      }
+      return n, &raw.Addr{HardwareAddr: source}, nil
+    }
+    if c.err != nil {
+      err := c.err
+      c.mutex.Unlock()
+      return 0, nil, err
+    }
+    deadline := c.deadline
+    c.mutex.Unlock()
+
+    var timer *time.Timer
+    var timeout <-chan time.Time
+    if !deadline.IsZero() {
+      wait := time.Until(deadline)
+      if wait <= 0 {
+        return 0, nil, readTimeout{}
+      }
+      timer = time.NewTimer(wait)
+      timeout = timer.C
+    }
+    select {
+    case <-c.notify:
+      if timer != nil {
+        timer.Stop()
+      }
+    case <-timeout:
+      return 0, nil, readTimeout{}
+    }
+  }
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+  c.mutex.Lock()
+  c.deadline = t
+  c.mutex.Unlock()
+  // Wake up a read waiting on the old deadline.
+  c.wake()
+  return nil
+}
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+  return c.SetReadDeadline(t)
+}
+
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+  return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr {
+  return &raw.Addr{HardwareAddr: c.local}
+}
+
+// Close ends the ssh sessions. The injector exits at the end of its stdin,
+// and tcpdump when it next writes a frame.
+func (c *sshConn) Close() error {
+  c.mutex.Lock()
+  if c.closed {
+    c.mutex.Unlock()
+    return nil
+  }
+  c.closed = true
+  c.mutex.Unlock()
+  c.wake()
+
+  c.stdin.Close()
+  for _, cmd := range []*exec.Cmd{c.capture, c.inject} {
+    cmd.Process.Kill()
+    go cmd.Wait()
+  }
+  return nil
+}
+
+// run_inject sends the frames of the capture read from r on iface, until
+// it ends, for --transport=ssh to run on the host the devices are on.
+func run_inject(iface *net.Interface, r io.Reader) int {
+  conn, err := raw.ListenPacket(iface, homeplug.EtherType, nil)
+  if err != nil {
+    mainLog.Errorf("failed to listen on %s: %v", iface.Name, err)
+    return 1
+  }
+  defer conn.Close()
+  p, err := new_pcap_reader(r)
+  if err != nil {
+    mainLog.Errorf("failed to read frames: %v", err)
+    return 1
+  }
+  for {
+    b, err := p.Next()
+    if err == io.EOF {
+      return 0
+    } else if err != nil {
+      mainLog.Errorf("failed to read frames: %v", err)
+      return 1
+    }
+    if len(b) < 14 {
+      transportLog.Debugf("dropping a frame of %d bytes", len(b))
+      continue
+    }
+    if _, err := conn.WriteTo(b, &raw.Addr{HardwareAddr: net.HardwareAddr(b[0:6])}); err != nil {
+      mainLog.Errorf("failed to send frame on %s: %v", iface.Name, err)
+      return 1
+    }
+  }
+}
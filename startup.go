@@ -0,0 +1,105 @@
+package main
+
+import (
+  "sync"
+  "time"
+  "context"
+  "net/http"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Backoff between attempts to open the transport at startup.
+const (
+  startupMinBackoff = time.Second
+  startupMaxBackoff = 30 * time.Second
+)
+
+var exporterUp = prometheus.NewGaugeFunc(
+  prometheus.GaugeOpts{
+    Namespace: namespace,
+    Name:      "up",
+    Help:      "Whether the transports to the devices of every --interface are open and up. It is 0 while the exporter waits for the interface at startup.",
+  },
+  func() float64 {
+    servedMutex.Lock()
+    defer servedMutex.Unlock()
+    if len(servedTransports) == 0 {
+      return 0
+    }
+    for _, t := range servedTransports {
+      if t.State() != transportUp {
+        return 0
+      }
+    }
+    return 1
+  })
+
+// servedTransports are the transports of the segments polled, whose health
+// homeplug_up tells, as opposed to those of probes.
+var (
+  servedMutex      sync.Mutex
+  servedTransports []*Transport
+)
+
+// serve_transport adds t to the transports that homeplug_up tells of.
+func serve_transport(t *Transport) {
+  servedMutex.Lock()
+  defer servedMutex.Unlock()
+  servedTransports = append(servedTransports, t)
+}
+
+// open_with_retry calls open until it succeeds, waiting longer after each
+// failure, for at most wait. If metrics is not nil, it is served on the
+// listen address meanwhile, so that a scrape tells the exporter is waiting
+// rather than down, and the server is shut down before returning. It returns
+// the last error of open if it never succeeds.
+func open_with_retry(wait time.Duration, metrics http.Handler, open func() error) error {
+  err := open()
+  if err == nil || wait <= 0 {
+    return err
+  }
+
+  if metrics != nil {
+    mux := http.NewServeMux()
+    mux.Handle(*metricsEndpoint, metrics)
+    server := &http.Server{Addr: *listeningAddress, Handler: mux}
+    go func() {
+      if err := server.ListenAndServe(); err != http.ErrServerClosed {
+        mainLog.Errorf("failed to serve metrics while waiting: %v", err)
+      }
+    }()
+    defer func() {
+      ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+      defer cancel()
+      server.Shutdown(ctx)
+    }()
+  }
+
+  deadline := time.Now().Add(wait)
+  backoff := startupMinBackoff
+  for {
+    remaining := time.Until(deadline)
+    if remaining <= 0 {
+      return err
+    }
+    if backoff > remaining {
+      backoff = remaining
+    }
+    mainLog.Warnf("%v; retrying in %s, for up to %s", err, backoff.Round(time.Second), remaining.Round(time.Second))
+    time.Sleep(backoff)
+    if err = open(); err == nil {
+      return nil
+    }
+    if backoff *= 2; backoff > startupMaxBackoff {
+      backoff = startupMaxBackoff
+    }
+  }
+}
+
+// startup_metrics_handler serves the metrics registered so far, such as
+// homeplug_up, with the exporter's metric rules.
+func startup_metrics_handler(cfg *Config) http.Handler {
+  return promhttp.HandlerFor(cfg.metricRules().gatherer(prometheus.DefaultGatherer), promhttp.HandlerOpts{})
+}
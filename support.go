@@ -0,0 +1,192 @@
+package main
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "sync"
+  "time"
+  "bytes"
+  "context"
+  "strings"
+  "net/http"
+  "archive/tar"
+  "compress/gzip"
+  "encoding/hex"
+  "encoding/json"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/common/expfmt"
+  "github.com/prometheus/common/version"
+  "github.com/sirupsen/logrus"
+  "gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+  supportLogLines = 500
+  supportFrames   = 200
+)
+
+var (
+  recentLogs   = &ringBuffer{size: supportLogLines}
+  recentFrames = &ringBuffer{size: supportFrames}
+)
+
+// ringBuffer keeps the last size lines added to it.
+type ringBuffer struct {
+  mutex sync.Mutex
+  size  int
+  next  int
+  lines []string
+}
+
+func (r *ringBuffer) Add(line string) {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  if len(r.lines) < r.size {
+    r.lines = append(r.lines, line)
+    return
+  }
+  r.lines[r.next] = line
+  r.next = (r.next + 1) % r.size
+}
+
+func (r *ringBuffer) Lines() []string {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  return append(append([]string{}, r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+// logRecorder is a log hook that keeps recent log lines for support bundles,
+// regardless of the configured log target.
+type logRecorder struct{}
+
+func (logRecorder) Levels() []logrus.Level {
+  return logrus.AllLevels
+}
+
+func (logRecorder) Fire(e *logrus.Entry) error {
+  recentLogs.Add(fmt.Sprintf("%s %-5s %s", e.Time.Format(time.RFC3339Nano), e.Level, e.Message))
+  return nil
+}
+
+// record_frame keeps a raw Ethernet frame for support bundles.
+func record_frame(direction string, b []byte) {
+  recentFrames.Add(fmt.Sprintf("%s %s %s", time.Now().Format(time.RFC3339Nano), direction, hex.EncodeToString(b)))
+}
+
+// write_support_bundle writes a gzipped tarball containing everything needed
+// to reproduce a decoding problem: version and flags, recent logs and raw
+// frames, the decoded topology, and the current metrics.
+func write_support_bundle(w io.Writer, s *Snapshot) error {
+  gz := gzip.NewWriter(w)
+  tw := tar.NewWriter(gz)
+  now := time.Now()
+
+  add := func(name string, b []byte) error {
+    err := tw.WriteHeader(&tar.Header{
+      Name:    "homeplug_exporter/" + name,
+      Mode:    0644,
+      Size:    int64(len(b)),
+      ModTime: now,
+    })
+    if err != nil {
+      return err
+    }
+    _, err = tw.Write(b)
+    return err
+  }
+
+  files := []struct {
+    name    string
+    content func() ([]byte, error)
+  }{
+    {"version.txt", func() ([]byte, error) {
+      return []byte(version.Print("homeplug_exporter") + "\n"), nil
+    }},
+    {"flags.txt", support_flags},
+    {"logs.txt", func() ([]byte, error) {
+      return []byte(strings.Join(recentLogs.Lines(), "\n") + "\n"), nil
+    }},
+    {"frames.txt", func() ([]byte, error) {
+      return []byte(strings.Join(recentFrames.Lines(), "\n") + "\n"), nil
+    }},
+    {"topology.json", func() ([]byte, error) {
+      if s == nil {
+        return []byte("null\n"), nil
+      }
+      return json.MarshalIndent(new_api_topology(s), "", "  ")
+    }},
+    {"metrics.txt", support_metrics},
+  }
+
+  for _, f := range files {
+    b, err := f.content()
+    if err != nil {
+      b = []byte(fmt.Sprintf("error: %v\n", err))
+    }
+    if err := add(f.name, b); err != nil {
+      return err
+    }
+  }
+
+  if err := tw.Close(); err != nil {
+    return err
+  }
+  return gz.Close()
+}
+
+func support_flags() ([]byte, error) {
+  var b bytes.Buffer
+  fmt.Fprintf(&b, "args: %q\n", os.Args[1:])
+  for _, f := range kingpin.CommandLine.Model().Flags {
+    fmt.Fprintf(&b, "--%s=%s\n", f.Name, f.Value.String())
+  }
+  return b.Bytes(), nil
+}
+
+func support_metrics() ([]byte, error) {
+  mfs, err := prometheus.DefaultGatherer.Gather()
+  if err != nil && len(mfs) == 0 {
+    return nil, err
+  }
+  var b bytes.Buffer
+  for _, mf := range mfs {
+    if _, err := expfmt.MetricFamilyToText(&b, mf); err != nil {
+      return nil, err
+    }
+  }
+  return b.Bytes(), nil
+}
+
+// write_support_bundle_file polls the devices once and writes a support
+// bundle to path.
+func write_support_bundle_file(path string, poller *Poller) error {
+  s, err := poller.Poll(context.Background())
+  if err != nil {
+    httpLog.Errorf("Error polling Homeplug: %v", err)
+  }
+  f, err := os.Create(path)
+  if err != nil {
+    return err
+  }
+  if err := write_support_bundle(f, s); err != nil {
+    f.Close()
+    return err
+  }
+  return f.Close()
+}
+
+func support_bundle_handler(api *API) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    s, err := api.latest(r.Context())
+    if err != nil {
+      httpLog.Errorf("Error polling Homeplug: %v", err)
+    }
+    w.Header().Set("Content-Type", "application/gzip")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"homeplug_exporter-%s.tar.gz\"", time.Now().Format("20060102-150405")))
+    if err := write_support_bundle(w, s); err != nil {
+      httpLog.Errorf("Error writing support bundle: %v", err)
+    }
+  }
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+  "net"
+  "time"
+  "bytes"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// syntheticTarget is a fake network that the exporter answers probes of
+// itself, so that meta-monitoring can check the whole scrape pipeline
+// without depending on real devices. Its stations answer the requests of
+// every family with fixed replies, which are marshalled and unmarshalled as
+// if they had crossed the wire before being decoded.
+type syntheticTarget struct {
+  address  net.HardwareAddr
+  stations []net.HardwareAddr
+  rate     uint8
+}
+
+func new_synthetic_target(c SyntheticConfig) *syntheticTarget {
+  address, _ := net.ParseMAC(c.Address)
+  t := &syntheticTarget{address: address, rate: c.Rate}
+  for i := 0; i < c.Stations; i++ {
+    station := append(net.HardwareAddr(nil), address...)
+    station[5] += byte(i)
+    t.stations = append(t.stations, station)
+  }
+  return t
+}
+
+// Is reports whether dest is the synthetic target.
+func (t *syntheticTarget) Is(dest net.HardwareAddr) bool {
+  return t != nil && bytes.Equal(dest, t.address)
+}
+
+// Probe answers requests as the synthetic stations would, and decodes the
+// replies into a new snapshot.
+func (t *syntheticTarget) Probe(families []ProtocolFamily, requests []homeplug.Frame) *Snapshot {
+  s := &Snapshot{
+    Target: t.address,
+    Time:   time.Now(),
+  }
+  _, malformed := decode(s, families, t.answer(requests))
+  log_malformed(malformed)
+  return s
+}
+
+func (t *syntheticTarget) answer(requests []homeplug.Frame) []homeplug.Message {
+  var msgs []homeplug.Message
+  for _, r := range requests {
+    for i := range t.stations {
+      reply, ok := t.reply(i, &r)
+      if !ok {
+        continue
+      }
+      b, err := reply.MarshalBinary()
+      if err != nil {
+        continue
+      }
+      var h homeplug.Frame
+      if err := (&h).UnmarshalBinary(b); err != nil {
+        continue
+      }
+      msgs = append(msgs, homeplug.Message{Source: t.stations[i], Frame: h})
+    }
+  }
+  return msgs
+}
+
+// reply returns the confirm station i sends to request r, if it answers it.
+func (t *syntheticTarget) reply(i int, r *homeplug.Frame) (homeplug.Frame, bool) {
+  switch r.MMEType {
+  case homeplug.NwInfoReq:
+    b := append([]byte{1}, t.network(i)...)
+    b = append(b, 1, byte(len(t.stations) - 1))
+    for j, peer := range t.stations {
+      if j != i {
+        b = append(b, peer...)
+        b = append(b, byte(j + 1))
+        b = append(b, t.bridged(j)...)
+        b = append(b, t.rate, t.rate)
+      }
+    }
+    return homeplug.Frame{Version: homeplug.HPVersion, MMEType: homeplug.NwInfoCnf, Vendor: homeplug.HPVendor, Payload: b}, true
+  case homeplug.CMNwInfoReq:
+    b := append([]byte{1}, t.network(i)...)
+    b = append(b, 0, 0)
+    return homeplug.Frame{Version: homeplug.AVVersion, MMEType: homeplug.CMNwInfoCnf, Payload: b}, true
+  case homeplug.CMNwStatsReq:
+    b := []byte{byte(len(t.stations) - 1)}
+    for j, peer := range t.stations {
+      if j != i {
+        b = append(b, peer...)
+        b = append(b, t.rate, t.rate)
+      }
+    }
+    return homeplug.Frame{Version: homeplug.AVVersion, MMEType: homeplug.CMNwStatsCnf, Payload: b}, true
+  case homeplug.CMStaCapReq:
+    b := make([]byte, 25)
+    b[0] = 0x01
+    copy(b[1:7], t.stations[i])
+    copy(b[7:10], homeplug.HPVendor[:])
+    return homeplug.Frame{Version: homeplug.AVVersion, MMEType: homeplug.CMStaCapCnf, Payload: b}, true
+  }
+  return homeplug.Frame{}, false
+}
+
+// network returns the part of the network status shared by the Qualcomm and
+// standard network info confirms of station i, up to the CCo address. The
+// first station is the CCo, with TEI 1.
+func (t *syntheticTarget) network(i int) []byte {
+  b := make([]byte, 7, 16)
+  copy(b, t.address)
+  role := byte(0)
+  if i == 0 {
+    role = 2
+  }
+  b = append(b, 1, byte(i + 1), role)
+  return append(b, t.stations[0]...)
+}
+
+// bridged returns the address of the host bridged behind station i: its own
+// address with the locally administered bit flipped.
+func (t *syntheticTarget) bridged(i int) net.HardwareAddr {
+  b := append(net.HardwareAddr(nil), t.stations[i]...)
+  b[0] ^= 0x02
+  return b
+}
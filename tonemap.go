@@ -0,0 +1,141 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "bytes"
+  "context"
+
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// toneMapMaxSlots is the most tone map slots asked for per link; a link with
+// more than a few is already too noisy for its slots to tell much apart.
+const toneMapMaxSlots = 8
+
+// ToneMap is what the tone map that Reporter uses to send to Peer says of
+// each carrier, averaged over its slots.
+type ToneMap struct {
+  Reporter    net.HardwareAddr
+  Peer        net.HardwareAddr
+  Slots       int
+  // Bits are the bits each carrier carries.
+  Bits        []float64
+  // Modulations are the number of carriers with each modulation.
+  Modulations map[string]float64
+}
+
+// BandBits returns the average bits per carrier of the carriers in each
+// whole MHz of frequency, keyed by the MHz they start from.
+func (t *ToneMap) BandBits() map[int]float64 {
+  sums := map[int]float64{}
+  counts := map[int]int{}
+  for i, bits := range t.Bits {
+    mhz := int(float64(homeplug.ToneMapFirstCarrier + i) * homeplug.CarrierSpacing / 1e6)
+    sums[mhz] += bits
+    counts[mhz]++
+  }
+  for mhz := range sums {
+    sums[mhz] /= float64(counts[mhz])
+  }
+  return sums
+}
+
+// queryToneMaps asks each Qualcomm reporter in the snapshot for every slot of
+// the tone map it uses to send to each of its peers. Like querySchedules, it
+// returns the first error or missing answer.
+func (p *Poller) queryToneMaps(ctx context.Context, s *Snapshot, timeout time.Duration) error {
+  var failed error
+  for _, station := range s.Stations {
+    if !station.Reporter || station.Protocol != "qualcomm" {
+      continue
+    }
+    reporter := station.Address
+    if p.backoff.Suspended("tone_maps", reporter) || p.quarantine.Suspended(reporter) {
+      continue
+    }
+    for _, link := range s.Links {
+      if !bytes.Equal(link.Reporter, reporter) || !bytes.Equal(link.Source, reporter) {
+        continue
+      }
+      if ctx.Err() != nil {
+        return ctx.Err()
+      }
+      t, err := p.queryToneMap(ctx, s, reporter, link.Destination, timeout)
+      p.backoff.Record("tone_maps", reporter, err == nil)
+      if err != nil {
+        pollerLog.Errorf("Error querying tone map of %v to %v: %v", reporter, link.Destination, err)
+        if failed == nil {
+          failed = err
+        }
+        // The rest of its links are left for the next poll, as with the
+        // link stats.
+        break
+      }
+      if t != nil {
+        s.ToneMaps = append(s.ToneMaps, *t)
+      }
+    }
+  }
+  return failed
+}
+
+// queryToneMap asks reporter for each slot of the tone map it uses to send
+// to peer, one at a time, as the first tells how many there are. It returns
+// nil if the reporter has no tone map for peer yet.
+func (p *Poller) queryToneMap(ctx context.Context, s *Snapshot, reporter, peer net.HardwareAddr, timeout time.Duration) (*ToneMap, error) {
+  t := &ToneMap{
+    Reporter:    reporter,
+    Peer:        peer,
+    Bits:        make([]float64, homeplug.ToneMapCarriers),
+    Modulations: map[string]float64{},
+  }
+  slots := 1
+  for slot := 0; slot < slots; slot++ {
+    request := homeplug.ToneMapRequest(peer, uint8(slot))
+    msgs, err := p.transport.Request(ctx, reporter, []homeplug.Frame{request}, timeout, func(msgs []homeplug.Message) bool {
+      return bytes.Equal(msgs[len(msgs) - 1].Source, reporter) && msgs[len(msgs) - 1].Frame.MMEType == homeplug.ToneMapCnf
+    })
+    if err != nil {
+      return nil, err
+    }
+    var tm *homeplug.ToneMap
+    for _, m := range msgs {
+      if !bytes.Equal(m.Source, reporter) || m.Frame.MMEType != homeplug.ToneMapCnf {
+        continue
+      }
+      var decoded homeplug.ToneMap
+      if err := accept(&m.Frame, (&decoded).UnmarshalBinary(m.Frame.Payload)); err != nil {
+        logDedup.Errorf(decoderLog, "decode", "[%v] failed to unmarshal VS_TONE_MAP_CHAR frame: %v", m.Source, err)
+        continue
+      }
+      tm = &decoded
+      s.DecodedAs(&m)
+    }
+    if tm == nil {
+      return nil, fmt.Errorf("%v did not answer the tone map query of %v", reporter, peer)
+    }
+    if slot == 0 {
+      if tm.Slots == 0 {
+        return nil, nil
+      }
+      slots = int(tm.Slots)
+      if slots > toneMapMaxSlots {
+        slots = toneMapMaxSlots
+      }
+    }
+    for i, m := range tm.Modulations {
+      t.Bits[i] += float64(homeplug.ModulationBits[m])
+      t.Modulations[homeplug.Modulations[m]]++
+    }
+  }
+  for i := range t.Bits {
+    t.Bits[i] /= float64(slots)
+  }
+  for m := range t.Modulations {
+    t.Modulations[m] /= float64(slots)
+  }
+  t.Slots = slots
+  return t, nil
+}
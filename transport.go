@@ -0,0 +1,305 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "bytes"
+  "errors"
+  "syscall"
+  "sync/atomic"
+
+  "github.com/mdlayher/ethernet"
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// Transport carries Homeplug frames to and from the devices on an interface,
+// as a homeplug.Requester. Frames are received on the raw socket; they are
+// sent on it too unless a socket priority was requested, which needs a
+// socket of its own.
+type Transport struct {
+  iface      *net.Interface
+  opts       TransportOptions
+  conn       net.PacketConn
+  writer     net.PacketConn
+  vlan       *ethernet.VLAN
+  // sources are the source addresses to send unicast frames to each
+  // destination from, in place of the interface's own.
+  sources    map[string]net.HardwareAddr
+  // state is the health of the sockets, from the errors of the last read
+  // or write.
+  state      int32
+  // roundTrips are the lowest round trip of each station's requests since
+  // they were last taken, keyed by address.
+  rttMutex   sync.Mutex
+  roundTrips map[string]time.Duration
+}
+
+// Transport health states.
+const (
+  transportUp            = iota
+  // transportInterfaceDown is the interface going down or away.
+  transportInterfaceDown
+  // transportSocketFailed is any other read or write error, such as the
+  // socket having been closed.
+  transportSocketFailed
+)
+
+// transportStates are the exported names of the health states.
+var transportStates = []string{"up", "interface_down", "socket_failed"}
+
+var transportState = prometheus.NewGaugeVec(
+  prometheus.GaugeOpts{
+    Namespace: namespace,
+    Name:      "transport_state",
+    Help:      "Health of the transport, 1 for the current state and 0 for the others. It is reopened before the next query if it is not up.",
+  },
+  []string{"interface", "state"})
+
+var transportEchoes = prometheus.NewCounterVec(
+  prometheus.CounterOpts{
+    Namespace: namespace,
+    Name:      "transport_echoes_total",
+    Help:      "Frames received from an address the exporter sends from, by interface and MME type: its own requests coming back through a bridge loop or an adapter that echoes them. They are dropped.",
+  },
+  []string{"interface", "mme_type"})
+
+var transportFragments = prometheus.NewCounterVec(
+  prometheus.CounterOpts{
+    Namespace: namespace,
+    Name:      "transport_fragments_total",
+    Help:      "Fragments of MMEs received, by whether they were reassembled into whole MMEs or discarded because they contradicted the fragments before them. Fragments of MMEs that are still incomplete when a query ends are in neither.",
+  },
+  []string{"interface", "result"})
+
+// TransportOptions control how outgoing management frames are sent, so that
+// they can be prioritized by switches and queueing disciplines on the way
+// to the powerline adapters.
+type TransportOptions struct {
+  // VLANID and VLANPriority, when either is non-zero, tag outgoing frames
+  // with an 802.1Q header. A VLAN ID of 0 only sets the 802.1p priority.
+  VLANID          uint16
+  VLANPriority    uint8
+  // SocketPriority, when not negative, is set as SO_PRIORITY on the sending
+  // socket.
+  SocketPriority  int
+  // SourceAddresses, keyed by destination address, replace the source
+  // address of unicast frames to that destination. The interface is put in
+  // promiscuous mode to receive the replies.
+  SourceAddresses map[string]net.HardwareAddr
+  // ReplayFile, if set, is a pcap capture whose confirmations answer the
+  // requests in place of the devices.
+  ReplayFile      string
+  // SSH, if set, reaches the devices through a remote host instead of the
+  // interface, which stands in for the remote one.
+  SSH             *SSHOptions
+  // EtherTypes are received on, by a socket each. Frames are sent with the
+  // HomePlug AV EtherType whatever they are.
+  EtherTypes      []uint16
+}
+
+func NewTransport(iface *net.Interface, opts TransportOptions) (*Transport, error) {
+  t := &Transport{
+    iface:   iface,
+    opts:    opts,
+    sources: opts.SourceAddresses,
+  }
+
+  if opts.VLANID != 0 || opts.VLANPriority != 0 {
+    t.vlan = &ethernet.VLAN{
+      Priority: ethernet.Priority(opts.VLANPriority),
+      ID:       opts.VLANID,
+    }
+    if _, err := t.vlan.MarshalBinary(); err != nil {
+      return nil, fmt.Errorf("VLAN ID %d priority %d: %v", opts.VLANID, opts.VLANPriority, err)
+    }
+  }
+
+  if err := t.open(); err != nil {
+    return nil, err
+  }
+  t.setState(transportUp)
+  return t, nil
+}
+
+// open opens the sockets of the transport.
+func (t *Transport) open() error {
+  if t.opts.ReplayFile != "" {
+    conn, err := open_pcap_replay(t.opts.ReplayFile)
+    if err != nil {
+      return err
+    }
+    t.conn, t.writer = conn, conn
+    return nil
+  }
+
+  etherTypes := t.opts.EtherTypes
+  if len(etherTypes) == 0 {
+    etherTypes = []uint16{homeplug.EtherType}
+  }
+  if t.opts.SSH != nil {
+    own := []net.HardwareAddr{t.iface.HardwareAddr}
+    for _, src := range t.sources {
+      own = append(own, src)
+    }
+    conn, err := open_ssh(*t.opts.SSH, etherTypes, own)
+    if err != nil {
+      return err
+    }
+    t.conn, t.writer = conn, conn
+    return nil
+  }
+  conn, err := listen_ethertypes(t.iface, etherTypes, len(t.sources) > 0)
+  if err != nil {
+    return err
+  }
+
+  writer := conn
+  if t.opts.SocketPriority >= 0 {
+    w, err := listen_priority(t.iface, t.opts.SocketPriority)
+    if err != nil {
+      conn.Close()
+      return fmt.Errorf("failed to set socket priority %d: %v", t.opts.SocketPriority, err)
+    }
+    writer = w
+  }
+  t.conn, t.writer = conn, writer
+  return nil
+}
+
+// Ready reopens the sockets if the last read or write found the transport
+// unhealthy, unless the interface is still down. The interface is looked up
+// again, as its index changes if it was recreated.
+func (t *Transport) Ready() error {
+  state := t.State()
+  if state == transportUp {
+    return nil
+  }
+  iface, err := net.InterfaceByName(t.iface.Name)
+  if state == transportInterfaceDown && (err != nil || iface.Flags & net.FlagUp == 0) {
+    return fmt.Errorf("interface %s is down", t.iface.Name)
+  }
+  if err == nil {
+    t.iface = iface
+  }
+  if t.writer != t.conn {
+    t.writer.Close()
+  }
+  t.conn.Close()
+  if err := t.open(); err != nil {
+    return fmt.Errorf("transport is %s, and reopening it failed: %v", transportStates[state], err)
+  }
+  transportLog.Infof("reopened transport on %s, which was %s", t.iface.Name, transportStates[state])
+  t.setState(transportUp)
+  return nil
+}
+
+// Close closes the sockets of the transport.
+func (t *Transport) Close() error {
+  if t.writer != t.conn {
+    t.writer.Close()
+  }
+  return t.conn.Close()
+}
+
+// frame_size returns the length of the longest frame received on iface: its
+// MTU, the Ethernet header, and an 802.1Q tag if tagged. MME fragments other
+// than the last are that long, so a shorter buffer would cut them short.
+func frame_size(iface *net.Interface, tagged bool) int {
+  n := iface.MTU + 14
+  if tagged {
+    n += 4
+  }
+  return n
+}
+
+func (t *Transport) State() int32 {
+  return atomic.LoadInt32(&t.state)
+}
+
+func (t *Transport) setState(state int32) {
+  atomic.StoreInt32(&t.state, state)
+  for i, name := range transportStates {
+    value := 0.0
+    if int32(i) == state {
+      value = 1
+    }
+    transportState.WithLabelValues(t.iface.Name, name).Set(value)
+  }
+}
+
+// fail records the health state that err, from a read or write, puts the
+// transport in, and reports whether it is still up. Timeouts are how reads
+// end, and leave it up.
+func (t *Transport) fail(err error) bool {
+  state := classify_transport_error(err)
+  if state != transportUp && t.State() == transportUp {
+    transportLog.Errorf("transport on %s is %s: %v", t.iface.Name, transportStates[state], err)
+  }
+  if state != transportUp {
+    t.setState(state)
+  }
+  return state == transportUp
+}
+
+func classify_transport_error(err error) int32 {
+  var ne net.Error
+  if errors.As(err, &ne) && ne.Timeout() {
+    return transportUp
+  }
+  var errno syscall.Errno
+  if errors.As(err, &errno) {
+    switch errno {
+    case syscall.ENETDOWN, syscall.ENXIO, syscall.ENODEV:
+      return transportInterfaceDown
+    }
+  }
+  return transportSocketFailed
+}
+
+// roundTrip records that a request was answered by the first confirm of
+// source after rtt, if it is the lowest yet.
+func (t *Transport) roundTrip(source net.HardwareAddr, rtt time.Duration) {
+  t.rttMutex.Lock()
+  defer t.rttMutex.Unlock()
+  if t.roundTrips == nil {
+    t.roundTrips = map[string]time.Duration{}
+  }
+  if old, ok := t.roundTrips[source.String()]; !ok || rtt < old {
+    t.roundTrips[source.String()] = rtt
+  }
+}
+
+// TakeRoundTrips returns the lowest round trip of each station's requests
+// since the last call, keyed by address, and starts over.
+func (t *Transport) TakeRoundTrips() map[string]time.Duration {
+  t.rttMutex.Lock()
+  defer t.rttMutex.Unlock()
+  rtts := t.roundTrips
+  t.roundTrips = nil
+  return rtts
+}
+
+// source returns the source address for frames to dest.
+func (t *Transport) source(dest net.HardwareAddr) net.HardwareAddr {
+  if src, ok := t.sources[dest.String()]; ok {
+    return src
+  }
+  return t.iface.HardwareAddr
+}
+
+// own reports whether frames are sent from addr, so that one received from it
+// is one of the transport's own coming back rather than a reply.
+func (t *Transport) own(addr net.HardwareAddr) bool {
+  if bytes.Equal(addr, t.iface.HardwareAddr) {
+    return true
+  }
+  for _, src := range t.sources {
+    if bytes.Equal(addr, src) {
+      return true
+    }
+  }
+  return false
+}
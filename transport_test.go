@@ -0,0 +1,93 @@
+package main
+
+import (
+  "net"
+  "time"
+  "bytes"
+  "testing"
+
+  "github.com/mdlayher/ethernet"
+  "github.com/brandond/homeplug_exporter/pkg/homeplug"
+)
+
+// framesConn is a socket that receives frames, cut short to the buffers
+// they are read into as a raw socket would, and then times out.
+type framesConn struct {
+  net.PacketConn
+  frames [][]byte
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (c *framesConn) ReadFrom(b []byte) (int, net.Addr, error) {
+  if len(c.frames) == 0 {
+    return 0, nil, timeoutError{}
+  }
+  n := copy(b, c.frames[0])
+  c.frames = c.frames[1:]
+  return n, nil, nil
+}
+
+func (c *framesConn) SetReadDeadline(t time.Time) error {
+  return nil
+}
+
+func TestReadHomeplugReassemblesFullSizeFragments(t *testing.T) {
+  iface := &net.Interface{Name: "test0", MTU: 1500, HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}}
+  source := net.HardwareAddr{0x00, 0xB0, 0x52, 0xAA, 0x00, 0x01}
+
+  // Every fragment but the last fills the MTU, after the 5-byte header of
+  // an MMV 1 MME.
+  payload := make([]byte, 2 * (iface.MTU - 5) + 100)
+  for i := range payload {
+    payload[i] = byte(i)
+  }
+  conn := &framesConn{}
+  for number, o := 0, 0; o < len(payload); number++ {
+    end := o + iface.MTU - 5
+    if end > len(payload) {
+      end = len(payload)
+    }
+    h := homeplug.Frame{Version: homeplug.AVVersion, MMEType: homeplug.CMNwInfoCnf, Fragment: [2]byte{0x20 | byte(number), 7}, Payload: payload[o:end]}
+    b, err := h.MarshalBinary()
+    if err != nil {
+      t.Fatal(err)
+    }
+    f := ethernet.Frame{Destination: iface.HardwareAddr, Source: source, EtherType: homeplug.EtherType, Payload: b}
+    if b, err = f.MarshalBinary(); err != nil {
+      t.Fatal(err)
+    }
+    conn.frames = append(conn.frames, b)
+    o = end
+  }
+  if len(conn.frames[0]) != iface.MTU + 14 {
+    t.Fatalf("first fragment is %d bytes, want %d", len(conn.frames[0]), iface.MTU + 14)
+  }
+
+  ch := make(chan homeplug.Message)
+  go read_homeplug(&Transport{iface: iface, conn: conn}, ch, make(chan struct{}), time.Second)
+  var msgs []homeplug.Message
+  for m := range ch {
+    msgs = append(msgs, m)
+  }
+  if len(msgs) != 1 {
+    t.Fatalf("received %d messages, want 1", len(msgs))
+  }
+  if !bytes.Equal(msgs[0].Frame.Payload, payload) {
+    t.Errorf("reassembled %d bytes, want the %d bytes fragmented", len(msgs[0].Frame.Payload), len(payload))
+  }
+}
+
+func TestFrameSize(t *testing.T) {
+  iface := &net.Interface{MTU: 1500}
+  if n := frame_size(iface, false); n != 1514 {
+    t.Errorf("frame_size untagged = %d, want 1514", n)
+  }
+  if n := frame_size(iface, true); n != 1518 {
+    t.Errorf("frame_size tagged = %d, want 1518", n)
+  }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "strings"
+  "encoding/hex"
+)
+
+// ouiVendors names the makers of powerline adapters and chipsets by the
+// OUI of the addresses they assign. The vendors section of the
+// configuration file adds to it, or overrides it.
+var ouiVendors = map[string]string{
+  "00:b0:52": "Qualcomm Atheros",
+  "00:1f:84": "Gigle Semiconductor",
+  "00:0b:3b": "devolo",
+  "14:cc:20": "TP-Link",
+  "18:a6:f7": "TP-Link",
+  "30:b5:c2": "TP-Link",
+  "50:c7:bf": "TP-Link",
+  "60:e3:27": "TP-Link",
+  "64:70:02": "TP-Link",
+  "98:de:d0": "TP-Link",
+  "a0:f3:c1": "TP-Link",
+  "b0:4e:26": "TP-Link",
+  "c4:6e:1f": "TP-Link",
+  "e8:de:27": "TP-Link",
+  "ec:08:6b": "TP-Link",
+  "f4:f2:6d": "TP-Link",
+  "f8:1a:67": "TP-Link",
+  "00:04:0e": "AVM",
+  "24:65:11": "AVM",
+  "38:10:d5": "AVM",
+  "3c:a6:2f": "AVM",
+  "5c:49:79": "AVM",
+  "7c:ff:4d": "AVM",
+  "9c:c7:a6": "AVM",
+  "bc:05:43": "AVM",
+  "c0:25:06": "AVM",
+  "c8:0e:14": "AVM",
+  "e0:28:6d": "AVM",
+  "20:e5:2a": "Netgear",
+  "28:c6:8e": "Netgear",
+  "9c:3d:cf": "Netgear",
+  "a0:21:b7": "Netgear",
+  "c0:3f:0e": "Netgear",
+}
+
+// oui returns the OUI of a, or "" if it is locally administered and has
+// none.
+func oui(a net.HardwareAddr) string {
+  if len(a) < 3 || a[0] & 0x02 != 0 {
+    return ""
+  }
+  return fmt.Sprintf("%02x:%02x:%02x", a[0], a[1], a[2])
+}
+
+// parse_oui returns the string form of an OUI written as three bytes in
+// hex, separated by colons or hyphens or not at all.
+func parse_oui(s string) (string, error) {
+  b, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(s))
+  if err != nil || len(b) != 3 {
+    return "", fmt.Errorf("invalid OUI %q", s)
+  }
+  return fmt.Sprintf("%02x:%02x:%02x", b[0], b[1], b[2]), nil
+}
+
+// assign_vendors sets the vendor of every station whose OUI is in vendors,
+// keyed by its string form, or else in ouiVendors.
+func assign_vendors(s *Snapshot, vendors map[string]string) {
+  for i := range s.Stations {
+    o := oui(s.Stations[i].Address)
+    if o == "" {
+      continue
+    }
+    if vendor, ok := vendors[o]; ok {
+      s.Stations[i].Vendor = vendor
+    } else {
+      s.Stations[i].Vendor = ouiVendors[o]
+    }
+  }
+}
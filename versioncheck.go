@@ -0,0 +1,118 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "time"
+  "context"
+  "strconv"
+  "strings"
+  "net/http"
+  "encoding/json"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/common/version"
+)
+
+const (
+  defaultReleasesURL   = "https://api.github.com/repos/brandond/homeplug_exporter/releases/latest"
+  versionCheckInterval = 24 * time.Hour
+)
+
+var updateAvailable = prometheus.NewGaugeVec(
+  prometheus.GaugeOpts{
+    Namespace: namespace,
+    Name:      "exporter_update_available",
+    Help:      "Whether a release newer than the running exporter is available, labeled by the latest release.",
+  },
+  []string{"latest_version"},
+)
+
+// run_version_check asks url for the latest release once a day, and
+// exports whether it is newer than the running version. Failed checks leave
+// the result of the last one in place.
+func run_version_check(client *http.Client, url string) {
+  current, ok := parse_version(version.Version)
+  if !ok {
+    mainLog.Warnf("Not checking for updates: running version %q is not a release version", version.Version)
+    return
+  }
+  for {
+    latest, err := latest_release(client, url)
+    if err != nil {
+      mainLog.Warnf("Failed to check for updates: %v", err)
+    } else if v, ok := parse_version(latest); !ok {
+      mainLog.Warnf("Failed to check for updates: latest release %q is not a version", latest)
+    } else {
+      value := 0.0
+      if compare_versions(v, current) > 0 {
+        value = 1
+        mainLog.Infof("homeplug_exporter %s is available; running %s", latest, version.Version)
+      }
+      updateAvailable.Reset()
+      updateAvailable.WithLabelValues(latest).Set(value)
+    }
+    time.Sleep(versionCheckInterval)
+  }
+}
+
+// latest_release returns the tag of the latest release from the GitHub
+// releases API.
+func latest_release(client *http.Client, url string) (string, error) {
+  req, err := http.NewRequest(http.MethodGet, url, nil)
+  if err != nil {
+    return "", err
+  }
+  req.Header.Set("Accept", "application/vnd.github.v3+json")
+  req.Header.Set("User-Agent", "homeplug_exporter/" + version.Version)
+
+  ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+  defer cancel()
+  resp, err := client.Do(req.WithContext(ctx))
+  if err != nil {
+    return "", err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode / 100 != 2 {
+    return "", fmt.Errorf("server returned %s", resp.Status)
+  }
+  var release struct {
+    TagName string `json:"tag_name"`
+  }
+  if err := json.NewDecoder(io.LimitReader(resp.Body, 1 << 20)).Decode(&release); err != nil {
+    return "", err
+  }
+  return release.TagName, nil
+}
+
+// parse_version returns the major, minor and patch numbers of a version
+// such as v1.2.3. Anything after them, like the commits since the tag that
+// git describe adds, is ignored.
+func parse_version(s string) ([3]int, bool) {
+  var v [3]int
+  s = strings.TrimPrefix(s, "v")
+  if i := strings.IndexAny(s, "-+"); i >= 0 {
+    s = s[:i]
+  }
+  parts := strings.Split(s, ".")
+  if len(parts) != 3 {
+    return v, false
+  }
+  for i, part := range parts {
+    n, err := strconv.Atoi(part)
+    if err != nil || n < 0 {
+      return v, false
+    }
+    v[i] = n
+  }
+  return v, true
+}
+
+func compare_versions(a, b [3]int) int {
+  for i := range a {
+    if a[i] != b[i] {
+      return a[i] - b[i]
+    }
+  }
+  return 0
+}